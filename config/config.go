@@ -1,9 +1,11 @@
 package config
 
-const (
-    JWTSecret = "your-secret-key-here"
-    AccessTokenExpiry = 3600 // 1 hour
-    RefreshTokenExpiry = 7200 // 2 hours
+import (
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "time"
 )
 
 type OAuth2Config struct {
@@ -17,3 +19,667 @@ var DefaultConfig = OAuth2Config{
     TokenEndpoint:     "/token",
     UserInfoEndpoint:  "/userinfo",
 }
+
+const (
+    StoragePostgres = "postgres"
+    StorageSQLite   = "sqlite"
+    StorageMemory   = "memory"
+    StorageRedis    = "redis"
+    // StorageHybrid keeps users and clients in Postgres and short-lived
+    // codes and tokens in Redis.
+    StorageHybrid   = "hybrid"
+)
+
+const (
+    MailSenderSMTP = "smtp"
+    // MailSenderFile writes each message to a file, for local testing.
+    MailSenderFile = "file"
+    // MailSenderLog writes each message to the server log.
+    MailSenderLog  = "log"
+)
+
+const (
+    // MigrationsAuto applies pending schema migrations at startup.
+    MigrationsAuto = "auto"
+    // MigrationsVerify refuses to start if any migration is pending, for
+    // deployments that run `migrate up` as a separate step.
+    MigrationsVerify = "verify"
+)
+
+const (
+    LegacyAuthHTTP = "http"
+    LegacyAuthSQL  = "sql"
+)
+
+// Upstream identity provider types.
+const (
+    UpstreamOIDC   = "oidc"
+    UpstreamOAuth2 = "oauth2"
+)
+
+// Password hashing algorithms. Hashes made with any of them are accepted;
+// the configured one hashes new passwords.
+const (
+    HashArgon2id = "argon2id"
+    HashScrypt   = "scrypt"
+    HashBcrypt   = "bcrypt"
+    HashPBKDF2   = "pbkdf2"
+)
+
+// defaultJWTSecret is a placeholder shipped as the default for
+// development. Validate rejects it unless keys.allow_insecure_placeholder
+// is set. The token hash key has no default: it also signs login and other
+// short-lived tokens, so it must always be configured.
+const defaultJWTSecret = "your-secret-key-here"
+
+// Config is the complete server configuration. It is loaded once at
+// startup by Load and read everywhere else through Get.
+type Config struct {
+    // Issuer is the public base URL of this server, used as the iss claim.
+    Issuer            string                  `yaml:"issuer" toml:"issuer"`
+    // Scopes lists the scopes clients of the default realm may request;
+    // empty allows any.
+    Scopes            []string                `yaml:"scopes" toml:"scopes"`
+    Server            ServerConfig            `yaml:"server" toml:"server"`
+    Storage           StorageConfig           `yaml:"storage" toml:"storage"`
+    Tokens            TokenConfig             `yaml:"tokens" toml:"tokens"`
+    Keys              KeysConfig              `yaml:"keys" toml:"keys"`
+    Cleanup           CleanupConfig           `yaml:"cleanup" toml:"cleanup"`
+    Mail              MailConfig              `yaml:"mail" toml:"mail"`
+    EmailVerification EmailVerificationConfig `yaml:"email_verification" toml:"email_verification"`
+    PasswordReset     PasswordResetConfig     `yaml:"password_reset" toml:"password_reset"`
+    WebAuthn          WebAuthnConfig          `yaml:"webauthn" toml:"webauthn"`
+    Lockout           LockoutConfig           `yaml:"lockout" toml:"lockout"`
+    PasswordPolicy    PasswordPolicyConfig    `yaml:"password_policy" toml:"password_policy"`
+    PasswordHashing   PasswordHashingConfig   `yaml:"password_hashing" toml:"password_hashing"`
+    Admin             AdminConfig             `yaml:"admin" toml:"admin"`
+    LegacyAuth        LegacyAuthConfig        `yaml:"legacy_auth" toml:"legacy_auth"`
+    LDAP              LDAPConfig              `yaml:"ldap" toml:"ldap"`
+    SCIM              SCIMConfig              `yaml:"scim" toml:"scim"`
+    // UpstreamProviders are identity providers users can sign in with
+    // instead of a password.
+    UpstreamProviders []UpstreamProviderConfig `yaml:"upstream_providers" toml:"upstream_providers"`
+    Features          FeaturesConfig          `yaml:"features" toml:"features"`
+    // Realms are isolated tenants in addition to the default realm, which
+    // is configured by the top-level settings.
+    Realms            []RealmConfig           `yaml:"realms" toml:"realms"`
+}
+
+type ServerConfig struct {
+    ListenAddress string    `yaml:"listen_address" toml:"listen_address"`
+    TLS           TLSConfig `yaml:"tls" toml:"tls"`
+    // RateLimit is the number of requests per second allowed per client IP.
+    RateLimit       float64  `yaml:"rate_limit" toml:"rate_limit"`
+    ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+    // TrustedProxies lists the addresses or CIDR ranges of the reverse
+    // proxies in front of the server. The client IP, which rate limits and
+    // login lockouts count against, is taken from X-Forwarded-For only as
+    // far as these proxies added to it; without any, it is the address of
+    // the connection.
+    TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// TrustedProxyRanges parses TrustedProxies. A single address is a range
+// of its own.
+func (s ServerConfig) TrustedProxyRanges() ([]*net.IPNet, error) {
+    ranges := make([]*net.IPNet, 0, len(s.TrustedProxies))
+    for _, proxy := range s.TrustedProxies {
+        if !strings.Contains(proxy, "/") {
+            ip := net.ParseIP(proxy)
+            if ip == nil {
+                return nil, fmt.Errorf("%q is not an IP address or CIDR range", proxy)
+            }
+            bits := 8 * net.IPv6len
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 8*net.IPv4len
+            }
+            ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, ipNet, err := net.ParseCIDR(proxy)
+        if err != nil {
+            return nil, fmt.Errorf("%q is not an IP address or CIDR range", proxy)
+        }
+        ranges = append(ranges, ipNet)
+    }
+    return ranges, nil
+}
+
+type TLSConfig struct {
+    Enabled  bool   `yaml:"enabled" toml:"enabled"`
+    CertFile string `yaml:"cert_file" toml:"cert_file"`
+    KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+type StorageConfig struct {
+    Backend         string   `yaml:"backend" toml:"backend"`
+    DatabaseURL     string   `yaml:"database_url" toml:"database_url"`
+    SQLitePath      string   `yaml:"sqlite_path" toml:"sqlite_path"`
+    RedisURL        string   `yaml:"redis_url" toml:"redis_url"`
+    Migrations      string   `yaml:"migrations" toml:"migrations"`
+    MaxIdleConns    int      `yaml:"max_idle_conns" toml:"max_idle_conns"`
+    MaxOpenConns    int      `yaml:"max_open_conns" toml:"max_open_conns"`
+    ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+}
+
+// TokenConfig holds the server-wide token lifetimes and refresh policies.
+// Clients may override any of these through their own settings.
+type TokenConfig struct {
+    AccessTokenExpiry              Duration `yaml:"access_token_expiry" toml:"access_token_expiry"`
+    RefreshTokenIdleExpiry         Duration `yaml:"refresh_token_idle_expiry" toml:"refresh_token_idle_expiry"`
+    RefreshTokenAbsoluteExpiry     Duration `yaml:"refresh_token_absolute_expiry" toml:"refresh_token_absolute_expiry"`
+    RotateRefreshTokens            bool     `yaml:"rotate_refresh_tokens" toml:"rotate_refresh_tokens"`
+    RequireOfflineAccess           bool     `yaml:"require_offline_access" toml:"require_offline_access"`
+    ClientSecretRotationOverlap    Duration `yaml:"client_secret_rotation_overlap" toml:"client_secret_rotation_overlap"`
+    // ClientSecretRotationMaxOverlap caps the overlap a client may ask for
+    // when rotating its secret.
+    ClientSecretRotationMaxOverlap Duration `yaml:"client_secret_rotation_max_overlap" toml:"client_secret_rotation_max_overlap"`
+}
+
+type KeysConfig struct {
+    // JWTSecret signs access tokens with HS256.
+    JWTSecret string `yaml:"jwt_secret" toml:"jwt_secret"`
+    // SigningKey is a PEM encoded RSA or P-256 private key. When set,
+    // access tokens are signed with RS256 or ES256 instead and the public
+    // key is published in the JWKS document.
+    SigningKey string `yaml:"signing_key" toml:"signing_key"`
+    // SAMLCertificate and SAMLKey, a PEM encoded X.509 certificate and
+    // the RSA private key it certifies, sign SAML assertions. The realm
+    // acts as a SAML identity provider only when both are set.
+    SAMLCertificate string `yaml:"saml_certificate" toml:"saml_certificate"`
+    SAMLKey         string `yaml:"saml_key" toml:"saml_key"`
+    // TokenHashKey keys the hashes auth codes and refresh tokens are
+    // stored under, and signs login, MFA and other short-lived tokens.
+    // It is required. Changing it invalidates all outstanding ones, and
+    // changes the persistent name IDs SAML service providers know users
+    // by.
+    TokenHashKey string `yaml:"token_hash_key" toml:"token_hash_key"`
+    // MasterKeys wrap the data keys that encrypt sensitive columns. Keep a
+    // retired key listed until `keys rewrap` has moved every data key to
+    // ActiveMasterKey.
+    MasterKeys      []MasterKeyConfig `yaml:"master_keys" toml:"master_keys"`
+    ActiveMasterKey string            `yaml:"active_master_key" toml:"active_master_key"`
+    // AllowInsecurePlaceholder lets a development server run with the
+    // built-in or example keys, which anyone can use to forge tokens.
+    // Without it they are rejected.
+    AllowInsecurePlaceholder bool `yaml:"allow_insecure_placeholder" toml:"allow_insecure_placeholder"`
+}
+
+type MasterKeyConfig struct {
+    ID string `yaml:"id" toml:"id"`
+    // Key is 32 random bytes, base64 encoded.
+    Key string `yaml:"key" toml:"key"`
+}
+
+// RealmConfig describes one realm. Anything left unset falls back to the
+// top-level setting, except the signing keys, which are never shared.
+type RealmConfig struct {
+    // Name identifies the realm in URLs (/realms/<name>/...) and storage.
+    Name string `yaml:"name" toml:"name"`
+    // Issuer defaults to <issuer>/realms/<name>. Set it when the realm is
+    // served on its own host.
+    Issuer string `yaml:"issuer" toml:"issuer"`
+    // Hosts are the request hosts resolved to this realm.
+    Hosts  []string `yaml:"hosts" toml:"hosts"`
+    Scopes []string `yaml:"scopes" toml:"scopes"`
+    // JWTSecret defaults to a secret derived from keys.jwt_secret and the
+    // realm name.
+    JWTSecret  string           `yaml:"jwt_secret" toml:"jwt_secret"`
+    SigningKey string           `yaml:"signing_key" toml:"signing_key"`
+    // SAMLCertificate and SAMLKey make the realm a SAML identity
+    // provider; see KeysConfig.
+    SAMLCertificate string           `yaml:"saml_certificate" toml:"saml_certificate"`
+    SAMLKey         string           `yaml:"saml_key" toml:"saml_key"`
+    Tokens          RealmTokenConfig `yaml:"tokens" toml:"tokens"`
+    // ClientRegistration overrides features.client_registration.
+    ClientRegistration *bool `yaml:"client_registration" toml:"client_registration"`
+    // RequireEmailVerification overrides email_verification.required.
+    RequireEmailVerification *bool `yaml:"require_email_verification" toml:"require_email_verification"`
+}
+
+// RealmTokenConfig overrides parts of the top-level TokenConfig for a realm.
+type RealmTokenConfig struct {
+    AccessTokenExpiry          Duration `yaml:"access_token_expiry" toml:"access_token_expiry"`
+    RefreshTokenIdleExpiry     Duration `yaml:"refresh_token_idle_expiry" toml:"refresh_token_idle_expiry"`
+    RefreshTokenAbsoluteExpiry Duration `yaml:"refresh_token_absolute_expiry" toml:"refresh_token_absolute_expiry"`
+    RotateRefreshTokens        *bool    `yaml:"rotate_refresh_tokens" toml:"rotate_refresh_tokens"`
+    RequireOfflineAccess       *bool    `yaml:"require_offline_access" toml:"require_offline_access"`
+}
+
+// Apply returns base with the realm's overrides applied.
+func (o RealmTokenConfig) Apply(base TokenConfig) TokenConfig {
+    if o.AccessTokenExpiry > 0 {
+        base.AccessTokenExpiry = o.AccessTokenExpiry
+    }
+    if o.RefreshTokenIdleExpiry > 0 {
+        base.RefreshTokenIdleExpiry = o.RefreshTokenIdleExpiry
+    }
+    if o.RefreshTokenAbsoluteExpiry > 0 {
+        base.RefreshTokenAbsoluteExpiry = o.RefreshTokenAbsoluteExpiry
+    }
+    if o.RotateRefreshTokens != nil {
+        base.RotateRefreshTokens = *o.RotateRefreshTokens
+    }
+    if o.RequireOfflineAccess != nil {
+        base.RequireOfflineAccess = *o.RequireOfflineAccess
+    }
+    return base
+}
+
+type MailConfig struct {
+    // Sender is smtp, file or log.
+    Sender string     `yaml:"sender" toml:"sender"`
+    From   string     `yaml:"from" toml:"from"`
+    SMTP   SMTPConfig `yaml:"smtp" toml:"smtp"`
+    // Directory receives one file per message with the file sender.
+    Directory string `yaml:"directory" toml:"directory"`
+}
+
+// SMTPConfig points at the relay used by the smtp sender. STARTTLS is used
+// whenever the server offers it.
+type SMTPConfig struct {
+    Host     string `yaml:"host" toml:"host"`
+    Port     int    `yaml:"port" toml:"port"`
+    Username string `yaml:"username" toml:"username"`
+    Password string `yaml:"password" toml:"password"`
+}
+
+type EmailVerificationConfig struct {
+    // Required blocks login until the user has verified their email.
+    // Realms may override it.
+    Required   bool     `yaml:"required" toml:"required"`
+    LinkExpiry Duration `yaml:"link_expiry" toml:"link_expiry"`
+    // ResendInterval is the minimum time between two verification emails
+    // to the same user.
+    ResendInterval Duration `yaml:"resend_interval" toml:"resend_interval"`
+}
+
+type PasswordResetConfig struct {
+    // LinkExpiry is how long a reset link stays valid. A link also stops
+    // working once the password has changed.
+    LinkExpiry Duration `yaml:"link_expiry" toml:"link_expiry"`
+}
+
+type WebAuthnConfig struct {
+    // RPDisplayName is the name authenticators show for this server.
+    RPDisplayName string `yaml:"rp_display_name" toml:"rp_display_name"`
+    // RPID is the domain passkeys are bound to. It defaults to the host of
+    // each realm's issuer and can't be changed once passkeys exist.
+    RPID string `yaml:"rp_id" toml:"rp_id"`
+    // Origins are the web origins allowed to run WebAuthn ceremonies. They
+    // default to the origin of each realm's issuer.
+    Origins []string `yaml:"origins" toml:"origins"`
+}
+
+// LockoutConfig throttles password and MFA code guessing. Failures are
+// counted per username and per client IP within Window; unknown usernames
+// are counted too, so responses don't reveal which accounts exist.
+type LockoutConfig struct {
+    // MaxFailures locks a username after this many failures; 0 disables.
+    MaxFailures int `yaml:"max_failures" toml:"max_failures"`
+    // IPMaxFailures locks a client IP after this many failures, across
+    // usernames; 0 disables.
+    IPMaxFailures int      `yaml:"ip_max_failures" toml:"ip_max_failures"`
+    Window        Duration `yaml:"window" toml:"window"`
+    // Duration is how long a lockout lasts.
+    Duration Duration `yaml:"duration" toml:"duration"`
+    // Delay is how long a username must wait after its first failure. It
+    // doubles with every further failure, up to MaxDelay; 0 disables.
+    Delay    Duration `yaml:"delay" toml:"delay"`
+    MaxDelay Duration `yaml:"max_delay" toml:"max_delay"`
+}
+
+// PasswordPolicyConfig is checked whenever a user chooses a password: on
+// registration, reset and change. Lengths count characters.
+type PasswordPolicyConfig struct {
+    MinLength int `yaml:"min_length" toml:"min_length"`
+    MaxLength int `yaml:"max_length" toml:"max_length"`
+    // MinCharacterClasses is how many of lowercase letters, uppercase
+    // letters, digits and symbols a password must mix.
+    MinCharacterClasses int `yaml:"min_character_classes" toml:"min_character_classes"`
+    // RejectUserInfo rejects passwords that contain the username or email
+    // address, or are contained in them.
+    RejectUserInfo bool `yaml:"reject_user_info" toml:"reject_user_info"`
+    // History is how many of the user's latest passwords, the current one
+    // included, can't be chosen again; 0 disables.
+    History int `yaml:"history" toml:"history"`
+    // BreachedPasswords is a list of SHA-1 hashes of breached passwords to
+    // reject: either a directory of range files as served by the Pwned
+    // Passwords API, one per 5 character prefix and named <PREFIX>.txt,
+    // or a single file of full hashes, which is loaded into memory.
+    BreachedPasswords string `yaml:"breached_passwords" toml:"breached_passwords"`
+}
+
+// PasswordHashingConfig selects how passwords are hashed. A user whose
+// hash was made with another algorithm or other parameters is rehashed at
+// their next successful login.
+type PasswordHashingConfig struct {
+    // Algorithm is argon2id, scrypt, bcrypt or pbkdf2.
+    Algorithm string         `yaml:"algorithm" toml:"algorithm"`
+    Argon2id  Argon2idConfig `yaml:"argon2id" toml:"argon2id"`
+    Scrypt    ScryptConfig   `yaml:"scrypt" toml:"scrypt"`
+    Bcrypt    BcryptConfig   `yaml:"bcrypt" toml:"bcrypt"`
+    PBKDF2    PBKDF2Config   `yaml:"pbkdf2" toml:"pbkdf2"`
+}
+
+type Argon2idConfig struct {
+    // Memory is in KiB.
+    Memory      int `yaml:"memory" toml:"memory"`
+    Iterations  int `yaml:"iterations" toml:"iterations"`
+    Parallelism int `yaml:"parallelism" toml:"parallelism"`
+}
+
+type ScryptConfig struct {
+    // LogN is the base 2 logarithm of the CPU/memory cost N.
+    LogN int `yaml:"log_n" toml:"log_n"`
+    R    int `yaml:"r" toml:"r"`
+    P    int `yaml:"p" toml:"p"`
+}
+
+type BcryptConfig struct {
+    Cost int `yaml:"cost" toml:"cost"`
+}
+
+// PBKDF2Config configures PBKDF2 with HMAC-SHA256.
+type PBKDF2Config struct {
+    Iterations int `yaml:"iterations" toml:"iterations"`
+}
+
+// Upper limits on hashing costs, far above anything worth configuring.
+// Stored and imported hashes asking for more are rejected rather than
+// verified, as checking a single password could otherwise exhaust the
+// server's memory or keep it busy for minutes.
+const (
+    // MaxArgon2idMemory is in KiB: 1 GiB.
+    MaxArgon2idMemory     = 1 << 20
+    MaxArgon2idIterations = 64
+    // MaxScryptMemory bounds the 128*N*r bytes scrypt needs: 1 GiB.
+    MaxScryptMemory     = 1 << 30
+    MaxScryptP          = 16
+    MaxBcryptCost       = 16
+    MaxPBKDF2Iterations = 5000000
+)
+
+// ScryptMemoryAllowed reports whether scrypt with N = 2^logN and block
+// size r stays within MaxScryptMemory.
+func ScryptMemoryAllowed(logN, r int) bool {
+    return logN >= 0 && logN < 31 && r > 0 && r <= MaxScryptMemory/(128<<logN)
+}
+
+type AdminConfig struct {
+    // APIToken authenticates calls to the /admin endpoints as a bearer
+    // token. The admin API is disabled while it is empty.
+    APIToken string `yaml:"api_token" toml:"api_token"`
+}
+
+// LegacyAuthConfig points at the user store being migrated from. When a
+// login names a user that doesn't exist yet, the password is checked
+// there, and on success the user is created with it. From then on the
+// user signs in locally.
+type LegacyAuthConfig struct {
+    // Backend is http or sql; empty disables the fallback.
+    Backend string `yaml:"backend" toml:"backend"`
+    // Realm receives the migrated users.
+    Realm string          `yaml:"realm" toml:"realm"`
+    HTTP  LegacyHTTPConfig `yaml:"http" toml:"http"`
+    SQL   LegacySQLConfig  `yaml:"sql" toml:"sql"`
+}
+
+// LegacyHTTPConfig describes a callback that checks credentials; see
+// package legacy for the contract.
+type LegacyHTTPConfig struct {
+    URL string `yaml:"url" toml:"url"`
+    // Token is sent as a bearer token with every call.
+    Token   string   `yaml:"token" toml:"token"`
+    Timeout Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// LegacySQLConfig reads users from the old database directly.
+type LegacySQLConfig struct {
+    // Driver is postgres or sqlite.
+    Driver string `yaml:"driver" toml:"driver"`
+    // DSN is the connection URL, or the file path for sqlite.
+    DSN string `yaml:"dsn" toml:"dsn"`
+    // Query selects the password_hash and email columns, and optionally
+    // email_verified, of the user whose username is its ? parameter.
+    Query string `yaml:"query" toml:"query"`
+}
+
+// SCIMConfig controls the SCIM provisioning API under /scim/v2, which an
+// HR system or similar uses to manage users and groups.
+type SCIMConfig struct {
+    // Clients lists the client IDs that may get an access token with the
+    // scim scope through the client_credentials grant, each in its own
+    // realm. The API can't be used while it is empty.
+    Clients []string `yaml:"clients" toml:"clients"`
+}
+
+// LDAPConfig points at the directory, such as OpenLDAP or Active
+// Directory, that users of one realm sign in against. Directory users are
+// created locally at their first login and their profile is refreshed at
+// every login and sync, but their password is only ever checked by the
+// directory.
+type LDAPConfig struct {
+    // URL is ldap://host:389 or ldaps://host:636; empty disables the
+    // directory.
+    URL string `yaml:"url" toml:"url"`
+    // StartTLS upgrades ldap:// connections before anything is sent.
+    StartTLS bool `yaml:"start_tls" toml:"start_tls"`
+    // CAFile holds PEM certificates trusted for the directory's TLS
+    // certificate, in addition to the system ones.
+    CAFile string `yaml:"ca_file" toml:"ca_file"`
+    // BindDN and BindPassword are the service account users are searched
+    // with; empty binds anonymously.
+    BindDN       string `yaml:"bind_dn" toml:"bind_dn"`
+    BindPassword string `yaml:"bind_password" toml:"bind_password"`
+    // Realm receives the directory users.
+    Realm  string `yaml:"realm" toml:"realm"`
+    BaseDN string `yaml:"base_dn" toml:"base_dn"`
+    // UserFilter finds a user by the name they sign in with, which
+    // replaces {username}: (uid={username}) for OpenLDAP, or
+    // (&(objectClass=user)(sAMAccountName={username})) for Active
+    // Directory.
+    UserFilter string              `yaml:"user_filter" toml:"user_filter"`
+    Attributes LDAPAttributeConfig `yaml:"attributes" toml:"attributes"`
+    // GroupBaseDN, when set, is searched with GroupFilter for the user's
+    // groups, {dn} being replaced by the user's DN. Otherwise the groups
+    // are read from the user's GroupAttribute.
+    GroupBaseDN    string `yaml:"group_base_dn" toml:"group_base_dn"`
+    GroupFilter    string `yaml:"group_filter" toml:"group_filter"`
+    GroupAttribute string `yaml:"group_attribute" toml:"group_attribute"`
+    // Roles maps group DNs to the roles their members get. Without it,
+    // every group is a role named after its first RDN value, usually cn.
+    Roles map[string]string `yaml:"roles" toml:"roles"`
+    // SyncInterval between refreshes of all directory users; zero only
+    // refreshes users when they sign in.
+    SyncInterval Duration `yaml:"sync_interval" toml:"sync_interval"`
+    Timeout      Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// LDAPAttributeConfig names the directory attributes that fill in a user.
+type LDAPAttributeConfig struct {
+    Username string `yaml:"username" toml:"username"`
+    Email    string `yaml:"email" toml:"email"`
+}
+
+// UpstreamProviderConfig describes an identity provider users can sign in
+// with. Its redirect URI is <realm issuer>/login/upstream/<id>/callback.
+type UpstreamProviderConfig struct {
+    // ID names the provider in URLs and in the links to user accounts, so
+    // it must not change once users have signed in with it.
+    ID string `yaml:"id" toml:"id"`
+    // Name labels the login button; it defaults to the ID.
+    Name string `yaml:"name" toml:"name"`
+    // Type is oidc or oauth2.
+    Type string `yaml:"type" toml:"type"`
+    // Issuer is required for oidc providers; their endpoints and keys are
+    // discovered from it.
+    Issuer string `yaml:"issuer" toml:"issuer"`
+    // The endpoints are required for oauth2 providers and override
+    // discovery for oidc ones.
+    AuthorizationURL string   `yaml:"authorization_url" toml:"authorization_url"`
+    TokenURL         string   `yaml:"token_url" toml:"token_url"`
+    UserInfoURL      string   `yaml:"userinfo_url" toml:"userinfo_url"`
+    ClientID         string   `yaml:"client_id" toml:"client_id"`
+    ClientSecret     string   `yaml:"client_secret" toml:"client_secret"`
+    // Scopes default to openid, email and profile for oidc providers.
+    Scopes []string    `yaml:"scopes" toml:"scopes"`
+    Claims ClaimConfig `yaml:"claims" toml:"claims"`
+    // TrustEmail treats every email address from the provider as
+    // verified, for providers that only release verified addresses but
+    // send no email_verified claim.
+    TrustEmail bool `yaml:"trust_email" toml:"trust_email"`
+    // Realms the provider is offered in; empty means every realm.
+    Realms []string `yaml:"realms" toml:"realms"`
+}
+
+// ClaimConfig names the claims, from the ID token or the userinfo
+// response, that fill in a user. Empty names use the OpenID Connect ones.
+type ClaimConfig struct {
+    Subject       string `yaml:"subject" toml:"subject"`
+    Username      string `yaml:"username" toml:"username"`
+    Email         string `yaml:"email" toml:"email"`
+    EmailVerified string `yaml:"email_verified" toml:"email_verified"`
+}
+
+type CleanupConfig struct {
+    // Interval between janitor rounds; zero disables the janitor.
+    Interval  Duration `yaml:"interval" toml:"interval"`
+    BatchSize int      `yaml:"batch_size" toml:"batch_size"`
+}
+
+type FeaturesConfig struct {
+    // ClientRegistration enables the open POST /client/register endpoint.
+    // Realms may override it.
+    ClientRegistration bool `yaml:"client_registration" toml:"client_registration"`
+    // Metrics exposes expvar metrics at /debug/vars.
+    Metrics bool `yaml:"metrics" toml:"metrics"`
+}
+
+// Default returns the configuration used for anything not set in the file
+// or environment. It matches the server's historical hardcoded behaviour.
+func Default() *Config {
+    return &Config{
+        Issuer: "http://localhost:8000",
+        Server: ServerConfig{
+            ListenAddress:   ":8000",
+            RateLimit:       20,
+            ShutdownTimeout: Duration(10 * time.Second),
+        },
+        Storage: StorageConfig{
+            Backend:         StoragePostgres,
+            SQLitePath:      "oauth2.db",
+            RedisURL:        "redis://localhost:6379/0",
+            Migrations:      MigrationsAuto,
+            MaxIdleConns:    10,
+            MaxOpenConns:    100,
+            ConnMaxLifetime: Duration(time.Hour),
+        },
+        Tokens: TokenConfig{
+            AccessTokenExpiry:              Duration(time.Hour),
+            RefreshTokenIdleExpiry:         Duration(2 * time.Hour),
+            RefreshTokenAbsoluteExpiry:     Duration(30 * 24 * time.Hour),
+            RotateRefreshTokens:            true,
+            RequireOfflineAccess:           false,
+            ClientSecretRotationOverlap:    Duration(24 * time.Hour),
+            ClientSecretRotationMaxOverlap: Duration(7 * 24 * time.Hour),
+        },
+        Keys: KeysConfig{
+            JWTSecret: defaultJWTSecret,
+        },
+        Cleanup: CleanupConfig{
+            Interval:  Duration(5 * time.Minute),
+            BatchSize: 1000,
+        },
+        Mail: MailConfig{
+            Sender: MailSenderLog,
+            From:   "no-reply@localhost",
+            SMTP: SMTPConfig{
+                Port: 587,
+            },
+        },
+        EmailVerification: EmailVerificationConfig{
+            Required:       false,
+            LinkExpiry:     Duration(24 * time.Hour),
+            ResendInterval: Duration(time.Minute),
+        },
+        PasswordReset: PasswordResetConfig{
+            LinkExpiry: Duration(time.Hour),
+        },
+        WebAuthn: WebAuthnConfig{
+            RPDisplayName: "OAuth2 Provider",
+        },
+        Lockout: LockoutConfig{
+            MaxFailures:   5,
+            IPMaxFailures: 50,
+            Window:        Duration(15 * time.Minute),
+            Duration:      Duration(15 * time.Minute),
+            Delay:         Duration(time.Second),
+            MaxDelay:      Duration(30 * time.Second),
+        },
+        PasswordPolicy: PasswordPolicyConfig{
+            MinLength:      8,
+            MaxLength:      64,
+            RejectUserInfo: true,
+        },
+        PasswordHashing: PasswordHashingConfig{
+            Algorithm: HashArgon2id,
+            Argon2id: Argon2idConfig{
+                Memory:      19 * 1024,
+                Iterations:  2,
+                Parallelism: 1,
+            },
+            Scrypt: ScryptConfig{
+                LogN: 17,
+                R:    8,
+                P:    1,
+            },
+            Bcrypt: BcryptConfig{
+                Cost: 10,
+            },
+            PBKDF2: PBKDF2Config{
+                Iterations: 600000,
+            },
+        },
+        LegacyAuth: LegacyAuthConfig{
+            Realm: "default",
+            HTTP: LegacyHTTPConfig{
+                Timeout: Duration(5 * time.Second),
+            },
+        },
+        LDAP: LDAPConfig{
+            Realm:      "default",
+            UserFilter: "(uid={username})",
+            Attributes: LDAPAttributeConfig{
+                Username: "uid",
+                Email:    "mail",
+            },
+            GroupFilter:    "(member={dn})",
+            GroupAttribute: "memberOf",
+            Timeout:        Duration(5 * time.Second),
+        },
+        Features: FeaturesConfig{
+            ClientRegistration: true,
+            Metrics:            true,
+        },
+    }
+}
+
+var (
+    current   = Default()
+    currentMu sync.RWMutex
+)
+
+// Get returns the active configuration. Callers must not modify it.
+func Get() *Config {
+    currentMu.RLock()
+    defer currentMu.RUnlock()
+    return current
+}
+
+// Set replaces the active configuration; it is called once at startup.
+func Set(cfg *Config) {
+    currentMu.Lock()
+    defer currentMu.Unlock()
+    current = cfg
+}
@@ -10,11 +10,10 @@ import (
 	"time"
 )
 
-func InitDB() (*gorm.DB, error) {
-	dsn := os.Getenv("DATABASE_URL")
-	log.Printf("Connecting to database with DSN: %s", dsn)
+func InitDB(cfg StorageConfig) (*gorm.DB, error) {
+	log.Println("Connecting to database...")
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+	db, err := gorm.Open(postgres.Open(cfg.DatabaseURL), &gorm.Config{
 		Logger: logger.New(
 			log.New(os.Stdout, "\r\n", log.LstdFlags),
 			logger.Config{
@@ -41,9 +40,9 @@ func InitDB() (*gorm.DB, error) {
 	}
 
 	// Set connection pool settings
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetMaxOpenConns(100)
-	sqlDB.SetConnMaxLifetime(time.Hour)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration())
 
 	log.Println("Successfully connected to database")
 	return db, nil
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Load builds the configuration from the defaults, then the file at path
+// (YAML or TOML, chosen by extension; skipped when path is empty), then
+// environment variables. Secret references are resolved last. It does not
+// validate the result.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := loadFile(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parsing %s: unknown setting %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported extension %q, use .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// envOverride maps one environment variable onto a setting.
+type envOverride struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}
+
+// envOverrides lists every environment variable Load understands. The
+// unprefixed names predate the config file and are kept for existing
+// deployments.
+var envOverrides = []envOverride{
+	{"OAUTH2_ISSUER", setString(func(c *Config) *string { return &c.Issuer })},
+	{"OAUTH2_LISTEN_ADDRESS", setString(func(c *Config) *string { return &c.Server.ListenAddress })},
+	{"OAUTH2_TLS_ENABLED", setBool(func(c *Config) *bool { return &c.Server.TLS.Enabled })},
+	{"OAUTH2_TLS_CERT_FILE", setString(func(c *Config) *string { return &c.Server.TLS.CertFile })},
+	{"OAUTH2_TLS_KEY_FILE", setString(func(c *Config) *string { return &c.Server.TLS.KeyFile })},
+	{"OAUTH2_RATE_LIMIT", setFloat(func(c *Config) *float64 { return &c.Server.RateLimit })},
+	{"OAUTH2_TRUSTED_PROXIES", setStrings(func(c *Config) *[]string { return &c.Server.TrustedProxies })},
+	{"STORAGE_BACKEND", setString(func(c *Config) *string { return &c.Storage.Backend })},
+	{"OAUTH2_STORAGE_BACKEND", setString(func(c *Config) *string { return &c.Storage.Backend })},
+	{"DATABASE_URL", setString(func(c *Config) *string { return &c.Storage.DatabaseURL })},
+	{"OAUTH2_DATABASE_URL", setString(func(c *Config) *string { return &c.Storage.DatabaseURL })},
+	{"SQLITE_PATH", setString(func(c *Config) *string { return &c.Storage.SQLitePath })},
+	{"OAUTH2_SQLITE_PATH", setString(func(c *Config) *string { return &c.Storage.SQLitePath })},
+	{"REDIS_URL", setString(func(c *Config) *string { return &c.Storage.RedisURL })},
+	{"OAUTH2_REDIS_URL", setString(func(c *Config) *string { return &c.Storage.RedisURL })},
+	{"SCHEMA_MIGRATIONS", setString(func(c *Config) *string { return &c.Storage.Migrations })},
+	{"OAUTH2_SCHEMA_MIGRATIONS", setString(func(c *Config) *string { return &c.Storage.Migrations })},
+	{"OAUTH2_ACCESS_TOKEN_EXPIRY", setDuration(func(c *Config) *Duration { return &c.Tokens.AccessTokenExpiry })},
+	{"OAUTH2_REFRESH_TOKEN_IDLE_EXPIRY", setDuration(func(c *Config) *Duration { return &c.Tokens.RefreshTokenIdleExpiry })},
+	{"OAUTH2_REFRESH_TOKEN_ABSOLUTE_EXPIRY", setDuration(func(c *Config) *Duration { return &c.Tokens.RefreshTokenAbsoluteExpiry })},
+	{"OAUTH2_JWT_SECRET", setString(func(c *Config) *string { return &c.Keys.JWTSecret })},
+	{"OAUTH2_TOKEN_HASH_KEY", setString(func(c *Config) *string { return &c.Keys.TokenHashKey })},
+	{"OAUTH2_MASTER_KEYS", setMasterKeys},
+	{"OAUTH2_ACTIVE_MASTER_KEY", setString(func(c *Config) *string { return &c.Keys.ActiveMasterKey })},
+	{"OAUTH2_ALLOW_INSECURE_PLACEHOLDER_KEYS", setBool(func(c *Config) *bool { return &c.Keys.AllowInsecurePlaceholder })},
+	{"CLEANUP_INTERVAL", setDuration(func(c *Config) *Duration { return &c.Cleanup.Interval })},
+	{"OAUTH2_CLEANUP_INTERVAL", setDuration(func(c *Config) *Duration { return &c.Cleanup.Interval })},
+	{"OAUTH2_MAIL_SENDER", setString(func(c *Config) *string { return &c.Mail.Sender })},
+	{"OAUTH2_MAIL_FROM", setString(func(c *Config) *string { return &c.Mail.From })},
+	{"OAUTH2_MAIL_DIRECTORY", setString(func(c *Config) *string { return &c.Mail.Directory })},
+	{"OAUTH2_SMTP_HOST", setString(func(c *Config) *string { return &c.Mail.SMTP.Host })},
+	{"OAUTH2_SMTP_PORT", setInt(func(c *Config) *int { return &c.Mail.SMTP.Port })},
+	{"OAUTH2_SMTP_USERNAME", setString(func(c *Config) *string { return &c.Mail.SMTP.Username })},
+	{"OAUTH2_SMTP_PASSWORD", setString(func(c *Config) *string { return &c.Mail.SMTP.Password })},
+	{"OAUTH2_REQUIRE_EMAIL_VERIFICATION", setBool(func(c *Config) *bool { return &c.EmailVerification.Required })},
+	{"OAUTH2_PASSWORD_RESET_LINK_EXPIRY", setDuration(func(c *Config) *Duration { return &c.PasswordReset.LinkExpiry })},
+	{"OAUTH2_WEBAUTHN_RP_DISPLAY_NAME", setString(func(c *Config) *string { return &c.WebAuthn.RPDisplayName })},
+	{"OAUTH2_WEBAUTHN_RP_ID", setString(func(c *Config) *string { return &c.WebAuthn.RPID })},
+	{"OAUTH2_WEBAUTHN_ORIGINS", setStrings(func(c *Config) *[]string { return &c.WebAuthn.Origins })},
+	{"OAUTH2_LOCKOUT_MAX_FAILURES", setInt(func(c *Config) *int { return &c.Lockout.MaxFailures })},
+	{"OAUTH2_LOCKOUT_IP_MAX_FAILURES", setInt(func(c *Config) *int { return &c.Lockout.IPMaxFailures })},
+	{"OAUTH2_LOCKOUT_WINDOW", setDuration(func(c *Config) *Duration { return &c.Lockout.Window })},
+	{"OAUTH2_LOCKOUT_DURATION", setDuration(func(c *Config) *Duration { return &c.Lockout.Duration })},
+	{"OAUTH2_LOCKOUT_DELAY", setDuration(func(c *Config) *Duration { return &c.Lockout.Delay })},
+	{"OAUTH2_LOCKOUT_MAX_DELAY", setDuration(func(c *Config) *Duration { return &c.Lockout.MaxDelay })},
+	{"OAUTH2_PASSWORD_MIN_LENGTH", setInt(func(c *Config) *int { return &c.PasswordPolicy.MinLength })},
+	{"OAUTH2_PASSWORD_MAX_LENGTH", setInt(func(c *Config) *int { return &c.PasswordPolicy.MaxLength })},
+	{"OAUTH2_PASSWORD_MIN_CHARACTER_CLASSES", setInt(func(c *Config) *int { return &c.PasswordPolicy.MinCharacterClasses })},
+	{"OAUTH2_PASSWORD_REJECT_USER_INFO", setBool(func(c *Config) *bool { return &c.PasswordPolicy.RejectUserInfo })},
+	{"OAUTH2_PASSWORD_HISTORY", setInt(func(c *Config) *int { return &c.PasswordPolicy.History })},
+	{"OAUTH2_BREACHED_PASSWORDS", setString(func(c *Config) *string { return &c.PasswordPolicy.BreachedPasswords })},
+	{"OAUTH2_PASSWORD_HASH", setString(func(c *Config) *string { return &c.PasswordHashing.Algorithm })},
+	{"OAUTH2_PASSWORD_HASH_ARGON2ID_MEMORY", setInt(func(c *Config) *int { return &c.PasswordHashing.Argon2id.Memory })},
+	{"OAUTH2_PASSWORD_HASH_ARGON2ID_ITERATIONS", setInt(func(c *Config) *int { return &c.PasswordHashing.Argon2id.Iterations })},
+	{"OAUTH2_PASSWORD_HASH_ARGON2ID_PARALLELISM", setInt(func(c *Config) *int { return &c.PasswordHashing.Argon2id.Parallelism })},
+	{"OAUTH2_PASSWORD_HASH_SCRYPT_LOG_N", setInt(func(c *Config) *int { return &c.PasswordHashing.Scrypt.LogN })},
+	{"OAUTH2_PASSWORD_HASH_SCRYPT_R", setInt(func(c *Config) *int { return &c.PasswordHashing.Scrypt.R })},
+	{"OAUTH2_PASSWORD_HASH_SCRYPT_P", setInt(func(c *Config) *int { return &c.PasswordHashing.Scrypt.P })},
+	{"OAUTH2_PASSWORD_HASH_BCRYPT_COST", setInt(func(c *Config) *int { return &c.PasswordHashing.Bcrypt.Cost })},
+	{"OAUTH2_PASSWORD_HASH_PBKDF2_ITERATIONS", setInt(func(c *Config) *int { return &c.PasswordHashing.PBKDF2.Iterations })},
+	{"OAUTH2_ADMIN_API_TOKEN", setString(func(c *Config) *string { return &c.Admin.APIToken })},
+	{"OAUTH2_LEGACY_AUTH_BACKEND", setString(func(c *Config) *string { return &c.LegacyAuth.Backend })},
+	{"OAUTH2_LEGACY_AUTH_REALM", setString(func(c *Config) *string { return &c.LegacyAuth.Realm })},
+	{"OAUTH2_LEGACY_AUTH_HTTP_URL", setString(func(c *Config) *string { return &c.LegacyAuth.HTTP.URL })},
+	{"OAUTH2_LEGACY_AUTH_HTTP_TOKEN", setString(func(c *Config) *string { return &c.LegacyAuth.HTTP.Token })},
+	{"OAUTH2_LEGACY_AUTH_HTTP_TIMEOUT", setDuration(func(c *Config) *Duration { return &c.LegacyAuth.HTTP.Timeout })},
+	{"OAUTH2_LEGACY_AUTH_SQL_DRIVER", setString(func(c *Config) *string { return &c.LegacyAuth.SQL.Driver })},
+	{"OAUTH2_LEGACY_AUTH_SQL_DSN", setString(func(c *Config) *string { return &c.LegacyAuth.SQL.DSN })},
+	{"OAUTH2_LEGACY_AUTH_SQL_QUERY", setString(func(c *Config) *string { return &c.LegacyAuth.SQL.Query })},
+	{"OAUTH2_LDAP_URL", setString(func(c *Config) *string { return &c.LDAP.URL })},
+	{"OAUTH2_LDAP_START_TLS", setBool(func(c *Config) *bool { return &c.LDAP.StartTLS })},
+	{"OAUTH2_LDAP_CA_FILE", setString(func(c *Config) *string { return &c.LDAP.CAFile })},
+	{"OAUTH2_LDAP_BIND_DN", setString(func(c *Config) *string { return &c.LDAP.BindDN })},
+	{"OAUTH2_LDAP_BIND_PASSWORD", setString(func(c *Config) *string { return &c.LDAP.BindPassword })},
+	{"OAUTH2_LDAP_REALM", setString(func(c *Config) *string { return &c.LDAP.Realm })},
+	{"OAUTH2_LDAP_BASE_DN", setString(func(c *Config) *string { return &c.LDAP.BaseDN })},
+	{"OAUTH2_LDAP_USER_FILTER", setString(func(c *Config) *string { return &c.LDAP.UserFilter })},
+	{"OAUTH2_LDAP_SYNC_INTERVAL", setDuration(func(c *Config) *Duration { return &c.LDAP.SyncInterval })},
+	{"OAUTH2_SCIM_CLIENTS", setStrings(func(c *Config) *[]string { return &c.SCIM.Clients })},
+	{"OAUTH2_CLIENT_REGISTRATION", setBool(func(c *Config) *bool { return &c.Features.ClientRegistration })},
+	{"OAUTH2_METRICS", setBool(func(c *Config) *bool { return &c.Features.Metrics })},
+}
+
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	for _, override := range envOverrides {
+		value, ok := lookup(override.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := override.apply(cfg, value); err != nil {
+			return fmt.Errorf("environment variable %s: %v", override.name, err)
+		}
+	}
+	return nil
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+// setStrings parses a comma separated list.
+func setStrings(field func(*Config) *[]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*field(cfg) = values
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setFloat(field func(*Config) *float64) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		return field(cfg).UnmarshalText([]byte(value))
+	}
+}
+
+// setMasterKeys parses a comma-separated list of id=key pairs, where each
+// key may itself be a secret reference.
+func setMasterKeys(cfg *Config, value string) error {
+	var keys []MasterKeyConfig
+	for _, pair := range strings.Split(value, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || key == "" {
+			return fmt.Errorf("expected id=key pairs separated by commas")
+		}
+		keys = append(keys, MasterKeyConfig{ID: id, Key: key})
+	}
+	cfg.Keys.MasterKeys = keys
+	return nil
+}
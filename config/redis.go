@@ -0,0 +1,29 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"time"
+)
+
+func InitRedis(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %v", err)
+	}
+	log.Printf("Connecting to Redis at %s", opts.Addr)
+
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Printf("Failed to connect to Redis: %v", err)
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+
+	log.Println("Successfully connected to Redis")
+	return client, nil
+}
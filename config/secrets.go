@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secret-bearing settings may hold a reference instead of the value:
+//
+//	file:/run/secrets/jwt   the contents of the file, trailing newline trimmed
+//	env:JWT_SECRET          the value of another environment variable
+//
+// Anything else is used literally.
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+)
+
+// ResolveSecret returns the value a secret setting refers to.
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
+
+type secretField struct {
+	name  string
+	value *string
+}
+
+// resolveSecrets replaces every secret reference in cfg with its value.
+func resolveSecrets(cfg *Config) error {
+	fields := []secretField{
+		{"keys.jwt_secret", &cfg.Keys.JWTSecret},
+		{"keys.token_hash_key", &cfg.Keys.TokenHashKey},
+		{"keys.signing_key", &cfg.Keys.SigningKey},
+		{"keys.saml_certificate", &cfg.Keys.SAMLCertificate},
+		{"keys.saml_key", &cfg.Keys.SAMLKey},
+		{"storage.database_url", &cfg.Storage.DatabaseURL},
+		{"storage.redis_url", &cfg.Storage.RedisURL},
+		{"mail.smtp.password", &cfg.Mail.SMTP.Password},
+		{"admin.api_token", &cfg.Admin.APIToken},
+		{"legacy_auth.http.token", &cfg.LegacyAuth.HTTP.Token},
+		{"legacy_auth.sql.dsn", &cfg.LegacyAuth.SQL.DSN},
+		{"ldap.bind_password", &cfg.LDAP.BindPassword},
+	}
+	for i := range cfg.Keys.MasterKeys {
+		key := &cfg.Keys.MasterKeys[i]
+		fields = append(fields, secretField{fmt.Sprintf("keys.master_keys[%s]", key.ID), &key.Key})
+	}
+	for i := range cfg.Realms {
+		realm := &cfg.Realms[i]
+		fields = append(fields,
+			secretField{fmt.Sprintf("realms[%s].jwt_secret", realm.Name), &realm.JWTSecret},
+			secretField{fmt.Sprintf("realms[%s].signing_key", realm.Name), &realm.SigningKey},
+			secretField{fmt.Sprintf("realms[%s].saml_certificate", realm.Name), &realm.SAMLCertificate},
+			secretField{fmt.Sprintf("realms[%s].saml_key", realm.Name), &realm.SAMLKey},
+		)
+	}
+	for i := range cfg.UpstreamProviders {
+		provider := &cfg.UpstreamProviders[i]
+		fields = append(fields, secretField{fmt.Sprintf("upstream_providers[%s].client_secret", provider.ID), &provider.ClientSecret})
+	}
+
+	for _, field := range fields {
+		resolved, err := ResolveSecret(*field.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field.name, err)
+		}
+		*field.value = resolved
+	}
+	return nil
+}
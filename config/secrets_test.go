@@ -0,0 +1,54 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("TEST_SECRET", "from-env")
+
+	tests := []struct {
+		name  string
+		field func(cfg *Config) *string
+	}{
+		{"keys.jwt_secret", func(cfg *Config) *string { return &cfg.Keys.JWTSecret }},
+		{"storage.database_url", func(cfg *Config) *string { return &cfg.Storage.DatabaseURL }},
+		{"mail.smtp.password", func(cfg *Config) *string { return &cfg.Mail.SMTP.Password }},
+		{"admin.api_token", func(cfg *Config) *string { return &cfg.Admin.APIToken }},
+		{"legacy_auth.http.token", func(cfg *Config) *string { return &cfg.LegacyAuth.HTTP.Token }},
+		{"legacy_auth.sql.dsn", func(cfg *Config) *string { return &cfg.LegacyAuth.SQL.DSN }},
+		{"ldap.bind_password", func(cfg *Config) *string { return &cfg.LDAP.BindPassword }},
+		{"upstream_providers[].client_secret", func(cfg *Config) *string {
+			if len(cfg.UpstreamProviders) == 0 {
+				cfg.UpstreamProviders = []UpstreamProviderConfig{{ID: "corp"}}
+			}
+			return &cfg.UpstreamProviders[0].ClientSecret
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for reference, want := range map[string]string{"file:" + file: "from-file", "env:TEST_SECRET": "from-env", "literal": "literal"} {
+				cfg := Default()
+				*tt.field(cfg) = reference
+				if err := resolveSecrets(cfg); err != nil {
+					t.Fatalf("resolveSecrets: %v", err)
+				}
+				if got := *tt.field(cfg); got != want {
+					t.Errorf("%s = %q, want %q", reference, got, want)
+				}
+			}
+
+			cfg := Default()
+			*tt.field(cfg) = "env:TEST_SECRET_UNSET"
+			if err := resolveSecrets(cfg); err == nil {
+				t.Error("resolveSecrets accepted a reference to an unset variable")
+			}
+		})
+	}
+}
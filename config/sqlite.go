@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"log"
+	"os"
+	"time"
+)
+
+func InitSQLite(path string) (*gorm.DB, error) {
+	log.Printf("Opening SQLite database at %s", path)
+
+	return OpenSQLite(path, logger.New(
+		log.New(os.Stdout, "\r\n", log.LstdFlags),
+		logger.Config{
+			SlowThreshold:             time.Second,
+			LogLevel:                  logger.Info,
+			IgnoreRecordNotFoundError: false,
+			Colorful:                  true,
+		},
+	))
+}
+
+// OpenSQLite opens a SQLite database with the settings the storage layer
+// relies on: WAL journaling, a busy timeout instead of immediate "database
+// is locked" errors, and a single connection so writes are serialised.
+func OpenSQLite(path string, gormLogger logger.Interface) (*gorm.DB, error) {
+	dsn := path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: gormLogger,
+		NowFunc: func() time.Time {
+			return time.Now().UTC()
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to open SQLite database: %v", err)
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Printf("Failed to get database instance: %v", err)
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	return db, nil
+}
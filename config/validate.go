@@ -0,0 +1,473 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"oauth2-provider/models"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ValidationError lists every problem found in a configuration, so they
+// can all be fixed in one go.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// placeholderKeys are the key values shipped in the defaults and in
+// config.example.yaml.
+var placeholderKeys = map[string]bool{
+	defaultJWTSecret: true,
+	"change-me-to-a-random-string-of-32-or-more-characters":  true,
+	"change-me-to-another-random-string-of-32-or-more-chars": true,
+}
+
+// Validate checks the configuration and returns a *ValidationError for
+// anything that would stop the server from working, plus warnings for
+// settings that work but are unsafe in production.
+func (c *Config) Validate() (warnings []string, err error) {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if problem, insecure := checkIssuer(c.Issuer); problem != "" {
+		fail("issuer: %s", problem)
+	} else if insecure {
+		warnings = append(warnings, "issuer: uses http; use https in production")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddress); err != nil {
+		fail("server.listen_address: must be host:port or :port, got %q", c.Server.ListenAddress)
+	}
+	if c.Server.TLS.Enabled {
+		for name, path := range map[string]string{"cert_file": c.Server.TLS.CertFile, "key_file": c.Server.TLS.KeyFile} {
+			if path == "" {
+				fail("server.tls.%s: required when TLS is enabled", name)
+			} else if _, err := os.Stat(path); err != nil {
+				fail("server.tls.%s: %v", name, err)
+			}
+		}
+	}
+	if c.Server.RateLimit < 0 {
+		fail("server.rate_limit: must not be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		fail("server.shutdown_timeout: must be positive")
+	}
+	if _, err := c.Server.TrustedProxyRanges(); err != nil {
+		fail("server.trusted_proxies: %v", err)
+	}
+
+	switch c.Storage.Backend {
+	case StoragePostgres, StorageHybrid:
+		if c.Storage.DatabaseURL == "" {
+			fail("storage.database_url: required for the %s backend", c.Storage.Backend)
+		}
+	case StorageSQLite:
+		if c.Storage.SQLitePath == "" {
+			fail("storage.sqlite_path: required for the sqlite backend")
+		}
+	case StorageMemory, StorageRedis:
+	default:
+		fail("storage.backend: must be one of postgres, sqlite, memory, redis or hybrid, got %q", c.Storage.Backend)
+	}
+	if c.Storage.Backend == StorageRedis || c.Storage.Backend == StorageHybrid {
+		if c.Storage.RedisURL == "" {
+			fail("storage.redis_url: required for the %s backend", c.Storage.Backend)
+		}
+	}
+	if c.Storage.Backend == StorageMemory {
+		warnings = append(warnings, "storage.backend: memory storage loses all data on restart")
+	}
+	if c.Storage.Migrations != MigrationsAuto && c.Storage.Migrations != MigrationsVerify {
+		fail("storage.migrations: must be auto or verify, got %q", c.Storage.Migrations)
+	}
+	if c.Storage.MaxIdleConns < 0 || c.Storage.MaxOpenConns < 0 {
+		fail("storage: connection pool sizes must not be negative")
+	}
+
+	if c.Tokens.AccessTokenExpiry <= 0 {
+		fail("tokens.access_token_expiry: must be positive")
+	}
+	if c.Tokens.RefreshTokenIdleExpiry <= 0 {
+		fail("tokens.refresh_token_idle_expiry: must be positive")
+	}
+	if c.Tokens.RefreshTokenAbsoluteExpiry <= 0 {
+		fail("tokens.refresh_token_absolute_expiry: must be positive")
+	}
+	if c.Tokens.RefreshTokenIdleExpiry > c.Tokens.RefreshTokenAbsoluteExpiry {
+		fail("tokens.refresh_token_idle_expiry: must not exceed refresh_token_absolute_expiry")
+	}
+	if c.Tokens.ClientSecretRotationOverlap < 0 {
+		fail("tokens.client_secret_rotation_overlap: must not be negative")
+	}
+	if c.Tokens.ClientSecretRotationOverlap > c.Tokens.ClientSecretRotationMaxOverlap {
+		fail("tokens.client_secret_rotation_overlap: must not exceed client_secret_rotation_max_overlap")
+	}
+
+	// placeholder reports whether a key is one of the placeholders, which
+	// is only allowed, with a warning, when explicitly asked for
+	placeholder := func(field, value string) bool {
+		if !placeholderKeys[value] {
+			return false
+		}
+		if c.Keys.AllowInsecurePlaceholder {
+			warnings = append(warnings, field+": still a placeholder; anyone can forge tokens")
+		} else {
+			fail("%s: still a placeholder; set a random value, or keys.allow_insecure_placeholder for development only", field)
+		}
+		return true
+	}
+	if c.Keys.JWTSecret == "" {
+		fail("keys.jwt_secret: required")
+	} else if !placeholder("keys.jwt_secret", c.Keys.JWTSecret) && len(c.Keys.JWTSecret) < 32 {
+		fail("keys.jwt_secret: must be at least 32 characters")
+	}
+	if c.Keys.TokenHashKey == "" {
+		fail("keys.token_hash_key: required")
+	} else if !placeholder("keys.token_hash_key", c.Keys.TokenHashKey) && len(c.Keys.TokenHashKey) < 32 {
+		fail("keys.token_hash_key: must be at least 32 characters")
+	}
+
+	if (c.Keys.SAMLCertificate == "") != (c.Keys.SAMLKey == "") {
+		fail("keys.saml_certificate and keys.saml_key: set both or neither")
+	}
+
+	if len(c.Keys.MasterKeys) == 0 {
+		warnings = append(warnings, "keys.master_keys: none configured; features that encrypt data at rest are unavailable")
+	} else {
+		seen := make(map[string]bool)
+		for _, key := range c.Keys.MasterKeys {
+			if key.ID == "" {
+				fail("keys.master_keys: every key needs an id")
+				continue
+			}
+			if seen[key.ID] {
+				fail("keys.master_keys: duplicate id %q", key.ID)
+			}
+			seen[key.ID] = true
+			if raw, err := base64.StdEncoding.DecodeString(key.Key); err != nil || len(raw) != 32 {
+				fail("keys.master_keys[%s]: must be 32 bytes, base64 encoded", key.ID)
+			}
+		}
+		if c.Keys.ActiveMasterKey == "" {
+			fail("keys.active_master_key: required when master keys are configured")
+		} else if !seen[c.Keys.ActiveMasterKey] {
+			fail("keys.active_master_key: %q is not one of keys.master_keys", c.Keys.ActiveMasterKey)
+		}
+	}
+
+	switch c.Mail.Sender {
+	case MailSenderSMTP:
+		if c.Mail.SMTP.Host == "" {
+			fail("mail.smtp.host: required for the smtp sender")
+		}
+		if c.Mail.SMTP.Port <= 0 || c.Mail.SMTP.Port > 65535 {
+			fail("mail.smtp.port: must be between 1 and 65535")
+		}
+	case MailSenderFile:
+		if c.Mail.Directory == "" {
+			fail("mail.directory: required for the file sender")
+		}
+	case MailSenderLog:
+		warnings = append(warnings, "mail.sender: log only writes messages to the server log; nobody receives them")
+	default:
+		fail("mail.sender: must be one of smtp, file or log, got %q", c.Mail.Sender)
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		fail("mail.from: must be an email address, got %q", c.Mail.From)
+	}
+
+	if c.EmailVerification.LinkExpiry <= 0 {
+		fail("email_verification.link_expiry: must be positive")
+	}
+	if c.EmailVerification.ResendInterval < 0 {
+		fail("email_verification.resend_interval: must not be negative")
+	}
+	if c.PasswordReset.LinkExpiry <= 0 {
+		fail("password_reset.link_expiry: must be positive")
+	}
+	if c.WebAuthn.RPDisplayName == "" {
+		fail("webauthn.rp_display_name: must not be empty")
+	}
+	if strings.ContainsAny(c.WebAuthn.RPID, ":/") {
+		fail("webauthn.rp_id: must be a domain without scheme or port, got %q", c.WebAuthn.RPID)
+	}
+	for _, origin := range c.WebAuthn.Origins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			fail("webauthn.origins: %q must be a scheme and host, like https://login.example.com", origin)
+		}
+	}
+
+	if c.Lockout.MaxFailures < 0 || c.Lockout.IPMaxFailures < 0 {
+		fail("lockout: failure thresholds must not be negative")
+	}
+	if c.Lockout.MaxFailures > 0 || c.Lockout.IPMaxFailures > 0 || c.Lockout.Delay > 0 {
+		if c.Lockout.Window <= 0 {
+			fail("lockout.window: must be positive")
+		}
+	}
+	if (c.Lockout.MaxFailures > 0 || c.Lockout.IPMaxFailures > 0) && c.Lockout.Duration <= 0 {
+		fail("lockout.duration: must be positive")
+	}
+	if c.Lockout.Delay < 0 || c.Lockout.MaxDelay < 0 {
+		fail("lockout: delays must not be negative")
+	} else if c.Lockout.Delay > c.Lockout.MaxDelay {
+		fail("lockout.delay: must not exceed max_delay")
+	}
+	if c.Lockout.MaxFailures == 0 && c.Lockout.IPMaxFailures == 0 {
+		warnings = append(warnings, "lockout: disabled; passwords can be guessed at the rate limit")
+	}
+
+	policy := c.PasswordPolicy
+	if policy.MinLength < 1 {
+		fail("password_policy.min_length: must be at least 1")
+	}
+	if policy.MaxLength < policy.MinLength {
+		fail("password_policy.max_length: must not be less than min_length")
+	} else if policy.MaxLength > 72 && c.PasswordHashing.Algorithm == HashBcrypt {
+		// Characters can take more than one byte, but this catches the
+		// obvious mistake
+		fail("password_policy.max_length: must not exceed 72 with bcrypt, the most it can hash")
+	}
+	if policy.MinCharacterClasses < 0 || policy.MinCharacterClasses > 4 {
+		fail("password_policy.min_character_classes: must be between 0 and 4")
+	}
+	if policy.History < 0 {
+		fail("password_policy.history: must not be negative")
+	}
+	if policy.BreachedPasswords != "" {
+		if _, err := os.Stat(policy.BreachedPasswords); err != nil {
+			fail("password_policy.breached_passwords: %v", err)
+		}
+	} else {
+		warnings = append(warnings, "password_policy.breached_passwords: not set; passwords known from breaches are accepted")
+	}
+
+	hashing := c.PasswordHashing
+	switch hashing.Algorithm {
+	case HashArgon2id, HashScrypt, HashBcrypt, HashPBKDF2:
+	default:
+		fail("password_hashing.algorithm: must be one of argon2id, scrypt, bcrypt or pbkdf2, got %q", hashing.Algorithm)
+	}
+	if hashing.Argon2id.Memory < 8*hashing.Argon2id.Parallelism || hashing.Argon2id.Memory > MaxArgon2idMemory ||
+		hashing.Argon2id.Iterations < 1 || hashing.Argon2id.Iterations > MaxArgon2idIterations ||
+		hashing.Argon2id.Parallelism < 1 || hashing.Argon2id.Parallelism > 255 {
+		fail("password_hashing.argon2id: needs 1 to %d iterations, 1 to 255 lanes and 8 KiB of memory per lane, up to %d KiB",
+			MaxArgon2idIterations, MaxArgon2idMemory)
+	}
+	if hashing.Scrypt.LogN < 1 || hashing.Scrypt.LogN > 31 || hashing.Scrypt.R < 1 || hashing.Scrypt.P < 1 ||
+		hashing.Scrypt.P > MaxScryptP || !ScryptMemoryAllowed(hashing.Scrypt.LogN, hashing.Scrypt.R) {
+		fail("password_hashing.scrypt: log_n and r must be positive with 128*2^log_n*r at most %d bytes, p between 1 and %d",
+			MaxScryptMemory, MaxScryptP)
+	}
+	if hashing.Bcrypt.Cost < 4 || hashing.Bcrypt.Cost > MaxBcryptCost {
+		fail("password_hashing.bcrypt.cost: must be between 4 and %d", MaxBcryptCost)
+	}
+	if hashing.PBKDF2.Iterations < 1 || hashing.PBKDF2.Iterations > MaxPBKDF2Iterations {
+		fail("password_hashing.pbkdf2.iterations: must be between 1 and %d", MaxPBKDF2Iterations)
+	}
+	if c.Admin.APIToken != "" && len(c.Admin.APIToken) < 32 {
+		fail("admin.api_token: must be at least 32 characters")
+	}
+
+	realmNames := make(map[string]bool)
+	realmHosts := make(map[string]string)
+	for i, realm := range c.Realms {
+		field := fmt.Sprintf("realms[%d]", i)
+		if !realmNamePattern.MatchString(realm.Name) {
+			fail("%s.name: must be lowercase letters, digits and dashes, got %q", field, realm.Name)
+		} else {
+			field = fmt.Sprintf("realms[%s]", realm.Name)
+		}
+		if realm.Name == models.DefaultRealm {
+			fail("%s.name: %q is reserved for the realm configured by the top-level settings", field, realm.Name)
+		} else if realmNames[realm.Name] {
+			fail("%s.name: duplicate realm", field)
+		}
+		realmNames[realm.Name] = true
+
+		if realm.Issuer != "" {
+			if problem, _ := checkIssuer(realm.Issuer); problem != "" {
+				fail("%s.issuer: %s", field, problem)
+			}
+		}
+		if (realm.SAMLCertificate == "") != (realm.SAMLKey == "") {
+			fail("%s.saml_certificate and %s.saml_key: set both or neither", field, field)
+		}
+		for _, host := range realm.Hosts {
+			host = strings.ToLower(host)
+			if host == "" {
+				fail("%s.hosts: must not contain empty hosts", field)
+			} else if other, taken := realmHosts[host]; taken {
+				fail("%s.hosts: %s is already used by realm %s", field, host, other)
+			}
+			realmHosts[host] = realm.Name
+		}
+		if realm.JWTSecret != "" && !placeholder(field+".jwt_secret", realm.JWTSecret) && len(realm.JWTSecret) < 32 {
+			fail("%s.jwt_secret: must be at least 32 characters", field)
+		}
+		if realm.Tokens.AccessTokenExpiry < 0 || realm.Tokens.RefreshTokenIdleExpiry < 0 || realm.Tokens.RefreshTokenAbsoluteExpiry < 0 {
+			fail("%s.tokens: lifetimes must not be negative", field)
+		}
+		if tokens := realm.Tokens.Apply(c.Tokens); tokens.RefreshTokenIdleExpiry > tokens.RefreshTokenAbsoluteExpiry {
+			fail("%s.tokens.refresh_token_idle_expiry: must not exceed refresh_token_absolute_expiry", field)
+		}
+	}
+
+	legacy := c.LegacyAuth
+	switch legacy.Backend {
+	case "":
+	case LegacyAuthHTTP:
+		if u, err := url.Parse(legacy.HTTP.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			fail("legacy_auth.http.url: must be an http or https URL, got %q", legacy.HTTP.URL)
+		} else if u.Scheme == "http" {
+			warnings = append(warnings, "legacy_auth.http.url: uses http, so passwords are sent in the clear; use https in production")
+		}
+		if legacy.HTTP.Timeout <= 0 {
+			fail("legacy_auth.http.timeout: must be positive")
+		}
+	case LegacyAuthSQL:
+		if legacy.SQL.Driver != StoragePostgres && legacy.SQL.Driver != StorageSQLite {
+			fail("legacy_auth.sql.driver: must be postgres or sqlite, got %q", legacy.SQL.Driver)
+		}
+		if legacy.SQL.DSN == "" {
+			fail("legacy_auth.sql.dsn: required for the sql backend")
+		}
+		if strings.Count(legacy.SQL.Query, "?") != 1 {
+			fail("legacy_auth.sql.query: must take the username as its only ? parameter")
+		}
+	default:
+		fail("legacy_auth.backend: must be http or sql, got %q", legacy.Backend)
+	}
+	if legacy.Backend != "" && legacy.Realm != models.DefaultRealm && !realmNames[legacy.Realm] {
+		fail("legacy_auth.realm: unknown realm %q", legacy.Realm)
+	}
+
+	if ldap := c.LDAP; ldap.URL != "" {
+		if u, err := url.Parse(ldap.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			fail("ldap.url: must be an ldap or ldaps URL, got %q", ldap.URL)
+		} else if u.Scheme == "ldaps" && ldap.StartTLS {
+			fail("ldap.start_tls: can't be used with an ldaps URL")
+		} else if u.Scheme == "ldap" && !ldap.StartTLS {
+			warnings = append(warnings, "ldap.url: neither ldaps nor start_tls is used, so passwords are sent in the clear")
+		}
+		if ldap.CAFile != "" {
+			if _, err := os.Stat(ldap.CAFile); err != nil {
+				fail("ldap.ca_file: %v", err)
+			}
+		}
+		if ldap.BaseDN == "" {
+			fail("ldap.base_dn: required")
+		}
+		if !strings.HasPrefix(ldap.UserFilter, "(") || !strings.Contains(ldap.UserFilter, "{username}") {
+			fail("ldap.user_filter: must be a parenthesized filter containing {username}, got %q", ldap.UserFilter)
+		}
+		if ldap.Attributes.Username == "" || ldap.Attributes.Email == "" {
+			fail("ldap.attributes: username and email are required")
+		}
+		if ldap.GroupBaseDN != "" && !strings.Contains(ldap.GroupFilter, "{dn}") {
+			fail("ldap.group_filter: must contain {dn} when group_base_dn is set, got %q", ldap.GroupFilter)
+		}
+		if ldap.Realm != models.DefaultRealm && !realmNames[ldap.Realm] {
+			fail("ldap.realm: unknown realm %q", ldap.Realm)
+		}
+		if ldap.SyncInterval < 0 {
+			fail("ldap.sync_interval: must not be negative")
+		}
+		if ldap.Timeout <= 0 {
+			fail("ldap.timeout: must be positive")
+		}
+	}
+
+	providerIDs := make(map[string]bool)
+	for i, provider := range c.UpstreamProviders {
+		field := fmt.Sprintf("upstream_providers[%d]", i)
+		if !realmNamePattern.MatchString(provider.ID) {
+			fail("%s.id: must be lowercase letters, digits and dashes, got %q", field, provider.ID)
+		} else {
+			field = fmt.Sprintf("upstream_providers[%s]", provider.ID)
+		}
+		if providerIDs[provider.ID] {
+			fail("%s.id: duplicate provider", field)
+		}
+		providerIDs[provider.ID] = true
+
+		endpoints := map[string]string{
+			"authorization_url": provider.AuthorizationURL,
+			"token_url":         provider.TokenURL,
+			"userinfo_url":      provider.UserInfoURL,
+		}
+		switch provider.Type {
+		case UpstreamOIDC:
+			endpoints["issuer"] = provider.Issuer
+			if provider.Issuer == "" {
+				fail("%s.issuer: required for oidc providers", field)
+			}
+		case UpstreamOAuth2:
+			for _, name := range []string{"authorization_url", "token_url", "userinfo_url"} {
+				if endpoints[name] == "" {
+					fail("%s.%s: required for oauth2 providers", field, name)
+				}
+			}
+		default:
+			fail("%s.type: must be oidc or oauth2, got %q", field, provider.Type)
+		}
+		for _, name := range []string{"issuer", "authorization_url", "token_url", "userinfo_url"} {
+			if endpoints[name] == "" {
+				continue
+			}
+			if u, err := url.Parse(endpoints[name]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				fail("%s.%s: must be an absolute http(s) URL, got %q", field, name, endpoints[name])
+			} else if u.Scheme == "http" {
+				warnings = append(warnings, fmt.Sprintf("%s.%s: uses http; use https in production", field, name))
+			}
+		}
+		if provider.ClientID == "" {
+			fail("%s.client_id: required", field)
+		}
+		for _, realm := range provider.Realms {
+			if realm != models.DefaultRealm && !realmNames[realm] {
+				fail("%s.realms: unknown realm %q", field, realm)
+			}
+		}
+	}
+
+	if c.Cleanup.Interval < 0 {
+		fail("cleanup.interval: must not be negative")
+	}
+	if c.Cleanup.Interval > 0 && c.Cleanup.BatchSize <= 0 {
+		fail("cleanup.batch_size: must be positive")
+	}
+
+	if len(problems) > 0 {
+		return warnings, &ValidationError{Problems: problems}
+	}
+	return warnings, nil
+}
+
+// realmNamePattern keeps realm names safe to use in URL paths and storage
+// keys.
+var realmNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// checkIssuer returns what is wrong with an issuer URL, if anything, and
+// whether it uses plain http.
+func checkIssuer(issuer string) (problem string, insecure bool) {
+	u, err := url.Parse(issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Sprintf("must be an absolute http(s) URL, got %q", issuer), false
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "must not have a query or fragment", false
+	}
+	return "", u.Scheme == "http"
+}
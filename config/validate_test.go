@@ -0,0 +1,168 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateKeys(t *testing.T) {
+	const (
+		goodJWTSecret    = "a-jwt-secret-of-at-least-32-characters"
+		goodTokenHashKey = "a-token-hash-key-of-at-least-32-characters"
+	)
+	tests := []struct {
+		name          string
+		jwtSecret     string
+		tokenHashKey  string
+		allowInsecure bool
+		// wantProblem is part of the expected validation problem; empty
+		// means the keys are valid.
+		wantProblem string
+		wantWarning string
+	}{
+		{name: "valid", jwtSecret: goodJWTSecret, tokenHashKey: goodTokenHashKey},
+		{name: "default token hash key", jwtSecret: goodJWTSecret, tokenHashKey: Default().Keys.TokenHashKey, wantProblem: "keys.token_hash_key: required"},
+		{name: "short token hash key", jwtSecret: goodJWTSecret, tokenHashKey: "your-token-hash-key-here", wantProblem: "keys.token_hash_key: must be at least 32 characters"},
+		{name: "missing JWT secret", tokenHashKey: goodTokenHashKey, wantProblem: "keys.jwt_secret: required"},
+		{name: "short JWT secret", jwtSecret: "short", tokenHashKey: goodTokenHashKey, wantProblem: "keys.jwt_secret: must be at least 32 characters"},
+		{name: "default JWT secret", jwtSecret: Default().Keys.JWTSecret, tokenHashKey: goodTokenHashKey, wantProblem: "keys.jwt_secret: still a placeholder"},
+		{name: "default JWT secret allowed", jwtSecret: Default().Keys.JWTSecret, tokenHashKey: goodTokenHashKey, allowInsecure: true, wantWarning: "keys.jwt_secret: still a placeholder"},
+		{name: "example JWT secret", jwtSecret: "change-me-to-a-random-string-of-32-or-more-characters", tokenHashKey: goodTokenHashKey, wantProblem: "keys.jwt_secret: still a placeholder"},
+		{name: "example token hash key", jwtSecret: goodJWTSecret, tokenHashKey: "change-me-to-another-random-string-of-32-or-more-chars", wantProblem: "keys.token_hash_key: still a placeholder"},
+		{name: "example token hash key allowed", jwtSecret: goodJWTSecret, tokenHashKey: "change-me-to-another-random-string-of-32-or-more-chars", allowInsecure: true, wantWarning: "keys.token_hash_key: still a placeholder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Keys.JWTSecret = tt.jwtSecret
+			cfg.Keys.TokenHashKey = tt.tokenHashKey
+			cfg.Keys.AllowInsecurePlaceholder = tt.allowInsecure
+			warnings, err := cfg.Validate()
+			var problems []string
+			if validationErr, ok := err.(*ValidationError); ok {
+				problems = validationErr.Problems
+			} else if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+
+			var keyProblems []string
+			for _, problem := range problems {
+				if strings.HasPrefix(problem, "keys.") {
+					keyProblems = append(keyProblems, problem)
+				}
+			}
+			if tt.wantWarning != "" && !containsPrefix(warnings, tt.wantWarning) {
+				t.Errorf("Validate warned %q, want %q", warnings, tt.wantWarning)
+			}
+			if tt.wantProblem == "" {
+				if len(keyProblems) > 0 {
+					t.Errorf("Validate found %q, want no key problems", keyProblems)
+				}
+				return
+			}
+			if len(keyProblems) != 1 || !strings.Contains(keyProblems[0], tt.wantProblem) {
+				t.Errorf("Validate found %q, want %q", keyProblems, tt.wantProblem)
+			}
+		})
+	}
+}
+
+func containsPrefix(list []string, prefix string) bool {
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTrustedProxyRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "addresses", proxies: []string{"192.0.2.10", "2001:db8::1"}, want: []string{"192.0.2.10/32", "2001:db8::1/128"}},
+		{name: "ranges", proxies: []string{"10.0.0.0/8", "2001:db8::/32"}, want: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{name: "host name", proxies: []string{"proxy.internal"}, wantErr: true},
+		{name: "bad range", proxies: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Server.TrustedProxies = tt.proxies
+			ranges, err := cfg.Server.TrustedProxyRanges()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TrustedProxyRanges error = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, ipRange := range ranges {
+				got = append(got, ipRange.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("TrustedProxyRanges = %q, want %q", got, tt.want)
+			}
+
+			_, err = cfg.Validate()
+			validationErr, _ := err.(*ValidationError)
+			var problems []string
+			if validationErr != nil {
+				problems = validationErr.Problems
+			}
+			if got := containsPrefix(problems, "server.trusted_proxies: "); got != tt.wantErr {
+				t.Errorf("Validate found %q, want a trusted_proxies problem %v", problems, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePasswordHashingLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		modify      func(hashing *PasswordHashingConfig)
+		wantProblem string
+	}{
+		{name: "defaults", modify: func(hashing *PasswordHashingConfig) {}},
+		{name: "argon2id at the limits", modify: func(hashing *PasswordHashingConfig) {
+			hashing.Argon2id = Argon2idConfig{Memory: MaxArgon2idMemory, Iterations: MaxArgon2idIterations, Parallelism: 4}
+		}},
+		{name: "argon2id memory", modify: func(hashing *PasswordHashingConfig) { hashing.Argon2id.Memory = MaxArgon2idMemory + 1 }, wantProblem: "password_hashing.argon2id: "},
+		{name: "argon2id iterations", modify: func(hashing *PasswordHashingConfig) { hashing.Argon2id.Iterations = MaxArgon2idIterations + 1 }, wantProblem: "password_hashing.argon2id: "},
+		{name: "scrypt at the limits", modify: func(hashing *PasswordHashingConfig) {
+			hashing.Scrypt = ScryptConfig{LogN: 20, R: 8, P: MaxScryptP}
+		}},
+		{name: "scrypt memory", modify: func(hashing *PasswordHashingConfig) { hashing.Scrypt = ScryptConfig{LogN: 20, R: 9, P: 1} }, wantProblem: "password_hashing.scrypt: "},
+		{name: "scrypt log_n", modify: func(hashing *PasswordHashingConfig) { hashing.Scrypt = ScryptConfig{LogN: 31, R: 1, P: 1} }, wantProblem: "password_hashing.scrypt: "},
+		{name: "scrypt parallelism", modify: func(hashing *PasswordHashingConfig) { hashing.Scrypt.P = MaxScryptP + 1 }, wantProblem: "password_hashing.scrypt: "},
+		{name: "bcrypt cost", modify: func(hashing *PasswordHashingConfig) { hashing.Bcrypt.Cost = MaxBcryptCost + 1 }, wantProblem: "password_hashing.bcrypt.cost: "},
+		{name: "pbkdf2 iterations", modify: func(hashing *PasswordHashingConfig) { hashing.PBKDF2.Iterations = MaxPBKDF2Iterations + 1 }, wantProblem: "password_hashing.pbkdf2.iterations: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(&cfg.PasswordHashing)
+			_, err := cfg.Validate()
+			var problems []string
+			if validationErr, ok := err.(*ValidationError); ok {
+				problems = validationErr.Problems
+			}
+			var hashingProblems []string
+			for _, problem := range problems {
+				if strings.HasPrefix(problem, "password_hashing.") {
+					hashingProblems = append(hashingProblems, problem)
+				}
+			}
+			if tt.wantProblem == "" {
+				if len(hashingProblems) > 0 {
+					t.Errorf("Validate found %q, want no hashing problems", hashingProblems)
+				}
+				return
+			}
+			if len(hashingProblems) != 1 || !strings.HasPrefix(hashingProblems[0], tt.wantProblem) {
+				t.Errorf("Validate found %q, want %q", hashingProblems, tt.wantProblem)
+			}
+		})
+	}
+}
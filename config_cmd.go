@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"oauth2-provider/config"
+	"os"
+)
+
+const configUsage = `usage: oauth2-provider [-config file] config check [file]
+
+Loads the configuration file together with any environment overrides and
+reports every problem found, without starting the server.`
+
+// runConfig implements the config subcommand and returns the process exit
+// code.
+func runConfig(configPath string, args []string) int {
+	if len(args) == 0 || len(args) > 2 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+	if len(args) == 2 {
+		configPath = args[1]
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config check: %v\n", err)
+		return 1
+	}
+
+	warnings, err := cfg.Validate()
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	source := configPath
+	if source == "" {
+		source = "defaults and environment"
+	}
+	fmt.Printf("Configuration OK (%s)\n", source)
+	return 0
+}
@@ -0,0 +1,274 @@
+// Package directory authenticates users against an LDAP directory, such
+// as OpenLDAP or Active Directory, and reads their profile and groups.
+//
+// Users are found by searching with the service account, and their
+// password is checked by binding as them. Every call uses a connection of
+// its own, upgraded with StartTLS when configured, so the service account
+// and user binds never mix.
+package directory
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/url"
+	"oauth2-provider/config"
+	"os"
+	"sort"
+	"strings"
+)
+
+// syncPageSize is the page size of the search listing all users.
+const syncPageSize = 500
+
+// User is what the directory knows about a user.
+type User struct {
+	DN       string
+	Username string
+	Email    string
+	// Groups are the DNs of the user's groups.
+	Groups []string
+	// Roles are mapped from Groups, sorted and without duplicates.
+	Roles []string
+}
+
+// Directory is the configured LDAP directory. It is safe for concurrent
+// use.
+type Directory struct {
+	cfg       config.LDAPConfig
+	tlsConfig *tls.Config
+	// roles maps the configured group DNs to roles.
+	roles map[*ldap.DN]string
+}
+
+// New returns the configured directory, or nil if there is none.
+func New(cfg config.LDAPConfig) (*Directory, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	d := &Directory{
+		cfg:       cfg,
+		tlsConfig: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		roles:     make(map[*ldap.DN]string),
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		d.tlsConfig.RootCAs = pool
+	}
+	for group, role := range cfg.Roles {
+		dn, err := ldap.ParseDN(group)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group DN %q: %v", group, err)
+		}
+		d.roles[dn] = role
+	}
+	return d, nil
+}
+
+// Authenticate returns the user if password is theirs, or nil if the user
+// is unknown or the password is wrong.
+func (d *Directory) Authenticate(username, password string) (*User, error) {
+	// An empty password would make an unauthenticated bind, which
+	// directories accept for any DN
+	if password == "" {
+		return nil, nil
+	}
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := d.findUser(conn, username)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// Groups are read with the service account, which may see more than
+	// the user
+	if err := d.bind(conn); err != nil {
+		return nil, err
+	}
+	return d.user(conn, entry)
+}
+
+// Lookup returns the user with the given username, or nil if there is
+// none.
+func (d *Directory) Lookup(username string) (*User, error) {
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := d.findUser(conn, username)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return d.user(conn, entry)
+}
+
+// Users lists every user the user filter matches.
+func (d *Directory) Users() ([]*User, error) {
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := strings.ReplaceAll(d.cfg.UserFilter, "{username}", "*")
+	result, err := conn.SearchWithPaging(d.userSearch(filter, 0), syncPageSize)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		user, err := d.user(conn, entry)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// connect dials the directory and binds as the service account.
+func (d *Directory) connect() (*ldap.Conn, error) {
+	timeout := d.cfg.Timeout.Duration()
+	conn, err := ldap.DialURL(d.cfg.URL, ldap.DialWithTLSConfig(d.tlsConfig), ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if d.cfg.StartTLS {
+		if err := conn.StartTLS(d.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %v", err)
+		}
+	}
+	if err := d.bind(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Directory) bind(conn *ldap.Conn) error {
+	if d.cfg.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	if err := conn.Bind(d.cfg.BindDN, d.cfg.BindPassword); err != nil {
+		return fmt.Errorf("binding as %s: %v", d.cfg.BindDN, err)
+	}
+	return nil
+}
+
+func (d *Directory) userSearch(filter string, sizeLimit int) *ldap.SearchRequest {
+	attributes := []string{d.cfg.Attributes.Username, d.cfg.Attributes.Email}
+	if d.cfg.GroupBaseDN == "" {
+		attributes = append(attributes, d.cfg.GroupAttribute)
+	}
+	return ldap.NewSearchRequest(d.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		sizeLimit, 0, false, filter, attributes, nil)
+}
+
+// findUser returns the entry of the user with the given username, or nil
+// if there is none.
+func (d *Directory) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(d.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	result, err := conn.Search(d.userSearch(filter, 2))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	switch {
+	case err != nil || len(result.Entries) > 1:
+		return nil, fmt.Errorf("more than one entry matches username %q", username)
+	case len(result.Entries) == 0:
+		return nil, nil
+	}
+	return result.Entries[0], nil
+}
+
+// user reads the user's profile from their entry and looks up their
+// groups.
+func (d *Directory) user(conn *ldap.Conn, entry *ldap.Entry) (*User, error) {
+	user := &User{
+		DN:       entry.DN,
+		Username: entry.GetAttributeValue(d.cfg.Attributes.Username),
+		Email:    entry.GetAttributeValue(d.cfg.Attributes.Email),
+	}
+	if user.Username == "" {
+		return nil, fmt.Errorf("entry %s has no %s attribute", entry.DN, d.cfg.Attributes.Username)
+	}
+
+	if d.cfg.GroupBaseDN == "" {
+		user.Groups = entry.GetAttributeValues(d.cfg.GroupAttribute)
+	} else {
+		filter := strings.ReplaceAll(d.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+		filter = strings.ReplaceAll(filter, "{username}", ldap.EscapeFilter(user.Username))
+		result, err := conn.SearchWithPaging(ldap.NewSearchRequest(d.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, 0, false, filter, []string{"1.1"}, nil), syncPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("searching groups of %s: %v", entry.DN, err)
+		}
+		for _, group := range result.Entries {
+			user.Groups = append(user.Groups, group.DN)
+		}
+	}
+	user.Roles = d.mapRoles(user.Groups)
+	return user, nil
+}
+
+// mapRoles returns the roles of the groups: the configured ones, or the
+// value of each group's first RDN when none are configured.
+func (d *Directory) mapRoles(groups []string) []string {
+	found := make(map[string]bool)
+	add := func(role string) {
+		// Roles are stored separated by spaces
+		if role = strings.Join(strings.Fields(role), "-"); role != "" {
+			found[role] = true
+		}
+	}
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		if len(d.roles) == 0 {
+			add(dn.RDNs[0].Attributes[0].Value)
+			continue
+		}
+		for configured, role := range d.roles {
+			if configured.EqualFold(dn) {
+				add(role)
+			}
+		}
+	}
+	roles := make([]string, 0, len(found))
+	for role := range found {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
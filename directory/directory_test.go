@@ -0,0 +1,227 @@
+package directory_test
+
+import (
+	"oauth2-provider/config"
+	"oauth2-provider/directory"
+	"oauth2-provider/directory/directorytest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	serviceDN = "cn=service,dc=example,dc=com"
+	aliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+	bobDN     = "uid=bob,ou=people,dc=example,dc=com"
+	wildDN    = "uid=wild*card,ou=people,dc=example,dc=com"
+	adminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+	devTeamDN = "cn=Dev Team,ou=groups,dc=example,dc=com"
+)
+
+// testEntries returns a small directory: a service account, three users
+// and two groups, with memberships both on the users (memberOf) and on the
+// groups (member).
+func testEntries() []*directorytest.Entry {
+	return []*directorytest.Entry{
+		{DN: serviceDN, Password: "service-secret", Attributes: map[string][]string{"cn": {"service"}}},
+		{DN: aliceDN, Password: "alice-secret", Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"alice"},
+			"mail":        {"alice@example.com"},
+			"upn":         {"alice@corp.example.com"},
+			"memberOf":    {adminsDN, devTeamDN},
+		}},
+		{DN: bobDN, Password: "bob-secret", Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"bob"},
+			"mail":        {"bob@example.com"},
+			"upn":         {"bob@corp.example.com"},
+			"memberOf":    {devTeamDN},
+		}},
+		{DN: wildDN, Password: "wild-secret", Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"wild*card"},
+			"mail":        {"wild@example.com"},
+		}},
+		{DN: adminsDN, Attributes: map[string][]string{"cn": {"admins"}, "member": {aliceDN}}},
+		{DN: devTeamDN, Attributes: map[string][]string{"cn": {"Dev Team"}, "member": {aliceDN, bobDN}}},
+	}
+}
+
+// newDirectory starts a server with the test entries and returns a
+// directory using it with the default configuration, adjusted by modify.
+func newDirectory(t *testing.T, modify func(cfg *config.LDAPConfig)) (*directory.Directory, *directorytest.Server) {
+	server := directorytest.NewServer(t, testEntries()...)
+	cfg := config.Default().LDAP
+	cfg.URL = server.URL
+	cfg.BindDN = serviceDN
+	cfg.BindPassword = "service-secret"
+	cfg.BaseDN = "ou=people,dc=example,dc=com"
+	cfg.Timeout = config.Duration(5 * time.Second)
+	if modify != nil {
+		modify(&cfg)
+	}
+	dir, err := directory.New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return dir, server
+}
+
+func TestAuthenticate(t *testing.T) {
+	dir, _ := newDirectory(t, nil)
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     *directory.User
+	}{
+		{name: "right password", username: "alice", password: "alice-secret", want: &directory.User{
+			DN:       aliceDN,
+			Username: "alice",
+			Email:    "alice@example.com",
+			Groups:   []string{adminsDN, devTeamDN},
+			Roles:    []string{"Dev-Team", "admins"},
+		}},
+		{name: "wrong password", username: "alice", password: "bob-secret"},
+		{name: "empty password", username: "alice", password: ""},
+		{name: "unknown user", username: "mallory", password: "alice-secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := dir.Authenticate(tt.username, tt.password)
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+			if !reflect.DeepEqual(user, tt.want) {
+				t.Errorf("Authenticate = %+v, want %+v", user, tt.want)
+			}
+		})
+	}
+
+	t.Run("wrong service password", func(t *testing.T) {
+		dir, _ := newDirectory(t, func(cfg *config.LDAPConfig) { cfg.BindPassword = "wrong" })
+		if _, err := dir.Authenticate("alice", "alice-secret"); err == nil {
+			t.Error("Authenticate succeeded without a service account bind")
+		}
+	})
+}
+
+// TestFilterEscaping checks that usernames are matched literally, so
+// filter syntax in them can't widen the search.
+func TestFilterEscaping(t *testing.T) {
+	tests := []struct {
+		username   string
+		wantFilter string
+		wantUser   string
+	}{
+		{username: "alice", wantFilter: "(uid=alice)", wantUser: "alice"},
+		{username: "*", wantFilter: `(uid=\2a)`},
+		{username: "a*", wantFilter: `(uid=a\2a)`},
+		{username: "wild*card", wantFilter: `(uid=wild\2acard)`, wantUser: "wild*card"},
+		{username: "alice)(uid=*", wantFilter: `(uid=alice\29\28uid=\2a)`},
+		{username: `alice\`, wantFilter: `(uid=alice\5c)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			dir, server := newDirectory(t, nil)
+			user, err := dir.Lookup(tt.username)
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			var got string
+			if user != nil {
+				got = user.Username
+			}
+			if got != tt.wantUser {
+				t.Errorf("Lookup found %q, want %q", got, tt.wantUser)
+			}
+			if filters := server.Filters(); len(filters) == 0 || filters[0] != tt.wantFilter {
+				t.Errorf("filters = %q, want the user search %q first", filters, tt.wantFilter)
+			}
+		})
+	}
+}
+
+func TestMapping(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *config.LDAPConfig)
+		want   *directory.User
+	}{
+		{
+			name: "group attribute, roles from group names",
+			want: &directory.User{DN: aliceDN, Username: "alice", Email: "alice@example.com",
+				Groups: []string{adminsDN, devTeamDN}, Roles: []string{"Dev-Team", "admins"}},
+		},
+		{
+			name: "configured roles, group DNs compared case insensitively",
+			modify: func(cfg *config.LDAPConfig) {
+				cfg.Roles = map[string]string{
+					"CN=Admins,OU=Groups,DC=example,DC=com": "admin",
+					"cn=unused,ou=groups,dc=example,dc=com": "unused",
+				}
+			},
+			want: &directory.User{DN: aliceDN, Username: "alice", Email: "alice@example.com",
+				Groups: []string{adminsDN, devTeamDN}, Roles: []string{"admin"}},
+		},
+		{
+			name: "configured attributes",
+			modify: func(cfg *config.LDAPConfig) {
+				cfg.UserFilter = "(&(objectClass=person)(upn={username}))"
+				cfg.Attributes = config.LDAPAttributeConfig{Username: "upn", Email: "upn"}
+			},
+			want: &directory.User{DN: aliceDN, Username: "alice@corp.example.com", Email: "alice@corp.example.com",
+				Groups: []string{adminsDN, devTeamDN}, Roles: []string{"Dev-Team", "admins"}},
+		},
+		{
+			name: "group search",
+			modify: func(cfg *config.LDAPConfig) {
+				cfg.GroupBaseDN = "ou=groups,dc=example,dc=com"
+				cfg.GroupAttribute = "none"
+			},
+			want: &directory.User{DN: aliceDN, Username: "alice", Email: "alice@example.com",
+				Groups: []string{adminsDN, devTeamDN}, Roles: []string{"Dev-Team", "admins"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _ := newDirectory(t, tt.modify)
+			username := "alice"
+			if tt.want.Username != "alice" {
+				username = tt.want.Username
+			}
+			user, err := dir.Lookup(username)
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			if !reflect.DeepEqual(user, tt.want) {
+				t.Errorf("Lookup = %+v, want %+v", user, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsers(t *testing.T) {
+	dir, server := newDirectory(t, func(cfg *config.LDAPConfig) {
+		cfg.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	})
+	users, err := dir.Users()
+	if err != nil {
+		t.Fatalf("Users: %v", err)
+	}
+	var usernames []string
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+	if want := []string{"alice", "bob", "wild*card"}; !reflect.DeepEqual(usernames, want) {
+		t.Errorf("Users = %q, want %q", usernames, want)
+	}
+	if roles := users[1].Roles; !reflect.DeepEqual(roles, []string{"Dev-Team"}) {
+		t.Errorf("roles of bob = %q, want [Dev-Team]", roles)
+	}
+	// The group search of wild*card must not match every member
+	if filters := server.Filters(); filters[len(filters)-1] != `(member=uid=wild\2acard,ou=people,dc=example,dc=com)` {
+		t.Errorf("last group filter = %q", filters[len(filters)-1])
+	}
+}
@@ -0,0 +1,294 @@
+// Package encryption implements envelope encryption for sensitive columns.
+//
+// Values are encrypted with AES-256-GCM under a random data key. Data keys
+// are stored (see models.DataKey) wrapped by a master key that only lives
+// in configuration. Rotating a master key therefore means re-wrapping the
+// handful of data keys, not re-encrypting every row: configure the new key
+// next to the old one, make it active, roll out, then run Rewrap.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"strings"
+	"sync"
+)
+
+// ciphertextPrefix marks encrypted column values; the format is
+// enc:v1:<data key id>:<base64url(nonce || ciphertext)>.
+const ciphertextPrefix = "enc:v1:"
+
+var ErrNoMasterKey = errors.New("no master key configured")
+
+type Keyring struct {
+	store           storage.DataKeyRepository
+	masterKeys      map[string][]byte
+	activeMasterKey string
+
+	mu       sync.Mutex
+	dataKeys map[string][]byte
+}
+
+// NewKeyring returns a keyring using the configured master keys. It returns
+// ErrNoMasterKey when none are configured.
+func NewKeyring(store storage.DataKeyRepository, cfg config.KeysConfig) (*Keyring, error) {
+	if len(cfg.MasterKeys) == 0 {
+		return nil, ErrNoMasterKey
+	}
+
+	masterKeys := make(map[string][]byte, len(cfg.MasterKeys))
+	for _, key := range cfg.MasterKeys {
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, base64 encoded", key.ID)
+		}
+		masterKeys[key.ID] = raw
+	}
+	if _, ok := masterKeys[cfg.ActiveMasterKey]; !ok {
+		return nil, fmt.Errorf("active master key %q is not configured", cfg.ActiveMasterKey)
+	}
+
+	return &Keyring{
+		store:           store,
+		masterKeys:      masterKeys,
+		activeMasterKey: cfg.ActiveMasterKey,
+		dataKeys:        make(map[string][]byte),
+	}, nil
+}
+
+// GenerateMasterKey returns a new random master key, base64 encoded.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// IsEncrypted reports whether value was produced by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, ciphertextPrefix)
+}
+
+// Encrypt encrypts plaintext under the active data key, creating one if
+// needed. The associated data binds the ciphertext to where it is stored
+// (for example "users.totp_secret:42"); the same value must be passed to
+// Decrypt.
+func (k *Keyring) Encrypt(plaintext, associatedData []byte) (string, error) {
+	keyID, dataKey, err := k.activeDataKey()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(dataKey, plaintext, associatedData)
+	if err != nil {
+		return "", err
+	}
+	return ciphertextPrefix + keyID + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (k *Keyring) Decrypt(ciphertext string, associatedData []byte) ([]byte, error) {
+	if !IsEncrypted(ciphertext) {
+		return nil, errors.New("value is not encrypted")
+	}
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(ciphertext, ciphertextPrefix), ":")
+	if !ok {
+		return nil, errors.New("malformed ciphertext")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("malformed ciphertext")
+	}
+
+	dataKey, err := k.dataKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, sealed, associatedData)
+}
+
+func (k *Keyring) EncryptString(plaintext, associatedData string) (string, error) {
+	return k.Encrypt([]byte(plaintext), []byte(associatedData))
+}
+
+func (k *Keyring) DecryptString(ciphertext, associatedData string) (string, error) {
+	plaintext, err := k.Decrypt(ciphertext, []byte(associatedData))
+	return string(plaintext), err
+}
+
+// RotateDataKey creates a new active data key. Existing ciphertexts keep
+// decrypting with the key they name.
+func (k *Keyring) RotateDataKey() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keyID, _, err := k.createDataKeyLocked()
+	return keyID, err
+}
+
+// Rewrap re-wraps every data key that is not wrapped by the active master
+// key and returns how many were changed. Once it succeeds, retired master
+// keys can be removed from the configuration.
+func (k *Keyring) Rewrap() (int, error) {
+	keys, err := k.store.ListDataKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for i := range keys {
+		key := &keys[i]
+		if key.MasterKeyID == k.activeMasterKey {
+			continue
+		}
+
+		dataKey, err := k.unwrap(key)
+		if err != nil {
+			return rewrapped, err
+		}
+		wrapped, err := k.wrap(key.KeyID, dataKey)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		key.MasterKeyID = k.activeMasterKey
+		key.WrappedKey = wrapped
+		if err := k.store.UpdateDataKey(key); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+func (k *Keyring) activeDataKey() (string, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key := k.store.GetActiveDataKey(); key != nil {
+		dataKey, err := k.cachedLocked(key)
+		return key.KeyID, dataKey, err
+	}
+	return k.createDataKeyLocked()
+}
+
+func (k *Keyring) dataKey(keyID string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if dataKey, ok := k.dataKeys[keyID]; ok {
+		return dataKey, nil
+	}
+	key := k.store.GetDataKey(keyID)
+	if key == nil {
+		return nil, fmt.Errorf("data key %s not found", keyID)
+	}
+	return k.cachedLocked(key)
+}
+
+func (k *Keyring) cachedLocked(key *models.DataKey) ([]byte, error) {
+	if dataKey, ok := k.dataKeys[key.KeyID]; ok {
+		return dataKey, nil
+	}
+	dataKey, err := k.unwrap(key)
+	if err != nil {
+		return nil, err
+	}
+	k.dataKeys[key.KeyID] = dataKey
+	return dataKey, nil
+}
+
+func (k *Keyring) createDataKeyLocked() (string, []byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, err
+	}
+	keyID := utils.GenerateRandomString(16)
+
+	wrapped, err := k.wrap(keyID, dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	key := &models.DataKey{
+		KeyID:       keyID,
+		MasterKeyID: k.activeMasterKey,
+		WrappedKey:  wrapped,
+		Active:      true,
+	}
+	if err := k.store.StoreDataKey(key); err != nil {
+		return "", nil, err
+	}
+
+	log.Printf("Created data key %s wrapped by master key %s", keyID, k.activeMasterKey)
+	k.dataKeys[keyID] = dataKey
+	return keyID, dataKey, nil
+}
+
+// wrap encrypts a data key under the active master key, bound to its ID.
+func (k *Keyring) wrap(keyID string, dataKey []byte) (string, error) {
+	sealed, err := seal(k.masterKeys[k.activeMasterKey], dataKey, []byte(keyID))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *Keyring) unwrap(key *models.DataKey) ([]byte, error) {
+	masterKey, ok := k.masterKeys[key.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("data key %s is wrapped by master key %q, which is not configured", key.KeyID, key.MasterKeyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(key.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("data key %s: malformed wrapped key", key.KeyID)
+	}
+	dataKey, err := open(masterKey, sealed, []byte(key.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("data key %s: %v", key.KeyID, err)
+	}
+	return dataKey, nil
+}
+
+func seal(key, plaintext, associatedData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func open(key, sealed, associatedData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed ciphertext")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, errors.New("decryption failed")
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,219 @@
+package encryption_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/encryption"
+	"oauth2-provider/storage"
+	"strings"
+	"testing"
+)
+
+// masterKey returns a new master key configuration with the given ID.
+func masterKey(t *testing.T, id string) config.MasterKeyConfig {
+	t.Helper()
+	key, err := encryption.GenerateMasterKey()
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	return config.MasterKeyConfig{ID: id, Key: key}
+}
+
+func newKeyring(t *testing.T, store storage.DataKeyRepository, active string, masterKeys ...config.MasterKeyConfig) *encryption.Keyring {
+	t.Helper()
+	keyring, err := encryption.NewKeyring(store, config.KeysConfig{MasterKeys: masterKeys, ActiveMasterKey: active})
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return keyring
+}
+
+func TestNewKeyring(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	m1 := masterKey(t, "m1")
+
+	tests := []struct {
+		name    string
+		cfg     config.KeysConfig
+		wantErr string
+	}{
+		{name: "valid", cfg: config.KeysConfig{MasterKeys: []config.MasterKeyConfig{m1}, ActiveMasterKey: "m1"}},
+		{name: "no master keys", cfg: config.KeysConfig{ActiveMasterKey: "m1"}, wantErr: encryption.ErrNoMasterKey.Error()},
+		{name: "active key not configured", cfg: config.KeysConfig{MasterKeys: []config.MasterKeyConfig{m1}, ActiveMasterKey: "m2"}, wantErr: `active master key "m2" is not configured`},
+		{name: "short key", cfg: config.KeysConfig{MasterKeys: []config.MasterKeyConfig{{ID: "m1", Key: "c2hvcnQ="}}, ActiveMasterKey: "m1"}, wantErr: "master key m1 must be 32 bytes, base64 encoded"},
+		{name: "not base64", cfg: config.KeysConfig{MasterKeys: []config.MasterKeyConfig{{ID: "m1", Key: "not base64!"}}, ActiveMasterKey: "m1"}, wantErr: "master key m1 must be 32 bytes, base64 encoded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := encryption.NewKeyring(store, tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewKeyring: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("NewKeyring error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	keyring := newKeyring(t, storage.NewMemoryStorage(), "m1", masterKey(t, "m1"))
+
+	ciphertext, err := keyring.EncryptString("JBSWY3DPEHPK3PXP", "users.totp_secret:42")
+	if err != nil {
+		t.Fatalf("EncryptString: %v", err)
+	}
+	if !encryption.IsEncrypted(ciphertext) || strings.Contains(ciphertext, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("ciphertext = %q, want an encrypted value", ciphertext)
+	}
+	if again, _ := keyring.EncryptString("JBSWY3DPEHPK3PXP", "users.totp_secret:42"); again == ciphertext {
+		t.Error("encrypting twice gave the same ciphertext")
+	}
+
+	plaintext, err := keyring.DecryptString(ciphertext, "users.totp_secret:42")
+	if err != nil {
+		t.Fatalf("DecryptString: %v", err)
+	}
+	if plaintext != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("plaintext = %q, want the original", plaintext)
+	}
+
+	// Change one character well inside the sealed part
+	i := len(ciphertext) - 10
+	flipped := byte('A')
+	if ciphertext[i] == 'A' {
+		flipped = 'B'
+	}
+	tampered := ciphertext[:i] + string(flipped) + ciphertext[i+1:]
+
+	tests := []struct {
+		name           string
+		ciphertext     string
+		associatedData string
+	}{
+		{name: "associated data of another row", ciphertext: ciphertext, associatedData: "users.totp_secret:43"},
+		{name: "associated data of another column", ciphertext: ciphertext, associatedData: "users.recovery_codes:42"},
+		{name: "tampered ciphertext", ciphertext: tampered, associatedData: "users.totp_secret:42"},
+		{name: "unknown data key", ciphertext: "enc:v1:unknown:" + ciphertext[strings.LastIndex(ciphertext, ":")+1:], associatedData: "users.totp_secret:42"},
+		{name: "malformed", ciphertext: "enc:v1:no-separator", associatedData: "users.totp_secret:42"},
+		{name: "not encrypted", ciphertext: "JBSWY3DPEHPK3PXP", associatedData: "users.totp_secret:42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if plaintext, err := keyring.DecryptString(tt.ciphertext, tt.associatedData); err == nil {
+				t.Fatalf("DecryptString succeeded with %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestRotateDataKey(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	keyring := newKeyring(t, store, "m1", masterKey(t, "m1"))
+
+	before, err := keyring.EncryptString("before", "ad")
+	if err != nil {
+		t.Fatalf("EncryptString: %v", err)
+	}
+	keyID, err := keyring.RotateDataKey()
+	if err != nil {
+		t.Fatalf("RotateDataKey: %v", err)
+	}
+	after, err := keyring.EncryptString("after", "ad")
+	if err != nil {
+		t.Fatalf("EncryptString: %v", err)
+	}
+
+	if !strings.HasPrefix(after, "enc:v1:"+keyID+":") || strings.HasPrefix(before, "enc:v1:"+keyID+":") {
+		t.Errorf("ciphertexts %q and %q, want only the second under the new data key %s", before, after, keyID)
+	}
+	if active := store.GetActiveDataKey(); active == nil || active.KeyID != keyID {
+		t.Errorf("active data key = %+v, want %s", active, keyID)
+	}
+
+	for want, ciphertext := range map[string]string{"before": before, "after": after} {
+		if got, err := keyring.DecryptString(ciphertext, "ad"); err != nil || got != want {
+			t.Errorf("DecryptString = %q, %v, want %q", got, err, want)
+		}
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	m1, m2 := masterKey(t, "m1"), masterKey(t, "m2")
+
+	old := newKeyring(t, store, "m1", m1)
+	first, err := old.EncryptString("first", "ad")
+	if err != nil {
+		t.Fatalf("EncryptString: %v", err)
+	}
+	if _, err := old.RotateDataKey(); err != nil {
+		t.Fatalf("RotateDataKey: %v", err)
+	}
+	second, err := old.EncryptString("second", "ad")
+	if err != nil {
+		t.Fatalf("EncryptString: %v", err)
+	}
+
+	// Without the master key that wrapped them the data keys are lost
+	if _, err := newKeyring(t, store, "m2", m2).DecryptString(first, "ad"); err == nil {
+		t.Fatal("decrypted without the wrapping master key")
+	}
+
+	// m2 becomes active next to m1; Rewrap moves both data keys to it
+	rotating := newKeyring(t, store, "m2", m1, m2)
+	rewrapped, err := rotating.Rewrap()
+	if err != nil {
+		t.Fatalf("Rewrap: %v", err)
+	}
+	if rewrapped != 2 {
+		t.Errorf("Rewrap changed %d data keys, want 2", rewrapped)
+	}
+	if again, err := rotating.Rewrap(); err != nil || again != 0 {
+		t.Errorf("second Rewrap = %d, %v, want nothing left to change", again, err)
+	}
+	keys, err := store.ListDataKeys()
+	if err != nil {
+		t.Fatalf("ListDataKeys: %v", err)
+	}
+	for _, key := range keys {
+		if key.MasterKeyID != "m2" {
+			t.Errorf("data key %s wrapped by %s, want m2", key.KeyID, key.MasterKeyID)
+		}
+	}
+
+	// Once rewrapped, m1 can be removed
+	current := newKeyring(t, store, "m2", m2)
+	for want, ciphertext := range map[string]string{"first": first, "second": second} {
+		if got, err := current.DecryptString(ciphertext, "ad"); err != nil || got != want {
+			t.Errorf("DecryptString after Rewrap = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := newKeyring(t, store, "m1", m1).DecryptString(first, "ad"); err == nil {
+		t.Error("the retired master key still unwraps the data keys")
+	}
+}
+
+func TestRewrapUnknownMasterKey(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	if _, err := newKeyring(t, store, "m1", masterKey(t, "m1")).EncryptString("secret", "ad"); err != nil {
+		t.Fatalf("EncryptString: %v", err)
+	}
+
+	// Rewrapping without the key that wrapped the data keys fails and
+	// leaves them as they were
+	rewrapped, err := newKeyring(t, store, "m2", masterKey(t, "m2")).Rewrap()
+	if err == nil || rewrapped != 0 {
+		t.Fatalf("Rewrap = %d, %v, want an error", rewrapped, err)
+	}
+	if errors.Is(err, encryption.ErrNoMasterKey) || !strings.Contains(err.Error(), `master key "m1", which is not configured`) {
+		t.Errorf("Rewrap error = %v, want the missing master key named", err)
+	}
+	keys, _ := store.ListDataKeys()
+	if len(keys) != 1 || keys[0].MasterKeyID != "m1" {
+		t.Errorf("data keys = %+v, want the one wrapped by m1", keys)
+	}
+}
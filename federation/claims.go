@@ -0,0 +1,62 @@
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// mapClaims picks the identity out of the claims, using the configured
+// claim names.
+func (p *Provider) mapClaims(claims map[string]interface{}) (*Identity, error) {
+	names := p.cfg.Claims
+	identity := &Identity{
+		Subject:  claimString(claims, orDefault(names.Subject, "sub")),
+		Username: claimString(claims, orDefault(names.Username, "preferred_username")),
+		Email:    strings.TrimSpace(claimString(claims, orDefault(names.Email, "email"))),
+	}
+	if identity.Subject == "" {
+		return nil, errors.New("provider did not identify the user")
+	}
+	if identity.Email != "" {
+		identity.EmailVerified = p.cfg.TrustEmail || claimBool(claims, orDefault(names.EmailVerified, "email_verified"))
+	}
+	return identity, nil
+}
+
+func orDefault(name, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// claimString returns a string or numeric claim as a string; numeric IDs
+// are common with plain OAuth2 providers.
+func claimString(claims map[string]interface{}, name string) string {
+	switch value := claims[name].(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// claimBool returns a boolean claim, which some providers send as a
+// string.
+func claimBool(claims map[string]interface{}, name string) bool {
+	switch value := claims[name].(type) {
+	case bool:
+		return value
+	case string:
+		verified, _ := strconv.ParseBool(value)
+		return verified
+	default:
+		return false
+	}
+}
@@ -0,0 +1,263 @@
+package federation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discoveryTTL is how long discovered metadata and keys are used
+	// before they are fetched again.
+	discoveryTTL = time.Hour
+	// keysRefetchInterval limits how often an unknown key ID makes the
+	// keys be fetched again, so forged tokens can't flood the provider.
+	keysRefetchInterval = time.Minute
+	// clockSkew is tolerated between this server and the provider when
+	// checking token times.
+	clockSkew = time.Minute
+)
+
+// idTokenAlgorithms are the ID token signatures accepted: asymmetric
+// ones, as keys come from the provider's JWKS document.
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// metadata is the part of an OpenID Provider's metadata that is used.
+type metadata struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	UserInfoEndpoint         string   `json:"userinfo_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// onlySupports reports whether method is the only client authentication
+// the token endpoint supports.
+func (m *metadata) onlySupports(method string) bool {
+	return len(m.TokenEndpointAuthMethods) == 1 && m.TokenEndpointAuthMethods[0] == method
+}
+
+// discovery fetches and caches an OpenID Provider's metadata and signing
+// keys. Stale values are used while the provider can't be reached.
+type discovery struct {
+	issuer string
+	client *http.Client
+
+	mu            sync.Mutex
+	discovered    *metadata
+	discoveredAt  time.Time
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+func newDiscovery(issuer string, client *http.Client) *discovery {
+	return &discovery{issuer: issuer, client: client}
+}
+
+func (d *discovery) metadata() (*metadata, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.metadataLocked()
+}
+
+func (d *discovery) metadataLocked() (*metadata, error) {
+	if d.discovered != nil && time.Since(d.discoveredAt) < discoveryTTL {
+		return d.discovered, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(d.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	discovered := new(metadata)
+	err = doJSON(d.client, req, discovered)
+	if err == nil && discovered.Issuer != d.issuer {
+		err = fmt.Errorf("metadata names issuer %q", discovered.Issuer)
+	}
+	if err == nil && (discovered.AuthorizationEndpoint == "" || discovered.TokenEndpoint == "" || discovered.JWKSURI == "") {
+		err = errors.New("metadata lacks the authorization, token or JWKS endpoint")
+	}
+	if err != nil {
+		if d.discovered != nil {
+			return d.discovered, nil
+		}
+		return nil, fmt.Errorf("discovering %s: %v", d.issuer, err)
+	}
+	d.discovered = discovered
+	d.discoveredAt = time.Now()
+	return discovered, nil
+}
+
+// key returns the provider's signing key with the given ID, fetching the
+// keys again if it isn't known, as providers rotate their keys. Without an
+// ID, the only key is returned.
+func (d *discovery) key(keyID string) (interface{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key := d.findKeyLocked(keyID); key != nil && time.Since(d.keysFetchedAt) < discoveryTTL {
+		return key, nil
+	}
+	if time.Since(d.keysFetchedAt) >= keysRefetchInterval {
+		if err := d.fetchKeysLocked(); err != nil && d.keys == nil {
+			return nil, err
+		}
+	}
+	if key := d.findKeyLocked(keyID); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", keyID)
+}
+
+func (d *discovery) findKeyLocked(keyID string) interface{} {
+	if keyID == "" && len(d.keys) == 1 {
+		for _, key := range d.keys {
+			return key
+		}
+	}
+	return d.keys[keyID]
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	Use     string `json:"use"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (d *discovery) fetchKeysLocked() error {
+	discovered, err := d.metadataLocked()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, discovered.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	// Count the attempt even if it fails, so a broken endpoint isn't
+	// hammered
+	d.keysFetchedAt = time.Now()
+	if err := doJSON(d.client, req, &set); err != nil {
+		return fmt.Errorf("fetching keys of %s: %v", d.issuer, err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	d.keys = keys
+	return nil
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(value string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, e := decode(k.N), decode(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil, errors.New("malformed RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[k.Curve]
+		x, y := decode(k.X), decode(k.Y)
+		if !found || x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("malformed EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry
+// and nonce, and returns its claims.
+func (d *discovery) verifyIDToken(raw, clientID, nonce string) (map[string]interface{}, error) {
+	parser := &jwt.Parser{ValidMethods: idTokenAlgorithms, UseJSONNumber: true, SkipClaimsValidation: true}
+	token, err := parser.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		return d.key(keyID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if claimString(claims, "iss") != d.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claimString(claims, "iss"))
+	}
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []string{aud}
+	case []interface{}:
+		for _, value := range aud {
+			if s, ok := value.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	intended := false
+	for _, aud := range audience {
+		intended = intended || aud == clientID
+	}
+	if !intended {
+		return nil, errors.New("token is not meant for this client")
+	}
+	if azp := claimString(claims, "azp"); len(audience) > 1 && azp != clientID {
+		return nil, fmt.Errorf("token was issued to %q", azp)
+	}
+
+	now := time.Now()
+	expiresAt, err := claimTime(claims, "exp")
+	if err != nil || !now.Before(expiresAt.Add(clockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	if issuedAt, err := claimTime(claims, "iat"); err == nil && issuedAt.After(now.Add(clockSkew)) {
+		return nil, errors.New("token issued in the future")
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+func claimTime(claims map[string]interface{}, name string) (time.Time, error) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing %s claim", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(seconds), 0), nil
+}
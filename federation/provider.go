@@ -0,0 +1,265 @@
+// Package federation signs users in through upstream identity providers:
+// OpenID Connect providers, whose endpoints and keys are discovered from
+// their issuer, and plain OAuth2 providers with a userinfo endpoint.
+//
+// The authorization code flow is used with PKCE, plus a nonce bound into
+// the ID token for OpenID Connect. Keeping the state, nonce and code
+// verifier between the redirect and the callback is up to the caller.
+package federation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"oauth2-provider/config"
+	"strings"
+	"time"
+)
+
+// upstreamTimeout bounds every call to an upstream provider.
+const upstreamTimeout = 10 * time.Second
+
+// Identity is the user an upstream provider vouched for, after claim
+// mapping.
+type Identity struct {
+	// Subject identifies the user at the provider and never changes.
+	Subject  string
+	Username string
+	Email    string
+	// EmailVerified is set when the provider vouches for the address.
+	EmailVerified bool
+}
+
+// Provider is one configured upstream identity provider. It is safe for
+// concurrent use.
+type Provider struct {
+	cfg    config.UpstreamProviderConfig
+	client *http.Client
+	// oidc is set for OpenID Connect providers.
+	oidc *discovery
+}
+
+// NewProviders returns the configured upstream providers.
+func NewProviders(cfgs []config.UpstreamProviderConfig) []*Provider {
+	var providers []*Provider
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			cfg.Name = cfg.ID
+		}
+		if len(cfg.Scopes) == 0 && cfg.Type == config.UpstreamOIDC {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+		client := &http.Client{Timeout: upstreamTimeout}
+		provider := &Provider{cfg: cfg, client: client}
+		if cfg.Type == config.UpstreamOIDC {
+			provider.oidc = newDiscovery(cfg.Issuer, client)
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+func (p *Provider) ID() string   { return p.cfg.ID }
+func (p *Provider) Name() string { return p.cfg.Name }
+
+// OfferedIn reports whether users of the realm may sign in with the
+// provider.
+func (p *Provider) OfferedIn(realm string) bool {
+	if len(p.cfg.Realms) == 0 {
+		return true
+	}
+	for _, name := range p.cfg.Realms {
+		if name == realm {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoints returns the provider's endpoints, the configured ones taking
+// precedence over discovered ones.
+func (p *Provider) endpoints() (*metadata, error) {
+	endpoints := &metadata{
+		AuthorizationEndpoint: p.cfg.AuthorizationURL,
+		TokenEndpoint:         p.cfg.TokenURL,
+		UserInfoEndpoint:      p.cfg.UserInfoURL,
+	}
+	if p.oidc == nil {
+		return endpoints, nil
+	}
+	discovered, err := p.oidc.metadata()
+	if err != nil {
+		return nil, err
+	}
+	if endpoints.AuthorizationEndpoint == "" {
+		endpoints.AuthorizationEndpoint = discovered.AuthorizationEndpoint
+	}
+	if endpoints.TokenEndpoint == "" {
+		endpoints.TokenEndpoint = discovered.TokenEndpoint
+	}
+	if endpoints.UserInfoEndpoint == "" {
+		endpoints.UserInfoEndpoint = discovered.UserInfoEndpoint
+	}
+	endpoints.TokenEndpointAuthMethods = discovered.TokenEndpointAuthMethods
+	return endpoints, nil
+}
+
+// AuthorizationURL returns where to send the user to sign in. The same
+// code verifier and nonce must be given to Exchange.
+func (p *Provider) AuthorizationURL(redirectURI, state, nonce, codeVerifier string) (string, error) {
+	endpoints, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoints.AuthorizationEndpoint)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid authorization endpoint %q", endpoints.AuthorizationEndpoint)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("state", state)
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	if len(p.cfg.Scopes) > 0 {
+		query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	}
+	if p.oidc != nil {
+		query.Set("nonce", nonce)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+// Exchange redeems the code the provider sent back and returns the user
+// it signed in. For OpenID Connect providers the ID token must carry
+// nonce; claims missing from it are taken from the userinfo endpoint.
+func (p *Provider) Exchange(code, redirectURI, codeVerifier, nonce string) (*Identity, error) {
+	endpoints, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := p.redeem(endpoints, code, redirectURI, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if p.oidc != nil {
+		if tokens.IDToken == "" {
+			return nil, errors.New("token response has no ID token")
+		}
+		if claims, err = p.oidc.verifyIDToken(tokens.IDToken, p.cfg.ClientID, nonce); err != nil {
+			return nil, fmt.Errorf("invalid ID token: %v", err)
+		}
+	}
+	if endpoints.UserInfoEndpoint != "" && tokens.AccessToken != "" {
+		userInfo, err := p.userInfo(endpoints.UserInfoEndpoint, tokens.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		// The userinfo response must describe the ID token's user
+		if sub, found := claims["sub"]; found && claimString(userInfo, "sub") != claimString(claims, "sub") {
+			return nil, fmt.Errorf("userinfo subject does not match ID token subject %v", sub)
+		}
+		for name, value := range userInfo {
+			if _, found := claims[name]; !found {
+				claims[name] = value
+			}
+		}
+	}
+	return p.mapClaims(claims)
+}
+
+// redeem exchanges the code for tokens. OpenID Connect providers get the
+// client secret with HTTP Basic authentication unless they only support
+// client_secret_post; plain OAuth2 providers get it in the form, which is
+// what most of them expect.
+func (p *Provider) redeem(endpoints *metadata, code, redirectURI, codeVerifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+		"client_id":     {p.cfg.ClientID},
+	}
+	basic := p.oidc != nil && p.cfg.ClientSecret != "" && !endpoints.onlySupports("client_secret_post")
+	if p.cfg.ClientSecret != "" && !basic {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	tokens := new(tokenResponse)
+	if err := doJSON(p.client, req, tokens); err != nil {
+		return nil, fmt.Errorf("token request: %v", err)
+	}
+	if tokens.AccessToken == "" {
+		return nil, errors.New("token response has no access token")
+	}
+	return tokens, nil
+}
+
+func (p *Provider) userInfo(endpoint, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	var claims map[string]interface{}
+	if err := doJSON(p.client, req, &claims); err != nil {
+		return nil, fmt.Errorf("userinfo request: %v", err)
+	}
+	return claims, nil
+}
+
+// doJSON sends req and decodes a successful JSON response into v.
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthError struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &oauthError) == nil && oauthError.Error != "" {
+			return fmt.Errorf("%s: %s %s", resp.Status, oauthError.Error, oauthError.Description)
+		}
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
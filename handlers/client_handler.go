@@ -1,9 +1,11 @@
 package handlers
 
 import (
+    "errors"
     "github.com/labstack/echo/v4"
     "net/http"
     "oauth2-provider/models"
+    "oauth2-provider/realms"
     "oauth2-provider/services"
 )
 
@@ -16,29 +18,68 @@ func NewClientHandler(clientService *services.ClientService) *ClientHandler {
 }
 
 func (h *ClientHandler) Register(c echo.Context) error {
+    realm := c.Get("realm").(*realms.Realm)
+    if !realm.ClientRegistration {
+        return echo.ErrNotFound
+    }
+
     req := new(models.ClientRegistration)
     if err := c.Bind(req); err != nil {
         return echo.NewHTTPError(http.StatusBadRequest, err.Error())
     }
 
-    client, err := h.clientService.RegisterClient(req)
+    client, secret, err := h.clientService.RegisterClient(realm, req)
     if err != nil {
         return echo.NewHTTPError(http.StatusBadRequest, err.Error())
     }
 
+    // The secret is only ever returned here; it is stored hashed
     return c.JSON(http.StatusCreated, map[string]interface{}{
-        "client_id": client.ID,
-        "client_secret": client.Secret,
+        "client_id": client.ClientID,
+        "client_secret": secret,
         "redirect_uris": client.RedirectURIs,
     })
 }
 
 func (h *ClientHandler) Get(c echo.Context) error {
     clientID := c.Param("id")
-    client := h.clientService.GetClient(clientID)
+    client := h.clientService.GetClient(c.Get("realm").(*realms.Realm), clientID)
     if client == nil {
         return echo.NewHTTPError(http.StatusNotFound, "client not found")
     }
 
     return c.JSON(http.StatusOK, client)
 }
+
+func (h *ClientHandler) RotateSecret(c echo.Context) error {
+    req := new(models.ClientSecretRotation)
+    if err := c.Bind(req); err != nil {
+        return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+    }
+
+    // The client authenticates with its current secret, either in the
+    // body or with HTTP Basic authentication
+    if clientID, clientSecret, ok := c.Request().BasicAuth(); ok {
+        req.ClientID = clientID
+        req.ClientSecret = clientSecret
+    }
+    if req.ClientID != c.Param("id") {
+        return echo.NewHTTPError(http.StatusUnauthorized, "invalid client credentials")
+    }
+
+    secret, previousExpiresAt, err := h.clientService.RotateSecret(c.Get("realm").(*realms.Realm), req)
+    switch {
+    case errors.Is(err, services.ErrInvalidClientCredentials):
+        return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+    case errors.Is(err, services.ErrInvalidSecretOverlap):
+        return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+    case err != nil:
+        return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "client_id": req.ClientID,
+        "client_secret": secret,
+        "previous_secret_expires_at": previousExpiresAt,
+    })
+}
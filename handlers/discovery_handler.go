@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"oauth2-provider/config"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+)
+
+// DiscoveryHandler serves the metadata documents of the request's realm.
+type DiscoveryHandler struct{}
+
+func NewDiscoveryHandler() *DiscoveryHandler {
+	return &DiscoveryHandler{}
+}
+
+func (h *DiscoveryHandler) Configuration(c echo.Context) error {
+	realm := c.Get("realm").(*realms.Realm)
+
+	grantTypes := []string{"authorization_code", "refresh_token"}
+	if len(config.Get().SCIM.Clients) > 0 {
+		grantTypes = append(grantTypes, "client_credentials")
+	}
+	metadata := map[string]interface{}{
+		"issuer":                                realm.Issuer,
+		"authorization_endpoint":                realm.Issuer + config.DefaultConfig.AuthorizeEndpoint,
+		"token_endpoint":                        realm.Issuer + config.DefaultConfig.TokenEndpoint,
+		"userinfo_endpoint":                     realm.Issuer + config.DefaultConfig.UserInfoEndpoint,
+		"jwks_uri":                              realm.Issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 grantTypes,
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"subject_types_supported":               []string{"public"},
+		"claims_supported":                      []string{"sub", "preferred_username", "email", "email_verified", "roles", "auth_time", "amr", "acr"},
+		"acr_values_supported":                  []string{services.ACRSingleFactor, services.ACRMultiFactor},
+		"id_token_signing_alg_values_supported": []string{realm.SigningKey.Method.Alg()},
+	}
+	if len(realm.Scopes) > 0 {
+		metadata["scopes_supported"] = realm.Scopes
+	}
+	if realm.ClientRegistration {
+		metadata["registration_endpoint"] = realm.Issuer + "/client/register"
+	}
+
+	return c.JSON(http.StatusOK, metadata)
+}
+
+// JWKS publishes the realm's public signing key. Realms signing with an
+// HMAC secret publish an empty set.
+func (h *DiscoveryHandler) JWKS(c echo.Context) error {
+	realm := c.Get("realm").(*realms.Realm)
+
+	keys := []map[string]string{}
+	if jwk := realm.SigningKey.JWK(); jwk != nil {
+		keys = append(keys, jwk)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"keys": keys})
+}
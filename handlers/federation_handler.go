@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"html/template"
+	"net/http"
+	"net/url"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"strings"
+)
+
+// upstreamStateCookie keeps an upstream login's state token between the
+// redirect to the provider and the callback.
+const upstreamStateCookie = "upstream_login"
+
+// loginPage offers the upstream providers of the realm. Password and
+// passkey logins go through the JSON API.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in</h1>
+{{range .}}<p><a href="{{.LoginURL}}">Sign in with {{.Name}}</a></p>
+{{else}}<p>No identity providers are configured.</p>
+{{end}}</body>
+</html>
+`))
+
+// upstreamProviders lists the realm's providers with login URLs that
+// return to continueTo.
+func (h *UserHandler) upstreamProviders(realm *realms.Realm, continueTo string) []models.UpstreamProvider {
+	providers := []models.UpstreamProvider{}
+	for _, provider := range h.userService.UpstreamProviders(realm) {
+		loginURL := realm.Issuer + "/login/upstream/" + provider.ID()
+		if continueTo != "" {
+			loginURL += "?" + url.Values{"continue": {continueTo}}.Encode()
+		}
+		providers = append(providers, models.UpstreamProvider{ID: provider.ID(), Name: provider.Name(), LoginURL: loginURL})
+	}
+	return providers
+}
+
+// LoginPage renders the login buttons of the upstream providers. The
+// continue parameter, a path on this server such as an authorization
+// request, is where users go with a login code once signed in.
+func (h *UserHandler) LoginPage(c echo.Context) error {
+	continueTo := c.QueryParam("continue")
+	if !localPath(continueTo) {
+		return echo.NewHTTPError(http.StatusBadRequest, "continue must be a path on this server")
+	}
+	var page strings.Builder
+	if err := loginPage.Execute(&page, h.upstreamProviders(c.Get("realm").(*realms.Realm), continueTo)); err != nil {
+		return err
+	}
+	return c.HTML(http.StatusOK, page.String())
+}
+
+// ListUpstreamProviders is the JSON counterpart of LoginPage, for clients
+// drawing their own login buttons.
+func (h *UserHandler) ListUpstreamProviders(c echo.Context) error {
+	continueTo := c.QueryParam("continue")
+	if !localPath(continueTo) {
+		return echo.NewHTTPError(http.StatusBadRequest, "continue must be a path on this server")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"providers": h.upstreamProviders(c.Get("realm").(*realms.Realm), continueTo),
+	})
+}
+
+// UpstreamLogin sends the user to sign in at an upstream provider.
+func (h *UserHandler) UpstreamLogin(c echo.Context) error {
+	continueTo := c.QueryParam("continue")
+	if !localPath(continueTo) {
+		return echo.NewHTTPError(http.StatusBadRequest, "continue must be a path on this server")
+	}
+	realm := c.Get("realm").(*realms.Realm)
+	login, err := h.userService.BeginUpstreamLogin(realm, c.Param("provider"), continueTo)
+	if errors.Is(err, services.ErrUnknownUpstream) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+	}
+
+	c.SetCookie(upstreamCookie(realm, login.State, 600))
+	return c.Redirect(http.StatusFound, login.URL)
+}
+
+// UpstreamCallback completes an upstream login. With a continue path and
+// no second factor to check, the user is sent on with a one-time login
+// code; otherwise the response is the same as from /login.
+func (h *UserHandler) UpstreamCallback(c echo.Context) error {
+	realm := c.Get("realm").(*realms.Realm)
+	c.SetCookie(upstreamCookie(realm, "", -1))
+	if upstreamError := c.QueryParam("error"); upstreamError != "" {
+		message := "the identity provider refused the login: " + upstreamError
+		if description := c.QueryParam("error_description"); description != "" {
+			message += " (" + description + ")"
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, message)
+	}
+	cookie, err := c.Cookie(upstreamStateCookie)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, services.ErrInvalidUpstreamState.Error())
+	}
+
+	result, continueTo, err := h.userService.FinishUpstreamLogin(realm, c.Param("provider"), cookie.Value, c.QueryParam("state"), c.QueryParam("code"))
+	switch {
+	case errors.Is(err, services.ErrInvalidUpstreamState):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrUnknownUpstream):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrUpstreamAccountConflict):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrEmailNotVerified), errors.Is(err, services.ErrAccountDisabled):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	case errors.Is(err, services.ErrUpstreamFailed):
+		return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+	case errors.Is(err, services.ErrLegacyUnavailable), errors.Is(err, services.ErrDirectoryUnavailable):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if continueTo != "" && result.MFAToken == "" {
+		code, err := h.userService.IssueLoginCode(realm, result.LoginToken)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		separator := "?"
+		if strings.Contains(continueTo, "?") {
+			separator = "&"
+		}
+		return c.Redirect(http.StatusFound, continueTo+separator+url.Values{"login_code": {code}}.Encode())
+	}
+	return loginResponse(c, result)
+}
+
+// upstreamCookie holds the state token for the realm's callbacks only.
+// SameSite=Lax still sends it on the provider's top-level redirect back.
+func upstreamCookie(realm *realms.Realm, value string, maxAge int) *http.Cookie {
+	path := "/login/upstream/"
+	secure := false
+	if u, err := url.Parse(realm.Issuer); err == nil {
+		path = u.Path + path
+		secure = u.Scheme == "https"
+	}
+	return &http.Cookie{
+		Name:     upstreamStateCookie,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// localPath reports whether continueTo is empty or a path on this server,
+// so it can't send users, and their login code, anywhere else.
+func localPath(continueTo string) bool {
+	if continueTo == "" {
+		return true
+	}
+	if !strings.HasPrefix(continueTo, "/") || strings.HasPrefix(continueTo, "//") || strings.ContainsAny(continueTo, "\\\r\n") {
+		return false
+	}
+	u, err := url.Parse(continueTo)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"mime"
+	"net/http"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+)
+
+// ImportUsers creates users from a CSV (text/csv) or JSON body with
+// password hashes exported from another system. It is an admin endpoint.
+func (h *UserHandler) ImportUsers(c echo.Context) error {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	var format string
+	switch mediaType {
+	case "text/csv":
+		format = services.ImportFormatCSV
+	case echo.MIMEApplicationJSON:
+		format = services.ImportFormatJSON
+	default:
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "send text/csv or application/json")
+	}
+
+	users, err := services.ParseUserImport(c.Request().Body, format)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	result := h.userService.ImportUsers(c.Get("realm").(*realms.Realm), users)
+	return c.JSON(http.StatusOK, result)
+}
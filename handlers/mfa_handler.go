@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"strconv"
+)
+
+func (h *UserHandler) EnrollTOTP(c echo.Context) error {
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	enrollment, err := h.userService.EnrollTOTP(c.Get("realm").(*realms.Realm), uint(userID))
+	if err != nil {
+		return mfaError(err)
+	}
+
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+func (h *UserHandler) ConfirmTOTP(c echo.Context) error {
+	req := new(models.TOTPConfirm)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	codes, err := h.userService.ConfirmTOTP(c.Get("realm").(*realms.Realm), uint(userID), req.Code)
+	if err != nil {
+		return mfaError(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "TOTP enabled. Store the recovery codes somewhere safe; each works once.",
+		"recovery_codes": codes,
+	})
+}
+
+func mfaError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrMFAAlreadyEnabled), errors.Is(err, services.ErrTOTPNotEnrolled):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrInvalidMFACode):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrMFAUnavailable):
+		return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+}
@@ -3,9 +3,12 @@ package handlers
 import (
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"net/url"
 	"oauth2-provider/models"
+	"oauth2-provider/realms"
 	"oauth2-provider/services"
 	"strconv"
+	"strings"
 )
 
 type OAuthHandler struct {
@@ -22,18 +25,24 @@ func (h *OAuthHandler) Authorize(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err := h.oauthService.ValidateAuthorizationRequest(req); err != nil {
+	realm := c.Get("realm").(*realms.Realm)
+	if err := h.oauthService.ValidateAuthorizationRequest(realm, req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	// For simplicity, assuming user is already authenticated
-	// In real implementation, check session and show login/consent page
-	code, err := h.oauthService.GenerateAuthorizationCode(
-		req.ClientID,
-		1, // Temporary userID for testing
-		req.CodeChallenge,
-		req.CodeChallengeMethod,
-	)
+	// A login code, exchanged for the login token from /login or
+	// /login/mfa, identifies the user. Without one the user is sent to the
+	// login page, which comes back here with a code added to the request
+	if req.LoginCode == "" {
+		continueTo := c.Request().URL.Path + "?" + c.QueryParams().Encode()
+		return c.Redirect(http.StatusFound, realm.Issuer+"/login?"+url.Values{"continue": {continueTo}}.Encode())
+	}
+	auth, err := h.oauthService.RedeemLoginCode(realm, req.LoginCode)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+
+	code, err := h.oauthService.GenerateAuthorizationCode(realm, req, auth)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -50,26 +59,37 @@ func (h *OAuthHandler) Token(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	accessToken, refreshToken, err := h.oauthService.ExchangeToken(req)
+	// Client credentials may also be sent with HTTP Basic authentication
+	if clientID, clientSecret, ok := c.Request().BasicAuth(); ok {
+		req.ClientID = clientID
+		req.ClientSecret = clientSecret
+	}
+
+	resp, err := h.oauthService.ExchangeToken(c.Get("realm").(*realms.Realm), req)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-		"token_type":    "Bearer",
-		"expires_in":    "3600",
-	})
+	return c.JSON(http.StatusOK, resp)
 }
 
 func (h *OAuthHandler) UserInfo(c echo.Context) error {
 	userIDStr := c.Get("user_id").(string)
 	userID, _ := strconv.ParseUint(userIDStr, 10, 64)
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"sub":   userID,
-		"name":  "John Doe",
-		"email": "john@example.com",
-	})
+	user := h.oauthService.GetUser(c.Get("realm").(*realms.Realm), uint(userID))
+	if user == nil {
+		return echo.ErrUnauthorized
+	}
+
+	claims := map[string]interface{}{
+		"sub":                userID,
+		"preferred_username": user.Username,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified,
+	}
+	if user.Roles != "" {
+		claims["roles"] = strings.Fields(user.Roles)
+	}
+	return c.JSON(http.StatusOK, claims)
 }
\ No newline at end of file
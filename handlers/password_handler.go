@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"html/template"
+	"net/http"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"strconv"
+	"strings"
+)
+
+// passwordResetPage is the form reset links open. It posts back to the
+// same URL, so it works under /realms/<name> as well.
+var passwordResetPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<h1>Reset your password</h1>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+{{if .Done}}<p>Your password has been changed. You can now sign in with the new password.</p>
+{{else if .Token}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<label>New password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Change password</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+type passwordResetView struct {
+	Token string
+	Error string
+	Done  bool
+}
+
+func renderPasswordReset(c echo.Context, status int, view passwordResetView) error {
+	var page strings.Builder
+	if err := passwordResetPage.Execute(&page, view); err != nil {
+		return err
+	}
+	return c.HTML(status, page.String())
+}
+
+func (h *UserHandler) ForgotPassword(c echo.Context) error {
+	req := new(models.PasswordForgot)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.userService.ForgotPassword(c.Get("realm").(*realms.Realm), req.Email); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "If the address belongs to an account, a password reset email is on its way",
+	})
+}
+
+func (h *UserHandler) PasswordResetForm(c echo.Context) error {
+	token := c.QueryParam("token")
+	if _, err := h.userService.CheckPasswordResetToken(c.Get("realm").(*realms.Realm), token); err != nil {
+		return renderPasswordReset(c, http.StatusBadRequest, passwordResetView{Error: err.Error()})
+	}
+	return renderPasswordReset(c, http.StatusOK, passwordResetView{Token: token})
+}
+
+// ResetPassword accepts the reset form, answering with HTML, or a JSON
+// body, answering with JSON.
+func (h *UserHandler) ResetPassword(c echo.Context) error {
+	req := new(models.PasswordReset)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	form := !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+
+	err := h.userService.ResetPassword(c.Get("realm").(*realms.Realm), req.Token, req.Password)
+	if err != nil {
+		rejected := errors.Is(err, services.ErrEmptyPassword) || errors.As(err, new(*passwords.PolicyError))
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalidResetLink) || errors.Is(err, services.ErrPasswordManagedByDirectory) || rejected {
+			status = http.StatusBadRequest
+		}
+		if form {
+			view := passwordResetView{Error: err.Error()}
+			if rejected {
+				view.Token = req.Token
+			}
+			return renderPasswordReset(c, status, view)
+		}
+		return passwordError(status, err)
+	}
+
+	if form {
+		return renderPasswordReset(c, http.StatusOK, passwordResetView{Done: true})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Password changed",
+	})
+}
+
+func (h *UserHandler) ChangePassword(c echo.Context) error {
+	req := new(models.PasswordChange)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	err := h.userService.ChangePassword(c.Get("realm").(*realms.Realm), uint(userID), req.CurrentPassword, req.NewPassword, c.RealIP())
+	if blocked := new(services.LoginBlockedError); errors.As(err, &blocked) {
+		return loginBlocked(c, blocked)
+	}
+	if errors.Is(err, services.ErrWrongPassword) || errors.Is(err, services.ErrPasswordManagedByDirectory) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if errors.Is(err, services.ErrEmptyPassword) || errors.As(err, new(*passwords.PolicyError)) {
+		return passwordError(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Password changed",
+	})
+}
+
+// passwordError lists the rules a rejected password breaks next to the
+// message.
+func passwordError(status int, err error) error {
+	var policyErr *passwords.PolicyError
+	if errors.As(err, &policyErr) {
+		return echo.NewHTTPError(status, map[string]interface{}{
+			"message":  err.Error(),
+			"problems": policyErr.Problems,
+		})
+	}
+	return echo.NewHTTPError(status, err.Error())
+}
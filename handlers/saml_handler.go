@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"html/template"
+	"net/http"
+	"net/url"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"strings"
+)
+
+// samlPostForm hands a SAML message to the service provider with the
+// HTTP-POST binding, submitting itself when scripts run.
+var samlPostForm = template.Must(template.New("saml-post").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Signing in</title></head>
+<body>
+<form method="post" action="{{.URL}}" id="saml">
+<input type="hidden" name="SAMLResponse" value="{{.Message}}">
+{{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}">
+{{end}}<noscript><button type="submit">Continue</button></noscript>
+</form>
+<script>document.getElementById("saml").submit();</script>
+</body>
+</html>
+`))
+
+type SAMLHandler struct {
+	samlService *services.SAMLService
+}
+
+func NewSAMLHandler(samlService *services.SAMLService) *SAMLHandler {
+	return &SAMLHandler{samlService: samlService}
+}
+
+// Metadata publishes the realm's IdP metadata, which service providers
+// are configured with.
+func (h *SAMLHandler) Metadata(c echo.Context) error {
+	metadata, err := h.samlService.Metadata(c.Get("realm").(*realms.Realm))
+	if err != nil {
+		return samlError(err)
+	}
+	return c.Blob(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// SSO answers a service provider's AuthnRequest. Users without a login
+// code are sent to the login page first, which brings them back here.
+func (h *SAMLHandler) SSO(c echo.Context) error {
+	realm := c.Get("realm").(*realms.Realm)
+	login, err := h.samlService.ParseAuthnRequest(realm, c.Request())
+	if err != nil {
+		return samlError(err)
+	}
+	return h.completeLogin(c, realm, login)
+}
+
+// IdPInitiated signs the user in to the service provider named by the sp
+// parameter without a request from it. RelayState is passed on, usually
+// the page to open there.
+func (h *SAMLHandler) IdPInitiated(c echo.Context) error {
+	realm := c.Get("realm").(*realms.Realm)
+	login, err := h.samlService.BeginIdPInitiatedLogin(realm, c.Request(), c.QueryParam("sp"), c.QueryParam("RelayState"))
+	if err != nil {
+		return samlError(err)
+	}
+	return h.completeLogin(c, realm, login)
+}
+
+func (h *SAMLHandler) completeLogin(c echo.Context, realm *realms.Realm, login *services.SAMLLogin) error {
+	var auth *services.Authentication
+	if code := c.QueryParam("login_code"); code != "" {
+		auth, _ = h.samlService.RedeemLoginCode(realm, code)
+	}
+	if auth == nil || !login.Accepts(auth) {
+		return c.Redirect(http.StatusFound, realm.Issuer+"/login?"+url.Values{"continue": {login.ContinuePath()}}.Encode())
+	}
+
+	response, err := h.samlService.CompleteLogin(realm, login, auth)
+	if err != nil {
+		return samlError(err)
+	}
+	return samlReply(c, response)
+}
+
+// SLO handles a service provider's LogoutRequest and sends the user back
+// with the LogoutResponse.
+func (h *SAMLHandler) SLO(c echo.Context) error {
+	response, err := h.samlService.Logout(c.Get("realm").(*realms.Realm), c.Request())
+	if err != nil {
+		return samlError(err)
+	}
+	return samlReply(c, response)
+}
+
+// samlReply delivers a message to the service provider through the
+// browser.
+func samlReply(c echo.Context, response *services.SAMLResponse) error {
+	if response.RedirectURL != "" {
+		return c.Redirect(http.StatusFound, response.RedirectURL)
+	}
+	var page strings.Builder
+	if err := samlPostForm.Execute(&page, response); err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.HTML(http.StatusOK, page.String())
+}
+
+func samlError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrSAMLDisabled):
+		return echo.ErrNotFound
+	case errors.Is(err, services.ErrUnknownServiceProvider), errors.Is(err, services.ErrInvalidSAMLRequest), errors.Is(err, services.ErrNoSingleLogoutService):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrInvalidLoginToken):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+}
+
+// serviceProviderJSON shows a service provider with its attribute mapping.
+func serviceProviderJSON(provider *models.SAMLServiceProvider) map[string]interface{} {
+	return map[string]interface{}{
+		"entity_id":      provider.EntityID,
+		"name_id_format": provider.NameIDFormat,
+		"attributes":     provider.AttributeMap(),
+		"metadata":       provider.Metadata,
+		"created_at":     provider.CreatedAt,
+		"updated_at":     provider.UpdatedAt,
+	}
+}
+
+// RegisterServiceProvider registers a service provider from its metadata.
+// It is an admin endpoint.
+func (h *SAMLHandler) RegisterServiceProvider(c echo.Context) error {
+	req := new(models.SAMLServiceProviderRegistration)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	provider, err := h.samlService.RegisterServiceProvider(c.Get("realm").(*realms.Realm), req)
+	switch {
+	case errors.Is(err, services.ErrSAMLDisabled):
+		return echo.ErrNotFound
+	case errors.Is(err, storage.ErrServiceProviderExists):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusCreated, serviceProviderJSON(provider))
+}
+
+// ListServiceProviders lists the realm's service providers. It is an
+// admin endpoint.
+func (h *SAMLHandler) ListServiceProviders(c echo.Context) error {
+	providers, err := h.samlService.ListServiceProviders(c.Get("realm").(*realms.Realm))
+	if err != nil {
+		return samlError(err)
+	}
+	list := make([]map[string]interface{}, 0, len(providers))
+	for i := range providers {
+		list = append(list, serviceProviderJSON(&providers[i]))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"service_providers": list})
+}
+
+// UpdateServiceProvider replaces the metadata and settings of the service
+// provider named by the entity_id parameter. It is an admin endpoint.
+func (h *SAMLHandler) UpdateServiceProvider(c echo.Context) error {
+	req := new(models.SAMLServiceProviderRegistration)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	provider, err := h.samlService.UpdateServiceProvider(c.Get("realm").(*realms.Realm), c.QueryParam("entity_id"), req)
+	switch {
+	case errors.Is(err, services.ErrSAMLDisabled):
+		return echo.ErrNotFound
+	case errors.Is(err, services.ErrUnknownServiceProvider):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, serviceProviderJSON(provider))
+}
+
+// DeleteServiceProvider removes the service provider named by the
+// entity_id parameter. It is an admin endpoint.
+func (h *SAMLHandler) DeleteServiceProvider(c echo.Context) error {
+	err := h.samlService.DeleteServiceProvider(c.Get("realm").(*realms.Realm), c.QueryParam("entity_id"))
+	if errors.Is(err, services.ErrUnknownServiceProvider) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return samlError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
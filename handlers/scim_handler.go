@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"strconv"
+	"strings"
+)
+
+const scimContentType = "application/scim+json"
+
+type SCIMHandler struct {
+	scimService *services.SCIMService
+}
+
+func NewSCIMHandler(scimService *services.SCIMService) *SCIMHandler {
+	return &SCIMHandler{scimService: scimService}
+}
+
+// scimErrorResponse is the error body of RFC 7644 section 3.12.
+type scimErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func (h *SCIMHandler) ListUsers(c echo.Context) error {
+	return h.list(c, h.scimService.ListUsers)
+}
+
+func (h *SCIMHandler) GetUser(c echo.Context) error {
+	return h.get(c, h.scimService.GetUser)
+}
+
+func (h *SCIMHandler) CreateUser(c echo.Context) error {
+	return h.create(c, h.scimService.CreateUser)
+}
+
+func (h *SCIMHandler) ReplaceUser(c echo.Context) error {
+	return h.update(c, h.scimService.ReplaceUser)
+}
+
+func (h *SCIMHandler) PatchUser(c echo.Context) error {
+	return h.update(c, h.scimService.PatchUser)
+}
+
+func (h *SCIMHandler) DeleteUser(c echo.Context) error {
+	return h.delete(c, h.scimService.DeleteUser)
+}
+
+func (h *SCIMHandler) ListGroups(c echo.Context) error {
+	return h.list(c, h.scimService.ListGroups)
+}
+
+func (h *SCIMHandler) GetGroup(c echo.Context) error {
+	return h.get(c, h.scimService.GetGroup)
+}
+
+func (h *SCIMHandler) CreateGroup(c echo.Context) error {
+	return h.create(c, h.scimService.CreateGroup)
+}
+
+func (h *SCIMHandler) ReplaceGroup(c echo.Context) error {
+	return h.update(c, h.scimService.ReplaceGroup)
+}
+
+func (h *SCIMHandler) PatchGroup(c echo.Context) error {
+	return h.update(c, h.scimService.PatchGroup)
+}
+
+func (h *SCIMHandler) DeleteGroup(c echo.Context) error {
+	return h.delete(c, h.scimService.DeleteGroup)
+}
+
+// ServiceProviderConfig describes the SCIM features the server supports.
+// Like the other discovery endpoints it needs no token.
+func (h *SCIMHandler) ServiceProviderConfig(c echo.Context) error {
+	return scimReply(c, http.StatusOK, services.SCIMServiceProviderConfig(c.Get("realm").(*realms.Realm)))
+}
+
+func (h *SCIMHandler) Schemas(c echo.Context) error {
+	return scimDiscovery(c, services.SCIMSchemas(c.Get("realm").(*realms.Realm)))
+}
+
+func (h *SCIMHandler) ResourceTypes(c echo.Context) error {
+	return scimDiscovery(c, services.SCIMResourceTypes(c.Get("realm").(*realms.Realm)))
+}
+
+// scimDiscovery lists schemas or resource types, or shows the one named
+// by the id parameter.
+func scimDiscovery(c echo.Context, resources []map[string]interface{}) error {
+	if id := c.Param("id"); id != "" {
+		for _, resource := range resources {
+			if resource["id"] == id {
+				return scimReply(c, http.StatusOK, resource)
+			}
+		}
+		return scimFail(c, services.ErrSCIMNotFound)
+	}
+	list := &services.SCIMList{
+		Schemas:      []string{services.SCIMListResponseSchema},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+	}
+	for _, resource := range resources {
+		list.Resources = append(list.Resources, resource)
+	}
+	return scimReply(c, http.StatusOK, list)
+}
+
+func (h *SCIMHandler) list(c echo.Context, list func(*realms.Realm, *services.SCIMQuery) (*services.SCIMList, error)) error {
+	query := &services.SCIMQuery{Filter: c.QueryParam("filter"), StartIndex: 1, Count: -1}
+	for name, value := range map[string]*int{"startIndex": &query.StartIndex, "count": &query.Count} {
+		if param := c.QueryParam(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				return scimFail(c, &services.SCIMError{Type: "invalidValue", Detail: name + " must be a number"})
+			}
+			*value = max(n, 0)
+		}
+	}
+
+	result, err := list(c.Get("realm").(*realms.Realm), query)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	attributes, excluded := scimAttributes(c)
+	for i, resource := range result.Resources {
+		result.Resources[i] = resource.Project(attributes, excluded)
+	}
+	return scimReply(c, http.StatusOK, result)
+}
+
+func (h *SCIMHandler) get(c echo.Context, get func(*realms.Realm, string) (services.SCIMResource, error)) error {
+	resource, err := get(c.Get("realm").(*realms.Realm), c.Param("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	if match := c.Request().Header.Get("If-None-Match"); match != "" && resource.MatchesVersion(match) {
+		c.Response().Header().Set("ETag", resource.Version())
+		return c.NoContent(http.StatusNotModified)
+	}
+	return scimResourceReply(c, http.StatusOK, resource)
+}
+
+func (h *SCIMHandler) create(c echo.Context, create func(*realms.Realm, map[string]interface{}) (services.SCIMResource, error)) error {
+	body, err := scimBody(c)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	resource, err := create(c.Get("realm").(*realms.Realm), body)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	c.Response().Header().Set("Location", resource.Location())
+	return scimResourceReply(c, http.StatusCreated, resource)
+}
+
+func (h *SCIMHandler) update(c echo.Context, update func(*realms.Realm, string, map[string]interface{}, string) (services.SCIMResource, error)) error {
+	body, err := scimBody(c)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	resource, err := update(c.Get("realm").(*realms.Realm), c.Param("id"), body, c.Request().Header.Get("If-Match"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	return scimResourceReply(c, http.StatusOK, resource)
+}
+
+func (h *SCIMHandler) delete(c echo.Context, remove func(*realms.Realm, string, string) error) error {
+	if err := remove(c.Get("realm").(*realms.Realm), c.Param("id"), c.Request().Header.Get("If-Match")); err != nil {
+		return scimFail(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// scimBody decodes a request body. Bind isn't used as it doesn't know the
+// application/scim+json content type.
+func scimBody(c echo.Context) (map[string]interface{}, error) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil || body == nil {
+		return nil, &services.SCIMError{Type: "invalidSyntax", Detail: "request body must be a JSON object"}
+	}
+	return body, nil
+}
+
+// scimAttributes returns the attributes and excludedAttributes
+// parameters, which are comma-separated lists.
+func scimAttributes(c echo.Context) (attributes, excluded []string) {
+	split := func(param string) []string {
+		var names []string
+		for _, name := range strings.Split(c.QueryParam(param), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return split("attributes"), split("excludedAttributes")
+}
+
+func scimResourceReply(c echo.Context, status int, resource services.SCIMResource) error {
+	c.Response().Header().Set("ETag", resource.Version())
+	return scimReply(c, status, resource.Project(scimAttributes(c)))
+}
+
+func scimReply(c echo.Context, status int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Blob(status, scimContentType, data)
+}
+
+// scimFail renders an error in the SCIM format. Unexpected errors are
+// left to the server's error handler.
+func scimFail(c echo.Context, err error) error {
+	var status int
+	var scimErr *services.SCIMError
+	switch {
+	case errors.Is(err, services.ErrSCIMNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, services.ErrSCIMPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.As(err, &scimErr) && scimErr.Type == "uniqueness":
+		status = http.StatusConflict
+	case errors.As(err, &scimErr):
+		status = http.StatusBadRequest
+	default:
+		return err
+	}
+	response := scimErrorResponse{
+		Schemas: []string{services.SCIMErrorSchema},
+		Status:  strconv.Itoa(status),
+		Detail:  err.Error(),
+	}
+	if scimErr != nil {
+		response.ScimType = scimErr.Type
+	}
+	return scimReply(c, status, response)
+}
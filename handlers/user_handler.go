@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"oauth2-provider/models"
+	"oauth2-provider/realms"
 	"oauth2-provider/services"
 	"strconv"
+	"time"
 )
 
 type UserHandler struct {
@@ -22,8 +25,12 @@ func (h *UserHandler) Register(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err := h.userService.Register(req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	err := h.userService.Register(c.Get("realm").(*realms.Realm), req)
+	if errors.Is(err, services.ErrLegacyUnavailable) || errors.Is(err, services.ErrDirectoryUnavailable) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return passwordError(http.StatusBadRequest, err)
 	}
 
 	return c.JSON(http.StatusCreated, map[string]string{
@@ -37,13 +44,116 @@ func (h *UserHandler) Login(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	user, err := h.userService.Login(req)
+	result, err := h.userService.Login(c.Get("realm").(*realms.Realm), req, c.RealIP())
+	if blocked := new(services.LoginBlockedError); errors.As(err, &blocked) {
+		return loginBlocked(c, blocked)
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) || errors.Is(err, services.ErrAccountDisabled) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if errors.Is(err, services.ErrLegacyUnavailable) || errors.Is(err, services.ErrDirectoryUnavailable) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
 	}
 
+	return loginResponse(c, result)
+}
+
+// LoginMFA completes a login that needs a second factor.
+func (h *UserHandler) LoginMFA(c echo.Context) error {
+	req := new(models.MFALogin)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	result, err := h.userService.VerifyMFA(c.Get("realm").(*realms.Realm), req.MFAToken, req.Code, c.RealIP())
+	if blocked := new(services.LoginBlockedError); errors.As(err, &blocked) {
+		return loginBlocked(c, blocked)
+	}
+	if errors.Is(err, services.ErrInvalidMFAToken) || errors.Is(err, services.ErrInvalidMFACode) {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return loginResponse(c, result)
+}
+
+// loginBlocked tells the client how many seconds to wait before trying
+// again.
+func loginBlocked(c echo.Context, err *services.LoginBlockedError) error {
+	seconds := int64((err.RetryAfter + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests, err.Error())
+}
+
+func loginResponse(c echo.Context, result *services.LoginResult) error {
+	if result.MFAToken != "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":      "Second factor required",
+			"mfa_required": true,
+			"mfa_token":    result.MFAToken,
+			"mfa_methods":  result.MFAMethods,
+		})
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message": "Login successful",
-		"user_id": strconv.FormatUint(uint64(user.ID), 10),
+		"message":            "Login successful",
+		"user_id":            strconv.FormatUint(uint64(result.User.ID), 10),
+		"login_token":        result.LoginToken,
+		"recent_login_token": result.RecentLoginToken,
 	})
-}
\ No newline at end of file
+}
+
+// LoginCode exchanges a login token for a one-time code, for the login
+// page to send the user back to its continue path with. Login tokens
+// themselves are never put in URLs.
+func (h *UserHandler) LoginCode(c echo.Context) error {
+	req := new(models.LoginCodeRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	code, err := h.userService.IssueLoginCode(c.Get("realm").(*realms.Realm), req.LoginToken)
+	if errors.Is(err, services.ErrInvalidLoginToken) {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"login_code": code,
+	})
+}
+
+func (h *UserHandler) VerifyEmail(c echo.Context) error {
+	if err := h.userService.VerifyEmail(c.Get("realm").(*realms.Realm), c.QueryParam("token")); err != nil {
+		if errors.Is(err, services.ErrInvalidVerificationLink) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Email address verified",
+	})
+}
+
+func (h *UserHandler) ResendVerification(c echo.Context) error {
+	req := new(models.VerificationResend)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.userService.ResendVerification(c.Get("realm").(*realms.Realm), req.Email); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "If the address belongs to an unverified account, a verification email is on its way",
+	})
+}
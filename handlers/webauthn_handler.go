@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (h *UserHandler) BeginWebAuthnRegistration(c echo.Context) error {
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	challenge, err := h.userService.BeginWebAuthnRegistration(c.Get("realm").(*realms.Realm), uint(userID))
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return c.JSON(http.StatusOK, challenge)
+}
+
+func (h *UserHandler) FinishWebAuthnRegistration(c echo.Context) error {
+	req := new(models.WebAuthnRegistration)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	credential, err := h.userService.FinishWebAuthnRegistration(c.Get("realm").(*realms.Realm), uint(userID), req)
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return c.JSON(http.StatusCreated, credentialResponse(credential))
+}
+
+// BeginPasskeyLogin starts a passwordless login.
+func (h *UserHandler) BeginPasskeyLogin(c echo.Context) error {
+	challenge, err := h.userService.BeginPasskeyLogin(c.Get("realm").(*realms.Realm))
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return c.JSON(http.StatusOK, challenge)
+}
+
+func (h *UserHandler) FinishPasskeyLogin(c echo.Context) error {
+	req := new(models.WebAuthnLogin)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	result, err := h.userService.FinishPasskeyLogin(c.Get("realm").(*realms.Realm), req)
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return loginResponse(c, result)
+}
+
+// BeginWebAuthnMFA starts using an authenticator as the second factor of a
+// password login.
+func (h *UserHandler) BeginWebAuthnMFA(c echo.Context) error {
+	req := new(models.WebAuthnLogin)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	challenge, err := h.userService.BeginWebAuthnMFA(c.Get("realm").(*realms.Realm), req.MFAToken)
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return c.JSON(http.StatusOK, challenge)
+}
+
+func (h *UserHandler) FinishWebAuthnMFA(c echo.Context) error {
+	req := new(models.WebAuthnLogin)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	result, err := h.userService.FinishWebAuthnMFA(c.Get("realm").(*realms.Realm), req)
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return loginResponse(c, result)
+}
+
+func (h *UserHandler) ListWebAuthnCredentials(c echo.Context) error {
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	credentials, err := h.userService.ListWebAuthnCredentials(c.Get("realm").(*realms.Realm), uint(userID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	response := make([]map[string]interface{}, 0, len(credentials))
+	for i := range credentials {
+		response = append(response, credentialResponse(&credentials[i]))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"credentials": response,
+	})
+}
+
+func (h *UserHandler) RenameWebAuthnCredential(c echo.Context) error {
+	req := new(models.WebAuthnCredentialRename)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	credential, err := h.userService.RenameWebAuthnCredential(c.Get("realm").(*realms.Realm), uint(userID), c.Param("id"), req.Name)
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	return c.JSON(http.StatusOK, credentialResponse(credential))
+}
+
+func (h *UserHandler) DeleteWebAuthnCredential(c echo.Context) error {
+	userID, _ := strconv.ParseUint(c.Get("user_id").(string), 10, 64)
+	if err := h.userService.DeleteWebAuthnCredential(c.Get("realm").(*realms.Realm), uint(userID), c.Param("id")); err != nil {
+		return webAuthnError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// credentialResponse describes an authenticator to its owner; the public
+// key stays on the server.
+func credentialResponse(credential *models.WebAuthnCredential) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":              credential.CredentialID,
+		"name":            credential.Name,
+		"aaguid":          credential.AAGUID,
+		"transports":      strings.Fields(credential.Transports),
+		"backup_eligible": credential.BackupEligible,
+		"backed_up":       credential.BackupState,
+		"created_at":      credential.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if credential.LastUsedAt != nil {
+		response["last_used_at"] = credential.LastUsedAt.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+func webAuthnError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidWebAuthnSession), errors.Is(err, services.ErrInvalidCredentialName):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrInvalidWebAuthnResponse), errors.Is(err, services.ErrInvalidMFAToken):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	case errors.Is(err, services.ErrEmailNotVerified), errors.Is(err, services.ErrAccountDisabled):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	case errors.Is(err, services.ErrCredentialNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrCredentialRegistered):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+}
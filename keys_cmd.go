@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"oauth2-provider/encryption"
+	"os"
+)
+
+const keysUsage = `usage: oauth2-provider [-config file] keys <command>
+
+Commands:
+  generate-master-key   print a new random master key
+  rotate-data-key       create a new active data key
+  rewrap                re-wrap data keys with the active master key`
+
+// runKeys implements the keys subcommand and returns the process exit code.
+func runKeys(configPath string, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, keysUsage)
+		return 2
+	}
+
+	if args[0] == "generate-master-key" {
+		key, err := encryption.GenerateMasterKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "keys: %v\n", err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keys: %v\n", err)
+		return 1
+	}
+	store, err := initStore(cfg.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keys: %v\n", err)
+		return 1
+	}
+	keyring, err := encryption.NewKeyring(store, cfg.Keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keys: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "rotate-data-key":
+		keyID, err := keyring.RotateDataKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "keys rotate-data-key: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Data key %s is now active\n", keyID)
+	case "rewrap":
+		rewrapped, err := keyring.Rewrap()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "keys rewrap: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Re-wrapped %d data key(s) with master key %s\n", rewrapped, cfg.Keys.ActiveMasterKey)
+	default:
+		fmt.Fprintln(os.Stderr, keysUsage)
+		return 2
+	}
+	return 0
+}
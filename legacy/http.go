@@ -0,0 +1,90 @@
+package legacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"oauth2-provider/config"
+)
+
+// httpAuthenticator calls the legacy system's credential callback.
+type httpAuthenticator struct {
+	cfg    config.LegacyHTTPConfig
+	client *http.Client
+}
+
+func newHTTPAuthenticator(cfg config.LegacyHTTPConfig) *httpAuthenticator {
+	return &httpAuthenticator{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout.Duration()},
+	}
+}
+
+type callbackRequest struct {
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+type callbackUser struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func (a *httpAuthenticator) Authenticate(username, password string) (*User, error) {
+	resp, err := a.call(callbackRequest{Action: "authenticate", Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var found callbackUser
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&found); err != nil {
+			return nil, fmt.Errorf("legacy auth: invalid response: %v", err)
+		}
+		return &User{Username: username, Email: found.Email, EmailVerified: found.EmailVerified}, nil
+	case http.StatusUnauthorized:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("legacy auth: unexpected status %s", resp.Status)
+	}
+}
+
+func (a *httpAuthenticator) Exists(username string) (bool, error) {
+	resp, err := a.call(callbackRequest{Action: "lookup", Username: username})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("legacy auth: unexpected status %s", resp.Status)
+	}
+}
+
+func (a *httpAuthenticator) call(body callbackRequest) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.cfg.Token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("legacy auth: %v", err)
+	}
+	return resp, nil
+}
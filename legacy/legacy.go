@@ -0,0 +1,53 @@
+// Package legacy checks credentials against the user store being migrated
+// from, so users who haven't been imported can still sign in and be
+// created on the way.
+//
+// The HTTP backend POSTs JSON to a callback the old system exposes, with
+// the configured token as a bearer token:
+//
+//	{"action": "authenticate", "username": "...", "password": "..."}
+//
+// answered with 200 and {"email": "...", "email_verified": true} when the
+// password is right, or 401 when it is wrong or the user is unknown, and
+//
+//	{"action": "lookup", "username": "..."}
+//
+// answered with 200 if the user exists or 404 if not. Any other status is
+// an error. The SQL backend reads the password hash from the old database
+// and verifies it like an imported one.
+package legacy
+
+import (
+	"fmt"
+	"oauth2-provider/config"
+)
+
+// User is what the legacy store knows about a user.
+type User struct {
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+type Authenticator interface {
+	// Authenticate returns the user if password is theirs, or nil if the
+	// user is unknown or the password is wrong.
+	Authenticate(username, password string) (*User, error)
+	// Exists reports whether the legacy store has a user by that name.
+	Exists(username string) (bool, error)
+}
+
+// New returns the authenticator selected by the configuration, or nil if
+// there is no legacy store.
+func New(cfg config.LegacyAuthConfig) (Authenticator, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case config.LegacyAuthHTTP:
+		return newHTTPAuthenticator(cfg.HTTP), nil
+	case config.LegacyAuthSQL:
+		return newSQLAuthenticator(cfg.SQL)
+	default:
+		return nil, fmt.Errorf("unknown legacy auth backend %q", cfg.Backend)
+	}
+}
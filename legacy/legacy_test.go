@@ -0,0 +1,190 @@
+package legacy_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"oauth2-provider/config"
+	"oauth2-provider/legacy"
+	"oauth2-provider/passwords"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// callbackServer is a legacy system's credential callback that knows
+// alice with password "secret" and fails every call for "broken".
+func callbackServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer callback-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q", got)
+		}
+		var req struct {
+			Action   string `json:"action"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+
+		switch {
+		case req.Username == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case req.Action == "lookup" && req.Username == "alice":
+			if req.Password != "" {
+				t.Errorf("lookup sent a password")
+			}
+			w.WriteHeader(http.StatusOK)
+		case req.Action == "lookup":
+			w.WriteHeader(http.StatusNotFound)
+		case req.Action == "authenticate" && req.Username == "alice" && req.Password == "secret":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"email": "alice@example.com", "email_verified": true}`))
+		case req.Action == "authenticate":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			t.Errorf("unexpected action %q", req.Action)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newSQLStore creates a legacy database holding alice, whose password
+// "secret" is hashed in Django's format, and bob, whose password
+// "hunter2" has a PHC hash, and returns an authenticator reading it.
+func newSQLStore(t *testing.T) legacy.Authenticator {
+	path := filepath.Join(t.TempDir(), "legacy.sqlite")
+	db, err := config.OpenSQLite(path, nil)
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	salt := "abcdefgh"
+	key := pbkdf2.Key([]byte("secret"), []byte(salt), 1000, sha256.Size, sha256.New)
+	django := "pbkdf2_sha256$1000$" + salt + "$" + base64.StdEncoding.EncodeToString(key)
+	phc, err := passwords.Hash("hunter2")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE accounts (login TEXT PRIMARY KEY, pw TEXT, mail TEXT, verified INTEGER)",
+		"INSERT INTO accounts VALUES ('alice', '" + django + "', 'alice@example.com', 1)",
+		"INSERT INTO accounts VALUES ('bob', '" + phc + "', 'bob@example.com', 0)",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	store, err := legacy.New(config.LegacyAuthConfig{
+		Backend: config.LegacyAuthSQL,
+		SQL: config.LegacySQLConfig{
+			Driver: config.StorageSQLite,
+			DSN:    path,
+			Query:  "SELECT pw AS password_hash, mail AS email, verified AS email_verified FROM accounts WHERE login = ?",
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return store
+}
+
+func TestHTTPAuthenticate(t *testing.T) {
+	server := callbackServer(t)
+	store, err := legacy.New(config.LegacyAuthConfig{
+		Backend: config.LegacyAuthHTTP,
+		HTTP: config.LegacyHTTPConfig{
+			URL:     server.URL,
+			Token:   "callback-token",
+			Timeout: config.Duration(5 * time.Second),
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	testAuthenticate(t, store, []authenticateTest{
+		{name: "right password", username: "alice", password: "secret", want: &legacy.User{Username: "alice", Email: "alice@example.com", EmailVerified: true}},
+		{name: "wrong password", username: "alice", password: "wrong"},
+		{name: "unknown user", username: "mallory", password: "secret"},
+		{name: "server error", username: "broken", password: "secret", wantErr: true},
+	})
+	testExists(t, store, []existsTest{
+		{name: "known user", username: "alice", want: true},
+		{name: "unknown user", username: "mallory"},
+		{name: "server error", username: "broken", wantErr: true},
+	})
+}
+
+func TestSQLAuthenticate(t *testing.T) {
+	store := newSQLStore(t)
+	testAuthenticate(t, store, []authenticateTest{
+		{name: "imported hash", username: "alice", password: "secret", want: &legacy.User{Username: "alice", Email: "alice@example.com", EmailVerified: true}},
+		{name: "PHC hash", username: "bob", password: "hunter2", want: &legacy.User{Username: "bob", Email: "bob@example.com"}},
+		{name: "wrong password", username: "alice", password: "hunter2"},
+		{name: "unknown user", username: "mallory", password: "secret"},
+	})
+	testExists(t, store, []existsTest{
+		{name: "known user", username: "bob", want: true},
+		{name: "unknown user", username: "mallory"},
+	})
+}
+
+type authenticateTest struct {
+	name               string
+	username, password string
+	want               *legacy.User
+	wantErr            bool
+}
+
+func testAuthenticate(t *testing.T, store legacy.Authenticator, tests []authenticateTest) {
+	for _, tt := range tests {
+		t.Run("Authenticate/"+tt.name, func(t *testing.T) {
+			user, err := store.Authenticate(tt.username, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate error = %v, want error %v", err, tt.wantErr)
+			}
+			switch {
+			case tt.want == nil && user != nil:
+				t.Errorf("Authenticate = %+v, want nil", user)
+			case tt.want != nil && (user == nil || *user != *tt.want):
+				t.Errorf("Authenticate = %+v, want %+v", user, tt.want)
+			}
+		})
+	}
+}
+
+type existsTest struct {
+	name     string
+	username string
+	want     bool
+	wantErr  bool
+}
+
+func testExists(t *testing.T, store legacy.Authenticator, tests []existsTest) {
+	for _, tt := range tests {
+		t.Run("Exists/"+tt.name, func(t *testing.T) {
+			exists, err := store.Exists(tt.username)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exists error = %v, want error %v", err, tt.wantErr)
+			}
+			if exists != tt.want {
+				t.Errorf("Exists = %v, want %v", exists, tt.want)
+			}
+		})
+	}
+}
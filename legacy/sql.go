@@ -0,0 +1,100 @@
+package legacy
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"oauth2-provider/config"
+	"oauth2-provider/passwords"
+	"strconv"
+)
+
+// sqlAuthenticator reads users from the legacy database. Queries are not
+// logged, as their results hold password hashes.
+type sqlAuthenticator struct {
+	db    *gorm.DB
+	query string
+}
+
+func newSQLAuthenticator(cfg config.LegacySQLConfig) (*sqlAuthenticator, error) {
+	var db *gorm.DB
+	var err error
+	switch cfg.Driver {
+	case config.StoragePostgres:
+		db, err = gorm.Open(postgres.Open(cfg.DSN), &gorm.Config{Logger: logger.Discard})
+	case config.StorageSQLite:
+		db, err = config.OpenSQLite(cfg.DSN, logger.Discard)
+	default:
+		return nil, fmt.Errorf("unknown legacy database driver %q", cfg.Driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("legacy database: %v", err)
+	}
+	return &sqlAuthenticator{db: db, query: cfg.Query}, nil
+}
+
+// legacyRow is a user as selected by the configured query.
+type legacyRow struct {
+	passwordHash  string
+	email         string
+	emailVerified bool
+}
+
+func (a *sqlAuthenticator) find(username string) (*legacyRow, error) {
+	rows, err := a.db.Raw(a.query, username).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("legacy database: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("legacy database: %v", err)
+	}
+	values := make([]sql.NullString, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	if err := rows.Scan(targets...); err != nil {
+		return nil, fmt.Errorf("legacy database: %v", err)
+	}
+
+	row := &legacyRow{}
+	for i, column := range columns {
+		switch column {
+		case "password_hash":
+			row.passwordHash = values[i].String
+		case "email":
+			row.email = values[i].String
+		case "email_verified":
+			// Databases without a boolean type return 0 or 1
+			row.emailVerified, _ = strconv.ParseBool(values[i].String)
+		}
+	}
+	return row, nil
+}
+
+func (a *sqlAuthenticator) Authenticate(username, password string) (*User, error) {
+	row, err := a.find(username)
+	if err != nil || row == nil {
+		return nil, err
+	}
+	hash, err := passwords.ImportHash(row.passwordHash)
+	if err != nil {
+		return nil, fmt.Errorf("legacy database: user %s: %v", username, err)
+	}
+	if ok, _ := passwords.Verify(password, hash); !ok {
+		return nil, nil
+	}
+	return &User{Username: username, Email: row.email, EmailVerified: row.emailVerified}, nil
+}
+
+func (a *sqlAuthenticator) Exists(username string) (bool, error) {
+	row, err := a.find(username)
+	return row != nil, err
+}
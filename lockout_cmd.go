@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"os"
+)
+
+const lockoutUsage = `usage: oauth2-provider [-config file] lockout unlock [-realm name] [-ip] <username|address>
+
+Commands:
+  unlock  lift the lockout of a username, or of a client IP address with
+          -ip, and forget its failed login attempts`
+
+// runLockout implements the lockout subcommand and returns the process
+// exit code.
+func runLockout(configPath string, args []string) int {
+	if len(args) == 0 || args[0] != "unlock" {
+		fmt.Fprintln(os.Stderr, lockoutUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("lockout unlock", flag.ContinueOnError)
+	realmName := flags.String("realm", models.DefaultRealm, "realm of the user")
+	ip := flags.Bool("ip", false, "unlock a client IP address instead of a username")
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, lockoutUsage) }
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lockout: %v\n", err)
+		return 1
+	}
+	registry, err := realms.NewRegistry(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lockout: %v\n", err)
+		return 1
+	}
+	realm := registry.Get(*realmName)
+	if realm == nil {
+		fmt.Fprintf(os.Stderr, "lockout: unknown realm %q\n", *realmName)
+		return 1
+	}
+	store, err := initStore(cfg.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lockout: %v\n", err)
+		return 1
+	}
+
+	userService := services.NewUserService(store, nil, nil, nil, nil, nil, nil)
+	unlock := userService.UnlockUser
+	if *ip {
+		unlock = userService.UnlockIP
+	}
+	if err := unlock(realm, flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "lockout unlock: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Unlocked %s in realm %s\n", flags.Arg(0), realm.Name)
+	return 0
+}
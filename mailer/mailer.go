@@ -0,0 +1,116 @@
+// Package mailer sends the emails the server needs, such as verification
+// links, through a configurable Sender.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"oauth2-provider/config"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Sender interface {
+	Send(msg Message) error
+}
+
+// NewSender returns the sender selected by the configuration.
+func NewSender(cfg config.MailConfig) (Sender, error) {
+	switch cfg.Sender {
+	case config.MailSenderSMTP:
+		return &SMTPSender{cfg: cfg}, nil
+	case config.MailSenderFile:
+		if err := os.MkdirAll(cfg.Directory, 0o700); err != nil {
+			return nil, fmt.Errorf("mail directory: %v", err)
+		}
+		return &FileSender{from: cfg.From, directory: cfg.Directory}, nil
+	case config.MailSenderLog:
+		return &LogSender{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail sender %q", cfg.Sender)
+	}
+}
+
+// SMTPSender delivers messages through an SMTP relay.
+type SMTPSender struct {
+	cfg config.MailConfig
+}
+
+func (s *SMTPSender) Send(msg Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(s.cfg.SMTP.Host, strconv.Itoa(s.cfg.SMTP.Port))
+	var auth smtp.Auth
+	if s.cfg.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.SMTP.Username, s.cfg.SMTP.Password, s.cfg.SMTP.Host)
+	}
+	return smtp.SendMail(addr, auth, s.cfg.From, []string{msg.To}, format(s.cfg.From, msg))
+}
+
+// FileSender writes every message to its own .eml file in a directory.
+type FileSender struct {
+	from      string
+	directory string
+}
+
+func (s *FileSender) Send(msg Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(msg.To))
+	return os.WriteFile(filepath.Join(s.directory, name), format(s.from, msg), 0o600)
+}
+
+// LogSender writes messages to the server log instead of sending them.
+type LogSender struct{}
+
+func (s *LogSender) Send(msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// checkHeaders rejects values that would inject extra headers.
+func checkHeaders(msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return errors.New("mail headers must not contain line breaks")
+	}
+	return nil
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+func sanitize(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+}
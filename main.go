@@ -1,112 +1,435 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
 	echoMiddleware "github.com/labstack/echo/v4/middleware"
 	"gorm.io/gorm"
 	"log"
+	"net/http"
 	"oauth2-provider/config"
+	"oauth2-provider/directory"
+	"oauth2-provider/encryption"
+	"oauth2-provider/federation"
 	"oauth2-provider/handlers"
+	"oauth2-provider/legacy"
+	"oauth2-provider/mailer"
 	"oauth2-provider/middleware"
-	"oauth2-provider/models"
+	"oauth2-provider/migrations"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
 	"oauth2-provider/services"
 	"oauth2-provider/storage"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
-func migrateModel(db *gorm.DB, model interface{}, modelName string) error {
-	log.Printf("Starting migration for %s model...", modelName)
-	if err := db.AutoMigrate(model); err != nil {
-		log.Printf("Failed to migrate %s model. Error: %v", modelName, err)
+func initStore(cfg config.StorageConfig) (storage.Store, error) {
+	switch cfg.Backend {
+	case config.StoragePostgres:
+		return initPostgresStore(cfg)
+	case config.StorageSQLite:
+		return initSQLiteStore(cfg)
+	case config.StorageMemory:
+		log.Println("In-memory storage initialized; data will not survive a restart")
+		return storage.NewMemoryStorage(), nil
+	case config.StorageRedis:
+		client, err := config.InitRedis(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Redis storage initialized")
+		return storage.NewRedisStorage(client), nil
+	case config.StorageHybrid:
+		accounts, err := initPostgresStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		client, err := config.InitRedis(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Hybrid storage initialized: accounts in PostgreSQL, codes and tokens in Redis")
+		return storage.NewHybridStorage(accounts, storage.NewRedisStorage(client)), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+func initPostgresStore(cfg config.StorageConfig) (*storage.PostgresStorage, error) {
+	log.Println("Attempting to connect to database...")
+	// Initialize database
+	db, err := config.InitDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Successfully connected to database")
+
+	if err := prepareSchema(db, cfg.Migrations); err != nil {
+		return nil, err
+	}
+
+	// Initialize storage with database
+	store := storage.NewPostgresStorage(db)
+	log.Println("PostgreSQL storage initialized")
+
+	// Hash any client secrets still stored in plaintext
+	if err := store.MigrateClientSecrets(); err != nil {
+		return nil, fmt.Errorf("client secret migration failed: %v", err)
+	}
+
+	// Replace any cleartext auth codes and refresh tokens with their hashes
+	if err := store.MigrateTokenHashes(); err != nil {
+		return nil, fmt.Errorf("token hash migration failed: %v", err)
+	}
+
+	return store, nil
+}
+
+func initSQLiteStore(cfg config.StorageConfig) (*storage.SQLiteStorage, error) {
+	db, err := config.InitSQLite(cfg.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := prepareSchema(db, cfg.Migrations); err != nil {
+		return nil, err
+	}
+
+	log.Println("SQLite storage initialized")
+	return storage.NewSQLiteStorage(db), nil
+}
+
+// prepareSchema brings the database schema up to date or, in verify mode,
+// refuses to continue if it is behind.
+func prepareSchema(db *gorm.DB, mode string) error {
+	migrator, err := migrations.New(db)
+	if err != nil {
 		return err
 	}
-	log.Printf("%s model migration completed successfully", modelName)
+
+	switch mode {
+	case config.MigrationsAuto:
+		log.Println("Applying pending schema migrations...")
+		applied, err := migrator.Up(0)
+		if err != nil {
+			return err
+		}
+		log.Printf("Schema up to date, %d migration(s) applied", applied)
+	case config.MigrationsVerify:
+		if err := migrator.Check(); err != nil {
+			return fmt.Errorf("refusing to start: %v", err)
+		}
+		log.Println("Schema verified")
+	default:
+		return fmt.Errorf("unknown schema migration mode %q", mode)
+	}
 	return nil
 }
 
+// loadConfig loads, validates and activates the configuration, logging any
+// warnings.
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := cfg.Validate()
+	for _, warning := range warnings {
+		log.Printf("Configuration warning: %s", warning)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.Set(cfg)
+	return cfg, nil
+}
+
+// ipExtractor decides the client IP that rate limits and login lockouts
+// count against. X-Forwarded-For can be written by anyone, so it is only
+// read back as far as the configured proxies appended to it.
+func ipExtractor(cfg config.ServerConfig) echo.IPExtractor {
+	ranges, _ := cfg.TrustedProxyRanges()
+	if len(ranges) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, ipRange := range ranges {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 func main() {
+	configPath := flag.String("config", os.Getenv("OAUTH2_CONFIG"), "path to a YAML or TOML configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config file] [migrate <command> | config check | keys <command> | mfa reset <username> | lockout unlock <username> | users import <file>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			os.Exit(runMigrate(*configPath, args[1:]))
+		case "config":
+			os.Exit(runConfig(*configPath, args[1:]))
+		case "keys":
+			os.Exit(runKeys(*configPath, args[1:]))
+		case "mfa":
+			os.Exit(runMFA(*configPath, args[1:]))
+		case "lockout":
+			os.Exit(runLockout(*configPath, args[1:]))
+		case "users":
+			os.Exit(runUsers(*configPath, args[1:]))
+		default:
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
 	log.Println("Starting OAuth2 Provider application...")
 
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
 	// Initialize Echo
 	e := echo.New()
+	e.IPExtractor = ipExtractor(cfg.Server)
 	log.Println("Echo framework initialized")
 
 	// Middleware
 	e.Use(echoMiddleware.Logger())
 	e.Use(echoMiddleware.Recover())
 	e.Use(echoMiddleware.CORS())
-	e.Use(echoMiddleware.RateLimiter(echoMiddleware.NewRateLimiterMemoryStore(20)))
+	if cfg.Server.RateLimit > 0 {
+		e.Use(echoMiddleware.RateLimiter(echoMiddleware.NewRateLimiterMemoryStore(rate.Limit(cfg.Server.RateLimit))))
+	}
 	log.Println("Middleware configured successfully")
 
-	log.Println("Attempting to connect to database...")
-	// Initialize database
-	db, err := config.InitDB()
+	registry, err := realms.NewRegistry(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		log.Fatalf("Failed to load realms: %v", err)
 	}
-	log.Println("Successfully connected to database")
-
-	// Auto migrate database schema one by one with detailed error logging
-	log.Println("Starting database migration...")
+	log.Printf("%d realm(s) configured", len(cfg.Realms)+1)
 
-	// Migrate User model
-	if err := migrateModel(db, &models.User{}, "User"); err != nil {
-		log.Fatalf("Database migration failed at User model: %v", err)
+	store, err := initStore(cfg.Storage)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
-	// Migrate Client model with extra logging
-	log.Println("Attempting to migrate Client model...")
-	if err := migrateModel(db, &models.Client{}, "Client"); err != nil {
-		// Print the schema of the Client model for debugging
-		log.Printf("Client model schema: %+v", &models.Client{})
-		log.Fatalf("Database migration failed at Client model: %v", err)
+	// Unlock the keyring and move data keys onto the active master key
+	var keyring *encryption.Keyring
+	if len(cfg.Keys.MasterKeys) > 0 {
+		keyring, err = encryption.NewKeyring(store, cfg.Keys)
+		if err != nil {
+			log.Fatalf("Failed to initialize keyring: %v", err)
+		}
+		rewrapped, err := keyring.Rewrap()
+		if err != nil {
+			log.Fatalf("Failed to re-wrap data keys: %v", err)
+		}
+		if rewrapped > 0 {
+			log.Printf("Re-wrapped %d data key(s) with master key %s", rewrapped, cfg.Keys.ActiveMasterKey)
+		}
+		log.Println("Keyring initialized")
+	} else {
+		log.Println("No master keys configured; TOTP enrollment is disabled")
 	}
 
-	// Migrate AuthCode model
-	if err := migrateModel(db, &models.AuthCode{}, "AuthCode"); err != nil {
-		log.Fatalf("Database migration failed at AuthCode model: %v", err)
+	// Initialize services
+	oauthService := services.NewOAuthService(store)
+	sender, err := mailer.NewSender(cfg.Mail)
+	if err != nil {
+		log.Fatalf("Failed to initialize mail sender: %v", err)
 	}
 
-	// Migrate RefreshToken model
-	if err := migrateModel(db, &models.RefreshToken{}, "RefreshToken"); err != nil {
-		log.Fatalf("Database migration failed at RefreshToken model: %v", err)
+	passwordPolicy, err := passwords.NewPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
 	}
 
-	log.Println("Database migration completed successfully")
+	legacyAuth, err := legacy.New(cfg.LegacyAuth)
+	if err != nil {
+		log.Fatalf("Failed to initialize legacy authentication: %v", err)
+	}
+	if legacyAuth != nil {
+		log.Printf("Users missing from realm %s are migrated from the legacy %s store", cfg.LegacyAuth.Realm, cfg.LegacyAuth.Backend)
+	}
 
-	// Initialize storage with database
-	store := storage.NewPostgresStorage(db)
-	log.Println("PostgreSQL storage initialized")
+	ldapDirectory, err := directory.New(cfg.LDAP)
+	if err != nil {
+		log.Fatalf("Failed to initialize LDAP directory: %v", err)
+	}
+	if ldapDirectory != nil {
+		log.Printf("Users of realm %s sign in against the LDAP directory at %s", cfg.LDAP.Realm, cfg.LDAP.URL)
+	}
 
-	// Initialize services
-	oauthService := services.NewOAuthService(store)
-	userService := services.NewUserService(store)
+	upstreamProviders := federation.NewProviders(cfg.UpstreamProviders)
+	userService := services.NewUserService(store, sender, keyring, passwordPolicy, legacyAuth, upstreamProviders, ldapDirectory)
 	clientService := services.NewClientService(store)
+	samlService := services.NewSAMLService(store)
+	scimService := services.NewSCIMService(store, userService)
 	log.Println("Services initialized")
 
+	// Stop background work and the server on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start the janitor purging expired codes and tokens
+	var background sync.WaitGroup
+	if interval := cfg.Cleanup.Interval.Duration(); interval > 0 {
+		janitor := services.NewJanitor(store, interval, cfg.Cleanup.BatchSize)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			janitor.Run(ctx)
+		}()
+	} else {
+		log.Println("Janitor disabled")
+	}
+
+	// Keep the profiles of directory users current
+	if interval := cfg.LDAP.SyncInterval.Duration(); ldapDirectory != nil && interval > 0 {
+		realm := registry.Get(cfg.LDAP.Realm)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			userService.RunDirectorySync(ctx, realm, interval)
+		}()
+	}
+
 	// Initialize handlers
 	oauthHandler := handlers.NewOAuthHandler(oauthService)
 	userHandler := handlers.NewUserHandler(userService)
 	clientHandler := handlers.NewClientHandler(clientService)
+	discoveryHandler := handlers.NewDiscoveryHandler()
+	samlHandler := handlers.NewSAMLHandler(samlService)
+	scimHandler := handlers.NewSCIMHandler(scimService)
 	log.Println("Handlers initialized")
 
-	// Routes
-	// OAuth2 endpoints
-	e.GET("/authorize", oauthHandler.Authorize)
-	e.POST("/token", oauthHandler.Token)
-	e.GET("/userinfo", oauthHandler.UserInfo, middleware.JWTAuth)
+	// Routes. Every realm serves the same endpoints, either at the root
+	// (the default realm, or the realm owning the request host) or under
+	// /realms/<name>.
+	resolveRealm := middleware.ResolveRealm(registry)
+	recentLogin := middleware.RecentLogin(userService)
+	for _, g := range []*echo.Group{e.Group("", resolveRealm), e.Group("/realms/:realm", resolveRealm)} {
+		// Discovery
+		g.GET("/.well-known/openid-configuration", discoveryHandler.Configuration)
+		g.GET("/.well-known/jwks.json", discoveryHandler.JWKS)
 
-	// User management
-	e.POST("/register", userHandler.Register)
-	e.POST("/login", userHandler.Login)
+		// OAuth2 endpoints
+		g.GET(config.DefaultConfig.AuthorizeEndpoint, oauthHandler.Authorize)
+		g.POST(config.DefaultConfig.TokenEndpoint, oauthHandler.Token)
+		g.GET(config.DefaultConfig.UserInfoEndpoint, oauthHandler.UserInfo, middleware.JWTAuth)
 
-	// Client management
-	e.POST("/client/register", clientHandler.Register)
-	e.GET("/client/:id", clientHandler.Get, middleware.JWTAuth)
+		// User management
+		g.POST("/register", userHandler.Register)
+		g.POST("/login", userHandler.Login)
+		g.POST("/login/mfa", userHandler.LoginMFA)
+		g.POST("/login/code", userHandler.LoginCode)
+		g.POST("/login/mfa/webauthn/begin", userHandler.BeginWebAuthnMFA)
+		g.POST("/login/mfa/webauthn/finish", userHandler.FinishWebAuthnMFA)
+		g.POST("/login/webauthn/begin", userHandler.BeginPasskeyLogin)
+		g.POST("/login/webauthn/finish", userHandler.FinishPasskeyLogin)
+		g.GET("/login", userHandler.LoginPage)
+		g.GET("/login/upstream", userHandler.ListUpstreamProviders)
+		g.GET("/login/upstream/:provider", userHandler.UpstreamLogin)
+		g.GET("/login/upstream/:provider/callback", userHandler.UpstreamCallback)
+		g.GET("/verify-email", userHandler.VerifyEmail)
+		g.POST("/verify-email/resend", userHandler.ResendVerification)
+		g.POST("/password/forgot", userHandler.ForgotPassword)
+		g.GET("/password/reset", userHandler.PasswordResetForm)
+		g.POST("/password/reset", userHandler.ResetPassword)
+		g.POST("/password/change", userHandler.ChangePassword, middleware.JWTAuth)
+		// Second factors are changed with a recent login token, never an
+		// access token or a login token (see middleware.RecentLogin)
+		g.POST("/mfa/totp", userHandler.EnrollTOTP, recentLogin)
+		g.POST("/mfa/totp/confirm", userHandler.ConfirmTOTP, recentLogin)
+		g.POST("/mfa/webauthn/register/begin", userHandler.BeginWebAuthnRegistration, recentLogin)
+		g.POST("/mfa/webauthn/register/finish", userHandler.FinishWebAuthnRegistration, recentLogin)
+		g.GET("/mfa/webauthn/credentials", userHandler.ListWebAuthnCredentials, middleware.JWTAuth)
+		g.PATCH("/mfa/webauthn/credentials/:id", userHandler.RenameWebAuthnCredential, recentLogin)
+		g.DELETE("/mfa/webauthn/credentials/:id", userHandler.DeleteWebAuthnCredential, recentLogin)
+
+		// SAML identity provider, for realms with a SAML key
+		g.GET("/saml/metadata", samlHandler.Metadata)
+		g.GET("/saml/sso", samlHandler.SSO)
+		g.POST("/saml/sso", samlHandler.SSO)
+		g.GET("/saml/idp-initiated", samlHandler.IdPInitiated)
+		g.GET("/saml/slo", samlHandler.SLO)
+		g.POST("/saml/slo", samlHandler.SLO)
+
+		// SCIM provisioning, for the clients in scim.clients
+		scim := middleware.RequireScope(services.SCIMScope)
+		g.GET("/scim/v2/Users", scimHandler.ListUsers, scim)
+		g.POST("/scim/v2/Users", scimHandler.CreateUser, scim)
+		g.GET("/scim/v2/Users/:id", scimHandler.GetUser, scim)
+		g.PUT("/scim/v2/Users/:id", scimHandler.ReplaceUser, scim)
+		g.PATCH("/scim/v2/Users/:id", scimHandler.PatchUser, scim)
+		g.DELETE("/scim/v2/Users/:id", scimHandler.DeleteUser, scim)
+		g.GET("/scim/v2/Groups", scimHandler.ListGroups, scim)
+		g.POST("/scim/v2/Groups", scimHandler.CreateGroup, scim)
+		g.GET("/scim/v2/Groups/:id", scimHandler.GetGroup, scim)
+		g.PUT("/scim/v2/Groups/:id", scimHandler.ReplaceGroup, scim)
+		g.PATCH("/scim/v2/Groups/:id", scimHandler.PatchGroup, scim)
+		g.DELETE("/scim/v2/Groups/:id", scimHandler.DeleteGroup, scim)
+		g.GET("/scim/v2/ServiceProviderConfig", scimHandler.ServiceProviderConfig)
+		g.GET("/scim/v2/Schemas", scimHandler.Schemas)
+		g.GET("/scim/v2/Schemas/:id", scimHandler.Schemas)
+		g.GET("/scim/v2/ResourceTypes", scimHandler.ResourceTypes)
+		g.GET("/scim/v2/ResourceTypes/:id", scimHandler.ResourceTypes)
+
+		// Administration
+		g.POST("/admin/users/import", userHandler.ImportUsers, middleware.AdminAuth)
+		g.POST("/admin/saml/service-providers", samlHandler.RegisterServiceProvider, middleware.AdminAuth)
+		g.GET("/admin/saml/service-providers", samlHandler.ListServiceProviders, middleware.AdminAuth)
+		g.PUT("/admin/saml/service-providers", samlHandler.UpdateServiceProvider, middleware.AdminAuth)
+		g.DELETE("/admin/saml/service-providers", samlHandler.DeleteServiceProvider, middleware.AdminAuth)
+
+		// Client management; registration can be turned off per realm
+		g.POST("/client/register", clientHandler.Register)
+		g.GET("/client/:id", clientHandler.Get, middleware.JWTAuth)
+		g.POST("/client/:id/rotate-secret", clientHandler.RotateSecret)
+	}
+
+	// Metrics
+	if cfg.Features.Metrics {
+		e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+	}
 	log.Println("Routes configured")
 
 	// Start server
-	log.Println("Starting server on port 8000...")
-	if err := e.Start(":8000"); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	go func() {
+		var err error
+		if cfg.Server.TLS.Enabled {
+			log.Printf("Starting TLS server on %s...", cfg.Server.ListenAddress)
+			err = e.StartTLS(cfg.Server.ListenAddress, cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+		} else {
+			log.Printf("Starting server on %s...", cfg.Server.ListenAddress)
+			err = e.Start(cfg.Server.ListenAddress)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration())
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server cleanly: %v", err)
 	}
-}
\ No newline at end of file
+	background.Wait()
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"os"
+)
+
+const mfaUsage = `usage: oauth2-provider [-config file] mfa reset [-realm name] <username>
+
+Commands:
+  reset   remove the TOTP secret, recovery codes and security keys of a
+          user who lost them; the user can sign in with their password and
+          enroll again`
+
+// runMFA implements the mfa subcommand and returns the process exit code.
+func runMFA(configPath string, args []string) int {
+	if len(args) == 0 || args[0] != "reset" {
+		fmt.Fprintln(os.Stderr, mfaUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("mfa reset", flag.ContinueOnError)
+	realmName := flags.String("realm", models.DefaultRealm, "realm of the user")
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, mfaUsage) }
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mfa: %v\n", err)
+		return 1
+	}
+	registry, err := realms.NewRegistry(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mfa: %v\n", err)
+		return 1
+	}
+	realm := registry.Get(*realmName)
+	if realm == nil {
+		fmt.Fprintf(os.Stderr, "mfa: unknown realm %q\n", *realmName)
+		return 1
+	}
+	store, err := initStore(cfg.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mfa: %v\n", err)
+		return 1
+	}
+
+	// Resetting needs neither mail nor the keyring
+	userService := services.NewUserService(store, nil, nil, nil, nil, nil, nil)
+	if err := userService.ResetMFA(realm, flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "mfa reset: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Reset MFA of %s in realm %s\n", flags.Arg(0), realm.Name)
+	return 0
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+    "crypto/subtle"
+    "github.com/labstack/echo/v4"
+    "oauth2-provider/config"
+    "strings"
+)
+
+// AdminAuth accepts the configured admin API token as a bearer token. The
+// admin endpoints don't exist while no token is configured.
+func AdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        expected := config.Get().Admin.APIToken
+        if expected == "" {
+            return echo.ErrNotFound
+        }
+
+        token, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+        if !found || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+            return echo.ErrUnauthorized
+        }
+        return next(c)
+    }
+}
@@ -1,26 +1,27 @@
 package middleware
 
 import (
+    "errors"
     "github.com/labstack/echo/v4"
+    "net/http"
+    "oauth2-provider/realms"
+    "oauth2-provider/services"
     "oauth2-provider/utils"
+    "strconv"
     "strings"
 )
 
+// JWTAuth accepts access tokens issued by the request's realm to a user;
+// it must run after ResolveRealm.
 func JWTAuth(next echo.HandlerFunc) echo.HandlerFunc {
     return func(c echo.Context) error {
-        authHeader := c.Request().Header.Get("Authorization")
-        if authHeader == "" {
-            return echo.ErrUnauthorized
-        }
-
-        parts := strings.Split(authHeader, " ")
-        if len(parts) != 2 || parts[0] != "Bearer" {
-            return echo.ErrUnauthorized
+        claims, err := accessTokenClaims(c)
+        if err != nil {
+            return err
         }
 
-        token := parts[1]
-        claims, err := utils.ValidateJWT(token)
-        if err != nil {
+        // Tokens from the client_credentials grant name a client, not a user
+        if _, err := strconv.ParseUint(claims.Subject, 10, 64); err != nil {
             return echo.ErrUnauthorized
         }
 
@@ -28,3 +29,78 @@ func JWTAuth(next echo.HandlerFunc) echo.HandlerFunc {
         return next(c)
     }
 }
+
+// RecentLogin accepts the recent login token from /login, /login/mfa or a
+// passkey login in the X-Recent-Login-Token header, instead of an access
+// token. It guards the settings that let their holder sign in as the
+// user: access tokens are held by every client the user authorized, while
+// recent login tokens only reach the user's own login page, work once and
+// expire minutes after the login. The token for the next change, such as
+// the second step of an enrollment, is returned in the same header. It
+// must run after ResolveRealm.
+func RecentLogin(userService *services.UserService) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            token := c.Request().Header.Get("X-Recent-Login-Token")
+            if token == "" {
+                c.Response().Header().Set("WWW-Authenticate", `RecentLogin error="login_required"`)
+                return echo.NewHTTPError(http.StatusUnauthorized, "sign in again to change security settings")
+            }
+
+            auth, nextToken, err := userService.RedeemRecentLogin(c.Get("realm").(*realms.Realm), token)
+            if errors.Is(err, services.ErrInvalidLoginToken) {
+                c.Response().Header().Set("WWW-Authenticate", `RecentLogin error="login_required"`)
+                return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+            }
+            if err != nil {
+                return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+            }
+
+            c.Response().Header().Set("X-Recent-Login-Token", nextToken)
+            c.Set("user_id", strconv.FormatUint(uint64(auth.UserID), 10))
+            return next(c)
+        }
+    }
+}
+
+// RequireScope accepts access tokens issued by the request's realm that
+// grant scope, whether to a user or to a client. The token's subject is
+// set as "subject". It must run after ResolveRealm.
+func RequireScope(scope string) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            claims, err := accessTokenClaims(c)
+            if err != nil {
+                return err
+            }
+
+            for _, granted := range strings.Fields(claims.Scope) {
+                if granted == scope {
+                    c.Set("subject", claims.Subject)
+                    return next(c)
+                }
+            }
+            c.Response().Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+            return echo.NewHTTPError(http.StatusForbidden, "insufficient scope")
+        }
+    }
+}
+
+func accessTokenClaims(c echo.Context) (*utils.AccessTokenClaims, error) {
+    authHeader := c.Request().Header.Get("Authorization")
+    if authHeader == "" {
+        return nil, echo.ErrUnauthorized
+    }
+
+    parts := strings.Split(authHeader, " ")
+    if len(parts) != 2 || parts[0] != "Bearer" {
+        return nil, echo.ErrUnauthorized
+    }
+
+    realm := c.Get("realm").(*realms.Realm)
+    claims, err := utils.ValidateJWT(realm.SigningKey, realm.Issuer, parts[1])
+    if err != nil {
+        return nil, echo.ErrUnauthorized
+    }
+    return claims, nil
+}
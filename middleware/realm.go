@@ -0,0 +1,27 @@
+package middleware
+
+import (
+    "github.com/labstack/echo/v4"
+    "net/http"
+    "oauth2-provider/realms"
+)
+
+// ResolveRealm stores the realm a request is for under "realm": the one
+// named by the :realm path parameter, else the one serving the request's
+// host, else the default realm.
+func ResolveRealm(registry *realms.Registry) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            realm := registry.ForHost(c.Request().Host)
+            if name := c.Param("realm"); name != "" {
+                realm = registry.Get(name)
+                if realm == nil {
+                    return echo.NewHTTPError(http.StatusNotFound, "realm not found")
+                }
+            }
+
+            c.Set("realm", realm)
+            return next(c)
+        }
+    }
+}
@@ -0,0 +1,152 @@
+package middleware_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"oauth2-provider/config"
+	"oauth2-provider/handlers"
+	"oauth2-provider/middleware"
+	"oauth2-provider/realms"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newRealmServer serves the discovery documents like main.go does: at the
+// root for the default realm or the realm owning the host, and under
+// /realms/<name>. The realm acme signs with an EC key on its own host;
+// beta has a secret derived from the default one.
+func newRealmServer(t *testing.T) *echo.Echo {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Issuer = "https://auth.example.com"
+	cfg.Keys.JWTSecret = "a-jwt-secret-of-at-least-32-characters"
+	cfg.Realms = []config.RealmConfig{
+		{
+			Name:       "acme",
+			Issuer:     "https://login.acme.example",
+			Hosts:      []string{"login.acme.example"},
+			Scopes:     []string{"openid", "email"},
+			SigningKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+		},
+		{Name: "beta"},
+	}
+	registry, err := realms.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+
+	e := echo.New()
+	resolveRealm := middleware.ResolveRealm(registry)
+	discoveryHandler := handlers.NewDiscoveryHandler()
+	for _, g := range []*echo.Group{e.Group("", resolveRealm), e.Group("/realms/:realm", resolveRealm)} {
+		g.GET("/.well-known/openid-configuration", discoveryHandler.Configuration)
+		g.GET("/.well-known/jwks.json", discoveryHandler.JWKS)
+	}
+	return e
+}
+
+// get requests path from host and decodes the JSON response into v.
+func get(t *testing.T, e *echo.Echo, host, path string, v interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("decoding %s: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestResolveRealmDiscovery(t *testing.T) {
+	e := newRealmServer(t)
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantStatus int
+		wantIssuer string
+		wantAlg    string
+		wantScopes bool
+	}{
+		{name: "default realm", host: "auth.example.com", path: "/", wantIssuer: "https://auth.example.com", wantAlg: "HS256"},
+		{name: "unknown host", host: "other.example.com", path: "/", wantIssuer: "https://auth.example.com", wantAlg: "HS256"},
+		{name: "realm by host", host: "login.acme.example", path: "/", wantIssuer: "https://login.acme.example", wantAlg: "ES256", wantScopes: true},
+		{name: "realm by host with port", host: "login.acme.example:8443", path: "/", wantIssuer: "https://login.acme.example", wantAlg: "ES256", wantScopes: true},
+		{name: "realm by path", host: "auth.example.com", path: "/realms/beta/", wantIssuer: "https://auth.example.com/realms/beta", wantAlg: "HS256"},
+		{name: "path wins over host", host: "login.acme.example", path: "/realms/beta/", wantIssuer: "https://auth.example.com/realms/beta", wantAlg: "HS256"},
+		{name: "default realm by path", host: "login.acme.example", path: "/realms/default/", wantIssuer: "https://auth.example.com", wantAlg: "HS256"},
+		{name: "unknown realm", host: "auth.example.com", path: "/realms/unknown/", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metadata struct {
+				Issuer        string   `json:"issuer"`
+				TokenEndpoint string   `json:"token_endpoint"`
+				JWKSURI       string   `json:"jwks_uri"`
+				Algs          []string `json:"id_token_signing_alg_values_supported"`
+				Scopes        []string `json:"scopes_supported"`
+			}
+			status := get(t, e, tt.host, tt.path+".well-known/openid-configuration", &metadata)
+			wantStatus := tt.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusOK
+			}
+			if status != wantStatus {
+				t.Fatalf("openid-configuration status = %d, want %d", status, wantStatus)
+			}
+			if wantStatus != http.StatusOK {
+				return
+			}
+
+			if metadata.Issuer != tt.wantIssuer || metadata.TokenEndpoint != tt.wantIssuer+"/token" || metadata.JWKSURI != tt.wantIssuer+"/.well-known/jwks.json" {
+				t.Errorf("metadata = %+v, want everything under %s", metadata, tt.wantIssuer)
+			}
+			if len(metadata.Algs) != 1 || metadata.Algs[0] != tt.wantAlg {
+				t.Errorf("signing algorithms = %v, want [%s]", metadata.Algs, tt.wantAlg)
+			}
+			if (len(metadata.Scopes) > 0) != tt.wantScopes {
+				t.Errorf("scopes_supported = %v", metadata.Scopes)
+			}
+
+			// Realms signing with a secret publish no keys
+			var jwks struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			if status := get(t, e, tt.host, tt.path+".well-known/jwks.json", &jwks); status != http.StatusOK {
+				t.Fatalf("jwks.json status = %d", status)
+			}
+			if tt.wantAlg == "HS256" {
+				if jwks.Keys == nil || len(jwks.Keys) != 0 {
+					t.Errorf("keys = %v, want an empty set", jwks.Keys)
+				}
+				return
+			}
+			if len(jwks.Keys) != 1 || jwks.Keys[0]["alg"] != tt.wantAlg || jwks.Keys[0]["kty"] != "EC" || jwks.Keys[0]["kid"] == "" {
+				t.Errorf("keys = %v, want the realm's %s key", jwks.Keys, tt.wantAlg)
+			}
+			if _, ok := jwks.Keys[0]["d"]; ok {
+				t.Error("the JWKS contains the private key")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"oauth2-provider/config"
+	"oauth2-provider/migrations"
+	"os"
+	"strconv"
+)
+
+const migrateUsage = `usage: oauth2-provider migrate <command> [steps]
+
+Commands:
+  up [n]     apply all pending migrations, or the next n
+  down [n]   roll back the last migration, or the last n
+  status     list migrations and whether they are applied`
+
+// runMigrate implements the migrate subcommand against the SQL database of
+// the configured storage backend and returns the process exit code.
+func runMigrate(configPath string, args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	steps := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "invalid step count %q\n", args[1])
+			return 2
+		}
+		steps = n
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+
+	db, err := openSQLDatabase(cfg.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	migrator, err := migrations.New(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(steps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate up: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Applied %d migration(s)\n", applied)
+	case "down":
+		rolledBack, err := migrator.Down(steps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate down: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Rolled back %d migration(s)\n", rolledBack)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate status: %v\n", err)
+			return 1
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-40s %s\n", status.Version, status.Name, state)
+		}
+		if err := migrator.Check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if !errors.Is(err, migrations.ErrSchemaBehind) {
+				return 1
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
+
+func openSQLDatabase(cfg config.StorageConfig) (*gorm.DB, error) {
+	switch cfg.Backend {
+	case config.StoragePostgres, config.StorageHybrid:
+		return config.InitDB(cfg)
+	case config.StorageSQLite:
+		return config.InitSQLite(cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("storage backend %q has no SQL schema to migrate", cfg.Backend)
+	}
+}
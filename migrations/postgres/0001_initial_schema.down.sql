@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS auth_codes;
+DROP TABLE IF EXISTS clients;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,70 @@
+-- Initial schema. Tables created by the AutoMigrate-based releases already
+-- exist, so every statement is written to be a no-op against them and only
+-- adds what is missing. Legacy cleartext columns (clients.secret,
+-- auth_codes.code, refresh_tokens.token) are hashed and dropped by the
+-- storage layer after migrations run.
+
+CREATE TABLE IF NOT EXISTS users (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    username   TEXT NOT NULL,
+    password   TEXT NOT NULL,
+    email      TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (email);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE IF NOT EXISTS clients (
+    id            BIGSERIAL PRIMARY KEY,
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ,
+    deleted_at    TIMESTAMPTZ,
+    client_id     TEXT NOT NULL,
+    redirect_uris TEXT[],
+    grant_types   TEXT[]
+);
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS secret_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS previous_secret_hash TEXT;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS previous_secret_expires_at TIMESTAMPTZ;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS access_token_ttl BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS refresh_token_idle_ttl BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS refresh_token_absolute_ttl BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS rotate_refresh_tokens BOOLEAN;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS require_offline_access BOOLEAN;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_client_id ON clients (client_id);
+CREATE INDEX IF NOT EXISTS idx_clients_deleted_at ON clients (deleted_at);
+
+CREATE TABLE IF NOT EXISTS auth_codes (
+    id                    BIGSERIAL PRIMARY KEY,
+    created_at            TIMESTAMPTZ,
+    updated_at            TIMESTAMPTZ,
+    deleted_at            TIMESTAMPTZ,
+    client_id             TEXT,
+    user_id               BIGINT,
+    expires_at            TIMESTAMPTZ,
+    code_challenge        TEXT,
+    code_challenge_method TEXT,
+    used                  BOOLEAN
+);
+ALTER TABLE auth_codes ADD COLUMN IF NOT EXISTS code_hash TEXT;
+ALTER TABLE auth_codes ADD COLUMN IF NOT EXISTS scope TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auth_codes_code_hash ON auth_codes (code_hash);
+CREATE INDEX IF NOT EXISTS idx_auth_codes_deleted_at ON auth_codes (deleted_at);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    user_id    BIGINT NOT NULL,
+    client_id  TEXT NOT NULL,
+    expires_at TIMESTAMPTZ
+);
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS token_hash TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS scope TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS absolute_expires_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_deleted_at ON refresh_tokens (deleted_at);
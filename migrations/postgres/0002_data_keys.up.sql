@@ -0,0 +1,12 @@
+CREATE TABLE data_keys (
+    id            BIGSERIAL PRIMARY KEY,
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ,
+    deleted_at    TIMESTAMPTZ,
+    key_id        TEXT NOT NULL,
+    master_key_id TEXT NOT NULL,
+    wrapped_key   TEXT NOT NULL,
+    active        BOOLEAN NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX idx_data_keys_key_id ON data_keys (key_id);
+CREATE INDEX idx_data_keys_deleted_at ON data_keys (deleted_at);
@@ -0,0 +1,12 @@
+-- Fails if two realms share a username or email.
+ALTER TABLE refresh_tokens DROP COLUMN realm;
+ALTER TABLE auth_codes DROP COLUMN realm;
+
+DROP INDEX IF EXISTS idx_clients_realm;
+ALTER TABLE clients DROP COLUMN realm;
+
+DROP INDEX IF EXISTS idx_users_realm_username;
+DROP INDEX IF EXISTS idx_users_realm_email;
+ALTER TABLE users DROP COLUMN realm;
+CREATE UNIQUE INDEX idx_users_username ON users (username);
+CREATE UNIQUE INDEX idx_users_email ON users (email);
@@ -0,0 +1,13 @@
+-- Every record belongs to a realm; existing ones move into the default
+-- realm. Usernames and emails are only unique within their realm.
+ALTER TABLE users ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+DROP INDEX IF EXISTS idx_users_username;
+DROP INDEX IF EXISTS idx_users_email;
+CREATE UNIQUE INDEX idx_users_realm_username ON users (realm, username);
+CREATE UNIQUE INDEX idx_users_realm_email ON users (realm, email);
+
+ALTER TABLE clients ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX idx_clients_realm ON clients (realm);
+
+ALTER TABLE auth_codes ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE refresh_tokens ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
@@ -0,0 +1,8 @@
+ALTER TABLE auth_codes DROP COLUMN auth_time;
+ALTER TABLE auth_codes DROP COLUMN auth_methods;
+ALTER TABLE auth_codes DROP COLUMN nonce;
+
+ALTER TABLE users DROP COLUMN recovery_codes;
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
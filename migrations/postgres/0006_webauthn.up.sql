@@ -0,0 +1,21 @@
+CREATE TABLE webauthn_credentials (
+    id               BIGSERIAL PRIMARY KEY,
+    created_at       TIMESTAMPTZ,
+    updated_at       TIMESTAMPTZ,
+    deleted_at       TIMESTAMPTZ,
+    realm            TEXT NOT NULL DEFAULT 'default',
+    user_id          BIGINT NOT NULL,
+    credential_id    TEXT NOT NULL,
+    name             TEXT,
+    public_key       BYTEA NOT NULL,
+    attestation_type TEXT,
+    aaguid           TEXT,
+    sign_count       BIGINT,
+    transports       TEXT,
+    backup_eligible  BOOLEAN NOT NULL DEFAULT false,
+    backup_state     BOOLEAN NOT NULL DEFAULT false,
+    last_used_at     TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX idx_webauthn_credentials_realm_credential_id ON webauthn_credentials (realm, credential_id);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+CREATE INDEX idx_webauthn_credentials_deleted_at ON webauthn_credentials (deleted_at);
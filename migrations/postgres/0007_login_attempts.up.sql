@@ -0,0 +1,12 @@
+CREATE TABLE login_attempts (
+    id               BIGSERIAL PRIMARY KEY,
+    realm            TEXT NOT NULL DEFAULT 'default',
+    key              TEXT NOT NULL,
+    failures         BIGINT NOT NULL DEFAULT 0,
+    first_failure_at TIMESTAMPTZ,
+    last_failure_at  TIMESTAMPTZ,
+    expires_at       TIMESTAMPTZ,
+    locked_until     TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX idx_login_attempts_realm_key ON login_attempts (realm, key);
+CREATE INDEX idx_login_attempts_expires_at ON login_attempts (expires_at);
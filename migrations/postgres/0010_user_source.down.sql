@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN roles;
+ALTER TABLE users DROP COLUMN source;
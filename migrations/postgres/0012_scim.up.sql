@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN external_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE groups (
+    id           BIGSERIAL PRIMARY KEY,
+    created_at   TIMESTAMPTZ,
+    updated_at   TIMESTAMPTZ,
+    realm        TEXT NOT NULL DEFAULT 'default',
+    display_name TEXT NOT NULL,
+    external_id  TEXT NOT NULL DEFAULT '',
+    members      TEXT
+);
+CREATE UNIQUE INDEX idx_groups_realm_display_name ON groups (realm, display_name);
@@ -0,0 +1,2 @@
+-- The backfilled expiries are kept.
+ALTER TABLE refresh_tokens ALTER COLUMN absolute_expires_at DROP NOT NULL;
@@ -0,0 +1,65 @@
+CREATE TABLE users (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    username   TEXT NOT NULL,
+    password   TEXT NOT NULL,
+    email      TEXT NOT NULL
+);
+CREATE UNIQUE INDEX idx_users_username ON users (username);
+CREATE UNIQUE INDEX idx_users_email ON users (email);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+
+-- Array columns hold JSON arrays; see models.StringArray.
+CREATE TABLE clients (
+    id                         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at                 DATETIME,
+    updated_at                 DATETIME,
+    deleted_at                 DATETIME,
+    client_id                  TEXT NOT NULL,
+    redirect_uris              TEXT,
+    grant_types                TEXT,
+    secret_hash                TEXT NOT NULL DEFAULT '',
+    previous_secret_hash       TEXT,
+    previous_secret_expires_at DATETIME,
+    access_token_ttl           INTEGER NOT NULL DEFAULT 0,
+    refresh_token_idle_ttl     INTEGER NOT NULL DEFAULT 0,
+    refresh_token_absolute_ttl INTEGER NOT NULL DEFAULT 0,
+    rotate_refresh_tokens      NUMERIC,
+    require_offline_access     NUMERIC
+);
+CREATE UNIQUE INDEX idx_client_id ON clients (client_id);
+CREATE INDEX idx_clients_deleted_at ON clients (deleted_at);
+
+CREATE TABLE auth_codes (
+    id                    INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at            DATETIME,
+    updated_at            DATETIME,
+    deleted_at            DATETIME,
+    code_hash             TEXT,
+    client_id             TEXT,
+    user_id               INTEGER,
+    scope                 TEXT,
+    expires_at            DATETIME,
+    code_challenge        TEXT,
+    code_challenge_method TEXT,
+    used                  NUMERIC
+);
+CREATE UNIQUE INDEX idx_auth_codes_code_hash ON auth_codes (code_hash);
+CREATE INDEX idx_auth_codes_deleted_at ON auth_codes (deleted_at);
+
+CREATE TABLE refresh_tokens (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at          DATETIME,
+    updated_at          DATETIME,
+    deleted_at          DATETIME,
+    token_hash          TEXT,
+    user_id             INTEGER NOT NULL,
+    client_id           TEXT NOT NULL,
+    scope               TEXT,
+    expires_at          DATETIME,
+    absolute_expires_at DATETIME
+);
+CREATE UNIQUE INDEX idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX idx_refresh_tokens_deleted_at ON refresh_tokens (deleted_at);
@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled NUMERIC NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes TEXT;
+
+ALTER TABLE auth_codes ADD COLUMN nonce TEXT;
+ALTER TABLE auth_codes ADD COLUMN auth_methods TEXT;
+ALTER TABLE auth_codes ADD COLUMN auth_time DATETIME;
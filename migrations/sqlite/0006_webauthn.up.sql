@@ -0,0 +1,21 @@
+CREATE TABLE webauthn_credentials (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at       DATETIME,
+    updated_at       DATETIME,
+    deleted_at       DATETIME,
+    realm            TEXT NOT NULL DEFAULT 'default',
+    user_id          INTEGER NOT NULL,
+    credential_id    TEXT NOT NULL,
+    name             TEXT,
+    public_key       BLOB NOT NULL,
+    attestation_type TEXT,
+    aaguid           TEXT,
+    sign_count       INTEGER,
+    transports       TEXT,
+    backup_eligible  NUMERIC NOT NULL DEFAULT false,
+    backup_state     NUMERIC NOT NULL DEFAULT false,
+    last_used_at     DATETIME
+);
+CREATE UNIQUE INDEX idx_webauthn_credentials_realm_credential_id ON webauthn_credentials (realm, credential_id);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+CREATE INDEX idx_webauthn_credentials_deleted_at ON webauthn_credentials (deleted_at);
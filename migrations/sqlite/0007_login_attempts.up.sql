@@ -0,0 +1,12 @@
+CREATE TABLE login_attempts (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    realm            TEXT NOT NULL DEFAULT 'default',
+    key              TEXT NOT NULL,
+    failures         INTEGER NOT NULL DEFAULT 0,
+    first_failure_at DATETIME,
+    last_failure_at  DATETIME,
+    expires_at       DATETIME,
+    locked_until     DATETIME
+);
+CREATE UNIQUE INDEX idx_login_attempts_realm_key ON login_attempts (realm, key);
+CREATE INDEX idx_login_attempts_expires_at ON login_attempts (expires_at);
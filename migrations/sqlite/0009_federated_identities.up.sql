@@ -0,0 +1,13 @@
+CREATE TABLE federated_identities (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at    DATETIME,
+    updated_at    DATETIME,
+    realm         TEXT NOT NULL DEFAULT 'default',
+    user_id       INTEGER NOT NULL,
+    provider      TEXT NOT NULL,
+    subject       TEXT NOT NULL,
+    email         TEXT,
+    last_login_at DATETIME
+);
+CREATE UNIQUE INDEX idx_federated_identities_realm_provider_subject ON federated_identities (realm, provider, subject);
+CREATE INDEX idx_federated_identities_user_id ON federated_identities (user_id);
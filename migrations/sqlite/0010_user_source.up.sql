@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN source TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN roles TEXT;
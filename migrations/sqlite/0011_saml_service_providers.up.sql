@@ -0,0 +1,11 @@
+CREATE TABLE saml_service_providers (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at     DATETIME,
+    updated_at     DATETIME,
+    realm          TEXT NOT NULL DEFAULT 'default',
+    entity_id      TEXT NOT NULL,
+    metadata       TEXT NOT NULL,
+    name_id_format TEXT NOT NULL,
+    attributes     TEXT
+);
+CREATE UNIQUE INDEX idx_saml_service_providers_realm_entity_id ON saml_service_providers (realm, entity_id);
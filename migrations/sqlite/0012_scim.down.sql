@@ -0,0 +1,3 @@
+DROP TABLE groups;
+ALTER TABLE users DROP COLUMN disabled;
+ALTER TABLE users DROP COLUMN external_id;
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN external_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN disabled NUMERIC NOT NULL DEFAULT false;
+
+CREATE TABLE groups (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at   DATETIME,
+    updated_at   DATETIME,
+    realm        TEXT NOT NULL DEFAULT 'default',
+    display_name TEXT NOT NULL,
+    external_id  TEXT NOT NULL DEFAULT '',
+    members      TEXT
+);
+CREATE UNIQUE INDEX idx_groups_realm_display_name ON groups (realm, display_name);
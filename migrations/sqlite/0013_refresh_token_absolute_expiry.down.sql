@@ -0,0 +1,2 @@
+-- The backfilled expiries are kept.
+SELECT 1;
@@ -0,0 +1,4 @@
+-- Refresh tokens issued before absolute expiries were recorded have none.
+-- Their idle expiry was their only lifetime, so it becomes their cap;
+-- tokens without either are expired outright so the janitor purges them.
+UPDATE refresh_tokens SET absolute_expires_at = COALESCE(expires_at, CURRENT_TIMESTAMP) WHERE absolute_expires_at IS NULL;
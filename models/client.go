@@ -2,14 +2,29 @@ package models
 
 import (
 	"gorm.io/gorm"
+	"time"
 )
 
 type Client struct {
 	gorm.Model
-	ClientID     string   `gorm:"column:client_id;uniqueIndex:idx_client_id;not null"`
-	Secret       string   `gorm:"column:secret;not null"`
-	RedirectURIs []string `gorm:"column:redirect_uris;type:text[];serializer:json"`
-	GrantTypes   []string `gorm:"column:grant_types;type:text[];serializer:json"`
+	Realm        string      `gorm:"column:realm;index;not null;default:default" json:"-"`
+	ClientID     string      `gorm:"column:client_id;uniqueIndex:idx_client_id;not null" json:"client_id"`
+	RedirectURIs StringArray `gorm:"column:redirect_uris" json:"redirect_uris"`
+	GrantTypes   StringArray `gorm:"column:grant_types" json:"grant_types"`
+
+	// Only hashes of client secrets are stored. After a rotation the
+	// previous secret stays valid until PreviousSecretExpiresAt.
+	SecretHash              string     `gorm:"column:secret_hash;not null;default:''" json:"-"`
+	PreviousSecretHash      string     `gorm:"column:previous_secret_hash" json:"-"`
+	PreviousSecretExpiresAt *time.Time `gorm:"column:previous_secret_expires_at" json:"-"`
+
+	// Token policy overrides in seconds. Zero lifetimes and nil flags fall
+	// back to the server-wide defaults in config.TokenConfig.
+	AccessTokenTTL          int   `gorm:"column:access_token_ttl;not null;default:0" json:"access_token_ttl,omitempty"`
+	RefreshTokenIdleTTL     int   `gorm:"column:refresh_token_idle_ttl;not null;default:0" json:"refresh_token_idle_ttl,omitempty"`
+	RefreshTokenAbsoluteTTL int   `gorm:"column:refresh_token_absolute_ttl;not null;default:0" json:"refresh_token_absolute_ttl,omitempty"`
+	RotateRefreshTokens     *bool `gorm:"column:rotate_refresh_tokens" json:"rotate_refresh_tokens,omitempty"`
+	RequireOfflineAccess    *bool `gorm:"column:require_offline_access" json:"require_offline_access,omitempty"`
 }
 
 func (Client) TableName() string {
@@ -17,24 +32,51 @@ func (Client) TableName() string {
 }
 
 type ClientRegistration struct {
-	RedirectURIs []string `json:"redirect_uris" validate:"required,min=1"`
+	RedirectURIs            []string `json:"redirect_uris" validate:"required,min=1"`
+	AccessTokenTTL          int      `json:"access_token_ttl" validate:"min=0"`
+	RefreshTokenIdleTTL     int      `json:"refresh_token_idle_ttl" validate:"min=0"`
+	RefreshTokenAbsoluteTTL int      `json:"refresh_token_absolute_ttl" validate:"min=0"`
+	RotateRefreshTokens     *bool    `json:"rotate_refresh_tokens"`
+	RequireOfflineAccess    *bool    `json:"require_offline_access"`
+}
+
+type ClientSecretRotation struct {
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	OverlapSeconds int    `json:"overlap_seconds" validate:"min=0"`
 }
 
 type AuthorizationRequest struct {
 	ClientID            string `query:"client_id" validate:"required"`
 	RedirectURI         string `query:"redirect_uri" validate:"required,url"`
 	ResponseType        string `query:"response_type" validate:"required,oneof=code"`
+	Scope               string `query:"scope"`
 	State               string `query:"state"`
 	CodeChallenge      string `query:"code_challenge" validate:"required"`
 	CodeChallengeMethod string `query:"code_challenge_method" validate:"required,oneof=S256 plain"`
+	Nonce               string `query:"nonce"`
+	// LoginCode is a one-time code from /login/code, or from an upstream
+	// login, and identifies the user.
+	LoginCode string `query:"login_code"`
 }
 
 type TokenRequest struct {
-	GrantType    string `json:"grant_type" validate:"required,oneof=authorization_code refresh_token"`
+	GrantType    string `json:"grant_type" validate:"required,oneof=authorization_code refresh_token client_credentials"`
 	Code         string `json:"code"`
 	RedirectURI  string `json:"redirect_uri"`
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
 	CodeVerifier string `json:"code_verifier" validate:"required_if=GrantType authorization_code"`
 	RefreshToken string `json:"refresh_token"`
-}
\ No newline at end of file
+	// Scope is only used by the client_credentials grant.
+	Scope string `json:"scope"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// DataKey is a random key that encrypts sensitive columns. It is only ever
+// stored wrapped (encrypted) by one of the configured master keys, recorded
+// in MasterKeyID, so rotating a master key just re-wraps these rows.
+type DataKey struct {
+	gorm.Model
+	KeyID       string `gorm:"uniqueIndex;not null"`
+	MasterKeyID string `gorm:"not null"`
+	WrappedKey  string `gorm:"not null" json:"-"`
+	// Active marks the key used for new encryptions; older keys are kept
+	// to decrypt what they encrypted.
+	Active bool `gorm:"not null;default:false"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// FederatedIdentity links a user to their account at an upstream identity
+// provider, so later logins through that provider find the same user.
+type FederatedIdentity struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Realm     string `gorm:"uniqueIndex:idx_federated_identities_realm_provider_subject;not null;default:default"`
+	UserID    uint   `gorm:"index;not null"`
+	// Provider is the ID of the upstream provider in the configuration.
+	Provider string `gorm:"uniqueIndex:idx_federated_identities_realm_provider_subject;not null"`
+	// Subject identifies the user at the provider; it never changes,
+	// unlike their email address or username there.
+	Subject string `gorm:"uniqueIndex:idx_federated_identities_realm_provider_subject;not null"`
+	// Email is the address the provider reported at the last login.
+	Email       string
+	LastLoginAt *time.Time
+}
+
+// UpstreamProvider is a "sign in with" option offered on the login page.
+type UpstreamProvider struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+}
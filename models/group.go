@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Group is a named set of users within a realm, provisioned over SCIM.
+type Group struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Realm     string `gorm:"uniqueIndex:idx_groups_realm_display_name;not null;default:default"`
+	// DisplayName is unique within the realm.
+	DisplayName string `gorm:"uniqueIndex:idx_groups_realm_display_name;not null"`
+	// ExternalID is the group's ID in the system provisioning it.
+	ExternalID string `gorm:"not null;default:''"`
+	// Members holds the IDs of the member users, separated by spaces.
+	Members string
+}
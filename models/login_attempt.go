@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// LoginAttempt counts recent failed logins for one key, a username or a
+// client IP, and records any lockout in force for it.
+type LoginAttempt struct {
+	ID    uint   `gorm:"primarykey"`
+	Realm string `gorm:"uniqueIndex:idx_login_attempts_realm_key;not null;default:default"`
+	// Key is "user:<username>" or "ip:<address>".
+	Key      string `gorm:"uniqueIndex:idx_login_attempts_realm_key;not null"`
+	Failures int    `gorm:"not null;default:0"`
+	// FirstFailureAt starts the window failures are counted in; the count
+	// starts over once ExpiresAt has passed.
+	FirstFailureAt time.Time
+	LastFailureAt  time.Time
+	ExpiresAt      time.Time `gorm:"index"`
+	LockedUntil    *time.Time
+}
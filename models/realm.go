@@ -0,0 +1,6 @@
+package models
+
+// DefaultRealm is the realm of every record created before realms existed
+// and of requests that don't name one. It is served at the server root
+// under the top-level issuer.
+const DefaultRealm = "default"
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Name ID formats a SAML service provider can identify users by.
+const (
+	// NameIDPersistent is an opaque ID of the user that never changes
+	// and differs between service providers.
+	NameIDPersistent = "persistent"
+	NameIDEmail      = "email"
+	NameIDUsername   = "username"
+)
+
+// SAMLAttributeFields are the user fields a service provider can be sent
+// as attributes.
+var SAMLAttributeFields = []string{"id", "username", "email", "email_verified", "roles"}
+
+// SAMLServiceProvider is an application registered with a realm's SAML
+// identity provider.
+type SAMLServiceProvider struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Realm     string    `gorm:"uniqueIndex:idx_saml_service_providers_realm_entity_id;not null;default:default" json:"-"`
+	// EntityID identifies the provider in its requests and is the
+	// audience of the assertions it gets.
+	EntityID string `gorm:"uniqueIndex:idx_saml_service_providers_realm_entity_id;not null" json:"entity_id"`
+	// Metadata is the provider's SAML metadata document, which lists its
+	// endpoints and certificates.
+	Metadata string `gorm:"not null" json:"metadata"`
+	// NameIDFormat is one of the NameID constants.
+	NameIDFormat string `gorm:"not null" json:"name_id_format"`
+	// Attributes maps user fields to the attribute names the provider
+	// expects, as field=name pairs separated by spaces. Fields left out
+	// are not sent.
+	Attributes string `json:"-"`
+}
+
+// SAMLServiceProviderRegistration registers or updates a service provider
+// from its metadata.
+type SAMLServiceProviderRegistration struct {
+	Metadata     string `json:"metadata" validate:"required"`
+	NameIDFormat string `json:"name_id_format"`
+	// Attributes maps the user fields id, username, email, email_verified
+	// and roles to attribute names; empty sends all of them under their
+	// field names.
+	Attributes map[string]string `json:"attributes"`
+}
+
+// AttributeMap returns Attributes as a map from user field to attribute
+// name. Without a mapping every field is sent under its own name.
+func (p *SAMLServiceProvider) AttributeMap() map[string]string {
+	attributes := make(map[string]string)
+	if p.Attributes == "" {
+		for _, field := range SAMLAttributeFields {
+			attributes[field] = field
+		}
+		return attributes
+	}
+	for _, pair := range strings.Fields(p.Attributes) {
+		if field, name, ok := strings.Cut(pair, "="); ok {
+			attributes[field] = name
+		}
+	}
+	return attributes
+}
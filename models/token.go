@@ -7,19 +7,33 @@ import (
 
 type AuthCode struct {
 	gorm.Model
-	Code               string
-	ClientID           string
-	UserID             uint
-	ExpiresAt          time.Time
-	CodeChallenge      string
+	// CodeHash is utils.HashToken of the code; the raw code is never stored.
+	CodeHash            string `gorm:"uniqueIndex" json:"-"`
+	Realm               string `gorm:"not null;default:default"`
+	ClientID            string
+	UserID              uint
+	Scope               string
+	ExpiresAt           time.Time
+	CodeChallenge       string
 	CodeChallengeMethod string
-	Used               bool
+	Nonce               string
+	// AuthMethods (space separated amr values) and AuthTime describe how
+	// the user signed in, for the ID token.
+	AuthMethods string
+	AuthTime    *time.Time
+	Used        bool
 }
 
 type RefreshToken struct {
 	gorm.Model
-	Token    string `gorm:"uniqueIndex;not null"`
-	UserID   uint   `gorm:"not null"`
-	ClientID string `gorm:"not null"`
-	ExpiresAt time.Time
+	// TokenHash is utils.HashToken of the token; the raw token is never stored.
+	TokenHash string `gorm:"uniqueIndex" json:"-"`
+	Realm     string `gorm:"not null;default:default"`
+	UserID    uint   `gorm:"not null"`
+	ClientID  string `gorm:"not null"`
+	Scope     string
+	// ExpiresAt is the idle expiry; it slides forward on each use but
+	// never past AbsoluteExpiresAt, which is fixed when the grant is issued.
+	ExpiresAt         time.Time
+	AbsoluteExpiresAt time.Time
 }
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// StringArray is a list of strings stored as a native text[] column on
+// Postgres and as a JSON array on databases without array types.
+type StringArray []string
+
+func (StringArray) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "postgres" {
+		return "text[]"
+	}
+	return "text"
+}
+
+func (a StringArray) GormValue(ctx context.Context, db *gorm.DB) clause.Expr {
+	if db.Dialector.Name() == "postgres" {
+		value, err := pq.StringArray(a).Value()
+		if err != nil {
+			db.AddError(err)
+		}
+		return clause.Expr{SQL: "?", Vars: []interface{}{value}}
+	}
+
+	value, err := a.Value()
+	if err != nil {
+		db.AddError(err)
+	}
+	return clause.Expr{SQL: "?", Vars: []interface{}{value}}
+}
+
+// Value encodes the array as JSON. GORM uses GormValue instead, which
+// picks the encoding for the connected database.
+func (a StringArray) Value() (driver.Value, error) {
+	if a == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(a))
+	return string(data), err
+}
+
+// Scan accepts both the JSON and the Postgres array encodings.
+func (a *StringArray) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into StringArray", src)
+	}
+
+	if len(data) > 0 && data[0] == '[' {
+		var values []string
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		*a = values
+		return nil
+	}
+
+	var values pq.StringArray
+	if err := values.Scan(data); err != nil {
+		return err
+	}
+	*a = StringArray(values)
+	return nil
+}
@@ -2,22 +2,109 @@ package models
 
 import (
 	"gorm.io/gorm"
+	"time"
 )
 
 type User struct {
 	gorm.Model
-	Username string `gorm:"uniqueIndex;not null"`
+	// Usernames and emails are unique within a realm.
+	Realm    string `gorm:"uniqueIndex:idx_users_realm_username;uniqueIndex:idx_users_realm_email;not null;default:default" json:"-"`
+	Username string `gorm:"uniqueIndex:idx_users_realm_username;not null"`
 	Password string `gorm:"not null"`
-	Email    string `gorm:"uniqueIndex;not null"`
+	Email    string `gorm:"uniqueIndex:idx_users_realm_email;not null"`
+	// PasswordHistory holds the hashes of the user's previous passwords,
+	// newest first, separated by spaces.
+	PasswordHistory string `json:"-"`
+
+	EmailVerified bool `gorm:"not null;default:false"`
+	// VerificationSentAt is when the latest verification email was sent.
+	// Only the link in that email is valid.
+	VerificationSentAt *time.Time
+
+	// TOTPSecret is encrypted with the keyring. It is set on enrollment
+	// but only checked at login once TOTPEnabled confirms the enrollment.
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `gorm:"not null;default:false"`
+	// TOTPLastStep is the time step of the last accepted code; codes from
+	// that step or earlier are rejected so none can be replayed.
+	TOTPLastStep int64 `gorm:"not null;default:0"`
+	// RecoveryCodes holds the keyed hashes of the unused recovery codes,
+	// separated by spaces.
+	RecoveryCodes string `json:"-"`
+
+	// Source is where the user's password and profile are kept: empty for
+	// local users, SourceLDAP for directory users, whose record here is a
+	// copy refreshed at every login and sync.
+	Source string `gorm:"not null;default:''"`
+	// Roles are the user's roles, separated by spaces. Directory users get
+	// them from their groups.
+	Roles string
+
+	// ExternalID is the user's ID in the system provisioning them over
+	// SCIM, such as the HR system.
+	ExternalID string `gorm:"not null;default:''"`
+	// Disabled users can't sign in, and their codes and refresh tokens are
+	// refused.
+	Disabled bool `gorm:"not null;default:false"`
 }
 
+// SourceLDAP marks users who sign in against the LDAP directory.
+const SourceLDAP = "ldap"
+
 type UserLogin struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
 
+type MFALogin struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	// Code is a TOTP code or a recovery code.
+	Code string `json:"code" validate:"required"`
+}
+
+// LoginCodeRequest asks for a one-time code standing in for a login token
+// in a URL.
+type LoginCodeRequest struct {
+	LoginToken string `json:"login_token" validate:"required"`
+}
+
+type TOTPConfirm struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type VerificationResend struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type PasswordForgot struct {
+	Email string `json:"email" form:"email" validate:"required,email"`
+}
+
+type PasswordReset struct {
+	Token    string `json:"token" form:"token" validate:"required"`
+	Password string `json:"password" form:"password" validate:"required"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
 type UserRegister struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 	Email    string `json:"email" validate:"required,email"`
-}
\ No newline at end of file
+}
+// UserImport is one user of a bulk import. PasswordHash was exported from
+// another system; see passwords.ImportHash for the accepted formats.
+type UserImport struct {
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	PasswordHash  string `json:"password_hash"`
+	EmailVerified bool   `json:"email_verified"`
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"encoding/json"
+	"gorm.io/gorm"
+	"time"
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user.
+type WebAuthnCredential struct {
+	gorm.Model
+	Realm  string `gorm:"uniqueIndex:idx_webauthn_credentials_realm_credential_id;not null;default:default"`
+	UserID uint   `gorm:"index;not null"`
+	// CredentialID is the authenticator's credential ID, base64url encoded.
+	CredentialID string `gorm:"uniqueIndex:idx_webauthn_credentials_realm_credential_id;not null"`
+	// Name is chosen by the user to tell their authenticators apart.
+	Name            string
+	PublicKey       []byte `gorm:"not null"`
+	AttestationType string
+	// AAGUID identifies the authenticator model; it is all zeros when the
+	// authenticator doesn't disclose it.
+	AAGUID string `gorm:"column:aaguid"`
+	// SignCount is the authenticator's signature counter. A counter that
+	// goes backwards suggests the authenticator was cloned.
+	SignCount uint32
+	// Transports lists how the browser can reach the authenticator (usb,
+	// nfc, ble, internal, hybrid), separated by spaces.
+	Transports     string
+	BackupEligible bool `gorm:"not null;default:false"`
+	BackupState    bool `gorm:"not null;default:false"`
+	LastUsedAt     *time.Time
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// WebAuthnChallenge starts a WebAuthn ceremony. Options go to
+// navigator.credentials.create() or .get(); Session is sent back with the
+// authenticator's response.
+type WebAuthnChallenge struct {
+	Options interface{} `json:"options"`
+	Session string      `json:"session"`
+}
+
+type WebAuthnRegistration struct {
+	Session string `json:"session" validate:"required"`
+	// Name labels the authenticator in the user's list.
+	Name string `json:"name"`
+	// Credential is the PublicKeyCredential from
+	// navigator.credentials.create(), serialized as JSON.
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type WebAuthnLogin struct {
+	// MFAToken is set when the authenticator is the second factor of a
+	// password login.
+	MFAToken string `json:"mfa_token,omitempty"`
+	Session  string `json:"session"`
+	// Credential is the PublicKeyCredential from
+	// navigator.credentials.get(), serialized as JSON.
+	Credential json.RawMessage `json:"credential"`
+}
+
+type WebAuthnCredentialRename struct {
+	Name string `json:"name" validate:"required"`
+}
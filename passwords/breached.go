@@ -0,0 +1,108 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedList tells whether a password is known from a data breach. Only
+// SHA-1 hashes are compared, as in the Pwned Passwords corpus.
+type BreachedList interface {
+	Contains(password string) (bool, error)
+}
+
+// OpenBreachedList opens the list at path: a directory of range files, one
+// per 5 character hash prefix named <PREFIX>.txt with lines of
+// SUFFIX:COUNT, or a file with one full hash per line, optionally followed
+// by :COUNT. Range files are read on demand, so the directory can hold the
+// whole corpus; a single file is loaded into memory.
+func OpenBreachedList(path string) (BreachedList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return rangeDirectory(path), nil
+	}
+	return loadHashFile(path)
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// parseHashLine splits a HASH[:COUNT] line. Entries with a count of 0 are
+// padding the API adds to hide the size of a range, not breached hashes.
+func parseHashLine(line string) (hash string, breached bool) {
+	hash, count, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.ToUpper(hash), count != "0"
+}
+
+// rangeDirectory looks each password up in the range file of its prefix.
+type rangeDirectory string
+
+func (d rangeDirectory) Contains(password string) (bool, error) {
+	hash := sha1Hex(password)
+	file, err := os.Open(filepath.Join(string(d), hash[:5]+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if suffix, breached := parseHashLine(scanner.Text()); suffix == hash[5:] {
+			return breached, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+type hashSet map[[sha1.Size]byte]struct{}
+
+func loadHashFile(path string) (hashSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := make(hashSet)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		hash, breached := parseHashLine(scanner.Text())
+		var key [sha1.Size]byte
+		if len(hash) != hex.EncodedLen(sha1.Size) {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		if _, err := hex.Decode(key[:], []byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		if breached {
+			set[key] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (s hashSet) Contains(password string) (bool, error) {
+	_, found := s[sha1.Sum([]byte(password))]
+	return found, nil
+}
@@ -0,0 +1,137 @@
+package passwords_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"oauth2-provider/passwords"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeRangeFiles writes range files as served by the Pwned Passwords range
+// API: the lines of each file hold the hash suffixes of one prefix.
+func writeRangeFiles(t *testing.T, ranges map[string][]string) string {
+	dir := t.TempDir()
+	for prefix, lines := range ranges {
+		if err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(strings.Join(lines, "\r\n")), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRangeDirectory(t *testing.T) {
+	breached := sha1Hex("password")
+	padding := sha1Hex("padding-only")
+	lowercase := sha1Hex("lowercase-suffix")
+	sibling := sha1Hex("other-password")
+	dir := writeRangeFiles(t, map[string][]string{
+		breached[:5]: {
+			"0018A45C4D1DEF81644B54AB7F969B88D65:1",
+			breached[5:] + ":9659365",
+		},
+		padding[:5]:   {padding[5:] + ":0"},
+		lowercase[:5]: {strings.ToLower(lowercase[5:]) + ":3"},
+		// A range whose file lists a hash sharing the prefix only
+		sibling[:5]: {strings.Repeat("0", 35) + ":4"},
+	})
+	list, err := passwords.OpenBreachedList(dir)
+	if err != nil {
+		t.Fatalf("OpenBreachedList: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{name: "listed", password: "password", want: true},
+		{name: "padding entry", password: "padding-only"},
+		{name: "lowercase suffix", password: "lowercase-suffix", want: true},
+		{name: "other suffix in the range", password: "other-password"},
+		{name: "no range file", password: "not-breached-at-all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := list.Contains(tt.password)
+			if err != nil {
+				t.Fatalf("Contains: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRangeDirectoryPrefixOnly checks that a lookup only reads the range
+// of the password's 5 character prefix, never a file naming the full
+// hash, so a range directory is all a deployment needs to hold.
+func TestRangeDirectoryPrefixOnly(t *testing.T) {
+	hash := sha1Hex("password")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, hash+".txt"), []byte(hash[5:]+":1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, hash[:6]+".txt"), []byte(hash[6:]+":1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := passwords.OpenBreachedList(dir)
+	if err != nil {
+		t.Fatalf("OpenBreachedList: %v", err)
+	}
+	if got, err := list.Contains("password"); err != nil || got {
+		t.Errorf("Contains = %v, %v; want false without a %s.txt range", got, err, hash[:5])
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		password string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "bare hash", contents: sha1Hex("password") + "\n", password: "password", want: true},
+		{name: "hash with count", contents: sha1Hex("password") + ":42\n", password: "password", want: true},
+		{name: "lowercase hash", contents: strings.ToLower(sha1Hex("password")) + "\n", password: "password", want: true},
+		{name: "zero count", contents: sha1Hex("password") + ":0\n", password: "password"},
+		{name: "blank lines", contents: "\n" + sha1Hex("a") + "\n\n" + sha1Hex("password") + "\n", password: "password", want: true},
+		{name: "not listed", contents: sha1Hex("a") + "\n", password: "password"},
+		{name: "truncated hash", contents: sha1Hex("password")[:39] + "\n", wantErr: true},
+		{name: "not hex", contents: strings.Repeat("Z", 40) + "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hashes.txt")
+			if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			list, err := passwords.OpenBreachedList(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("OpenBreachedList accepted a malformed file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenBreachedList: %v", err)
+			}
+			got, err := list.Contains(tt.password)
+			if err != nil {
+				t.Fatalf("Contains: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
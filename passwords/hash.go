@@ -0,0 +1,174 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"oauth2-provider/config"
+	"strconv"
+	"strings"
+)
+
+// verifier checks passwords against hashes in one format.
+type verifier interface {
+	// Verify reports whether password matches encoded. It fails if
+	// encoded is malformed.
+	Verify(password, encoded string) (bool, error)
+	// Valid reports whether encoded is a well-formed hash, without the
+	// cost of verifying a password.
+	Valid(encoded string) bool
+}
+
+// hasher hashes passwords with one algorithm and the configured
+// parameters. Hashes are encoded in the PHC string format,
+// $<id>[$v=<version>][$<param>=<value>,...]$<salt>$<hash>, except bcrypt,
+// which keeps its own $2a$ format.
+type hasher interface {
+	verifier
+	Hash(password string) (string, error)
+	// Outdated reports whether encoded was made with other parameters
+	// than Hash uses.
+	Outdated(encoded string) bool
+}
+
+// hashers builds the hasher of each algorithm from the configuration.
+var hashers = map[string]func(cfg config.PasswordHashingConfig) hasher{
+	config.HashArgon2id: newArgon2id,
+	config.HashScrypt:   newScrypt,
+	config.HashBcrypt:   newBcrypt,
+	config.HashPBKDF2:   newPBKDF2,
+}
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// Hash hashes password with the configured algorithm.
+func Hash(password string) (string, error) {
+	cfg := config.Get().PasswordHashing
+	return hashers[cfg.Algorithm](cfg).Hash(password)
+}
+
+// Verify reports whether password matches encoded, which may have been
+// made by any supported algorithm or imported in a legacy format. rehash
+// is set when the password matches but encoded uses another algorithm or
+// other parameters than configured, so it should be replaced with a fresh
+// Hash of password.
+func Verify(password, encoded string) (ok, rehash bool) {
+	cfg := config.Get().PasswordHashing
+	algorithm := identify(encoded)
+	if legacy, found := legacyFormats[algorithm]; found {
+		ok, err := legacy.Verify(password, encoded)
+		return err == nil && ok, err == nil && ok
+	}
+	newHasher, found := hashers[algorithm]
+	if !found {
+		return false, false
+	}
+	hasher := newHasher(cfg)
+	ok, err := hasher.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, false
+	}
+	return true, algorithm != cfg.Algorithm || hasher.Outdated(encoded)
+}
+
+// Valid reports whether encoded is a hash Verify can check.
+func Valid(encoded string) bool {
+	algorithm := identify(encoded)
+	if legacy, found := legacyFormats[algorithm]; found {
+		return legacy.Valid(encoded)
+	}
+	if newHasher, found := hashers[algorithm]; found {
+		return newHasher(config.Get().PasswordHashing).Valid(encoded)
+	}
+	return false
+}
+
+// identify returns the hasher or legacy format encoded was made with, or
+// "" if it is not a supported hash.
+func identify(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"), strings.HasPrefix(encoded, "$argon2i$"):
+		return config.HashArgon2id
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		return config.HashScrypt
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return config.HashBcrypt
+	case strings.HasPrefix(encoded, "$pbkdf2-"):
+		return config.HashPBKDF2
+	case strings.HasPrefix(encoded, "$5$"), strings.HasPrefix(encoded, "$6$"):
+		return "sha-crypt"
+	case strings.HasPrefix(encoded, "{"):
+		return "ldap"
+	}
+	return ""
+}
+
+// phcHash is a decoded PHC string.
+type phcHash struct {
+	id      string
+	version string
+	params  map[string]string
+	salt    []byte
+	hash    []byte
+}
+
+func parsePHC(encoded string) (*phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 4 || fields[0] != "" {
+		return nil, errMalformedHash
+	}
+	h := &phcHash{id: fields[1], params: make(map[string]string)}
+	fields = fields[2:]
+	if strings.HasPrefix(fields[0], "v=") {
+		h.version = strings.TrimPrefix(fields[0], "v=")
+		fields = fields[1:]
+	}
+	if len(fields) == 3 {
+		for _, param := range strings.Split(fields[0], ",") {
+			name, value, found := strings.Cut(param, "=")
+			if !found {
+				return nil, errMalformedHash
+			}
+			h.params[name] = value
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return nil, errMalformedHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(fields[0]); err != nil {
+		return nil, errMalformedHash
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(fields[1]); err != nil || len(h.hash) == 0 {
+		return nil, errMalformedHash
+	}
+	return h, nil
+}
+
+// intParam returns the named parameter, which must be a positive integer.
+func (h *phcHash) intParam(name string) (int, error) {
+	n, err := strconv.Atoi(h.params[name])
+	if err != nil || n < 1 {
+		return 0, errMalformedHash
+	}
+	return n, nil
+}
+
+// encodePHC formats a PHC string; params are name=value pairs in the
+// algorithm's order.
+func encodePHC(id, version, params string, salt, hash []byte) string {
+	encoded := "$" + id
+	if version != "" {
+		encoded += "$v=" + version
+	}
+	return encoded + "$" + params +
+		"$" + base64.RawStdEncoding.EncodeToString(salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(hash)
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
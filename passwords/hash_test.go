@@ -0,0 +1,226 @@
+package passwords_test
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"oauth2-provider/config"
+	"oauth2-provider/passwords"
+	"strings"
+	"testing"
+)
+
+// useHashing configures password hashing for the duration of the test.
+func useHashing(t *testing.T, hashing config.PasswordHashingConfig) {
+	cfg := config.Default()
+	cfg.PasswordHashing = hashing
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(config.Default()) })
+}
+
+// cheapHashing returns parameters that keep the tests fast, with
+// algorithm selected.
+func cheapHashing(algorithm string) config.PasswordHashingConfig {
+	return config.PasswordHashingConfig{
+		Algorithm: algorithm,
+		Argon2id:  config.Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1},
+		Scrypt:    config.ScryptConfig{LogN: 4, R: 8, P: 1},
+		Bcrypt:    config.BcryptConfig{Cost: 4},
+		PBKDF2:    config.PBKDF2Config{Iterations: 1000},
+	}
+}
+
+// TestVerifyReferenceHashes checks hashes made by other implementations,
+// as users imported from elsewhere bring them.
+func TestVerifyReferenceHashes(t *testing.T) {
+	useHashing(t, cheapHashing(config.HashArgon2id))
+	sha := sha1.Sum([]byte("password"))
+	tests := []struct {
+		name     string
+		encoded  string
+		password string
+	}{
+		// The examples of the Argon2 reference implementation
+		{name: "argon2id", password: "password", encoded: "$argon2id$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo/8GaUw434IimaPqxwCo"},
+		{name: "argon2i", password: "password", encoded: "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"},
+		// Python's hashlib
+		{name: "scrypt", password: "password", encoded: "$scrypt$ln=10,r=8,p=1$TmFDbC1zYWx0LTEyMzQ1Ng$6v4H3IIH+2EQRZqTKKuraIqCn5MCIy6RvJ89fXKsYUs"},
+		{name: "pbkdf2-sha1", password: "password", encoded: "$pbkdf2-sha1$i=1000$TmFDbC1zYWx0LTEyMzQ1Ng$8t9Fy3y/Cvcf5v+HiLzkNyCHPFqusKrUZgcZhvGU9Ns"},
+		{name: "pbkdf2-sha256", password: "password", encoded: "$pbkdf2-sha256$i=1000$TmFDbC1zYWx0LTEyMzQ1Ng$dQGv7WOjaTPPULkdMe9wO0CXeiHZzJ/m1xQNq3L+5Vg"},
+		{name: "pbkdf2-sha512", password: "password", encoded: "$pbkdf2-sha512$i=1000$TmFDbC1zYWx0LTEyMzQ1Ng$N4mLXo+dadCO9HdJMKH4cYw2najcrLezwB+M1QEz+Is"},
+		// The OpenBSD bcrypt test vectors
+		{name: "bcrypt", password: "U*U", encoded: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{name: "ldap sha", password: "password", encoded: "{SHA}" + base64.StdEncoding.EncodeToString(sha[:])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !passwords.Valid(tt.encoded) {
+				t.Errorf("Valid(%q) = false", tt.encoded)
+			}
+			// None of these match the configured parameters
+			if ok, rehash := passwords.Verify(tt.password, tt.encoded); !ok || !rehash {
+				t.Errorf("Verify = %v, %v; want true, true", ok, rehash)
+			}
+			if ok, rehash := passwords.Verify(tt.password+"x", tt.encoded); ok || rehash {
+				t.Errorf("Verify with a wrong password = %v, %v; want false, false", ok, rehash)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{algorithm: config.HashArgon2id, prefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+		{algorithm: config.HashScrypt, prefix: "$scrypt$ln=4,r=8,p=1$"},
+		{algorithm: config.HashBcrypt, prefix: "$2a$04$"},
+		{algorithm: config.HashPBKDF2, prefix: "$pbkdf2-sha256$i=1000$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			useHashing(t, cheapHashing(tt.algorithm))
+			encoded, err := passwords.Hash("Correct-Horse-9")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if !strings.HasPrefix(encoded, tt.prefix) || !passwords.Valid(encoded) {
+				t.Errorf("Hash = %q, want a valid hash starting with %q", encoded, tt.prefix)
+			}
+			if again, _ := passwords.Hash("Correct-Horse-9"); again == encoded {
+				t.Error("two hashes of the same password are equal; the salt isn't random")
+			}
+			if ok, rehash := passwords.Verify("Correct-Horse-9", encoded); !ok || rehash {
+				t.Errorf("Verify = %v, %v; want true, false", ok, rehash)
+			}
+			if ok, _ := passwords.Verify("correct-horse-9", encoded); ok {
+				t.Error("Verify accepted a wrong password")
+			}
+		})
+	}
+}
+
+// TestRehash checks that Verify asks for a new hash whenever the stored
+// one was made with another algorithm or other parameters than
+// configured, so hashes are upgraded transparently at login.
+func TestRehash(t *testing.T) {
+	hashWith := func(t *testing.T, hashing config.PasswordHashingConfig) string {
+		useHashing(t, hashing)
+		encoded, err := passwords.Hash("Correct-Horse-9")
+		if err != nil {
+			t.Fatalf("Hash: %v", err)
+		}
+		return encoded
+	}
+
+	tests := []struct {
+		name       string
+		hashedWith func(cfg *config.PasswordHashingConfig)
+		configured func(cfg *config.PasswordHashingConfig)
+		wantRehash bool
+	}{
+		{name: "same argon2id parameters"},
+		{name: "argon2id memory raised", configured: func(cfg *config.PasswordHashingConfig) { cfg.Argon2id.Memory = 128 }, wantRehash: true},
+		{name: "argon2id iterations raised", configured: func(cfg *config.PasswordHashingConfig) { cfg.Argon2id.Iterations = 2 }, wantRehash: true},
+		{name: "argon2id parallelism changed", configured: func(cfg *config.PasswordHashingConfig) { cfg.Argon2id.Parallelism = 2 }, wantRehash: true},
+		{name: "argon2id lowered", hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Argon2id.Iterations = 2 }, wantRehash: true},
+		{
+			name:       "scrypt cost raised",
+			hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashScrypt },
+			configured: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm, cfg.Scrypt.LogN = config.HashScrypt, 5 },
+			wantRehash: true,
+		},
+		{
+			name:       "same scrypt parameters",
+			hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashScrypt },
+			configured: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashScrypt },
+		},
+		{
+			name:       "bcrypt cost raised",
+			hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashBcrypt },
+			configured: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm, cfg.Bcrypt.Cost = config.HashBcrypt, 5 },
+			wantRehash: true,
+		},
+		{
+			name:       "pbkdf2 iterations raised",
+			hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashPBKDF2 },
+			configured: func(cfg *config.PasswordHashingConfig) {
+				cfg.Algorithm, cfg.PBKDF2.Iterations = config.HashPBKDF2, 2000
+			},
+			wantRehash: true,
+		},
+		{name: "bcrypt to argon2id", hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashBcrypt }, wantRehash: true},
+		{name: "pbkdf2 to argon2id", hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashPBKDF2 }, wantRehash: true},
+		{name: "argon2id to scrypt", configured: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashScrypt }, wantRehash: true},
+		// Parameters of algorithms other than the stored one don't matter
+		{name: "other algorithm's parameters", configured: func(cfg *config.PasswordHashingConfig) { cfg.Bcrypt.Cost = 12 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashedWith := cheapHashing(config.HashArgon2id)
+			if tt.hashedWith != nil {
+				tt.hashedWith(&hashedWith)
+			}
+			encoded := hashWith(t, hashedWith)
+
+			configured := cheapHashing(config.HashArgon2id)
+			if tt.configured != nil {
+				tt.configured(&configured)
+			}
+			useHashing(t, configured)
+			ok, rehash := passwords.Verify("Correct-Horse-9", encoded)
+			if !ok || rehash != tt.wantRehash {
+				t.Errorf("Verify = %v, %v; want true, %v", ok, rehash, tt.wantRehash)
+			}
+			// Only a matching password may trigger a rehash
+			if ok, rehash := passwords.Verify("wrong", encoded); ok || rehash {
+				t.Errorf("Verify with a wrong password = %v, %v; want false, false", ok, rehash)
+			}
+		})
+	}
+}
+
+func TestMalformedHashes(t *testing.T) {
+	useHashing(t, cheapHashing(config.HashArgon2id))
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{name: "empty", encoded: ""},
+		{name: "plaintext", encoded: "password"},
+		{name: "unknown algorithm", encoded: "$md5$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 version 16", encoded: "$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 without version", encoded: "$argon2id$m=64,t=1,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 missing parameter", encoded: "$argon2id$v=19$m=64,t=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 zero parameter", encoded: "$argon2id$v=19$m=64,t=0,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 too many lanes", encoded: "$argon2id$v=19$m=64,t=1,p=256$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 parameter without value", encoded: "$argon2id$v=19$m=64,t,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "salt not base64", encoded: "$argon2id$v=19$m=64,t=1,p=1$c29t*XNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "padded base64", encoded: "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ=$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "no hash", encoded: "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$"},
+		{name: "no salt field", encoded: "$argon2id$v=19$m=64,t=1,p=1$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "scrypt cost too high", encoded: "$scrypt$ln=32,r=8,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		// Costs over the limits in config would tie up the server
+		{name: "argon2 memory over the limit", encoded: "$argon2id$v=19$m=1048577,t=1,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "argon2 iterations over the limit", encoded: "$argon2id$v=19$m=64,t=65,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "scrypt memory over the limit", encoded: "$scrypt$ln=20,r=9,p=1$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "scrypt parallelism over the limit", encoded: "$scrypt$ln=4,r=8,p=17$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "pbkdf2 iterations over the limit", encoded: "$pbkdf2-sha256$i=5000001$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "bcrypt cost over the limit", encoded: "$2a$17$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{name: "sha-crypt rounds over the limit", encoded: "$5$rounds=5000001$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{name: "pbkdf2 unknown digest", encoded: "$pbkdf2-md5$i=1000$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo"},
+		{name: "bcrypt truncated", encoded: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvy"},
+		{name: "ldap unknown scheme", encoded: "{MD5}X03MO1qnZdYdgyfeuILPmQ=="},
+		{name: "ldap unsalted with extra bytes", encoded: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9gA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if passwords.Valid(tt.encoded) {
+				t.Errorf("Valid(%q) = true", tt.encoded)
+			}
+			if ok, rehash := passwords.Verify("password", tt.encoded); ok || rehash {
+				t.Errorf("Verify = %v, %v; want false, false", ok, rehash)
+			}
+		})
+	}
+}
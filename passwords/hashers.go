@@ -0,0 +1,243 @@
+package passwords
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"oauth2-provider/config"
+	"strconv"
+)
+
+// keyLength is the length of the derived keys of new hashes. Verifying
+// uses the length of the stored key.
+const keyLength = 32
+
+// argon2idHasher encodes as $argon2id$v=19$m=<KiB>,t=<iterations>,p=<lanes>.
+// It also verifies imported argon2i hashes.
+type argon2idHasher struct {
+	cfg config.Argon2idConfig
+}
+
+func newArgon2id(cfg config.PasswordHashingConfig) hasher {
+	return &argon2idHasher{cfg: cfg.Argon2id}
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, uint32(h.cfg.Iterations), uint32(h.cfg.Memory), uint8(h.cfg.Parallelism), keyLength)
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", h.cfg.Memory, h.cfg.Iterations, h.cfg.Parallelism)
+	return encodePHC("argon2id", strconv.Itoa(argon2.Version), params, salt, key), nil
+}
+
+func (h *argon2idHasher) Verify(password, encoded string) (bool, error) {
+	phc, memory, iterations, parallelism, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey
+	if phc.id == "argon2i" {
+		key = argon2.Key
+	}
+	derived := key([]byte(password), phc.salt, uint32(iterations), uint32(memory), uint8(parallelism), uint32(len(phc.hash)))
+	return subtle.ConstantTimeCompare(derived, phc.hash) == 1, nil
+}
+
+func (h *argon2idHasher) Valid(encoded string) bool {
+	_, _, _, _, err := h.parse(encoded)
+	return err == nil
+}
+
+func (h *argon2idHasher) Outdated(encoded string) bool {
+	phc, memory, iterations, parallelism, err := h.parse(encoded)
+	return err != nil || phc.id != "argon2id" ||
+		memory != h.cfg.Memory || iterations != h.cfg.Iterations || parallelism != h.cfg.Parallelism
+}
+
+func (h *argon2idHasher) parse(encoded string) (phc *phcHash, memory, iterations, parallelism int, err error) {
+	phc, err = parsePHC(encoded)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if (phc.id != "argon2id" && phc.id != "argon2i") || phc.version != strconv.Itoa(argon2.Version) {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	if memory, err = phc.intParam("m"); err != nil || memory > config.MaxArgon2idMemory {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	if iterations, err = phc.intParam("t"); err != nil || iterations > config.MaxArgon2idIterations {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	if parallelism, err = phc.intParam("p"); err != nil || parallelism > 255 {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	return phc, memory, iterations, parallelism, nil
+}
+
+// scryptHasher encodes as $scrypt$ln=<log2 N>,r=<block size>,p=<parallelism>.
+type scryptHasher struct {
+	cfg config.ScryptConfig
+}
+
+func newScrypt(cfg config.PasswordHashingConfig) hasher {
+	return &scryptHasher{cfg: cfg.Scrypt}
+}
+
+func (h *scryptHasher) Hash(password string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.cfg.LogN, h.cfg.R, h.cfg.P, keyLength)
+	if err != nil {
+		return "", err
+	}
+	params := fmt.Sprintf("ln=%d,r=%d,p=%d", h.cfg.LogN, h.cfg.R, h.cfg.P)
+	return encodePHC("scrypt", "", params, salt, key), nil
+}
+
+func (h *scryptHasher) Verify(password, encoded string) (bool, error) {
+	phc, logN, r, p, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key([]byte(password), phc.salt, 1<<logN, r, p, len(phc.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, phc.hash) == 1, nil
+}
+
+func (h *scryptHasher) Valid(encoded string) bool {
+	_, _, _, _, err := h.parse(encoded)
+	return err == nil
+}
+
+func (h *scryptHasher) Outdated(encoded string) bool {
+	_, logN, r, p, err := h.parse(encoded)
+	return err != nil || logN != h.cfg.LogN || r != h.cfg.R || p != h.cfg.P
+}
+
+func (h *scryptHasher) parse(encoded string) (phc *phcHash, logN, r, p int, err error) {
+	phc, err = parsePHC(encoded)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if phc.id != "scrypt" {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	if logN, err = phc.intParam("ln"); err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if r, err = phc.intParam("r"); err != nil || !config.ScryptMemoryAllowed(logN, r) {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	if p, err = phc.intParam("p"); err != nil || p > config.MaxScryptP {
+		return nil, 0, 0, 0, errMalformedHash
+	}
+	return phc, logN, r, p, nil
+}
+
+// bcryptHasher keeps bcrypt's own $2a$<cost>$ format, which is what the
+// server stored before hashing was configurable.
+type bcryptHasher struct {
+	cfg config.BcryptConfig
+}
+
+func newBcrypt(cfg config.PasswordHashingConfig) hasher {
+	return &bcryptHasher{cfg: cfg.Bcrypt}
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cfg.Cost)
+	return string(hash), err
+}
+
+func (h *bcryptHasher) Verify(password, encoded string) (bool, error) {
+	if cost, err := bcrypt.Cost([]byte(encoded)); err != nil || cost > config.MaxBcryptCost {
+		return false, errMalformedHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) Valid(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost <= config.MaxBcryptCost && len(encoded) == 60
+}
+
+func (h *bcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cfg.Cost
+}
+
+// pbkdf2Digests are the HMAC digests PBKDF2 hashes may use, by PHC id.
+// New hashes use SHA-256; the others are accepted for imported hashes.
+var pbkdf2Digests = map[string]func() hash.Hash{
+	"pbkdf2-sha1":   sha1.New,
+	"pbkdf2-sha256": sha256.New,
+	"pbkdf2-sha512": sha512.New,
+}
+
+// pbkdf2Hasher encodes as $pbkdf2-<digest>$i=<iterations>.
+type pbkdf2Hasher struct {
+	cfg config.PBKDF2Config
+}
+
+func newPBKDF2(cfg config.PasswordHashingConfig) hasher {
+	return &pbkdf2Hasher{cfg: cfg.PBKDF2}
+}
+
+func (h *pbkdf2Hasher) Hash(password string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, h.cfg.Iterations, keyLength, sha256.New)
+	return encodePHC("pbkdf2-sha256", "", fmt.Sprintf("i=%d", h.cfg.Iterations), salt, key), nil
+}
+
+func (h *pbkdf2Hasher) Verify(password, encoded string) (bool, error) {
+	phc, iterations, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := pbkdf2.Key([]byte(password), phc.salt, iterations, len(phc.hash), pbkdf2Digests[phc.id])
+	return subtle.ConstantTimeCompare(key, phc.hash) == 1, nil
+}
+
+func (h *pbkdf2Hasher) Valid(encoded string) bool {
+	_, _, err := h.parse(encoded)
+	return err == nil
+}
+
+func (h *pbkdf2Hasher) Outdated(encoded string) bool {
+	phc, iterations, err := h.parse(encoded)
+	return err != nil || phc.id != "pbkdf2-sha256" || iterations != h.cfg.Iterations
+}
+
+func (h *pbkdf2Hasher) parse(encoded string) (phc *phcHash, iterations int, err error) {
+	phc, err = parsePHC(encoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, found := pbkdf2Digests[phc.id]; !found {
+		return nil, 0, errMalformedHash
+	}
+	if iterations, err = phc.intParam("i"); err != nil || iterations > config.MaxPBKDF2Iterations {
+		return nil, 0, errMalformedHash
+	}
+	return phc, iterations, nil
+}
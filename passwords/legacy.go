@@ -0,0 +1,247 @@
+package passwords
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Formats in which imported hashes are accepted but never made: users
+// with such a hash get a current one at their next login.
+var legacyFormats = map[string]verifier{
+	"ldap":      ldapSHA{},
+	"sha-crypt": shaCrypt{},
+}
+
+// ldapDigests are the schemes of RFC 2307 style {SHA} hashes, salted or
+// not, by scheme name.
+var ldapDigests = map[string]struct {
+	new    func() hash.Hash
+	salted bool
+}{
+	"SHA":     {sha1.New, false},
+	"SSHA":    {sha1.New, true},
+	"SHA256":  {sha256.New, false},
+	"SSHA256": {sha256.New, true},
+	"SHA512":  {sha512.New, false},
+	"SSHA512": {sha512.New, true},
+}
+
+// ldapSHA verifies {SCHEME}base64(digest || salt) hashes, as stored by
+// OpenLDAP and many directory exports.
+type ldapSHA struct{}
+
+func (ldapSHA) parse(encoded string) (newHash func() hash.Hash, digest, salt []byte, err error) {
+	scheme, payload, found := strings.Cut(strings.TrimPrefix(encoded, "{"), "}")
+	digests, known := ldapDigests[strings.ToUpper(scheme)]
+	if !strings.HasPrefix(encoded, "{") || !found || !known {
+		return nil, nil, nil, errMalformedHash
+	}
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	size := digests.new().Size()
+	if err != nil || len(raw) < size || (!digests.salted && len(raw) != size) {
+		return nil, nil, nil, errMalformedHash
+	}
+	return digests.new, raw[:size], raw[size:], nil
+}
+
+func (h ldapSHA) Verify(password, encoded string) (bool, error) {
+	newHash, digest, salt, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	d := newHash()
+	d.Write([]byte(password))
+	d.Write(salt)
+	return subtle.ConstantTimeCompare(d.Sum(nil), digest) == 1, nil
+}
+
+func (h ldapSHA) Valid(encoded string) bool {
+	_, _, _, err := h.parse(encoded)
+	return err == nil
+}
+
+// shaCrypt verifies the SHA-256 ($5$) and SHA-512 ($6$) crypt(3) formats
+// used by glibc, following https://www.akkadia.org/drepper/SHA-crypt.txt.
+type shaCrypt struct{}
+
+const (
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shaCryptDefaultRounds = 5000
+	// shaCryptMaxRounds is far below the 999999999 crypt(3) allows, which
+	// would take minutes to verify. Hashes with more rounds are rejected.
+	shaCryptMaxRounds = 5000000
+)
+
+// shaCryptOrders lists, for each digest size, the order in which digest
+// bytes are encoded, three at a time.
+var shaCryptOrders = map[int][]int{
+	sha256.Size: {0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14, 15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29, 31, 30},
+	sha512.Size: {0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4, 47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51, 31, 52, 10,
+		53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35, 15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19, 62, 20, 41, 63},
+}
+
+func (shaCrypt) parse(encoded string) (newHash func() hash.Hash, salt string, rounds int, digest string, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$5$"):
+		newHash = sha256.New
+	case strings.HasPrefix(encoded, "$6$"):
+		newHash = sha512.New
+	default:
+		return nil, "", 0, "", errMalformedHash
+	}
+	fields := strings.Split(encoded[3:], "$")
+	rounds = shaCryptDefaultRounds
+	if strings.HasPrefix(fields[0], "rounds=") {
+		rounds, err = strconv.Atoi(strings.TrimPrefix(fields[0], "rounds="))
+		if err != nil || rounds > shaCryptMaxRounds {
+			return nil, "", 0, "", errMalformedHash
+		}
+		// Too few rounds are raised to the minimum, as crypt(3) does
+		rounds = max(rounds, 1000)
+		fields = fields[1:]
+	}
+	if len(fields) != 2 || len(fields[1]) != (newHash().Size()*8+5)/6 {
+		return nil, "", 0, "", errMalformedHash
+	}
+	salt = fields[0]
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	return newHash, salt, rounds, fields[1], nil
+}
+
+func (h shaCrypt) Verify(password, encoded string) (bool, error) {
+	newHash, salt, rounds, digest, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	computed := shaCryptEncode(shaCryptDigest(newHash, []byte(password), []byte(salt), rounds))
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(digest)) == 1, nil
+}
+
+func (h shaCrypt) Valid(encoded string) bool {
+	_, _, _, _, err := h.parse(encoded)
+	return err == nil
+}
+
+func shaCryptDigest(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	sum := func(parts ...[]byte) []byte {
+		d := newHash()
+		for _, part := range parts {
+			d.Write(part)
+		}
+		return d.Sum(nil)
+	}
+	size := newHash().Size()
+
+	b := sum(password, salt, password)
+	a := newHash()
+	a.Write(password)
+	a.Write(salt)
+	for n := len(password); n > 0; n -= size {
+		a.Write(b[:min(n, size)])
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(password)
+		}
+	}
+	digest := a.Sum(nil)
+
+	dp := sum(bytes.Repeat(password, len(password)))
+	p := repeatTo(dp, len(password))
+	ds := sum(bytes.Repeat(salt, 16+int(digest[0])))
+	s := repeatTo(ds, len(salt))
+
+	for i := 0; i < rounds; i++ {
+		c := newHash()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(p)
+		}
+		digest = c.Sum(nil)
+	}
+	return digest
+}
+
+// repeatTo repeats b up to length n.
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+func shaCryptEncode(digest []byte) string {
+	order := shaCryptOrders[len(digest)]
+	var out strings.Builder
+	for i := 0; i < len(order); i += 3 {
+		var w, chars int
+		switch len(order) - i {
+		case 1:
+			w, chars = int(digest[order[i]]), 2
+		case 2:
+			w, chars = int(digest[order[i]])<<8|int(digest[order[i+1]]), 3
+		default:
+			w, chars = int(digest[order[i]])<<16|int(digest[order[i+1]])<<8|int(digest[order[i+2]]), 4
+		}
+		for ; chars > 0; chars-- {
+			out.WriteByte(shaCryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return out.String()
+}
+
+var ErrUnsupportedHash = errors.New("unsupported or malformed password hash")
+
+// ImportHash checks a hash exported from another system and returns it in
+// the form Verify expects. Django's pbkdf2_<digest>, argon2 and bcrypt
+// hashes are converted; other supported formats are returned as they are.
+func ImportHash(encoded string) (string, error) {
+	encoded = strings.TrimSpace(encoded)
+	switch {
+	case strings.HasPrefix(encoded, "pbkdf2_"):
+		fields := strings.Split(encoded, "$")
+		if len(fields) != 4 {
+			return "", ErrUnsupportedHash
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return "", ErrUnsupportedHash
+		}
+		params := "i=" + fields[1]
+		encoded = encodePHC(strings.Replace(fields[0], "_", "-", 1), "", params, []byte(fields[2]), key)
+	case strings.HasPrefix(encoded, "argon2$argon2"):
+		encoded = strings.TrimPrefix(encoded, "argon2")
+	case strings.HasPrefix(encoded, "bcrypt$$2"):
+		encoded = strings.TrimPrefix(encoded, "bcrypt$")
+	}
+	if !Valid(encoded) {
+		return "", ErrUnsupportedHash
+	}
+	return encoded, nil
+}
@@ -0,0 +1,135 @@
+package passwords_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/passwords"
+	"testing"
+)
+
+// TestImportHash checks the formats accepted from other systems against
+// hashes made by them: each must be imported in a form Verify accepts
+// for the password it was made from.
+func TestImportHash(t *testing.T) {
+	useHashing(t, cheapHashing(config.HashArgon2id))
+	tests := []struct {
+		name     string
+		imported string
+		password string
+		want     string
+	}{
+		// Django, with keys computed by Python's hashlib
+		{
+			name:     "django pbkdf2_sha256",
+			imported: "pbkdf2_sha256$1000$pepper$RbCTL9FiwCX50tTpYlPMZDE/K82SzkqN6mE7lILcfpc=",
+			password: "password",
+			want:     "$pbkdf2-sha256$i=1000$cGVwcGVy$RbCTL9FiwCX50tTpYlPMZDE/K82SzkqN6mE7lILcfpc",
+		},
+		{
+			name:     "django pbkdf2_sha1",
+			imported: "pbkdf2_sha1$1000$pepper$yfvJZD2RWOmM8C9cubupWdCWCV8=",
+			password: "password",
+			want:     "$pbkdf2-sha1$i=1000$cGVwcGVy$yfvJZD2RWOmM8C9cubupWdCWCV8",
+		},
+		{
+			name:     "django argon2",
+			imported: "argon2$argon2id$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo/8GaUw434IimaPqxwCo",
+			password: "password",
+			want:     "$argon2id$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo/8GaUw434IimaPqxwCo",
+		},
+		{
+			name:     "django bcrypt",
+			imported: "bcrypt$$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+			password: "U*U",
+			want:     "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		},
+		// Formats Verify takes as they are
+		{
+			name:     "phc",
+			imported: "$argon2id$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo/8GaUw434IimaPqxwCo",
+			password: "password",
+		},
+		{name: "bcrypt", imported: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", password: "U*U"},
+		{name: "ldap ssha", imported: "{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0", password: "password"},
+		{name: "ldap scheme in lowercase", imported: "{ssha}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0", password: "password"},
+		{
+			name:     "ldap ssha512",
+			imported: "{SSHA512}o9FQwV8amk4H05j62UVoRg47BEVwtjK/Z+J9OiMaBOSTGq2ho772vZTQiAHODGhP7UUHBYZ99vB/oKOVxCVgcTEyMzQ1Njc4",
+			password: "password",
+		},
+		// The examples of https://www.akkadia.org/drepper/SHA-crypt.txt
+		{name: "sha256-crypt", imported: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", password: "Hello world!"},
+		{
+			name:     "sha512-crypt",
+			imported: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			password: "Hello world!",
+		},
+		{
+			name:     "sha-crypt with rounds and a long salt",
+			imported: "$5$rounds=10000$saltstringsaltstring$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+			password: "Hello world!",
+		},
+		{
+			name:     "sha-crypt with too few rounds",
+			imported: "$5$rounds=10$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC",
+			password: "the minimum number is still observed",
+		},
+		{
+			name:     "surrounding whitespace",
+			imported: " {SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0\n",
+			password: "password",
+			want:     "{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == "" {
+				want = tt.imported
+			}
+			got, err := passwords.ImportHash(tt.imported)
+			if err != nil {
+				t.Fatalf("ImportHash: %v", err)
+			}
+			if got != want {
+				t.Errorf("ImportHash = %q, want %q", got, want)
+			}
+			if ok, _ := passwords.Verify(tt.password, got); !ok {
+				t.Errorf("Verify(%q, %q) = false", tt.password, got)
+			}
+			if ok, _ := passwords.Verify("wrong", got); ok {
+				t.Errorf("Verify(%q, %q) = true", "wrong", got)
+			}
+		})
+	}
+}
+
+func TestImportHashUnsupported(t *testing.T) {
+	tests := []struct {
+		name     string
+		imported string
+	}{
+		{name: "empty", imported: ""},
+		{name: "plain text", imported: "password"},
+		{name: "md5-crypt", imported: "$1$saltstri$YMyguxXMBpd2TEZ.vS/3q1"},
+		{name: "django bcrypt_sha256", imported: "bcrypt_sha256$$2b$12$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{name: "django pbkdf2 missing a field", imported: "pbkdf2_sha256$1000$RbCTL9FiwCX50tTpYlPMZDE/K82SzkqN6mE7lILcfpc="},
+		{name: "django pbkdf2 key not base64", imported: "pbkdf2_sha256$1000$pepper$not*base64"},
+		{name: "django pbkdf2 unknown digest", imported: "pbkdf2_md5$1000$pepper$X03MO1qnZdYdgyfeuILPmQ=="},
+		{name: "ldap unknown scheme", imported: "{MD5}X03MO1qnZdYdgyfeuILPmQ=="},
+		{name: "ldap digest too short", imported: "{SSHA}yI6cZwQadOA1e+/f"},
+		{name: "sha-crypt digest truncated", imported: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc"},
+		{name: "sha-crypt rounds not a number", imported: "$5$rounds=many$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{name: "sha-crypt most rounds crypt(3) allows", imported: "$5$rounds=999999999$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{name: "django pbkdf2 too many iterations", imported: "pbkdf2_sha256$100000000$pepper$RbCTL9FiwCX50tTpYlPMZDE/K82SzkqN6mE7lILcfpc="},
+		{name: "django argon2 too much memory", imported: "argon2$argon2id$v=19$m=4194304,t=2,p=4$c29tZXNhbHQ$GpZ3sK/oH9p7VIiV56G/64Zo/8GaUw434IimaPqxwCo"},
+		{name: "bcrypt maximum cost", imported: "$2a$31$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := passwords.ImportHash(tt.imported); !errors.Is(err, passwords.ErrUnsupportedHash) {
+				t.Errorf("ImportHash(%q) = %q, %v; want ErrUnsupportedHash", tt.imported, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Package passwords decides which passwords users may choose.
+//
+// A Policy checks length, character classes and similarity to the user's
+// own username and email address, and looks the password up in a locally
+// stored list of breached passwords. Nothing is sent over the network.
+package passwords
+
+import (
+	"fmt"
+	"oauth2-provider/config"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PolicyError lists every rule a password breaks, so the user can fix them
+// all at once.
+type PolicyError struct {
+	Problems []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password " + strings.Join(e.Problems, "; ")
+}
+
+type Policy struct {
+	cfg      config.PasswordPolicyConfig
+	breached BreachedList
+}
+
+// NewPolicy returns the policy described by cfg, opening its breached
+// password list.
+func NewPolicy(cfg config.PasswordPolicyConfig) (*Policy, error) {
+	policy := &Policy{cfg: cfg}
+	if cfg.BreachedPasswords != "" {
+		breached, err := OpenBreachedList(cfg.BreachedPasswords)
+		if err != nil {
+			return nil, fmt.Errorf("breached passwords: %v", err)
+		}
+		policy.breached = breached
+	}
+	return policy, nil
+}
+
+// Check returns a *PolicyError if password breaks the policy. userInfo is
+// the username and email address of the user choosing it. Other errors
+// mean the breached password list couldn't be read.
+func (p *Policy) Check(password string, userInfo ...string) error {
+	var problems []string
+	length := utf8.RuneCountInString(password)
+	if length < p.cfg.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.cfg.MinLength))
+	}
+	if length > p.cfg.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d characters long", p.cfg.MaxLength))
+	}
+	if characterClasses(password) < p.cfg.MinCharacterClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.cfg.MinCharacterClasses))
+	}
+	if p.cfg.RejectUserInfo && resemblesUserInfo(password, userInfo) {
+		problems = append(problems, "must not contain your username or email address")
+	}
+	if len(problems) > 0 {
+		return &PolicyError{Problems: problems}
+	}
+
+	if p.breached != nil {
+		breached, err := p.breached.Contains(password)
+		if err != nil {
+			return fmt.Errorf("checking breached passwords: %v", err)
+		}
+		if breached {
+			return &PolicyError{Problems: []string{"has appeared in a data breach; choose another"}}
+		}
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// resemblesUserInfo reports whether the password contains the username,
+// the email address or its local part, ignoring case, or is contained in
+// one of them. Values shorter than 3 characters are too common to count.
+func resemblesUserInfo(password string, userInfo []string) bool {
+	if password == "" {
+		return false
+	}
+	password = strings.ToLower(password)
+	var values []string
+	for _, value := range userInfo {
+		value = strings.ToLower(value)
+		values = append(values, value)
+		if local, _, found := strings.Cut(value, "@"); found {
+			values = append(values, local)
+		}
+	}
+	for _, value := range values {
+		if utf8.RuneCountInString(value) < 3 {
+			continue
+		}
+		if strings.Contains(password, value) || strings.Contains(value, password) {
+			return true
+		}
+	}
+	return false
+}
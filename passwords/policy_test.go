@@ -0,0 +1,118 @@
+package passwords_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/passwords"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	const (
+		tooShort = "must be at least 8 characters long"
+		tooLong  = "must be at most 16 characters long"
+		tooPlain = "must mix at least 3 of lowercase letters, uppercase letters, digits and symbols"
+		userInfo = "must not contain your username or email address"
+		breached = "has appeared in a data breach; choose another"
+	)
+	dir := t.TempDir()
+	list := filepath.Join(dir, "breached.txt")
+	if err := os.WriteFile(list, []byte(sha1Hex("Breached-Pass-1")+":12\n"+sha1Hex("Abc-1")+":3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := passwords.NewPolicy(config.PasswordPolicyConfig{
+		MinLength:           8,
+		MaxLength:           16,
+		MinCharacterClasses: 3,
+		RejectUserInfo:      true,
+		BreachedPasswords:   list,
+	})
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{name: "acceptable", password: "Correct-Horse-9"},
+		{name: "minimum length", password: "Abcdef-1"},
+		{name: "too short", password: "Abc-12", want: []string{tooShort}},
+		{name: "too long", password: "Correct-Horse-Battery", want: []string{tooLong}},
+		{name: "length counts characters", password: "Äöüßäöü1"},
+		{name: "two classes", password: "correcthorse9", want: []string{tooPlain}},
+		{name: "symbols count as a class", password: "correct horse9"},
+		{name: "unicode letters", password: "ÉCOLE-école"},
+		{name: "contains the username", password: "Alice-Rocks-1", want: []string{userInfo}},
+		{name: "contains the username in another case", password: "xALICEx-99", want: []string{userInfo}},
+		{name: "contains the local part", password: "Wonder.Land-7a", want: []string{userInfo}},
+		{name: "contained in the email address", password: "nd@Example.co", want: []string{userInfo}},
+		{name: "every problem at once", password: "alice", want: []string{tooShort, tooPlain, userInfo}},
+		{name: "breached", password: "Breached-Pass-1", want: []string{breached}},
+		// The breached list is only consulted for otherwise acceptable
+		// passwords
+		{name: "breached and too short", password: "Abc-1", want: []string{tooShort}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.password, "alice", "wonder.land@example.com")
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Check(%q) = %v, want nil", tt.password, err)
+				}
+				return
+			}
+			var policyErr *passwords.PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Check(%q) = %v, want a *PolicyError", tt.password, err)
+			}
+			if !reflect.DeepEqual(policyErr.Problems, tt.want) {
+				t.Errorf("problems = %q, want %q", policyErr.Problems, tt.want)
+			}
+			if want := "password " + strings.Join(tt.want, "; "); err.Error() != want {
+				t.Errorf("Error() = %q, want %q", err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestPolicyUserInfo(t *testing.T) {
+	tests := []struct {
+		name           string
+		rejectUserInfo bool
+		userInfo       []string
+		password       string
+		wantRejected   bool
+	}{
+		{name: "rule disabled", password: "Alice-Rocks-1", userInfo: []string{"alice"}},
+		{name: "username", rejectUserInfo: true, password: "Alice-Rocks-1", userInfo: []string{"alice"}, wantRejected: true},
+		{name: "short usernames ignored", rejectUserInfo: true, password: "Al-Rocks-1", userInfo: []string{"al"}},
+		{name: "short local part ignored", rejectUserInfo: true, password: "Jo-Rocks-1", userInfo: []string{"jo@example.com"}},
+		{name: "whole email address", rejectUserInfo: true, password: "jo@example.com", userInfo: []string{"jo@example.com"}, wantRejected: true},
+		{name: "no user info", rejectUserInfo: true, password: "Alice-Rocks-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := passwords.NewPolicy(config.PasswordPolicyConfig{MinLength: 1, MaxLength: 64, RejectUserInfo: tt.rejectUserInfo})
+			if err != nil {
+				t.Fatalf("NewPolicy: %v", err)
+			}
+			err = policy.Check(tt.password, tt.userInfo...)
+			if rejected := err != nil; rejected != tt.wantRejected {
+				t.Errorf("Check(%q, %q) = %v, want rejected %v", tt.password, tt.userInfo, err, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func TestNewPolicyMissingList(t *testing.T) {
+	_, err := passwords.NewPolicy(config.PasswordPolicyConfig{BreachedPasswords: filepath.Join(t.TempDir(), "missing")})
+	if err == nil {
+		t.Error("NewPolicy accepted a breached password list that doesn't exist")
+	}
+}
@@ -0,0 +1,167 @@
+// Package realms resolves the isolated tenants the server hosts. Each realm
+// has its own issuer, signing key, users, clients, scopes and token policy;
+// storage is scoped with storage.Store.ForRealm.
+package realms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/utils"
+	"strings"
+)
+
+type Realm struct {
+	Name   string
+	Issuer string
+	// Scopes lists the scopes clients may request; empty allows any.
+	Scopes             []string
+	Tokens             config.TokenConfig
+	ClientRegistration bool
+	// RequireEmailVerification blocks login until the user's email is
+	// verified.
+	RequireEmailVerification bool
+	SigningKey               *utils.SigningKey
+	// SAMLKey signs SAML assertions; the realm is a SAML identity provider
+	// only when it is set.
+	SAMLKey *utils.SAMLKey
+}
+
+// AllowsScope reports whether every scope in the space-separated list is
+// supported by the realm.
+func (r *Realm) AllowsScope(scope string) bool {
+	if len(r.Scopes) == 0 {
+		return true
+	}
+	for _, requested := range strings.Fields(scope) {
+		supported := false
+		for _, s := range r.Scopes {
+			if s == requested {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry holds every configured realm.
+type Registry struct {
+	defaultRealm *Realm
+	byName       map[string]*Realm
+	byHost       map[string]*Realm
+}
+
+// NewRegistry builds the realms described by a validated configuration:
+// the default realm from the top-level settings plus cfg.Realms.
+func NewRegistry(cfg *config.Config) (*Registry, error) {
+	defaultRealm, err := newRealm(cfg, config.RealmConfig{
+		Name:       models.DefaultRealm,
+		Issuer:     cfg.Issuer,
+		Scopes:     cfg.Scopes,
+		JWTSecret:  cfg.Keys.JWTSecret,
+		SigningKey: cfg.Keys.SigningKey,
+
+		SAMLCertificate: cfg.Keys.SAMLCertificate,
+		SAMLKey:         cfg.Keys.SAMLKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Registry{
+		defaultRealm: defaultRealm,
+		byName:       map[string]*Realm{defaultRealm.Name: defaultRealm},
+		byHost:       make(map[string]*Realm),
+	}
+	for _, realmCfg := range cfg.Realms {
+		realm, err := newRealm(cfg, realmCfg)
+		if err != nil {
+			return nil, err
+		}
+		r.byName[realm.Name] = realm
+		for _, host := range realmCfg.Hosts {
+			r.byHost[strings.ToLower(host)] = realm
+		}
+	}
+	return r, nil
+}
+
+func newRealm(cfg *config.Config, realmCfg config.RealmConfig) (*Realm, error) {
+	realm := &Realm{
+		Name:               realmCfg.Name,
+		Issuer:             strings.TrimRight(realmCfg.Issuer, "/"),
+		Scopes:             realmCfg.Scopes,
+		Tokens:             realmCfg.Tokens.Apply(cfg.Tokens),
+		ClientRegistration: cfg.Features.ClientRegistration,
+
+		RequireEmailVerification: cfg.EmailVerification.Required,
+	}
+	if realm.Issuer == "" {
+		realm.Issuer = strings.TrimRight(cfg.Issuer, "/") + "/realms/" + realm.Name
+	}
+	if realmCfg.ClientRegistration != nil {
+		realm.ClientRegistration = *realmCfg.ClientRegistration
+	}
+	if realmCfg.RequireEmailVerification != nil {
+		realm.RequireEmailVerification = *realmCfg.RequireEmailVerification
+	}
+
+	switch {
+	case realmCfg.SigningKey != "":
+		key, err := utils.ParseSigningKey(realmCfg.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("realm %s: %v", realm.Name, err)
+		}
+		realm.SigningKey = key
+	case realmCfg.JWTSecret != "":
+		realm.SigningKey = utils.NewHMACKey([]byte(realmCfg.JWTSecret))
+	default:
+		realm.SigningKey = utils.NewHMACKey(deriveSecret(cfg.Keys.JWTSecret, realm.Name))
+	}
+
+	if realmCfg.SAMLCertificate != "" {
+		key, err := utils.ParseSAMLKey(realmCfg.SAMLCertificate, realmCfg.SAMLKey)
+		if err != nil {
+			return nil, fmt.Errorf("realm %s: %v", realm.Name, err)
+		}
+		realm.SAMLKey = key
+	}
+	return realm, nil
+}
+
+// deriveSecret gives a realm without its own secret one that is distinct
+// from every other realm's, so tokens never validate across realms.
+func deriveSecret(secret, realm string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("realm:" + realm))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (r *Registry) Default() *Realm {
+	return r.defaultRealm
+}
+
+// Get returns the named realm, or nil if there is none.
+func (r *Registry) Get(name string) *Realm {
+	return r.byName[name]
+}
+
+// ForHost returns the realm serving the host of a request, falling back to
+// the default realm.
+func (r *Registry) ForHost(host string) *Realm {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if realm, ok := r.byHost[strings.ToLower(host)]; ok {
+		return realm
+	}
+	return r.defaultRealm
+}
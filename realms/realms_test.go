@@ -0,0 +1,155 @@
+package realms
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"oauth2-provider/config"
+	"oauth2-provider/utils"
+	"testing"
+	"time"
+)
+
+// testConfig returns a configuration with the default realm at
+// https://auth.example.com, the realm acme served on its own hosts and the
+// realm beta under the default issuer.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	registration := false
+	cfg := config.Default()
+	cfg.Issuer = "https://auth.example.com/"
+	cfg.Keys.JWTSecret = "a-jwt-secret-of-at-least-32-characters"
+	cfg.Realms = []config.RealmConfig{
+		{
+			Name:       "acme",
+			Issuer:     "https://login.acme.example/",
+			Hosts:      []string{"login.acme.example", "SSO.Acme.Example"},
+			Scopes:     []string{"openid", "email"},
+			SigningKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+			Tokens:     config.RealmTokenConfig{AccessTokenExpiry: config.Duration(5 * time.Minute)},
+
+			ClientRegistration: &registration,
+		},
+		{Name: "beta"},
+	}
+	return cfg
+}
+
+func TestRegistry(t *testing.T) {
+	cfg := testConfig(t)
+	registry, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+
+	t.Run("realms", func(t *testing.T) {
+		tests := []struct {
+			name               string
+			wantIssuer         string
+			wantAlg            string
+			wantAccessTokenTTL time.Duration
+		}{
+			{name: "default", wantIssuer: "https://auth.example.com", wantAlg: "HS256", wantAccessTokenTTL: time.Hour},
+			{name: "acme", wantIssuer: "https://login.acme.example", wantAlg: "ES256", wantAccessTokenTTL: 5 * time.Minute},
+			{name: "beta", wantIssuer: "https://auth.example.com/realms/beta", wantAlg: "HS256", wantAccessTokenTTL: time.Hour},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				realm := registry.Get(tt.name)
+				if realm == nil {
+					t.Fatal("realm not found")
+				}
+				if realm.Issuer != tt.wantIssuer {
+					t.Errorf("issuer = %q, want %q", realm.Issuer, tt.wantIssuer)
+				}
+				if alg := realm.SigningKey.Method.Alg(); alg != tt.wantAlg {
+					t.Errorf("signing algorithm = %s, want %s", alg, tt.wantAlg)
+				}
+				if ttl := realm.Tokens.AccessTokenExpiry.Duration(); ttl != tt.wantAccessTokenTTL {
+					t.Errorf("access token expiry = %v, want %v", ttl, tt.wantAccessTokenTTL)
+				}
+				// Settings a realm doesn't override come from the top level
+				if realm.Tokens.RefreshTokenAbsoluteExpiry != cfg.Tokens.RefreshTokenAbsoluteExpiry {
+					t.Errorf("refresh token absolute expiry = %v, want the top-level %v", realm.Tokens.RefreshTokenAbsoluteExpiry, cfg.Tokens.RefreshTokenAbsoluteExpiry)
+				}
+			})
+		}
+		if registry.Default() != registry.Get("default") {
+			t.Error("Default isn't the realm named default")
+		}
+		if registry.Get("unknown") != nil {
+			t.Error("Get found an unknown realm")
+		}
+		if registry.Get("acme").ClientRegistration || !registry.Get("beta").ClientRegistration {
+			t.Error("client registration not overridden for acme only")
+		}
+	})
+
+	t.Run("by host", func(t *testing.T) {
+		tests := []struct {
+			host string
+			want string
+		}{
+			{host: "login.acme.example", want: "acme"},
+			{host: "login.acme.example:8443", want: "acme"},
+			{host: "sso.acme.example", want: "acme"},
+			{host: "LOGIN.ACME.EXAMPLE", want: "acme"},
+			{host: "auth.example.com", want: "default"},
+			{host: "beta", want: "default"},
+			{host: "", want: "default"},
+		}
+		for _, tt := range tests {
+			if got := registry.ForHost(tt.host); got.Name != tt.want {
+				t.Errorf("ForHost(%q) = %s, want %s", tt.host, got.Name, tt.want)
+			}
+		}
+	})
+
+	t.Run("derived secrets", func(t *testing.T) {
+		// A token of one realm must not validate in another
+		defaultKey, betaKey := registry.Default().SigningKey, registry.Get("beta").SigningKey
+		token, err := utils.GenerateJWT(defaultKey, "https://auth.example.com", 1, "openid", time.Minute)
+		if err != nil {
+			t.Fatalf("GenerateJWT: %v", err)
+		}
+		if _, err := utils.ValidateJWT(defaultKey, "https://auth.example.com", token); err != nil {
+			t.Fatalf("ValidateJWT in the issuing realm: %v", err)
+		}
+		if _, err := utils.ValidateJWT(betaKey, "https://auth.example.com", token); err == nil {
+			t.Error("a default realm token validated with the key of realm beta")
+		}
+	})
+}
+
+func TestDeriveSecret(t *testing.T) {
+	const secret = "a-jwt-secret-of-at-least-32-characters"
+	beta := deriveSecret(secret, "beta")
+
+	if !bytes.Equal(beta, deriveSecret(secret, "beta")) {
+		t.Error("deriveSecret isn't deterministic")
+	}
+	if len(beta) != 64 {
+		t.Errorf("derived secret is %d bytes, want 64", len(beta))
+	}
+	for name, other := range map[string][]byte{
+		"another realm":       deriveSecret(secret, "gamma"),
+		"another base secret": deriveSecret(secret+"!", "beta"),
+		"the base secret":     []byte(secret),
+	} {
+		if bytes.Equal(beta, other) {
+			t.Errorf("derived secret equals that of %s", name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"errors"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication method references (RFC 8176) recorded for a login.
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRHardwareKey = "hwk"
+	AMRMFA         = "mfa"
+	// AMRFederated marks a login at an upstream identity provider. RFC
+	// 8176 has no value for it.
+	AMRFederated = "fed"
+)
+
+// Authentication context classes, after the NIST 800-63 assurance levels:
+// one factor, or more than one.
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+const (
+	// loginTokenPurpose binds login tokens to the authorization endpoint.
+	loginTokenPurpose = "login"
+	// loginTokenTTL is how long a completed login may be used to authorize
+	// clients before the user has to sign in again.
+	loginTokenTTL = 5 * time.Minute
+
+	// One-time login codes are kept in the authorization code store under
+	// these client IDs instead of a client's. Client IDs are random, so no
+	// client has them.
+	//
+	// loginCodeClient marks the codes standing in for a login token in
+	// URLs, which end up in access logs and browser history.
+	loginCodeClient = "login"
+	// recentLoginClient marks the tokens that let a user change security
+	// settings shortly after signing in.
+	recentLoginClient = "recent-login"
+	// recentLoginTTL is how long after signing in security settings may be
+	// changed.
+	recentLoginTTL = 5 * time.Minute
+)
+
+var ErrInvalidLoginToken = errors.New("invalid or expired login token")
+
+// Authentication records who signed in, how and when.
+type Authentication struct {
+	UserID  uint
+	Methods []string
+	Time    time.Time
+}
+
+// ACR returns the authentication context class the methods add up to.
+func (a *Authentication) ACR() string {
+	return acrFor(a.Methods)
+}
+
+func acrFor(methods []string) string {
+	for _, method := range methods {
+		if method == AMRMFA {
+			return ACRMultiFactor
+		}
+	}
+	return ACRSingleFactor
+}
+
+// issueLoginToken hands a completed login to the authorization endpoint.
+// The token may be used more than once until it expires, so it is only
+// ever sent in request bodies and headers; URLs carry a code from
+// IssueLoginCode instead.
+func issueLoginToken(realm *realms.Realm, auth *Authentication) string {
+	return utils.SignToken(loginTokenPurpose, auth.Time.Add(loginTokenTTL),
+		realm.Name,
+		strconv.FormatUint(uint64(auth.UserID), 10),
+		strings.Join(auth.Methods, " "),
+		strconv.FormatInt(auth.Time.Unix(), 10),
+	)
+}
+
+// ParseLoginToken returns the login a token from Login or VerifyMFA
+// stands for.
+func ParseLoginToken(realm *realms.Realm, token string) (*Authentication, error) {
+	fields, err := utils.VerifySignedToken(loginTokenPurpose, token)
+	if err != nil || len(fields) != 4 || fields[0] != realm.Name {
+		return nil, ErrInvalidLoginToken
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidLoginToken
+	}
+	authTime, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidLoginToken
+	}
+	return &Authentication{
+		UserID:  uint(userID),
+		Methods: strings.Fields(fields[2]),
+		Time:    time.Unix(authTime, 0),
+	}, nil
+}
+
+// storeOneTimeLogin keeps auth in the authorization code store under a
+// new code, which the first redeemOneTimeLogin for the same client
+// consumes.
+func storeOneTimeLogin(store storage.Store, realm *realms.Realm, client string, auth *Authentication) (string, error) {
+	code := utils.GenerateRandomString(32)
+	authTime := auth.Time
+	err := store.ForRealm(realm.Name).StoreAuthCodeGrant(code, &models.AuthCode{
+		ClientID:    client,
+		UserID:      auth.UserID,
+		AuthMethods: strings.Join(auth.Methods, " "),
+		AuthTime:    &authTime,
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// redeemOneTimeLogin returns the login a code from storeOneTimeLogin
+// stands for, as long as it happened less than ttl ago.
+func redeemOneTimeLogin(store storage.Store, realm *realms.Realm, client, code string, ttl time.Duration) (*Authentication, error) {
+	if code == "" {
+		return nil, ErrInvalidLoginToken
+	}
+	authCode := store.ForRealm(realm.Name).GetAuthCode(code)
+	if authCode == nil || authCode.ClientID != client || authCode.AuthTime == nil || time.Since(*authCode.AuthTime) >= ttl {
+		return nil, ErrInvalidLoginToken
+	}
+	return &Authentication{
+		UserID:  authCode.UserID,
+		Methods: strings.Fields(authCode.AuthMethods),
+		Time:    *authCode.AuthTime,
+	}, nil
+}
+
+// IssueLoginCode exchanges a login token for a code that can be put in a
+// URL, such as the continue path of the login page. The code works once.
+func (s *UserService) IssueLoginCode(realm *realms.Realm, loginToken string) (string, error) {
+	auth, err := ParseLoginToken(realm, loginToken)
+	if err != nil {
+		return "", err
+	}
+	return storeOneTimeLogin(s.store, realm, loginCodeClient, auth)
+}
+
+// RedeemLoginCode returns the login a code from IssueLoginCode stands
+// for, and consumes the code.
+func (s *OAuthService) RedeemLoginCode(realm *realms.Realm, code string) (*Authentication, error) {
+	return redeemOneTimeLogin(s.store, realm, loginCodeClient, code, loginTokenTTL)
+}
+
+// RedeemLoginCode returns the login a code from IssueLoginCode stands
+// for, and consumes the code.
+func (s *SAMLService) RedeemLoginCode(realm *realms.Realm, code string) (*Authentication, error) {
+	return redeemOneTimeLogin(s.store, realm, loginCodeClient, code, loginTokenTTL)
+}
+
+// RedeemRecentLogin consumes a recent login token from a login response
+// and returns the login with the token to use next. Each token works
+// once, and none outlives recentLoginTTL after the login.
+func (s *UserService) RedeemRecentLogin(realm *realms.Realm, token string) (*Authentication, string, error) {
+	auth, err := redeemOneTimeLogin(s.store, realm, recentLoginClient, token, recentLoginTTL)
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := storeOneTimeLogin(s.store, realm, recentLoginClient, auth)
+	if err != nil {
+		return nil, "", err
+	}
+	return auth, next, nil
+}
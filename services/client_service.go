@@ -1,46 +1,137 @@
 package services
 
 import (
-	"github.com/lib/pq"
+	"errors"
+	"fmt"
 	"oauth2-provider/models"
+	"oauth2-provider/realms"
 	"oauth2-provider/storage"
+	"oauth2-provider/utils"
 	"log"
+	"time"
+)
+
+var (
+	ErrInvalidClientCredentials = errors.New("invalid client credentials")
+	ErrInvalidSecretOverlap     = errors.New("invalid overlap_seconds")
 )
 
 type ClientService struct {
-	store *storage.PostgresStorage
+	store storage.Store
 }
 
-func NewClientService(store *storage.PostgresStorage) *ClientService {
+func NewClientService(store storage.Store) *ClientService {
 	return &ClientService{store: store}
 }
 
-func (s *ClientService) RegisterClient(req *models.ClientRegistration) (*models.Client, error) {
+// RegisterClient creates a new client and returns it together with its
+// plaintext secret. The secret is not stored and can't be recovered later.
+func (s *ClientService) RegisterClient(realm *realms.Realm, req *models.ClientRegistration) (*models.Client, string, error) {
 	// Log the incoming request
 	log.Printf("Registering new client with RedirectURIs: %v", req.RedirectURIs)
 
-	// Convert []string to pq.StringArray explicitly
-	redirectURIs := make(pq.StringArray, len(req.RedirectURIs))
+	if req.AccessTokenTTL < 0 || req.RefreshTokenIdleTTL < 0 || req.RefreshTokenAbsoluteTTL < 0 {
+		return nil, "", errors.New("token lifetimes must not be negative")
+	}
+	if req.RefreshTokenIdleTTL > 0 && req.RefreshTokenAbsoluteTTL > 0 && req.RefreshTokenIdleTTL > req.RefreshTokenAbsoluteTTL {
+		return nil, "", errors.New("refresh token idle lifetime must not exceed its absolute lifetime")
+	}
+
+	redirectURIs := make(models.StringArray, len(req.RedirectURIs))
 	copy(redirectURIs, req.RedirectURIs)
 
+	secret := utils.GenerateRandomString(32)
 	client := &models.Client{
 		RedirectURIs: redirectURIs,
-		GrantTypes:   pq.StringArray{"authorization_code"},
+		GrantTypes:   models.StringArray{"authorization_code"},
+		SecretHash:   utils.HashSecret(secret),
+
+		AccessTokenTTL:          req.AccessTokenTTL,
+		RefreshTokenIdleTTL:     req.RefreshTokenIdleTTL,
+		RefreshTokenAbsoluteTTL: req.RefreshTokenAbsoluteTTL,
+		RotateRefreshTokens:     req.RotateRefreshTokens,
+		RequireOfflineAccess:    req.RequireOfflineAccess,
 	}
 
 	// Log the client data before storing
 	log.Printf("Client data before storing: RedirectURIs=%v, GrantTypes=%v", client.RedirectURIs, client.GrantTypes)
 
-	err := s.store.StoreClient(client)
+	err := s.store.ForRealm(realm.Name).StoreClient(client)
 	if err != nil {
 		log.Printf("Error storing client: %v", err)
-		return nil, err
+		return nil, "", err
 	}
 
 	log.Printf("Successfully registered client with ID: %s", client.ClientID)
+	return client, secret, nil
+}
+
+func (s *ClientService) GetClient(realm *realms.Realm, clientID string) *models.Client {
+	return s.store.ForRealm(realm.Name).GetClient(clientID)
+}
+
+func (s *ClientService) AuthenticateClient(realm *realms.Realm, clientID, secret string) (*models.Client, error) {
+	return authenticateClient(s.store.ForRealm(realm.Name), clientID, secret)
+}
+
+// RotateSecret issues a new secret for the client. The current secret stays
+// valid for the overlap window so deployments can switch over without
+// downtime; any secret kept from an earlier rotation is discarded. Only the
+// current secret can rotate: a leaked previous secret must not be able to
+// replace the secret the client moved on to.
+func (s *ClientService) RotateSecret(realm *realms.Realm, req *models.ClientSecretRotation) (string, *time.Time, error) {
+	client := s.store.ForRealm(realm.Name).GetClient(req.ClientID)
+	if client == nil || req.ClientSecret == "" || !utils.CheckSecretHash(req.ClientSecret, client.SecretHash) {
+		return "", nil, ErrInvalidClientCredentials
+	}
+
+	if req.OverlapSeconds < 0 {
+		return "", nil, fmt.Errorf("%w: must not be negative", ErrInvalidSecretOverlap)
+	}
+	overlap := realm.Tokens.ClientSecretRotationOverlap.Duration()
+	if req.OverlapSeconds > 0 {
+		maxOverlap := realm.Tokens.ClientSecretRotationMaxOverlap.Duration()
+		if time.Duration(req.OverlapSeconds)*time.Second > maxOverlap {
+			return "", nil, fmt.Errorf("%w: must not exceed %d", ErrInvalidSecretOverlap, int64(maxOverlap/time.Second))
+		}
+		overlap = time.Duration(req.OverlapSeconds) * time.Second
+	}
+
+	secret := utils.GenerateRandomString(32)
+	previousExpiresAt := time.Now().Add(overlap)
+
+	client.PreviousSecretHash = client.SecretHash
+	client.PreviousSecretExpiresAt = &previousExpiresAt
+	client.SecretHash = utils.HashSecret(secret)
+
+	if err := s.store.ForRealm(realm.Name).UpdateClient(client); err != nil {
+		log.Printf("Error rotating client secret: %v", err)
+		return "", nil, err
+	}
+
+	log.Printf("Rotated secret for client %s, previous secret valid until %s", client.ClientID, previousExpiresAt.Format(time.RFC3339))
+	return secret, &previousExpiresAt, nil
+}
+
+func authenticateClient(store storage.ClientRepository, clientID, secret string) (*models.Client, error) {
+	if clientID == "" || secret == "" {
+		return nil, ErrInvalidClientCredentials
+	}
+
+	client := store.GetClient(clientID)
+	if client == nil || !clientSecretMatches(client, secret, time.Now()) {
+		return nil, ErrInvalidClientCredentials
+	}
+
 	return client, nil
 }
 
-func (s *ClientService) GetClient(clientID string) *models.Client {
-	return s.store.GetClient(clientID)
-}
\ No newline at end of file
+func clientSecretMatches(client *models.Client, secret string, now time.Time) bool {
+	if utils.CheckSecretHash(secret, client.SecretHash) {
+		return true
+	}
+	if client.PreviousSecretExpiresAt != nil && now.Before(*client.PreviousSecretExpiresAt) {
+		return utils.CheckSecretHash(secret, client.PreviousSecretHash)
+	}
+	return false
+}
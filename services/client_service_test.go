@@ -0,0 +1,125 @@
+package services_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"testing"
+	"time"
+)
+
+func TestRotateSecret(t *testing.T) {
+	realm := &realms.Realm{Name: "default", Tokens: config.TokenConfig{
+		ClientSecretRotationOverlap:    config.Duration(time.Hour),
+		ClientSecretRotationMaxOverlap: config.Duration(24 * time.Hour),
+	}}
+
+	register := func(t *testing.T) (*services.ClientService, storage.Store, *models.Client, string) {
+		t.Helper()
+		memory := storage.NewMemoryStorage()
+		clientService := services.NewClientService(memory)
+		client, secret, err := clientService.RegisterClient(realm, &models.ClientRegistration{RedirectURIs: []string{"https://app.example.com/callback"}})
+		if err != nil {
+			t.Fatalf("RegisterClient: %v", err)
+		}
+		return clientService, memory.ForRealm(realm.Name), client, secret
+	}
+	rotate := func(clientService *services.ClientService, clientID, secret string, overlapSeconds int) (string, *time.Time, error) {
+		return clientService.RotateSecret(realm, &models.ClientSecretRotation{ClientID: clientID, ClientSecret: secret, OverlapSeconds: overlapSeconds})
+	}
+
+	t.Run("overlap", func(t *testing.T) {
+		tests := []struct {
+			name           string
+			overlapSeconds int
+			wantOverlap    time.Duration
+			wantErr        bool
+		}{
+			{name: "default", wantOverlap: time.Hour},
+			{name: "requested", overlapSeconds: 600, wantOverlap: 10 * time.Minute},
+			{name: "at the maximum", overlapSeconds: 24 * 3600, wantOverlap: 24 * time.Hour},
+			{name: "above the maximum", overlapSeconds: 24*3600 + 1, wantErr: true},
+			{name: "negative", overlapSeconds: -1, wantErr: true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				clientService, store, client, secret := register(t)
+
+				start := time.Now()
+				newSecret, previousExpiresAt, err := rotate(clientService, client.ClientID, secret, tt.overlapSeconds)
+				if tt.wantErr {
+					if !errors.Is(err, services.ErrInvalidSecretOverlap) {
+						t.Fatalf("RotateSecret error = %v, want ErrInvalidSecretOverlap", err)
+					}
+					if store.GetClient(client.ClientID).SecretHash != client.SecretHash {
+						t.Error("a rejected rotation replaced the secret")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("RotateSecret: %v", err)
+				}
+				if newSecret == "" || newSecret == secret {
+					t.Fatalf("new secret = %q, want a fresh secret", newSecret)
+				}
+				if got := previousExpiresAt.Sub(start); got < tt.wantOverlap || got > tt.wantOverlap+time.Minute {
+					t.Errorf("previous secret valid for %v, want %v", got, tt.wantOverlap)
+				}
+			})
+		}
+	})
+
+	t.Run("previous secret expires", func(t *testing.T) {
+		clientService, store, client, secret := register(t)
+		newSecret, _, err := rotate(clientService, client.ClientID, secret, 0)
+		if err != nil {
+			t.Fatalf("RotateSecret: %v", err)
+		}
+
+		for _, s := range []string{secret, newSecret} {
+			if _, err := clientService.AuthenticateClient(realm, client.ClientID, s); err != nil {
+				t.Errorf("AuthenticateClient within the overlap: %v", err)
+			}
+		}
+
+		rotated := store.GetClient(client.ClientID)
+		expired := time.Now().Add(-time.Second)
+		rotated.PreviousSecretExpiresAt = &expired
+		if err := store.UpdateClient(rotated); err != nil {
+			t.Fatalf("UpdateClient: %v", err)
+		}
+		if _, err := clientService.AuthenticateClient(realm, client.ClientID, secret); !errors.Is(err, services.ErrInvalidClientCredentials) {
+			t.Errorf("AuthenticateClient with the expired secret error = %v, want ErrInvalidClientCredentials", err)
+		}
+		if _, err := clientService.AuthenticateClient(realm, client.ClientID, newSecret); err != nil {
+			t.Errorf("AuthenticateClient with the new secret: %v", err)
+		}
+	})
+
+	t.Run("only the current secret rotates", func(t *testing.T) {
+		clientService, store, client, secret := register(t)
+		newSecret, _, err := rotate(clientService, client.ClientID, secret, 0)
+		if err != nil {
+			t.Fatalf("RotateSecret: %v", err)
+		}
+		current := store.GetClient(client.ClientID).SecretHash
+
+		// The previous secret still authenticates, but can't rotate
+		if _, _, err := rotate(clientService, client.ClientID, secret, 0); !errors.Is(err, services.ErrInvalidClientCredentials) {
+			t.Fatalf("RotateSecret with the previous secret error = %v, want ErrInvalidClientCredentials", err)
+		}
+		if store.GetClient(client.ClientID).SecretHash != current {
+			t.Error("the previous secret replaced the current one")
+		}
+
+		if _, _, err := rotate(clientService, client.ClientID, newSecret, 0); err != nil {
+			t.Errorf("RotateSecret with the current secret: %v", err)
+		}
+		if _, _, err := rotate(clientService, "unknown", newSecret, 0); !errors.Is(err, services.ErrInvalidClientCredentials) {
+			t.Errorf("RotateSecret for an unknown client error = %v, want ErrInvalidClientCredentials", err)
+		}
+	})
+}
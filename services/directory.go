@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/mail"
+	"oauth2-provider/config"
+	"oauth2-provider/directory"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/storage"
+	"strings"
+	"time"
+)
+
+const directorySyncLockName = "oauth2-provider:directory-sync"
+
+var (
+	// ErrDirectoryUnavailable is returned when a login needs the LDAP
+	// directory and it can't be reached.
+	ErrDirectoryUnavailable = errors.New("sign-in is temporarily unavailable; try again later")
+	// ErrPasswordManagedByDirectory is returned when a directory user
+	// tries to set a password here.
+	ErrPasswordManagedByDirectory = errors.New("your password is managed by your organization's directory")
+)
+
+// usesDirectory reports whether users of realm may sign in against the
+// LDAP directory.
+func (s *UserService) usesDirectory(realm *realms.Realm) bool {
+	return s.directory != nil && realm.Name == config.Get().LDAP.Realm
+}
+
+// directoryLogin checks the password of a directory user, or of a user
+// who doesn't exist yet, against the directory and returns the local copy
+// of the user, created or refreshed. It returns nil if the directory
+// doesn't know the user or the password is wrong.
+func (s *UserService) directoryLogin(realm *realms.Realm, username, password string) (*models.User, error) {
+	found, err := s.directory.Authenticate(username, password)
+	if err != nil {
+		log.Printf("Error checking directory credentials of %s: %v", username, err)
+		return nil, ErrDirectoryUnavailable
+	}
+	if found == nil {
+		return nil, nil
+	}
+	user, _, err := s.cacheDirectoryUser(realm, s.store.ForRealm(realm.Name), found)
+	return user, err
+}
+
+// cacheDirectoryUser creates or refreshes the local copy of a directory
+// user and reports whether anything changed. Email addresses can't change
+// once stored, so a changed address is only logged.
+func (s *UserService) cacheDirectoryUser(realm *realms.Realm, store storage.Store, found *directory.User) (*models.User, bool, error) {
+	roles := strings.Join(found.Roles, " ")
+	user := store.GetUserByUsername(found.Username)
+	if user == nil {
+		if address, err := mail.ParseAddress(found.Email); err != nil || address.Address != found.Email {
+			log.Printf("Error creating directory user %s: invalid email address %q", found.Username, found.Email)
+			return nil, false, errors.New("account could not be created")
+		}
+		if store.GetUserByEmail(found.Email) != nil {
+			log.Printf("Error creating directory user %s: email address already in use", found.Username)
+			return nil, false, errors.New("account could not be created")
+		}
+		// Directory users have no password here; the directory vouches
+		// for their address
+		user = &models.User{
+			Username:      found.Username,
+			Email:         found.Email,
+			EmailVerified: true,
+			Source:        models.SourceLDAP,
+			Roles:         roles,
+		}
+		if err := store.StoreUser(user); err != nil {
+			log.Printf("Error creating directory user %s: %v", found.Username, err)
+			return nil, false, errors.New("account could not be created")
+		}
+		audit(realm, AuditDirectoryProvisioned, "username", user.Username)
+		return user, true, nil
+	}
+
+	if user.Source != models.SourceLDAP {
+		log.Printf("Error refreshing directory user %s: a local user has the same username", found.Username)
+		return nil, false, errors.New("account could not be created")
+	}
+	if user.Email != found.Email {
+		log.Printf("Email address of directory user %s changed to %q; keeping %q", user.Username, found.Email, user.Email)
+	}
+	if user.Roles == roles {
+		return user, false, nil
+	}
+	audit(realm, AuditDirectoryRolesChanged, "username", user.Username, "from", user.Roles, "to", roles)
+	user.Roles = roles
+	if err := store.UpdateUser(user); err != nil {
+		return nil, false, err
+	}
+	return user, true, nil
+}
+
+// externalUsernameTaken reports whether username belongs to a user of the
+// legacy user store or the directory, who must not be preempted by a
+// local account.
+func (s *UserService) externalUsernameTaken(realm *realms.Realm, username string) (bool, error) {
+	if taken, err := s.legacyUsernameTaken(realm, username); err != nil || taken {
+		return taken, err
+	}
+	if !s.usesDirectory(realm) {
+		return false, nil
+	}
+	found, err := s.directory.Lookup(username)
+	if err != nil {
+		log.Printf("Error looking up directory user %s: %v", username, err)
+		return false, ErrDirectoryUnavailable
+	}
+	return found != nil, nil
+}
+
+// SyncDirectory refreshes the local copies of all directory users and
+// creates the missing ones. Users removed from the directory are kept, but
+// can no longer sign in.
+func (s *UserService) SyncDirectory(realm *realms.Realm) error {
+	if !s.usesDirectory(realm) {
+		return errors.New("realm has no directory")
+	}
+	found, err := s.directory.Users()
+	if err != nil {
+		return err
+	}
+	store := s.store.ForRealm(realm.Name)
+	changed, failed := 0, 0
+	for _, user := range found {
+		if _, updated, err := s.cacheDirectoryUser(realm, store, user); err != nil {
+			failed++
+		} else if updated {
+			changed++
+		}
+	}
+	log.Printf("Synced %d directory users of realm %s: %d created or updated, %d failed", len(found), realm.Name, changed, failed)
+	return nil
+}
+
+// RunDirectorySync syncs the directory once per interval until ctx is
+// cancelled. When the store is shared between replicas only the one
+// holding the lock syncs each round.
+func (s *UserService) RunDirectorySync(ctx context.Context, realm *realms.Realm, interval time.Duration) {
+	log.Printf("Directory sync started, syncing realm %s every %s", realm.Name, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Directory sync stopped")
+			return
+		case <-ticker.C:
+			s.syncDirectoryOnce(realm)
+		}
+	}
+}
+
+func (s *UserService) syncDirectoryOnce(realm *realms.Realm) {
+	if locker, ok := s.store.(storage.Locker); ok {
+		release, acquired, err := locker.TryLock(directorySyncLockName)
+		if err != nil {
+			log.Printf("Directory sync failed to take lock: %v", err)
+			return
+		}
+		if !acquired {
+			// Another replica is syncing
+			return
+		}
+		defer release()
+	}
+	if err := s.SyncDirectory(realm); err != nil {
+		log.Printf("Error syncing directory: %v", err)
+	}
+}
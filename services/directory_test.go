@@ -0,0 +1,103 @@
+package services_test
+
+import (
+	"oauth2-provider/config"
+	"oauth2-provider/directory"
+	"oauth2-provider/directory/directorytest"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"testing"
+	"time"
+)
+
+func TestSyncDirectory(t *testing.T) {
+	const (
+		aliceDN  = "uid=alice,ou=people,dc=example,dc=com"
+		adminsDN = "cn=admins,ou=groups,dc=example,dc=com"
+		devsDN   = "cn=devs,ou=groups,dc=example,dc=com"
+	)
+	server := directorytest.NewServer(t,
+		&directorytest.Entry{DN: "cn=service,dc=example,dc=com", Password: "service-secret"},
+		&directorytest.Entry{DN: aliceDN, Password: "alice-secret", Attributes: map[string][]string{
+			"uid": {"alice"}, "mail": {"alice@example.com"}, "memberOf": {adminsDN},
+		}},
+		&directorytest.Entry{DN: "uid=bob,ou=people,dc=example,dc=com", Attributes: map[string][]string{
+			"uid": {"bob"}, "mail": {"bob@example.com"}, "memberOf": {devsDN},
+		}},
+		// Clashes with a local user, so it must not be synced
+		&directorytest.Entry{DN: "uid=carol,ou=people,dc=example,dc=com", Attributes: map[string][]string{
+			"uid": {"carol"}, "mail": {"carol@example.com"},
+		}},
+		&directorytest.Entry{DN: "uid=dave,ou=people,dc=example,dc=com", Attributes: map[string][]string{
+			"uid": {"dave"}, "mail": {"not an address"},
+		}},
+	)
+	cfg := useTestConfig(t, func(cfg *config.Config) {
+		cfg.LDAP.URL = server.URL
+		cfg.LDAP.BindDN = "cn=service,dc=example,dc=com"
+		cfg.LDAP.BindPassword = "service-secret"
+		cfg.LDAP.BaseDN = "ou=people,dc=example,dc=com"
+		cfg.LDAP.Timeout = config.Duration(5 * time.Second)
+	})
+	dir, err := directory.New(cfg.LDAP)
+	if err != nil {
+		t.Fatalf("directory.New: %v", err)
+	}
+	realm := &realms.Realm{Name: cfg.LDAP.Realm}
+	memory := storage.NewMemoryStorage()
+	store := memory.ForRealm(realm.Name)
+	carol := &models.User{Username: "carol", Email: "carol@example.net", Password: "hash"}
+	if err := store.StoreUser(carol); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	userService := services.NewUserService(memory, nil, nil, nil, nil, nil, dir)
+
+	type want struct {
+		username string
+		roles    string
+	}
+	check := func(t *testing.T, wants []want) {
+		for _, w := range wants {
+			user := store.GetUserByUsername(w.username)
+			if user == nil {
+				t.Errorf("user %s not synced", w.username)
+				continue
+			}
+			if user.Source != models.SourceLDAP || !user.EmailVerified || user.Roles != w.roles {
+				t.Errorf("user %s = %+v, want a verified directory user with roles %q", w.username, user, w.roles)
+			}
+		}
+	}
+
+	if err := userService.SyncDirectory(realm); err != nil {
+		t.Fatalf("SyncDirectory: %v", err)
+	}
+	check(t, []want{{"alice", "admins"}, {"bob", "devs"}})
+	if got := store.GetUserByUsername("carol"); got == nil || got.Source == models.SourceLDAP || got.Email != carol.Email {
+		t.Errorf("local user carol = %+v, want it left alone", got)
+	}
+	if store.GetUserByUsername("dave") != nil {
+		t.Error("user with an invalid email address synced")
+	}
+
+	// Group changes in the directory reach the local copies
+	server.SetAttribute(aliceDN, "memberOf", adminsDN, devsDN)
+	if err := userService.SyncDirectory(realm); err != nil {
+		t.Fatalf("second SyncDirectory: %v", err)
+	}
+	check(t, []want{{"alice", "admins devs"}, {"bob", "devs"}})
+
+	// Directory users sign in with their directory password
+	result, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "alice-secret"}, "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if result.User.Username != "alice" || result.LoginToken == "" {
+		t.Errorf("Login = %+v, want a login of alice", result)
+	}
+	if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "wrong"}, ""); err == nil {
+		t.Error("Login with a wrong directory password succeeded")
+	}
+}
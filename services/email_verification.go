@@ -0,0 +1,92 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"oauth2-provider/config"
+	"oauth2-provider/mailer"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/utils"
+	"strconv"
+	"time"
+)
+
+// emailVerificationPurpose binds verification links to this flow.
+const emailVerificationPurpose = "email-verification"
+
+var ErrInvalidVerificationLink = errors.New("invalid or expired verification link")
+
+// sendVerification mails the user a link to verify their email address.
+// The link is signed over the realm, user, email and send time; recording
+// the send time on the user invalidates every earlier link, and verifying
+// invalidates this one.
+func (s *UserService) sendVerification(realm *realms.Realm, user *models.User) error {
+	sentAt := time.Now()
+	user.VerificationSentAt = &sentAt
+	if err := s.store.ForRealm(realm.Name).UpdateUser(user); err != nil {
+		return err
+	}
+
+	expiresAt := sentAt.Add(config.Get().EmailVerification.LinkExpiry.Duration())
+	token := utils.SignToken(emailVerificationPurpose, expiresAt,
+		realm.Name,
+		strconv.FormatUint(uint64(user.ID), 10),
+		user.Email,
+		strconv.FormatInt(sentAt.Unix(), 10),
+	)
+	link := realm.Issuer + "/verify-email?token=" + url.QueryEscape(token)
+
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\nThe link expires on %s. If you did not create an account, ignore this email.\n",
+			user.Username, link, expiresAt.UTC().Format(time.RFC1123)),
+	})
+}
+
+// ResendVerification sends a new verification link to the user registered
+// with email. Unknown and already verified addresses are ignored, as are
+// addresses a link was sent to less than the resend interval ago, so the
+// response doesn't reveal which addresses have accounts.
+func (s *UserService) ResendVerification(realm *realms.Realm, email string) error {
+	user := s.store.ForRealm(realm.Name).GetUserByEmail(email)
+	if user == nil || user.EmailVerified {
+		return nil
+	}
+
+	interval := config.Get().EmailVerification.ResendInterval.Duration()
+	if user.VerificationSentAt != nil && time.Since(*user.VerificationSentAt) < interval {
+		return nil
+	}
+
+	return s.sendVerification(realm, user)
+}
+
+// VerifyEmail marks the user a verification link was sent to as verified.
+func (s *UserService) VerifyEmail(realm *realms.Realm, token string) error {
+	fields, err := utils.VerifySignedToken(emailVerificationPurpose, token)
+	if err != nil || len(fields) != 4 || fields[0] != realm.Name {
+		return ErrInvalidVerificationLink
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return ErrInvalidVerificationLink
+	}
+
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(uint(userID))
+	if user == nil || user.EmailVerified || user.Email != fields[2] ||
+		user.VerificationSentAt == nil || strconv.FormatInt(user.VerificationSentAt.Unix(), 10) != fields[3] {
+		return ErrInvalidVerificationLink
+	}
+
+	user.EmailVerified = true
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+	log.Printf("Verified email of user %d in realm %s", user.ID, realm.Name)
+	return nil
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/mail"
+	"oauth2-provider/federation"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// upstreamLoginPurpose binds upstream login state to the callback.
+	upstreamLoginPurpose = "upstream-login"
+	// upstreamLoginTTL is how long the user has to sign in at the
+	// upstream provider.
+	upstreamLoginTTL = 10 * time.Minute
+)
+
+var (
+	ErrUnknownUpstream      = errors.New("unknown identity provider")
+	ErrInvalidUpstreamState = errors.New("invalid or expired upstream login; start again")
+	ErrUpstreamFailed       = errors.New("signing in with the identity provider failed")
+	// ErrUpstreamAccountConflict is returned when the provider's email
+	// address belongs to a local account that can't be linked safely.
+	ErrUpstreamAccountConflict = errors.New("an account with this email address already exists; sign in with your password")
+)
+
+// UpstreamLogin is a login started at an upstream provider.
+type UpstreamLogin struct {
+	// URL sends the user to the provider.
+	URL string
+	// State must be kept by the user agent, typically in a cookie, and
+	// handed to FinishUpstreamLogin along with the provider's response.
+	State string
+}
+
+// UpstreamProviders lists the providers users of the realm can sign in
+// with.
+func (s *UserService) UpstreamProviders(realm *realms.Realm) []*federation.Provider {
+	var providers []*federation.Provider
+	for _, provider := range s.upstream {
+		if provider.OfferedIn(realm.Name) {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+func (s *UserService) upstreamProvider(realm *realms.Realm, id string) *federation.Provider {
+	for _, provider := range s.UpstreamProviders(realm) {
+		if provider.ID() == id {
+			return provider
+		}
+	}
+	return nil
+}
+
+// UpstreamRedirectURI is where the provider sends users back to; it has to
+// be registered with the provider.
+func UpstreamRedirectURI(realm *realms.Realm, providerID string) string {
+	return realm.Issuer + "/login/upstream/" + providerID + "/callback"
+}
+
+// BeginUpstreamLogin starts signing in at an upstream provider. The state,
+// nonce and PKCE code verifier are kept in the returned state token,
+// together with continueTo, which FinishUpstreamLogin hands back.
+func (s *UserService) BeginUpstreamLogin(realm *realms.Realm, providerID, continueTo string) (*UpstreamLogin, error) {
+	provider := s.upstreamProvider(realm, providerID)
+	if provider == nil {
+		return nil, ErrUnknownUpstream
+	}
+	state := utils.GenerateRandomString(32)
+	nonce := utils.GenerateRandomString(32)
+	verifier := utils.GenerateRandomString(64)
+	authorizationURL, err := provider.AuthorizationURL(UpstreamRedirectURI(realm, providerID), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Error starting login with %s: %v", providerID, err)
+		return nil, ErrUpstreamFailed
+	}
+	token := utils.SignToken(upstreamLoginPurpose, time.Now().Add(upstreamLoginTTL),
+		realm.Name, providerID, state, nonce, verifier, continueTo)
+	return &UpstreamLogin{URL: authorizationURL, State: token}, nil
+}
+
+// FinishUpstreamLogin completes a login started by BeginUpstreamLogin with
+// the state and code the provider sent back. The user is found by their
+// link to the provider, linked by verified email address, or created. It
+// returns the continueTo given to BeginUpstreamLogin.
+func (s *UserService) FinishUpstreamLogin(realm *realms.Realm, providerID, stateToken, state, code string) (*LoginResult, string, error) {
+	fields, err := utils.VerifySignedToken(upstreamLoginPurpose, stateToken)
+	if err != nil || len(fields) != 6 || fields[0] != realm.Name || fields[1] != providerID ||
+		subtle.ConstantTimeCompare([]byte(fields[2]), []byte(state)) != 1 {
+		return nil, "", ErrInvalidUpstreamState
+	}
+	nonce, verifier, continueTo := fields[3], fields[4], fields[5]
+	provider := s.upstreamProvider(realm, providerID)
+	if provider == nil {
+		return nil, "", ErrUnknownUpstream
+	}
+
+	identity, err := provider.Exchange(code, UpstreamRedirectURI(realm, providerID), verifier, nonce)
+	if err != nil {
+		log.Printf("Error signing in with %s: %v", providerID, err)
+		return nil, "", ErrUpstreamFailed
+	}
+	user, err := s.upstreamUser(realm, provider, identity)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if user.Disabled {
+		return nil, "", ErrAccountDisabled
+	}
+	if realm.RequireEmailVerification && !user.EmailVerified {
+		return nil, "", ErrEmailNotVerified
+	}
+	methods, err := s.mfaMethods(realm, user)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(methods) > 0 {
+		return &LoginResult{User: user, MFAToken: issueMFAToken(realm, user, AMRFederated), MFAMethods: methods}, continueTo, nil
+	}
+	result, err := s.completeLogin(realm, user, AMRFederated)
+	return result, continueTo, err
+}
+
+// upstreamUser returns the user an upstream identity belongs to. An
+// identity seen before is linked already. Otherwise it is linked to the
+// account with the same email address, but only if both the provider and
+// the account have verified it: an unverified account could have been
+// registered by someone else to catch the owner's upstream login, and an
+// unverified upstream address could be anyone's. Failing that, a new user
+// is created.
+func (s *UserService) upstreamUser(realm *realms.Realm, provider *federation.Provider, identity *federation.Identity) (*models.User, error) {
+	store := s.store.ForRealm(realm.Name)
+	now := time.Now()
+
+	if link := store.GetFederatedIdentity(provider.ID(), identity.Subject); link != nil {
+		user := store.GetUser(link.UserID)
+		if user == nil {
+			log.Printf("Error signing in with %s: linked user %d not found", provider.ID(), link.UserID)
+			return nil, ErrUpstreamFailed
+		}
+		link.Email = identity.Email
+		link.LastLoginAt = &now
+		if err := store.UpdateFederatedIdentity(link); err != nil {
+			log.Printf("Error updating link of user %d to %s: %v", user.ID, provider.ID(), err)
+		}
+		return user, nil
+	}
+
+	if address, err := mail.ParseAddress(identity.Email); err != nil || address.Address != identity.Email {
+		log.Printf("Error signing in with %s: no usable email address for subject %s", provider.ID(), identity.Subject)
+		return nil, errors.New("the identity provider did not share a valid email address")
+	}
+	link := &models.FederatedIdentity{
+		Provider:    provider.ID(),
+		Subject:     identity.Subject,
+		Email:       identity.Email,
+		LastLoginAt: &now,
+	}
+
+	if user := store.GetUserByEmail(identity.Email); user != nil {
+		if !identity.EmailVerified || !user.EmailVerified {
+			return nil, ErrUpstreamAccountConflict
+		}
+		link.UserID = user.ID
+		if err := store.StoreFederatedIdentity(link); err != nil {
+			return nil, err
+		}
+		audit(realm, AuditUpstreamLinked, "username", user.Username, "provider", provider.ID())
+		return user, nil
+	}
+
+	username, err := s.upstreamUsername(realm, store, identity)
+	if err != nil {
+		return nil, err
+	}
+	// The user has no password until they set one with a reset link
+	user := &models.User{
+		Username:      username,
+		Email:         identity.Email,
+		EmailVerified: identity.EmailVerified,
+	}
+	if err := store.StoreUser(user); err != nil {
+		return nil, err
+	}
+	link.UserID = user.ID
+	if err := store.StoreFederatedIdentity(link); err != nil {
+		return nil, err
+	}
+	audit(realm, AuditUpstreamProvisioned, "username", user.Username, "provider", provider.ID())
+	return user, nil
+}
+
+// upstreamUsername picks a free username for a new user: the one the
+// provider suggested or the local part of their email address, with a
+// random suffix if it is taken, here, in the legacy user store or in the
+// directory.
+func (s *UserService) upstreamUsername(realm *realms.Realm, store storage.Store, identity *federation.Identity) (string, error) {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	username := base
+	for attempt := 0; attempt < 5; attempt++ {
+		taken := store.GetUserByUsername(username) != nil
+		if !taken {
+			var err error
+			if taken, err = s.externalUsernameTaken(realm, username); err != nil {
+				return "", err
+			}
+		}
+		if !taken {
+			return username, nil
+		}
+		username = base + "-" + strings.ToLower(utils.GenerateRandomString(6))
+	}
+	return "", errors.New("no free username found")
+}
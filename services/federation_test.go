@@ -0,0 +1,293 @@
+package services_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"oauth2-provider/config"
+	"oauth2-provider/federation"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	upstreamClientID     = "upstream-client"
+	upstreamClientSecret = "upstream-secret"
+)
+
+// fakeOIDCProvider is an OpenID provider that signs in whoever the test
+// tells it to. Codes are bound to the PKCE challenge and nonce of the
+// authorization request they answer.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]*upstreamGrant
+}
+
+type upstreamGrant struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	p := &fakeOIDCProvider{key: key, codes: make(map[string]*upstreamGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": "test-key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize plays the user signing in at the provider: it answers the
+// authorization request at authorizationURL with a code for claims,
+// returning the state and code the provider redirects back with.
+func (p *fakeOIDCProvider) authorize(t *testing.T, authorizationURL string, claims jwt.MapClaims) (state, code string) {
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatalf("authorization URL: %v", err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != upstreamClientID || query.Get("code_challenge_method") != "S256" ||
+		query.Get("code_challenge") == "" || query.Get("nonce") == "" {
+		t.Fatalf("incomplete authorization request %s", authorizationURL)
+	}
+	code = base64.RawURLEncoding.EncodeToString([]byte(time.Now().String() + query.Get("state")))
+	p.mu.Lock()
+	p.codes[code] = &upstreamGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	p.mu.Unlock()
+	return query.Get("state"), code
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(description string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": description})
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != upstreamClientID || secret != upstreamClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p.mu.Lock()
+	grant := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mu.Unlock()
+	if grant == nil {
+		fail("unknown code")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+		fail("code verifier does not match challenge")
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   upstreamClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": grant.nonce,
+	}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "upstream-access-token", "token_type": "Bearer", "id_token": idToken})
+}
+
+func TestFinishUpstreamLogin(t *testing.T) {
+	useTestConfig(t, nil)
+	provider := newFakeOIDCProvider(t)
+	realm := &realms.Realm{Name: "default", Issuer: "https://auth.example.com"}
+
+	newService := func() (*services.UserService, storage.Store) {
+		store := storage.NewMemoryStorage()
+		upstream := federation.NewProviders([]config.UpstreamProviderConfig{{
+			ID:           "corp",
+			Type:         config.UpstreamOIDC,
+			Issuer:       provider.URL,
+			ClientID:     upstreamClientID,
+			ClientSecret: upstreamClientSecret,
+		}})
+		return services.NewUserService(store, nil, nil, nil, nil, upstream, nil), store.ForRealm(realm.Name)
+	}
+	// signIn runs a whole upstream login as the user with claims.
+	signIn := func(t *testing.T, userService *services.UserService, claims jwt.MapClaims) (*services.LoginResult, error) {
+		login, err := userService.BeginUpstreamLogin(realm, "corp", "/continue")
+		if err != nil {
+			t.Fatalf("BeginUpstreamLogin: %v", err)
+		}
+		state, code := provider.authorize(t, login.URL, claims)
+		result, continueTo, err := userService.FinishUpstreamLogin(realm, "corp", login.State, state, code)
+		if err == nil && continueTo != "/continue" {
+			t.Errorf("continueTo = %q, want /continue", continueTo)
+		}
+		return result, err
+	}
+	addUser := func(t *testing.T, store storage.Store, email string, verified bool) *models.User {
+		user := &models.User{Username: "local", Email: email, EmailVerified: verified, Password: "x"}
+		if err := store.StoreUser(user); err != nil {
+			t.Fatalf("StoreUser: %v", err)
+		}
+		return user
+	}
+
+	t.Run("provisions new users", func(t *testing.T) {
+		userService, store := newService()
+		claims := jwt.MapClaims{"sub": "u-1", "email": "new@example.com", "email_verified": true, "preferred_username": "newbie"}
+		result, err := signIn(t, userService, claims)
+		if err != nil {
+			t.Fatalf("FinishUpstreamLogin: %v", err)
+		}
+		if result.LoginToken == "" || result.User.Username != "newbie" || !result.User.EmailVerified {
+			t.Fatalf("result = %+v, want a login of the verified user newbie", result)
+		}
+		link := store.GetFederatedIdentity("corp", "u-1")
+		if link == nil || link.UserID != result.User.ID {
+			t.Fatalf("link = %+v, want one to user %d", link, result.User.ID)
+		}
+
+		// The link identifies the user next time, even with another email
+		claims["email"] = "renamed@example.com"
+		again, err := signIn(t, userService, claims)
+		if err != nil {
+			t.Fatalf("second FinishUpstreamLogin: %v", err)
+		}
+		if again.User.ID != result.User.ID {
+			t.Errorf("second login signed in user %d, want %d", again.User.ID, result.User.ID)
+		}
+	})
+
+	linkTests := []struct {
+		name             string
+		localVerified    bool
+		upstreamVerified bool
+		wantLinked       bool
+	}{
+		{name: "both verified", localVerified: true, upstreamVerified: true, wantLinked: true},
+		{name: "local unverified", localVerified: false, upstreamVerified: true},
+		{name: "upstream unverified", localVerified: true, upstreamVerified: false},
+		{name: "neither verified", localVerified: false, upstreamVerified: false},
+	}
+	for _, tt := range linkTests {
+		t.Run("links by email/"+tt.name, func(t *testing.T) {
+			userService, store := newService()
+			local := addUser(t, store, "taken@example.com", tt.localVerified)
+			result, err := signIn(t, userService, jwt.MapClaims{"sub": "u-2", "email": "taken@example.com", "email_verified": tt.upstreamVerified})
+			link := store.GetFederatedIdentity("corp", "u-2")
+			if !tt.wantLinked {
+				if !errors.Is(err, services.ErrUpstreamAccountConflict) {
+					t.Fatalf("FinishUpstreamLogin error = %v, want ErrUpstreamAccountConflict", err)
+				}
+				if link != nil {
+					t.Errorf("link = %+v, want none", link)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FinishUpstreamLogin: %v", err)
+			}
+			if result.User.ID != local.ID || link == nil || link.UserID != local.ID {
+				t.Errorf("signed in user %d with link %+v, want the local user %d", result.User.ID, link, local.ID)
+			}
+		})
+	}
+
+	t.Run("rejects bad state", func(t *testing.T) {
+		userService, _ := newService()
+		login, err := userService.BeginUpstreamLogin(realm, "corp", "/continue")
+		if err != nil {
+			t.Fatalf("BeginUpstreamLogin: %v", err)
+		}
+		state, code := provider.authorize(t, login.URL, jwt.MapClaims{"sub": "u-3", "email": "x@example.com"})
+
+		tests := []struct {
+			name, provider, stateToken, state string
+		}{
+			{"other state", "corp", login.State, state + "x"},
+			{"tampered state token", "corp", login.State + "x", state},
+			{"no state token", "corp", "", state},
+			{"other provider", "other", login.State, state},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if _, _, err := userService.FinishUpstreamLogin(realm, tt.provider, tt.stateToken, tt.state, code); !errors.Is(err, services.ErrInvalidUpstreamState) {
+					t.Errorf("FinishUpstreamLogin error = %v, want ErrInvalidUpstreamState", err)
+				}
+			})
+		}
+	})
+
+	t.Run("rejects ID tokens with another nonce", func(t *testing.T) {
+		userService, store := newService()
+		_, err := signIn(t, userService, jwt.MapClaims{"sub": "u-4", "email": "nonce@example.com", "nonce": "replayed"})
+		if !errors.Is(err, services.ErrUpstreamFailed) {
+			t.Fatalf("FinishUpstreamLogin error = %v, want ErrUpstreamFailed", err)
+		}
+		if store.GetUserByEmail("nonce@example.com") != nil {
+			t.Error("a login with the wrong nonce created a user")
+		}
+	})
+
+	t.Run("sends the PKCE verifier of its own login", func(t *testing.T) {
+		userService, _ := newService()
+		first, err := userService.BeginUpstreamLogin(realm, "corp", "/continue")
+		if err != nil {
+			t.Fatalf("BeginUpstreamLogin: %v", err)
+		}
+		second, err := userService.BeginUpstreamLogin(realm, "corp", "/continue")
+		if err != nil {
+			t.Fatalf("BeginUpstreamLogin: %v", err)
+		}
+		_, code := provider.authorize(t, first.URL, jwt.MapClaims{"sub": "u-5", "email": "pkce@example.com"})
+		secondState, _ := provider.authorize(t, second.URL, nil)
+		// The first login's code, redeemed with the second login's verifier
+		if _, _, err := userService.FinishUpstreamLogin(realm, "corp", second.State, secondState, code); !errors.Is(err, services.ErrUpstreamFailed) {
+			t.Errorf("FinishUpstreamLogin error = %v, want ErrUpstreamFailed", err)
+		}
+	})
+}
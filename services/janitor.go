@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"oauth2-provider/storage"
+	"time"
+)
+
+const janitorLockName = "oauth2-provider:janitor"
+
+// janitorMetrics is published under "janitor" at /debug/vars.
+var janitorMetrics = expvar.NewMap("janitor")
+
+// Janitor periodically purges expired and used auth codes, expired
+// refresh tokens and stale failed-login records. When the store is shared
+// between replicas it takes a lock first, so only one replica does the
+// work each round.
+type Janitor struct {
+	store     storage.Store
+	interval  time.Duration
+	batchSize int
+}
+
+func NewJanitor(store storage.Store, interval time.Duration, batchSize int) *Janitor {
+	return &Janitor{store: store, interval: interval, batchSize: batchSize}
+}
+
+// Run purges once per interval until ctx is cancelled. A round in progress
+// finishes its current batch and then stops.
+func (j *Janitor) Run(ctx context.Context) {
+	log.Printf("Janitor started, purging every %s in batches of %d", j.interval, j.batchSize)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Janitor stopped")
+			return
+		case <-ticker.C:
+			j.RunOnce(ctx)
+		}
+	}
+}
+
+func (j *Janitor) RunOnce(ctx context.Context) {
+	if locker, ok := j.store.(storage.Locker); ok {
+		release, acquired, err := locker.TryLock(janitorLockName)
+		if err != nil {
+			log.Printf("Janitor failed to take lock: %v", err)
+			janitorMetrics.Add("errors", 1)
+			return
+		}
+		if !acquired {
+			// Another replica is cleaning up
+			janitorMetrics.Add("skipped_rounds", 1)
+			return
+		}
+		defer release()
+	}
+
+	started := time.Now()
+	janitorMetrics.Add("rounds", 1)
+
+	codes := j.purge(ctx, "purged_auth_codes", j.store.PurgeAuthCodes)
+	tokens := j.purge(ctx, "purged_refresh_tokens", j.store.PurgeRefreshTokens)
+	logins := j.purge(ctx, "purged_login_attempts", j.store.PurgeLoginAttempts)
+
+	lastRun := new(expvar.Int)
+	lastRun.Set(started.Unix())
+	janitorMetrics.Set("last_run_unix", lastRun)
+	duration := new(expvar.Float)
+	duration.Set(time.Since(started).Seconds())
+	janitorMetrics.Set("last_run_seconds", duration)
+
+	if codes > 0 || tokens > 0 || logins > 0 {
+		log.Printf("Janitor purged %d auth codes, %d refresh tokens and %d login attempt records", codes, tokens, logins)
+	}
+}
+
+// purge calls fn in batches until a batch comes back short, recording
+// progress under metric after every batch.
+func (j *Janitor) purge(ctx context.Context, metric string, fn func(now time.Time, limit int) (int64, error)) int64 {
+	var total int64
+	for ctx.Err() == nil {
+		n, err := fn(time.Now(), j.batchSize)
+		if err != nil {
+			log.Printf("Janitor failed to purge (%s): %v", metric, err)
+			janitorMetrics.Add("errors", 1)
+			return total
+		}
+		total += n
+		janitorMetrics.Add(metric, n)
+		if n < int64(j.batchSize) {
+			break
+		}
+	}
+	return total
+}
@@ -0,0 +1,210 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"oauth2-provider/models"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+// purgeCountingStore is a memory store counting the purge batches it is
+// asked for. onPurge, if set, runs before each refresh token batch.
+type purgeCountingStore struct {
+	*storage.MemoryStorage
+
+	mu                                      sync.Mutex
+	codeBatches, tokenBatches, loginBatches int
+	onPurge                                 func()
+}
+
+func (s *purgeCountingStore) PurgeAuthCodes(now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	s.codeBatches++
+	s.mu.Unlock()
+	return s.MemoryStorage.PurgeAuthCodes(now, limit)
+}
+
+func (s *purgeCountingStore) PurgeRefreshTokens(now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	s.tokenBatches++
+	onPurge := s.onPurge
+	s.mu.Unlock()
+	if onPurge != nil {
+		onPurge()
+	}
+	return s.MemoryStorage.PurgeRefreshTokens(now, limit)
+}
+
+func (s *purgeCountingStore) PurgeLoginAttempts(now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	s.loginBatches++
+	s.mu.Unlock()
+	return s.MemoryStorage.PurgeLoginAttempts(now, limit)
+}
+
+func (s *purgeCountingStore) batches() (codes, tokens, logins int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.codeBatches, s.tokenBatches, s.loginBatches
+}
+
+// lockingStore is a purgeCountingStore shared between replicas, whose
+// lock is held elsewhere unless free, or can't be checked when lockErr is
+// set.
+type lockingStore struct {
+	*purgeCountingStore
+	free     bool
+	lockErr  error
+	released int
+}
+
+func (s *lockingStore) TryLock(name string) (func(), bool, error) {
+	if s.lockErr != nil {
+		return nil, false, s.lockErr
+	}
+	if !s.free {
+		return nil, false, nil
+	}
+	return func() { s.released++ }, true, nil
+}
+
+// newPurgeCountingStore returns a store with expired refresh tokens.
+func newPurgeCountingStore(t *testing.T, expiredTokens int) *purgeCountingStore {
+	t.Helper()
+	useTestConfig(t, nil)
+	memory := storage.NewMemoryStorage()
+	store := memory.ForRealm("default")
+	expired := time.Now().Add(-time.Minute)
+	for i := 0; i < expiredTokens; i++ {
+		if err := store.StoreRefreshToken(utils.GenerateRandomString(32), &models.RefreshToken{
+			UserID:            1,
+			ClientID:          "app",
+			ExpiresAt:         expired,
+			AbsoluteExpiresAt: time.Now().Add(time.Hour),
+		}); err != nil {
+			t.Fatalf("StoreRefreshToken: %v", err)
+		}
+	}
+	if err := store.StoreRefreshToken("live", &models.RefreshToken{
+		UserID:            1,
+		ClientID:          "app",
+		ExpiresAt:         time.Now().Add(time.Hour),
+		AbsoluteExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("StoreRefreshToken: %v", err)
+	}
+	return &purgeCountingStore{MemoryStorage: memory}
+}
+
+func TestJanitorBatches(t *testing.T) {
+	tests := []struct {
+		name          string
+		expiredTokens int
+		// wantBatches counts the batch that comes back short
+		wantBatches int
+	}{
+		{name: "nothing to purge", expiredTokens: 0, wantBatches: 1},
+		{name: "less than a batch", expiredTokens: 2, wantBatches: 1},
+		{name: "several batches", expiredTokens: 7, wantBatches: 3},
+		{name: "whole batches", expiredTokens: 6, wantBatches: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newPurgeCountingStore(t, tt.expiredTokens)
+			services.NewJanitor(store, time.Hour, 3).RunOnce(context.Background())
+
+			if codes, tokens, logins := store.batches(); codes != 1 || tokens != tt.wantBatches || logins != 1 {
+				t.Errorf("purged in %d, %d and %d batches, want 1, %d and 1", codes, tokens, logins, tt.wantBatches)
+			}
+			if n, _ := store.MemoryStorage.PurgeRefreshTokens(time.Now(), 100); n != 0 {
+				t.Errorf("%d expired refresh tokens left", n)
+			}
+			if store.ForRealm("default").GetRefreshToken("live") == nil {
+				t.Error("a live refresh token was purged")
+			}
+		})
+	}
+}
+
+func TestJanitorLock(t *testing.T) {
+	tests := []struct {
+		name       string
+		free       bool
+		lockErr    error
+		wantPurged bool
+	}{
+		{name: "lock free", free: true, wantPurged: true},
+		{name: "lock held by another replica"},
+		{name: "lock unavailable", lockErr: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &lockingStore{purgeCountingStore: newPurgeCountingStore(t, 2), free: tt.free, lockErr: tt.lockErr}
+			services.NewJanitor(store, time.Hour, 3).RunOnce(context.Background())
+
+			codes, tokens, logins := store.batches()
+			if purged := codes+tokens+logins > 0; purged != tt.wantPurged {
+				t.Fatalf("purged = %v, want %v", purged, tt.wantPurged)
+			}
+			wantReleased := 0
+			if tt.wantPurged {
+				wantReleased = 1
+			}
+			if store.released != wantReleased {
+				t.Errorf("lock released %d times, want %d", store.released, wantReleased)
+			}
+		})
+	}
+}
+
+func TestJanitorShutdown(t *testing.T) {
+	t.Run("between rounds", func(t *testing.T) {
+		store := newPurgeCountingStore(t, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			services.NewJanitor(store, time.Millisecond, 3).Run(ctx)
+			close(stopped)
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, tokens, _ := store.batches(); tokens > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("janitor never ran")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("janitor didn't stop after cancellation")
+		}
+	})
+
+	t.Run("during a round", func(t *testing.T) {
+		// Cancelling during the first of several batches finishes that
+		// batch and purges no further
+		store := newPurgeCountingStore(t, 7)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		store.onPurge = cancel
+		services.NewJanitor(store, time.Hour, 3).RunOnce(ctx)
+
+		if codes, tokens, logins := store.batches(); codes != 1 || tokens != 1 || logins != 0 {
+			t.Errorf("purged in %d, %d and %d batches, want 1, 1 and 0", codes, tokens, logins)
+		}
+		if n, _ := store.MemoryStorage.PurgeRefreshTokens(time.Now(), 100); n != 4 {
+			t.Errorf("%d expired refresh tokens left, want the 4 of the unfinished batches", n)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"net/mail"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+)
+
+// ErrLegacyUnavailable is returned when a login needs the legacy user
+// store and it can't be reached.
+var ErrLegacyUnavailable = errors.New("sign-in is temporarily unavailable; try again later")
+
+// usesLegacy reports whether users missing from realm may still be in the
+// legacy user store.
+func (s *UserService) usesLegacy(realm *realms.Realm) bool {
+	return s.legacy != nil && realm.Name == config.Get().LegacyAuth.Realm
+}
+
+// migrateLegacyUser checks the password of a user who doesn't exist yet
+// against the legacy user store, and creates them with it if it matches.
+// It returns nil if the user is unknown there too or the password is
+// wrong. Once created, the user signs in locally like any other.
+func (s *UserService) migrateLegacyUser(realm *realms.Realm, username, password string) (*models.User, error) {
+	if !s.usesLegacy(realm) {
+		passwords.Verify(password, dummyPasswordHash())
+		return nil, nil
+	}
+	found, err := s.legacy.Authenticate(username, password)
+	if err != nil {
+		log.Printf("Error checking legacy credentials of %s: %v", username, err)
+		return nil, ErrLegacyUnavailable
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	if address, err := mail.ParseAddress(found.Email); err != nil || address.Address != found.Email {
+		log.Printf("Error migrating legacy user %s: invalid email address %q", username, found.Email)
+		return nil, errors.New("account could not be migrated")
+	}
+	hashedPassword, err := passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	store := s.store.ForRealm(realm.Name)
+	if store.GetUserByEmail(found.Email) != nil {
+		log.Printf("Error migrating legacy user %s: email address already in use", username)
+		return nil, errors.New("account could not be migrated")
+	}
+	user := &models.User{
+		Username:      username,
+		Password:      hashedPassword,
+		Email:         found.Email,
+		EmailVerified: found.EmailVerified,
+	}
+	if err := store.StoreUser(user); err != nil {
+		log.Printf("Error migrating legacy user %s: %v", username, err)
+		return nil, errors.New("account could not be migrated")
+	}
+	audit(realm, AuditUserMigrated, "username", username)
+	return user, nil
+}
+
+// legacyUsernameTaken reports whether username belongs to a user still in
+// the legacy user store, who must not be preempted by a registration.
+func (s *UserService) legacyUsernameTaken(realm *realms.Realm, username string) (bool, error) {
+	if !s.usesLegacy(realm) {
+		return false, nil
+	}
+	exists, err := s.legacy.Exists(username)
+	if err != nil {
+		log.Printf("Error looking up legacy user %s: %v", username, err)
+		return false, ErrLegacyUnavailable
+	}
+	return exists, nil
+}
@@ -0,0 +1,88 @@
+package services_test
+
+import (
+	"oauth2-provider/legacy"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"testing"
+)
+
+// countingLegacyStore is a legacy store knowing alice with password
+// "secret", which counts how often it is asked.
+type countingLegacyStore struct {
+	authenticateCalls, existsCalls int
+}
+
+func (s *countingLegacyStore) Authenticate(username, password string) (*legacy.User, error) {
+	s.authenticateCalls++
+	if username != "alice" || password != "secret" {
+		return nil, nil
+	}
+	return &legacy.User{Username: "alice", Email: "alice@example.com", EmailVerified: true}, nil
+}
+
+func (s *countingLegacyStore) Exists(username string) (bool, error) {
+	s.existsCalls++
+	return username == "alice", nil
+}
+
+func TestLegacyMigration(t *testing.T) {
+	cfg := useTestConfig(t, nil)
+	realm := &realms.Realm{Name: cfg.LegacyAuth.Realm}
+	store := storage.NewMemoryStorage()
+	legacyStore := &countingLegacyStore{}
+	userService := services.NewUserService(store, nil, nil, nil, legacyStore, nil, nil)
+
+	login := func(password string) (*services.LoginResult, error) {
+		return userService.Login(realm, &models.UserLogin{Username: "alice", Password: password}, "")
+	}
+
+	if _, err := login("wrong"); err == nil {
+		t.Fatal("Login with a wrong legacy password succeeded")
+	}
+	if store.ForRealm(realm.Name).GetUserByUsername("alice") != nil {
+		t.Fatal("a wrong legacy password created the user")
+	}
+
+	result, err := login("secret")
+	if err != nil {
+		t.Fatalf("first Login: %v", err)
+	}
+	user := store.ForRealm(realm.Name).GetUserByUsername("alice")
+	if user == nil || user.ID != result.User.ID {
+		t.Fatal("first Login didn't migrate the user")
+	}
+	if user.Email != "alice@example.com" || !user.EmailVerified {
+		t.Errorf("migrated user = %+v, want the legacy email, verified", user)
+	}
+	if user.Password == "secret" || user.Password == "" {
+		t.Errorf("migrated password hash = %q", user.Password)
+	}
+	if legacyStore.authenticateCalls != 2 {
+		t.Fatalf("legacy store asked %d times before migration, want 2", legacyStore.authenticateCalls)
+	}
+
+	// Once migrated the user signs in locally, whatever the password
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "right password", password: "secret"},
+		{name: "wrong password", password: "wrong", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := login(tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Login error = %v, want error %v", err, tt.wantErr)
+			}
+			if legacyStore.authenticateCalls != 2 || legacyStore.existsCalls != 0 {
+				t.Errorf("legacy store consulted after migration: %d authenticate, %d exists calls",
+					legacyStore.authenticateCalls, legacyStore.existsCalls)
+			}
+		})
+	}
+}
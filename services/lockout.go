@@ -0,0 +1,160 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/utils"
+	"sync"
+	"time"
+)
+
+// LoginBlockedError is returned while a username or client IP is locked
+// out, or still has to wait after a failed attempt. Unknown usernames are
+// blocked the same way as existing ones.
+type LoginBlockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return "too many failed attempts; try again later"
+}
+
+// dummyPasswordHash is checked against when a username doesn't exist, so
+// the response takes as long as it does for a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := passwords.Hash(utils.GenerateRandomString(16))
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+func userLockoutKey(username string) string { return "user:" + username }
+func ipLockoutKey(ip string) string         { return "ip:" + ip }
+
+// checkLoginAllowed returns a *LoginBlockedError if username or ip may
+// not try a password or code right now.
+func (s *UserService) checkLoginAllowed(realm *realms.Realm, username, ip string) error {
+	cfg := config.Get().Lockout
+	store := s.store.ForRealm(realm.Name)
+	now := time.Now()
+
+	var wait time.Duration
+	if attempt := store.GetLoginAttempt(userLockoutKey(username)); attempt != nil {
+		wait = lockedFor(attempt, now)
+		if now.Before(attempt.ExpiresAt) {
+			if delay := attempt.LastFailureAt.Add(loginDelay(cfg, attempt.Failures)).Sub(now); delay > wait {
+				wait = delay
+			}
+		}
+	}
+	if ip != "" {
+		if attempt := store.GetLoginAttempt(ipLockoutKey(ip)); attempt != nil {
+			if locked := lockedFor(attempt, now); locked > wait {
+				wait = locked
+			}
+		}
+	}
+	if wait > 0 {
+		return &LoginBlockedError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a wrong password or code against username and
+// ip, locking either once it reaches its threshold.
+func (s *UserService) recordLoginFailure(realm *realms.Realm, username, ip string) {
+	cfg := config.Get().Lockout
+	store := s.store.ForRealm(realm.Name)
+	now := time.Now()
+
+	if cfg.MaxFailures > 0 || cfg.Delay > 0 {
+		attempt, err := store.RecordLoginFailure(userLockoutKey(username), now, cfg.Window.Duration())
+		if err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		} else if cfg.MaxFailures > 0 && attempt.Failures >= cfg.MaxFailures && lockedFor(attempt, now) == 0 {
+			s.lockLogin(realm, attempt, now, "username", username)
+		}
+	}
+	if cfg.IPMaxFailures > 0 && ip != "" {
+		attempt, err := store.RecordLoginFailure(ipLockoutKey(ip), now, cfg.Window.Duration())
+		if err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		} else if attempt.Failures >= cfg.IPMaxFailures && lockedFor(attempt, now) == 0 {
+			s.lockLogin(realm, attempt, now, "ip", ip)
+		}
+	}
+}
+
+func (s *UserService) lockLogin(realm *realms.Realm, attempt *models.LoginAttempt, now time.Time, kind, subject string) {
+	until := now.Add(config.Get().Lockout.Duration.Duration())
+	if err := s.store.ForRealm(realm.Name).LockLogin(attempt.Key, until); err != nil {
+		log.Printf("Error locking %s %s: %v", kind, subject, err)
+		return
+	}
+	audit(realm, AuditLoginLocked,
+		kind, subject,
+		"failures", fmt.Sprint(attempt.Failures),
+		"until", until.UTC().Format(time.RFC3339),
+	)
+}
+
+// clearLoginFailures forgets the failures of a username after a
+// successful login. Those of the client IP are left to expire, so one
+// valid account doesn't reset an IP guessing at others.
+func (s *UserService) clearLoginFailures(realm *realms.Realm, username string) {
+	cfg := config.Get().Lockout
+	if cfg.MaxFailures == 0 && cfg.Delay == 0 {
+		return
+	}
+	if err := s.store.ForRealm(realm.Name).ClearLoginAttempts(userLockoutKey(username)); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+}
+
+// UnlockUser lifts the lockout of a username and forgets its failures. It
+// is an administrator action.
+func (s *UserService) UnlockUser(realm *realms.Realm, username string) error {
+	if err := s.store.ForRealm(realm.Name).ClearLoginAttempts(userLockoutKey(username)); err != nil {
+		return err
+	}
+	audit(realm, AuditLoginUnlocked, "username", username)
+	return nil
+}
+
+// UnlockIP lifts the lockout of a client IP and forgets its failures. It
+// is an administrator action.
+func (s *UserService) UnlockIP(realm *realms.Realm, ip string) error {
+	if err := s.store.ForRealm(realm.Name).ClearLoginAttempts(ipLockoutKey(ip)); err != nil {
+		return err
+	}
+	audit(realm, AuditLoginUnlocked, "ip", ip)
+	return nil
+}
+
+func lockedFor(attempt *models.LoginAttempt, now time.Time) time.Duration {
+	if attempt.LockedUntil == nil || !now.Before(*attempt.LockedUntil) {
+		return 0
+	}
+	return attempt.LockedUntil.Sub(now)
+}
+
+// loginDelay is how long a username must wait after its latest failure:
+// the configured delay, doubled for every failure after the first.
+func loginDelay(cfg config.LockoutConfig, failures int) time.Duration {
+	if cfg.Delay <= 0 || failures <= 0 {
+		return 0
+	}
+	delay, max := cfg.Delay.Duration(), cfg.MaxDelay.Duration()
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
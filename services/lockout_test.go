@@ -0,0 +1,164 @@
+package services_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"testing"
+	"time"
+)
+
+// newLockoutService stores alice and bob, both with the password
+// "password", under the given lockout settings.
+func newLockoutService(t *testing.T, lockout config.LockoutConfig) (*services.UserService, storage.Store, *realms.Realm) {
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.Lockout = lockout
+		cfg.PasswordHashing.Algorithm = config.HashArgon2id
+		cfg.PasswordHashing.Argon2id = config.Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1}
+	})
+	hash, err := passwords.Hash("password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	realm := &realms.Realm{Name: "default"}
+	memory := storage.NewMemoryStorage()
+	store := memory.ForRealm(realm.Name)
+	for _, username := range []string{"alice", "bob"} {
+		if err := store.StoreUser(&models.User{Username: username, Email: username + "@example.com", Password: hash}); err != nil {
+			t.Fatalf("StoreUser: %v", err)
+		}
+	}
+	return services.NewUserService(memory, nil, nil, nil, nil, nil, nil), store, realm
+}
+
+// loginBlockedFor returns how long Login said to wait, or 0 if it wasn't
+// blocked.
+func loginBlockedFor(t *testing.T, userService *services.UserService, realm *realms.Realm, username, password, ip string) time.Duration {
+	t.Helper()
+	_, err := userService.Login(realm, &models.UserLogin{Username: username, Password: password}, ip)
+	var blocked *services.LoginBlockedError
+	if errors.As(err, &blocked) {
+		return blocked.RetryAfter
+	}
+	return 0
+}
+
+func TestLoginLockoutByUsername(t *testing.T) {
+	userService, _, realm := newLockoutService(t, config.LockoutConfig{
+		MaxFailures: 3,
+		Window:      config.Duration(time.Hour),
+		Duration:    config.Duration(time.Hour),
+	})
+
+	for _, username := range []string{"alice", "mallory"} {
+		t.Run(username, func(t *testing.T) {
+			// Failures count from any IP
+			for i, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+				if wait := loginBlockedFor(t, userService, realm, username, "wrong", ip); wait != 0 {
+					t.Fatalf("attempt %d blocked for %v, want a wrong password", i+1, wait)
+				}
+			}
+			// Unknown usernames are locked the same way as existing ones
+			if wait := loginBlockedFor(t, userService, realm, username, "password", "192.0.2.4"); wait <= 59*time.Minute || wait > time.Hour {
+				t.Errorf("login after 3 failures blocked for %v, want an hour", wait)
+			}
+		})
+	}
+
+	if _, err := userService.Login(realm, &models.UserLogin{Username: "bob", Password: "password"}, "192.0.2.1"); err != nil {
+		t.Errorf("Login of another user: %v", err)
+	}
+	if err := userService.UnlockUser(realm, "alice"); err != nil {
+		t.Fatalf("UnlockUser: %v", err)
+	}
+	if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "password"}, "192.0.2.1"); err != nil {
+		t.Errorf("Login after UnlockUser: %v", err)
+	}
+}
+
+func TestLoginLockoutByIP(t *testing.T) {
+	userService, _, realm := newLockoutService(t, config.LockoutConfig{
+		IPMaxFailures: 3,
+		Window:        config.Duration(time.Hour),
+		Duration:      config.Duration(time.Hour),
+	})
+	const ip = "192.0.2.1"
+
+	// A successful login doesn't reset the failures of its IP, which could
+	// otherwise guess at other accounts indefinitely
+	loginBlockedFor(t, userService, realm, "alice", "wrong", ip)
+	loginBlockedFor(t, userService, realm, "bob", "wrong", ip)
+	if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "password"}, ip); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	loginBlockedFor(t, userService, realm, "carol", "wrong", ip)
+
+	tests := []struct {
+		name        string
+		username    string
+		ip          string
+		wantBlocked bool
+	}{
+		{name: "same IP", username: "alice", ip: ip, wantBlocked: true},
+		{name: "same IP, other user", username: "bob", ip: ip, wantBlocked: true},
+		{name: "other IP", username: "alice", ip: "192.0.2.2"},
+		// Logins without a client IP, such as from the command line, only
+		// count against the username
+		{name: "no IP", username: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if blocked := loginBlockedFor(t, userService, realm, tt.username, "password", tt.ip) > 0; blocked != tt.wantBlocked {
+				t.Errorf("blocked = %v, want %v", blocked, tt.wantBlocked)
+			}
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		loginBlockedFor(t, userService, realm, "alice", "wrong", "")
+	}
+	if wait := loginBlockedFor(t, userService, realm, "alice", "password", ""); wait != 0 {
+		t.Errorf("login without a client IP blocked for %v after failures without one", wait)
+	}
+
+	if err := userService.UnlockIP(realm, ip); err != nil {
+		t.Fatalf("UnlockIP: %v", err)
+	}
+	if wait := loginBlockedFor(t, userService, realm, "alice", "password", ip); wait != 0 {
+		t.Errorf("login after UnlockIP blocked for %v", wait)
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	userService, store, realm := newLockoutService(t, config.LockoutConfig{
+		Window:   config.Duration(24 * time.Hour),
+		Delay:    config.Duration(time.Hour),
+		MaxDelay: config.Duration(3 * time.Hour),
+	})
+
+	if wait := loginBlockedFor(t, userService, realm, "alice", "wrong", "192.0.2.1"); wait != 0 {
+		t.Fatalf("first attempt blocked for %v", wait)
+	}
+	if wait := loginBlockedFor(t, userService, realm, "alice", "password", "192.0.2.2"); wait <= 59*time.Minute || wait > time.Hour {
+		t.Errorf("login after one failure blocked for %v, want an hour", wait)
+	}
+	if wait := loginBlockedFor(t, userService, realm, "bob", "wrong", "192.0.2.1"); wait != 0 {
+		t.Errorf("another user blocked for %v", wait)
+	}
+
+	// The delay doubles with every failure, up to the maximum. Failures
+	// are recorded under user:<username>
+	now := time.Now()
+	for _, want := range []time.Duration{2 * time.Hour, 3 * time.Hour, 3 * time.Hour} {
+		if _, err := store.RecordLoginFailure("user:alice", now, 24*time.Hour); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if wait := loginBlockedFor(t, userService, realm, "alice", "password", ""); wait <= want-time.Minute || wait > want {
+			t.Errorf("login blocked for %v, want %v", wait, want)
+		}
+	}
+}
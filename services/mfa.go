@@ -0,0 +1,268 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// mfaTokenPurpose binds MFA challenge tokens to the second login step.
+	mfaTokenPurpose = "mfa-challenge"
+	// mfaTokenTTL is how long the user has to enter a code after
+	// entering their password.
+	mfaTokenTTL = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes an enrollment yields.
+	recoveryCodeCount = 10
+)
+
+// Second factors, as listed in a login's mfa_methods.
+const (
+	MFAMethodTOTP     = "totp"
+	MFAMethodWebAuthn = "webauthn"
+)
+
+var (
+	ErrMFAUnavailable    = errors.New("TOTP requires encryption keys (keys.master_keys) to be configured")
+	ErrMFAAlreadyEnabled = errors.New("TOTP is already enabled")
+	ErrTOTPNotEnrolled   = errors.New("TOTP enrollment has not been started")
+	ErrInvalidMFAToken   = errors.New("invalid or expired MFA token")
+	ErrInvalidMFACode    = errors.New("invalid code")
+)
+
+// EnrollTOTP generates a new TOTP secret for the user. It takes effect
+// once ConfirmTOTP has seen a code from the user's authenticator, so an
+// enrollment that is never finished doesn't lock the user out.
+func (s *UserService) EnrollTOTP(realm *realms.Realm, userID uint) (*models.TOTPEnrollment, error) {
+	if s.keyring == nil {
+		return nil, ErrMFAUnavailable
+	}
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(userID)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret := utils.GenerateTOTPSecret()
+	encrypted, err := s.keyring.EncryptString(secret, totpAssociatedData(realm, user))
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = encrypted
+	user.TOTPLastStep = 0
+	if err := store.UpdateUser(user); err != nil {
+		return nil, err
+	}
+
+	issuer := realm.Issuer
+	if u, err := url.Parse(realm.Issuer); err == nil && u.Hostname() != "" {
+		issuer = u.Hostname()
+	}
+	return &models.TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: utils.TOTPProvisioningURI(issuer, user.Username, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables TOTP once code shows the user's authenticator holds
+// the enrolled secret. It returns new recovery codes, which are only ever
+// shown this once.
+func (s *UserService) ConfirmTOTP(realm *realms.Realm, userID uint, code string) ([]string, error) {
+	if s.keyring == nil {
+		return nil, ErrMFAUnavailable
+	}
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(userID)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if !s.checkTOTP(realm, user, code) {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	user.TOTPEnabled = true
+	user.RecoveryCodes = strings.Join(hashes, " ")
+	if err := store.UpdateUser(user); err != nil {
+		return nil, err
+	}
+	log.Printf("Enabled TOTP for user %d in realm %s", user.ID, realm.Name)
+	return codes, nil
+}
+
+// ResetMFA removes the second factors of a user who lost them: TOTP, their
+// recovery codes and their WebAuthn authenticators. It is an administrator
+// action.
+func (s *UserService) ResetMFA(realm *realms.Realm, username string) error {
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUserByUsername(username)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	credentials, err := store.ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, credential := range credentials {
+		if err := store.DeleteWebAuthnCredential(credential.CredentialID); err != nil {
+			return err
+		}
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = ""
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+	log.Printf("Reset MFA of user %d in realm %s", user.ID, realm.Name)
+	return nil
+}
+
+// issueMFAToken starts the second login step after the first factor, a
+// password or an upstream provider. The token is signed over the password
+// fingerprint, so changing the password cancels it.
+func issueMFAToken(realm *realms.Realm, user *models.User, firstFactor string) string {
+	return utils.SignToken(mfaTokenPurpose, time.Now().Add(mfaTokenTTL),
+		realm.Name,
+		strconv.FormatUint(uint64(user.ID), 10),
+		passwordFingerprint(user),
+		firstFactor,
+	)
+}
+
+// VerifyMFA completes a login that Login answered with an MFA token. The
+// code may be a TOTP code or one of the user's recovery codes, which is
+// used up.
+func (s *UserService) VerifyMFA(realm *realms.Realm, mfaToken, code, ip string) (*LoginResult, error) {
+	user, firstFactor := s.parseMFAToken(realm, mfaToken)
+	if user == nil || !user.TOTPEnabled {
+		return nil, ErrInvalidMFAToken
+	}
+	if err := s.checkLoginAllowed(realm, user.Username, ip); err != nil {
+		return nil, err
+	}
+
+	if !s.checkTOTP(realm, user, code) && !useRecoveryCode(user, code) {
+		s.recordLoginFailure(realm, user.Username, ip)
+		return nil, ErrInvalidMFACode
+	}
+	s.clearLoginFailures(realm, user.Username)
+	if err := s.store.ForRealm(realm.Name).UpdateUser(user); err != nil {
+		return nil, err
+	}
+	return s.completeLogin(realm, user, firstFactor, AMROTP, AMRMFA)
+}
+
+// parseMFAToken returns the user an MFA token was issued to and the
+// method of their first factor, or nil if the token is invalid, or the
+// password has changed or the user been disabled since.
+func (s *UserService) parseMFAToken(realm *realms.Realm, mfaToken string) (*models.User, string) {
+	fields, err := utils.VerifySignedToken(mfaTokenPurpose, mfaToken)
+	if err != nil || len(fields) != 4 || fields[0] != realm.Name {
+		return nil, ""
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, ""
+	}
+	user := s.store.ForRealm(realm.Name).GetUser(uint(userID))
+	if user == nil || user.Disabled || passwordFingerprint(user) != fields[2] {
+		return nil, ""
+	}
+	return user, fields[3]
+}
+
+// mfaMethods lists the second factors the user can complete a login with.
+func (s *UserService) mfaMethods(realm *realms.Realm, user *models.User) ([]string, error) {
+	var methods []string
+	if user.TOTPEnabled {
+		methods = append(methods, MFAMethodTOTP)
+	}
+	credentials, err := s.store.ForRealm(realm.Name).ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(credentials) > 0 {
+		methods = append(methods, MFAMethodWebAuthn)
+	}
+	return methods, nil
+}
+
+// checkTOTP validates a TOTP code against the user's secret and records
+// its time step on the user; the caller saves the user.
+func (s *UserService) checkTOTP(realm *realms.Realm, user *models.User, code string) bool {
+	if s.keyring == nil {
+		return false
+	}
+	secret, err := s.keyring.DecryptString(user.TOTPSecret, totpAssociatedData(realm, user))
+	if err != nil {
+		log.Printf("Error decrypting TOTP secret of user %d: %v", user.ID, err)
+		return false
+	}
+	step, ok := utils.ValidateTOTP(secret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	user.TOTPLastStep = step
+	return true
+}
+
+// totpAssociatedData binds an encrypted secret to its user, so it can't
+// be copied onto another account.
+func totpAssociatedData(realm *realms.Realm, user *models.User) string {
+	return fmt.Sprintf("totp:%s:%d", realm.Name, user.ID)
+}
+
+// generateRecoveryCodes returns new recovery codes and their keyed hashes.
+func generateRecoveryCodes() (codes, hashes []string) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			panic(err)
+		}
+		code := strings.ToLower(encoding.EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, utils.HashToken(code))
+	}
+	return codes, hashes
+}
+
+// useRecoveryCode removes code from the user's unused recovery codes,
+// reporting whether it was one of them; the caller saves the user.
+func useRecoveryCode(user *models.User, code string) bool {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := utils.HashToken(normalized)
+
+	hashes := strings.Fields(user.RecoveryCodes)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			user.RecoveryCodes = strings.Join(append(hashes[:i:i], hashes[i+1:]...), " ")
+			log.Printf("User %d used a recovery code, %d left", user.ID, len(hashes)-1)
+			return true
+		}
+	}
+	return false
+}
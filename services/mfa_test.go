@@ -0,0 +1,237 @@
+package services_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"oauth2-provider/config"
+	"oauth2-provider/encryption"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// totpAt returns the code an authenticator holding secret shows at t.
+func totpAt(t *testing.T, secret string, at time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decoding TOTP secret: %v", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+// newMFAService returns a user service with a keyring, and alice, whose
+// password is "alice-password".
+func newMFAService(t *testing.T) (*services.UserService, storage.Store, *models.User) {
+	master, err := encryption.GenerateMasterKey()
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	cfg := useTestConfig(t, func(cfg *config.Config) {
+		cfg.Keys.MasterKeys = []config.MasterKeyConfig{{ID: "test", Key: master}}
+		cfg.Keys.ActiveMasterKey = "test"
+	})
+	memory := storage.NewMemoryStorage()
+	keyring, err := encryption.NewKeyring(memory, cfg.Keys)
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	hash, err := passwords.Hash("alice-password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	store := memory.ForRealm("default")
+	alice := &models.User{Username: "alice", Email: "alice@example.com", EmailVerified: true, Password: hash}
+	if err := store.StoreUser(alice); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	return services.NewUserService(memory, nil, keyring, nil, nil, nil, nil), store, alice
+}
+
+// enrollTOTP enables TOTP for user, returning the secret, the recovery
+// codes and the time of the code that confirmed the enrollment, whose step
+// is therefore used up.
+func enrollTOTP(t *testing.T, userService *services.UserService, realm *realms.Realm, user *models.User) (string, []string, time.Time) {
+	enrollment, err := userService.EnrollTOTP(realm, user.ID)
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	confirmed := time.Now()
+	codes, err := userService.ConfirmTOTP(realm, user.ID, totpAt(t, enrollment.Secret, confirmed))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	return enrollment.Secret, codes, confirmed
+}
+
+// mfaToken signs in as alice with her password, returning the token for
+// the second step.
+func mfaToken(t *testing.T, userService *services.UserService, realm *realms.Realm) string {
+	result, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "alice-password"}, "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if result.MFAToken == "" || result.LoginToken != "" {
+		t.Fatalf("Login = %+v, want a second step", result)
+	}
+	return result.MFAToken
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	realm := &realms.Realm{Name: "default", Issuer: "https://auth.example.com"}
+	userService, store, alice := newMFAService(t)
+
+	if _, err := userService.ConfirmTOTP(realm, alice.ID, "123456"); !errors.Is(err, services.ErrTOTPNotEnrolled) {
+		t.Fatalf("ConfirmTOTP before enrolling: error = %v, want ErrTOTPNotEnrolled", err)
+	}
+	enrollment, err := userService.EnrollTOTP(realm, alice.ID)
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/auth.example.com:alice?") {
+		t.Errorf("ProvisioningURI = %q, want one for alice at auth.example.com", enrollment.ProvisioningURI)
+	}
+	stored := store.GetUser(alice.ID)
+	if stored.TOTPEnabled || stored.TOTPSecret == "" || strings.Contains(stored.TOTPSecret, enrollment.Secret) {
+		t.Errorf("user after EnrollTOTP = %+v, want an encrypted secret, not enabled yet", stored)
+	}
+
+	wrong := totpAt(t, enrollment.Secret, time.Now().Add(-time.Hour))
+	if _, err := userService.ConfirmTOTP(realm, alice.ID, wrong); !errors.Is(err, services.ErrInvalidMFACode) {
+		t.Fatalf("ConfirmTOTP with a stale code: error = %v, want ErrInvalidMFACode", err)
+	}
+	codes, err := userService.ConfirmTOTP(realm, alice.ID, totpAt(t, enrollment.Secret, time.Now()))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Errorf("got %d recovery codes, want 10", len(codes))
+	}
+	if stored := store.GetUser(alice.ID); !stored.TOTPEnabled || strings.Contains(stored.RecoveryCodes, codes[0]) {
+		t.Errorf("user after ConfirmTOTP = %+v, want TOTP enabled and hashed recovery codes", stored)
+	}
+	if _, err := userService.EnrollTOTP(realm, alice.ID); !errors.Is(err, services.ErrMFAAlreadyEnabled) {
+		t.Errorf("EnrollTOTP when enabled: error = %v, want ErrMFAAlreadyEnabled", err)
+	}
+}
+
+func TestVerifyMFA(t *testing.T) {
+	realm := &realms.Realm{Name: "default", Issuer: "https://auth.example.com"}
+
+	t.Run("TOTP codes", func(t *testing.T) {
+		userService, _, alice := newMFAService(t)
+		secret, _, now := enrollTOTP(t, userService, realm, alice)
+
+		tests := []struct {
+			name string
+			code string
+			want bool
+		}{
+			// The enrollment used up the code of the current step
+			{name: "code of the confirmation", code: totpAt(t, secret, now)},
+			{name: "expired code", code: totpAt(t, secret, now.Add(-2*time.Minute))},
+			{name: "next code", code: totpAt(t, secret, now.Add(30*time.Second)), want: true},
+			{name: "next code again", code: totpAt(t, secret, now.Add(30*time.Second))},
+			{name: "not a code", code: "abcdef"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				result, err := userService.VerifyMFA(realm, mfaToken(t, userService, realm), tt.code, "")
+				if !tt.want {
+					if !errors.Is(err, services.ErrInvalidMFACode) {
+						t.Errorf("VerifyMFA error = %v, want ErrInvalidMFACode", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("VerifyMFA: %v", err)
+				}
+				if result.LoginToken == "" || result.User.ID != alice.ID {
+					t.Errorf("VerifyMFA = %+v, want a login of alice", result)
+				}
+			})
+		}
+	})
+
+	t.Run("recovery codes", func(t *testing.T) {
+		userService, store, alice := newMFAService(t)
+		_, codes, _ := enrollTOTP(t, userService, realm, alice)
+
+		tests := []struct {
+			name string
+			code string
+			want bool
+		}{
+			{name: "as shown", code: codes[0], want: true},
+			{name: "used already", code: codes[0]},
+			{name: "upper case", code: strings.ToUpper(codes[1]), want: true},
+			{name: "without the dash", code: strings.ReplaceAll(codes[2], "-", ""), want: true},
+			{name: "with spaces", code: " " + strings.ReplaceAll(codes[3], "-", " ") + " ", want: true},
+			{name: "made up", code: "abcd-efgh"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := userService.VerifyMFA(realm, mfaToken(t, userService, realm), tt.code, "")
+				if tt.want && err != nil {
+					t.Errorf("VerifyMFA: %v", err)
+				}
+				if !tt.want && !errors.Is(err, services.ErrInvalidMFACode) {
+					t.Errorf("VerifyMFA error = %v, want ErrInvalidMFACode", err)
+				}
+			})
+		}
+		if left := strings.Fields(store.GetUser(alice.ID).RecoveryCodes); len(left) != len(codes)-4 {
+			t.Errorf("%d recovery codes left, want %d", len(left), len(codes)-4)
+		}
+	})
+
+	t.Run("MFA tokens", func(t *testing.T) {
+		userService, store, alice := newMFAService(t)
+		_, codes, _ := enrollTOTP(t, userService, realm, alice)
+		token := mfaToken(t, userService, realm)
+
+		tests := []struct {
+			name  string
+			realm *realms.Realm
+			token string
+		}{
+			{name: "tampered", realm: realm, token: token + "x"},
+			{name: "other realm", realm: &realms.Realm{Name: "other"}, token: token},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if _, err := userService.VerifyMFA(tt.realm, tt.token, codes[0], ""); !errors.Is(err, services.ErrInvalidMFAToken) {
+					t.Errorf("VerifyMFA error = %v, want ErrInvalidMFAToken", err)
+				}
+			})
+		}
+
+		// Changing the password cancels second steps already started
+		hash, err := passwords.Hash("new-password")
+		if err != nil {
+			t.Fatalf("Hash: %v", err)
+		}
+		changed := store.GetUser(alice.ID)
+		changed.Password = hash
+		if err := store.UpdateUser(changed); err != nil {
+			t.Fatalf("UpdateUser: %v", err)
+		}
+		if _, err := userService.VerifyMFA(realm, token, codes[0], ""); !errors.Is(err, services.ErrInvalidMFAToken) {
+			t.Errorf("VerifyMFA after a password change: error = %v, want ErrInvalidMFAToken", err)
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"oauth2-provider/models"
+	"oauth2-provider/realms"
 	"oauth2-provider/storage"
 	"oauth2-provider/utils"
 	"strings"
@@ -12,15 +13,20 @@ import (
 )
 
 type OAuthService struct {
-	store *storage.PostgresStorage
+	store storage.Store
 }
 
-func NewOAuthService(store *storage.PostgresStorage) *OAuthService {
+func NewOAuthService(store storage.Store) *OAuthService {
 	return &OAuthService{store: store}
 }
 
-func (s *OAuthService) ValidateAuthorizationRequest(req *models.AuthorizationRequest) error {
-	client := s.store.GetClient(req.ClientID)
+// GetUser returns the user an access token was issued to.
+func (s *OAuthService) GetUser(realm *realms.Realm, userID uint) *models.User {
+	return s.store.ForRealm(realm.Name).GetUser(userID)
+}
+
+func (s *OAuthService) ValidateAuthorizationRequest(realm *realms.Realm, req *models.AuthorizationRequest) error {
+	client := s.store.ForRealm(realm.Name).GetClient(req.ClientID)
 	if client == nil {
 		return errors.New("invalid client")
 	}
@@ -37,6 +43,15 @@ func (s *OAuthService) ValidateAuthorizationRequest(req *models.AuthorizationReq
 		return errors.New("invalid redirect URI")
 	}
 
+	if !realm.AllowsScope(req.Scope) {
+		return errors.New("invalid scope")
+	}
+	// Provisioning access is only granted to clients acting on their own
+	// behalf, never through a user's consent
+	if hasScope(req.Scope, SCIMScope) {
+		return errors.New("invalid scope")
+	}
+
 	// Validate PKCE parameters
 	if req.CodeChallenge == "" {
 		return errors.New("code_challenge is required")
@@ -48,81 +63,219 @@ func (s *OAuthService) ValidateAuthorizationRequest(req *models.AuthorizationReq
 	return nil
 }
 
-func (s *OAuthService) GenerateAuthorizationCode(clientID string, userID uint, codeChallenge, codeChallengeMethod string) (string, error) {
+// GenerateAuthorizationCode issues a code for a validated request. How the
+// user signed in is kept with the code for the ID token.
+func (s *OAuthService) GenerateAuthorizationCode(realm *realms.Realm, req *models.AuthorizationRequest, auth *Authentication) (string, error) {
 	code := utils.GenerateRandomString(32)
-	err := s.store.StoreAuthCodeWithPKCE(code, clientID, userID, codeChallenge, codeChallengeMethod)
-	if err != nil {
+	authCode := &models.AuthCode{
+		ClientID:            req.ClientID,
+		UserID:              auth.UserID,
+		Scope:               req.Scope,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		Nonce:               req.Nonce,
+		AuthMethods:         strings.Join(auth.Methods, " "),
+	}
+	if !auth.Time.IsZero() {
+		authCode.AuthTime = &auth.Time
+	}
+	if err := s.store.ForRealm(realm.Name).StoreAuthCodeGrant(code, authCode); err != nil {
 		return "", err
 	}
 	return code, nil
 }
 
-func (s *OAuthService) ExchangeToken(req *models.TokenRequest) (string, string, error) {
-	if req.GrantType != "authorization_code" && req.GrantType != "refresh_token" {
-		return "", "", errors.New("unsupported grant type")
-	}
-
-	if req.GrantType == "authorization_code" {
-		return s.handleAuthorizationCodeGrant(req)
+func (s *OAuthService) ExchangeToken(realm *realms.Realm, req *models.TokenRequest) (*models.TokenResponse, error) {
+	switch req.GrantType {
+	case "authorization_code":
+		return s.handleAuthorizationCodeGrant(realm, req)
+	case "refresh_token":
+		return s.handleRefreshTokenGrant(realm, req)
+	case "client_credentials":
+		return s.handleClientCredentialsGrant(realm, req)
+	default:
+		return nil, errors.New("unsupported grant type")
 	}
-
-	return s.handleRefreshTokenGrant(req)
 }
 
-func (s *OAuthService) handleAuthorizationCodeGrant(req *models.TokenRequest) (string, string, error) {
-	authCode := s.store.GetAuthCode(req.Code)
+func (s *OAuthService) handleAuthorizationCodeGrant(realm *realms.Realm, req *models.TokenRequest) (*models.TokenResponse, error) {
+	store := s.store.ForRealm(realm.Name)
+	authCode := store.GetAuthCode(req.Code)
 	if authCode == nil {
-		return "", "", errors.New("invalid authorization code")
+		return nil, errors.New("invalid authorization code")
 	}
 
 	if err := s.validatePKCE(authCode, req.CodeVerifier); err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	// Generate tokens
-	accessToken, err := utils.GenerateJWT(authCode.UserID, time.Hour)
+	client, err := authenticateClient(store, req.ClientID, req.ClientSecret)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+	if client.ClientID != authCode.ClientID || !userActive(store, authCode.UserID) {
+		return nil, errors.New("invalid authorization code")
 	}
+	policy := tokenPolicyFor(realm, client)
 
-	refreshToken := utils.GenerateRandomString(32)
-	err = s.store.StoreRefreshToken(refreshToken, authCode.UserID, authCode.ClientID)
+	// Generate tokens
+	accessToken, err := utils.GenerateJWT(realm.SigningKey, realm.Issuer, authCode.UserID, authCode.Scope, policy.AccessTokenTTL)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	return accessToken, refreshToken, nil
+	resp := &models.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(policy.AccessTokenTTL.Seconds()),
+		Scope:       authCode.Scope,
+	}
+
+	if hasScope(authCode.Scope, "openid") {
+		resp.IDToken, err = generateIDToken(realm, authCode, store.GetUser(authCode.UserID), policy.AccessTokenTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Clients that require offline_access only get a refresh token when
+	// the user granted that scope.
+	if !policy.allowsRefreshToken(authCode.Scope) {
+		return resp, nil
+	}
+
+	now := time.Now()
+	absoluteExpiresAt := now.Add(policy.RefreshTokenAbsoluteTTL)
+	token := utils.GenerateRandomString(32)
+	refreshToken := &models.RefreshToken{
+		UserID:            authCode.UserID,
+		ClientID:          authCode.ClientID,
+		Scope:             authCode.Scope,
+		ExpiresAt:         policy.idleExpiry(now, absoluteExpiresAt),
+		AbsoluteExpiresAt: absoluteExpiresAt,
+	}
+	if err := store.StoreRefreshToken(token, refreshToken); err != nil {
+		return nil, err
+	}
+
+	resp.RefreshToken = token
+	return resp, nil
 }
 
-func (s *OAuthService) handleRefreshTokenGrant(req *models.TokenRequest) (string, string, error) {
+func (s *OAuthService) handleRefreshTokenGrant(realm *realms.Realm, req *models.TokenRequest) (*models.TokenResponse, error) {
 	if req.RefreshToken == "" {
-		return "", "", errors.New("refresh token is required")
+		return nil, errors.New("refresh token is required")
 	}
 
-	refreshToken := s.store.GetRefreshToken(req.RefreshToken)
+	store := s.store.ForRealm(realm.Name)
+	refreshToken := store.GetRefreshToken(req.RefreshToken)
 	if refreshToken == nil {
-		return "", "", errors.New("invalid refresh token")
+		return nil, errors.New("invalid refresh token")
 	}
 
-	// Delete the used refresh token
-	if err := s.store.DeleteRefreshToken(req.RefreshToken); err != nil {
-		return "", "", err
+	client, err := authenticateClient(store, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if client.ClientID != refreshToken.ClientID || !userActive(store, refreshToken.UserID) {
+		return nil, errors.New("invalid refresh token")
+	}
+	policy := tokenPolicyFor(realm, client)
+
+	now := time.Now()
+	if !now.Before(refreshToken.AbsoluteExpiresAt) || !now.Before(refreshToken.ExpiresAt) {
+		return nil, errors.New("refresh token expired")
+	}
+	if !policy.allowsRefreshToken(refreshToken.Scope) {
+		return nil, errors.New("offline_access scope is required")
 	}
 
 	// Generate new access token
-	accessToken, err := utils.GenerateJWT(refreshToken.UserID, time.Hour)
+	accessToken, err := utils.GenerateJWT(realm.SigningKey, realm.Issuer, refreshToken.UserID, refreshToken.Scope, policy.AccessTokenTTL)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	resp := &models.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(policy.AccessTokenTTL.Seconds()),
+		Scope:       refreshToken.Scope,
+	}
+
+	expiresAt := policy.idleExpiry(now, refreshToken.AbsoluteExpiresAt)
+
+	if !policy.RotateRefreshTokens {
+		// Keep the same token and slide its idle expiry forward
+		if err := store.UpdateRefreshTokenExpiry(req.RefreshToken, expiresAt); err != nil {
+			return nil, err
+		}
+		resp.RefreshToken = req.RefreshToken
+		return resp, nil
 	}
 
-	// Generate new refresh token
-	newRefreshToken := utils.GenerateRandomString(32)
-	err = s.store.StoreRefreshToken(newRefreshToken, refreshToken.UserID, refreshToken.ClientID)
+	// Generate new refresh token; it inherits the absolute expiry of the
+	// token it replaces so rotation can't extend the grant indefinitely.
+	newToken := utils.GenerateRandomString(32)
+	newRefreshToken := &models.RefreshToken{
+		UserID:            refreshToken.UserID,
+		ClientID:          refreshToken.ClientID,
+		Scope:             refreshToken.Scope,
+		ExpiresAt:         expiresAt,
+		AbsoluteExpiresAt: refreshToken.AbsoluteExpiresAt,
+	}
+
+	// Replace the used refresh token; losing a race with a concurrent
+	// request for the same token means it was already spent
+	if err := store.RotateRefreshToken(req.RefreshToken, newToken, newRefreshToken); err != nil {
+		if errors.Is(err, storage.ErrRefreshTokenNotFound) {
+			return nil, errors.New("invalid refresh token")
+		}
+		return nil, err
+	}
+
+	resp.RefreshToken = newToken
+	return resp, nil
+}
+
+// handleClientCredentialsGrant issues an access token to a client acting
+// on its own behalf. The only scope it can be granted is scim, and only to
+// the clients listed in scim.clients; no refresh token is issued.
+func (s *OAuthService) handleClientCredentialsGrant(realm *realms.Realm, req *models.TokenRequest) (*models.TokenResponse, error) {
+	store := s.store.ForRealm(realm.Name)
+	client, err := authenticateClient(store, req.ClientID, req.ClientSecret)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
+	if !isSCIMClient(client.ClientID) {
+		return nil, errors.New("client is not allowed the client_credentials grant")
+	}
+	scope := req.Scope
+	if scope == "" {
+		scope = SCIMScope
+	}
+	if scope != SCIMScope {
+		return nil, errors.New("invalid scope")
+	}
+	policy := tokenPolicyFor(realm, client)
+
+	accessToken, err := utils.GenerateClientJWT(realm.SigningKey, realm.Issuer, client.ClientID, scope, policy.AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &models.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(policy.AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	}, nil
+}
 
-	return accessToken, newRefreshToken, nil
+// userActive reports whether a user still exists and isn't disabled, so
+// codes and refresh tokens stop working once the account is.
+func userActive(store storage.UserRepository, userID uint) bool {
+	user := store.GetUser(userID)
+	return user != nil && !user.Disabled
 }
 
 func (s *OAuthService) validatePKCE(authCode *models.AuthCode, codeVerifier string) error {
@@ -144,4 +297,22 @@ func (s *OAuthService) validatePKCE(authCode *models.AuthCode, codeVerifier stri
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// generateIDToken issues the OpenID Connect ID token for a code, stating
+// how the user signed in and, with the email scope, their email address.
+func generateIDToken(realm *realms.Realm, authCode *models.AuthCode, user *models.User, ttl time.Duration) (string, error) {
+	claims := utils.IDTokenClaims{Nonce: authCode.Nonce}
+	if user != nil && hasScope(authCode.Scope, "email") {
+		claims.Email = user.Email
+		claims.EmailVerified = &user.EmailVerified
+	}
+	if authCode.AuthTime != nil {
+		claims.AuthTime = authCode.AuthTime.Unix()
+	}
+	if methods := strings.Fields(authCode.AuthMethods); len(methods) > 0 {
+		claims.AMR = methods
+		claims.ACR = acrFor(methods)
+	}
+	return utils.GenerateIDToken(realm.SigningKey, realm.Issuer, authCode.ClientID, authCode.UserID, ttl, claims)
+}
@@ -0,0 +1,375 @@
+package services_test
+
+import (
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestIDTokenEmailClaims(t *testing.T) {
+	cfg := useTestConfig(t, nil)
+	secret := []byte("test-secret-test-secret-test-secret")
+	realm := &realms.Realm{Name: "default", Issuer: "https://auth.example.com", Tokens: cfg.Tokens, SigningKey: utils.NewHMACKey(secret)}
+	memory := storage.NewMemoryStorage()
+	store := memory.ForRealm(realm.Name)
+	alice := &models.User{Username: "alice", Email: "alice@example.com", EmailVerified: true, Password: "hash"}
+	bob := &models.User{Username: "bob", Email: "bob@example.com", Password: "hash"}
+	for _, user := range []*models.User{alice, bob} {
+		if err := store.StoreUser(user); err != nil {
+			t.Fatalf("StoreUser: %v", err)
+		}
+	}
+	client := &models.Client{SecretHash: utils.HashSecret("app-secret"), RedirectURIs: models.StringArray{"https://app.example.com/cb"}}
+	if err := store.StoreClient(client); err != nil {
+		t.Fatalf("StoreClient: %v", err)
+	}
+	oauthService := services.NewOAuthService(memory)
+
+	tests := []struct {
+		name         string
+		user         *models.User
+		scope        string
+		wantIDToken  bool
+		wantEmail    string
+		wantVerified *bool
+	}{
+		{name: "email scope", user: alice, scope: "openid email", wantIDToken: true, wantEmail: "alice@example.com", wantVerified: &alice.EmailVerified},
+		{name: "unverified email", user: bob, scope: "openid email", wantIDToken: true, wantEmail: "bob@example.com", wantVerified: &bob.EmailVerified},
+		{name: "no email scope", user: alice, scope: "openid", wantIDToken: true},
+		{name: "no openid scope", user: alice, scope: "email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const verifier = "verifier-verifier-verifier-verifier-verifier"
+			code, err := oauthService.GenerateAuthorizationCode(realm, &models.AuthorizationRequest{
+				ClientID:            client.ClientID,
+				RedirectURI:         "https://app.example.com/cb",
+				Scope:               tt.scope,
+				CodeChallenge:       verifier,
+				CodeChallengeMethod: "plain",
+				Nonce:               "n-1",
+			}, &services.Authentication{UserID: tt.user.ID, Methods: []string{services.AMRPassword}, Time: time.Now()})
+			if err != nil {
+				t.Fatalf("GenerateAuthorizationCode: %v", err)
+			}
+			resp, err := oauthService.ExchangeToken(realm, &models.TokenRequest{
+				GrantType:    "authorization_code",
+				Code:         code,
+				CodeVerifier: verifier,
+				ClientID:     client.ClientID,
+				ClientSecret: "app-secret",
+			})
+			if err != nil {
+				t.Fatalf("ExchangeToken: %v", err)
+			}
+			if !tt.wantIDToken {
+				if resp.IDToken != "" {
+					t.Errorf("ID token issued without the openid scope")
+				}
+				return
+			}
+
+			claims := &utils.IDTokenClaims{}
+			if _, err := jwt.ParseWithClaims(resp.IDToken, claims, func(*jwt.Token) (interface{}, error) { return secret, nil }); err != nil {
+				t.Fatalf("parsing ID token: %v", err)
+			}
+			if claims.Nonce != "n-1" || claims.Subject != strconv.FormatUint(uint64(tt.user.ID), 10) {
+				t.Errorf("claims = %+v, want nonce n-1 and subject %d", claims, tt.user.ID)
+			}
+			if claims.Email != tt.wantEmail {
+				t.Errorf("email = %q, want %q", claims.Email, tt.wantEmail)
+			}
+			if (claims.EmailVerified == nil) != (tt.wantVerified == nil) ||
+				claims.EmailVerified != nil && *claims.EmailVerified != *tt.wantVerified {
+				t.Errorf("email_verified = %v, want %v", claims.EmailVerified, tt.wantVerified)
+			}
+		})
+	}
+}
+
+// oauthFixture is a realm with the user alice and the client app, whose
+// secret is "app-secret".
+type oauthFixture struct {
+	realm        *realms.Realm
+	store        storage.Store
+	oauthService *services.OAuthService
+	alice        *models.User
+	app          *models.Client
+}
+
+// newOAuthFixture sets up an oauthFixture with the realm's refresh tokens
+// idle for an hour and valid for a day at most. configure, if given,
+// adjusts the client before it is stored.
+func newOAuthFixture(t *testing.T, configure func(client *models.Client)) *oauthFixture {
+	t.Helper()
+	cfg := useTestConfig(t, func(cfg *config.Config) {
+		cfg.Tokens.RefreshTokenIdleExpiry = config.Duration(time.Hour)
+		cfg.Tokens.RefreshTokenAbsoluteExpiry = config.Duration(24 * time.Hour)
+		cfg.Tokens.RotateRefreshTokens = true
+		cfg.Tokens.RequireOfflineAccess = false
+	})
+	realm := &realms.Realm{Name: "default", Issuer: "https://auth.example.com", Tokens: cfg.Tokens,
+		SigningKey: utils.NewHMACKey([]byte("test-secret-test-secret-test-secret"))}
+	memory := storage.NewMemoryStorage()
+	store := memory.ForRealm(realm.Name)
+
+	alice := &models.User{Username: "alice", Email: "alice@example.com", Password: "hash"}
+	if err := store.StoreUser(alice); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	app := &models.Client{SecretHash: utils.HashSecret("app-secret"), RedirectURIs: models.StringArray{"https://app.example.com/cb"}}
+	if configure != nil {
+		configure(app)
+	}
+	if err := store.StoreClient(app); err != nil {
+		t.Fatalf("StoreClient: %v", err)
+	}
+	return &oauthFixture{realm: realm, store: store, oauthService: services.NewOAuthService(memory), alice: alice, app: app}
+}
+
+// authorize runs the authorization code grant for alice and app.
+func (f *oauthFixture) authorize(t *testing.T, scope string) *models.TokenResponse {
+	t.Helper()
+	const verifier = "verifier-verifier-verifier-verifier-verifier"
+	code, err := f.oauthService.GenerateAuthorizationCode(f.realm, &models.AuthorizationRequest{
+		ClientID:            f.app.ClientID,
+		RedirectURI:         "https://app.example.com/cb",
+		Scope:               scope,
+		CodeChallenge:       verifier,
+		CodeChallengeMethod: "plain",
+	}, &services.Authentication{UserID: f.alice.ID, Methods: []string{services.AMRPassword}, Time: time.Now()})
+	if err != nil {
+		t.Fatalf("GenerateAuthorizationCode: %v", err)
+	}
+	resp, err := f.oauthService.ExchangeToken(f.realm, &models.TokenRequest{
+		GrantType:    "authorization_code",
+		Code:         code,
+		CodeVerifier: verifier,
+		ClientID:     f.app.ClientID,
+		ClientSecret: "app-secret",
+	})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %v", err)
+	}
+	return resp
+}
+
+// refresh runs the refresh token grant as app.
+func (f *oauthFixture) refresh(refreshToken string) (*models.TokenResponse, error) {
+	return f.oauthService.ExchangeToken(f.realm, &models.TokenRequest{
+		GrantType:    "refresh_token",
+		RefreshToken: refreshToken,
+		ClientID:     f.app.ClientID,
+		ClientSecret: "app-secret",
+	})
+}
+
+// storeRefreshToken stores a refresh token for alice and app with the
+// given expiries.
+func (f *oauthFixture) storeRefreshToken(t *testing.T, scope string, expiresAt, absoluteExpiresAt time.Time) string {
+	t.Helper()
+	token := utils.GenerateRandomString(32)
+	if err := f.store.StoreRefreshToken(token, &models.RefreshToken{
+		UserID:            f.alice.ID,
+		ClientID:          f.app.ClientID,
+		Scope:             scope,
+		ExpiresAt:         expiresAt,
+		AbsoluteExpiresAt: absoluteExpiresAt,
+	}); err != nil {
+		t.Fatalf("StoreRefreshToken: %v", err)
+	}
+	return token
+}
+
+// within reports whether got is want, give or take a minute.
+func within(got, want time.Time) bool {
+	return got.Sub(want).Abs() < time.Minute
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	t.Run("issued", func(t *testing.T) {
+		f := newOAuthFixture(t, nil)
+		start := time.Now()
+		resp := f.authorize(t, "openid")
+		stored := f.store.GetRefreshToken(resp.RefreshToken)
+		if stored == nil {
+			t.Fatal("refresh token not stored")
+		}
+		if !within(stored.ExpiresAt, start.Add(time.Hour)) {
+			t.Errorf("idle expiry = %v, want an hour from now", stored.ExpiresAt)
+		}
+		if !within(stored.AbsoluteExpiresAt, start.Add(24*time.Hour)) {
+			t.Errorf("absolute expiry = %v, want a day from now", stored.AbsoluteExpiresAt)
+		}
+	})
+
+	t.Run("client lifetimes", func(t *testing.T) {
+		f := newOAuthFixture(t, func(client *models.Client) {
+			client.RefreshTokenIdleTTL = 600
+			client.RefreshTokenAbsoluteTTL = 3600
+		})
+		start := time.Now()
+		stored := f.store.GetRefreshToken(f.authorize(t, "openid").RefreshToken)
+		if stored == nil {
+			t.Fatal("refresh token not stored")
+		}
+		if !within(stored.ExpiresAt, start.Add(10*time.Minute)) || !within(stored.AbsoluteExpiresAt, start.Add(time.Hour)) {
+			t.Errorf("expiries = %v and %v, want the client's lifetimes", stored.ExpiresAt, stored.AbsoluteExpiresAt)
+		}
+	})
+
+	now := time.Now()
+	tests := []struct {
+		name              string
+		expiresAt         time.Time
+		absoluteExpiresAt time.Time
+		wantErr           bool
+		// wantExpiresAt is the idle expiry of the rotated token
+		wantExpiresAt time.Time
+	}{
+		{name: "valid", expiresAt: now.Add(time.Minute), absoluteExpiresAt: now.Add(12 * time.Hour), wantExpiresAt: now.Add(time.Hour)},
+		{name: "idle expiry capped at the absolute expiry", expiresAt: now.Add(time.Minute), absoluteExpiresAt: now.Add(10 * time.Minute), wantExpiresAt: now.Add(10 * time.Minute)},
+		{name: "idle expired", expiresAt: now.Add(-time.Second), absoluteExpiresAt: now.Add(12 * time.Hour), wantErr: true},
+		{name: "absolutely expired", expiresAt: now.Add(time.Minute), absoluteExpiresAt: now.Add(-time.Second), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOAuthFixture(t, nil)
+			token := f.storeRefreshToken(t, "openid", tt.expiresAt, tt.absoluteExpiresAt)
+
+			resp, err := f.refresh(token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("refresh with an expired token succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("refresh: %v", err)
+			}
+			if resp.RefreshToken == token {
+				t.Fatal("refresh token not rotated")
+			}
+			rotated := f.store.GetRefreshToken(resp.RefreshToken)
+			if rotated == nil {
+				t.Fatal("rotated refresh token not stored")
+			}
+			if !within(rotated.ExpiresAt, tt.wantExpiresAt) {
+				t.Errorf("idle expiry = %v, want %v", rotated.ExpiresAt, tt.wantExpiresAt)
+			}
+			// Rotation never extends the grant
+			if !rotated.AbsoluteExpiresAt.Equal(tt.absoluteExpiresAt) {
+				t.Errorf("absolute expiry = %v, want the original %v", rotated.AbsoluteExpiresAt, tt.absoluteExpiresAt)
+			}
+			if _, err := f.refresh(token); err == nil {
+				t.Error("the rotated refresh token still works")
+			}
+		})
+	}
+}
+
+func TestRefreshTokenWithoutRotation(t *testing.T) {
+	rotate := false
+	f := newOAuthFixture(t, func(client *models.Client) { client.RotateRefreshTokens = &rotate })
+	now := time.Now()
+	absoluteExpiresAt := now.Add(12 * time.Hour)
+	token := f.storeRefreshToken(t, "openid", now.Add(time.Minute), absoluteExpiresAt)
+
+	for i := 0; i < 2; i++ {
+		resp, err := f.refresh(token)
+		if err != nil {
+			t.Fatalf("refresh %d: %v", i+1, err)
+		}
+		if resp.RefreshToken != token || resp.AccessToken == "" {
+			t.Fatalf("refresh %d returned refresh token %q, want the same one", i+1, resp.RefreshToken)
+		}
+	}
+
+	// The idle expiry slid forward; the absolute expiry stayed
+	stored := f.store.GetRefreshToken(token)
+	if stored == nil {
+		t.Fatal("refresh token gone")
+	}
+	if !within(stored.ExpiresAt, now.Add(time.Hour)) {
+		t.Errorf("idle expiry = %v, want an hour from now", stored.ExpiresAt)
+	}
+	if !stored.AbsoluteExpiresAt.Equal(absoluteExpiresAt) {
+		t.Errorf("absolute expiry = %v, want %v", stored.AbsoluteExpiresAt, absoluteExpiresAt)
+	}
+}
+
+func TestRequireOfflineAccess(t *testing.T) {
+	tests := []struct {
+		name             string
+		require          bool
+		scope            string
+		wantRefreshToken bool
+	}{
+		{name: "not required", scope: "openid", wantRefreshToken: true},
+		{name: "required and granted", require: true, scope: "openid offline_access", wantRefreshToken: true},
+		{name: "required and not granted", require: true, scope: "openid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := tt.require
+			f := newOAuthFixture(t, func(client *models.Client) { client.RequireOfflineAccess = &require })
+
+			resp := f.authorize(t, tt.scope)
+			if got := resp.RefreshToken != ""; got != tt.wantRefreshToken {
+				t.Errorf("refresh token issued = %v, want %v", got, tt.wantRefreshToken)
+			}
+
+			// Tokens issued before the client required offline_access stop
+			// working once it does
+			token := f.storeRefreshToken(t, tt.scope, time.Now().Add(time.Hour), time.Now().Add(12*time.Hour))
+			if _, err := f.refresh(token); (err == nil) != tt.wantRefreshToken {
+				t.Errorf("refresh error = %v, want success %v", err, tt.wantRefreshToken)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenClientMismatch(t *testing.T) {
+	f := newOAuthFixture(t, nil)
+	other := &models.Client{SecretHash: utils.HashSecret("other-secret"), RedirectURIs: models.StringArray{"https://other.example.com/cb"}}
+	if err := f.store.StoreClient(other); err != nil {
+		t.Fatalf("StoreClient: %v", err)
+	}
+	token := f.authorize(t, "openid").RefreshToken
+
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+	}{
+		{name: "another client", clientID: other.ClientID, clientSecret: "other-secret"},
+		{name: "wrong secret", clientID: f.app.ClientID, clientSecret: "other-secret"},
+		{name: "no client", clientID: "", clientSecret: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := f.oauthService.ExchangeToken(f.realm, &models.TokenRequest{
+				GrantType:    "refresh_token",
+				RefreshToken: token,
+				ClientID:     tt.clientID,
+				ClientSecret: tt.clientSecret,
+			})
+			if err == nil {
+				t.Fatal("refresh with another client's token succeeded")
+			}
+		})
+	}
+
+	// The rejected attempts didn't spend the token
+	if _, err := f.refresh(token); err != nil {
+		t.Errorf("refresh by the token's client: %v", err)
+	}
+}
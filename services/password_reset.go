@@ -0,0 +1,183 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"oauth2-provider/config"
+	"oauth2-provider/mailer"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// passwordResetPurpose binds reset links to this flow.
+const passwordResetPurpose = "password-reset"
+
+var (
+	ErrInvalidResetLink = errors.New("invalid or expired password reset link")
+	ErrWrongPassword    = errors.New("current password is incorrect")
+	ErrEmptyPassword    = errors.New("password must not be empty")
+)
+
+// ForgotPassword mails a password reset link to the user registered with
+// email. Unknown addresses are ignored, so the response doesn't reveal
+// which addresses have accounts; so are directory users, whose password
+// can't be reset here.
+func (s *UserService) ForgotPassword(realm *realms.Realm, email string) error {
+	user := s.store.ForRealm(realm.Name).GetUserByEmail(email)
+	if user == nil || user.Source == models.SourceLDAP {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(config.Get().PasswordReset.LinkExpiry.Duration())
+	token := utils.SignToken(passwordResetPurpose, expiresAt,
+		realm.Name,
+		strconv.FormatUint(uint64(user.ID), 10),
+		passwordFingerprint(user),
+	)
+	link := realm.Issuer + "/password/reset?token=" + url.QueryEscape(token)
+
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nSomeone asked to reset the password of your account. To choose a new password, open this link:\n\n%s\n\nThe link expires on %s and works only once. If you did not ask for this, ignore this email.\n",
+			user.Username, link, expiresAt.UTC().Format(time.RFC1123)),
+	})
+}
+
+// passwordFingerprint identifies the user's current password hash. Reset
+// links are signed over it, so a link stops working once any reset or
+// change has replaced the password.
+func passwordFingerprint(user *models.User) string {
+	return utils.HashToken(user.Password)[:16]
+}
+
+// CheckPasswordResetToken returns the user a reset link was sent to, as
+// long as the link is still valid.
+func (s *UserService) CheckPasswordResetToken(realm *realms.Realm, token string) (*models.User, error) {
+	fields, err := utils.VerifySignedToken(passwordResetPurpose, token)
+	if err != nil || len(fields) != 3 || fields[0] != realm.Name {
+		return nil, ErrInvalidResetLink
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidResetLink
+	}
+
+	user := s.store.ForRealm(realm.Name).GetUser(uint(userID))
+	if user == nil || passwordFingerprint(user) != fields[2] {
+		return nil, ErrInvalidResetLink
+	}
+	return user, nil
+}
+
+// ResetPassword sets a new password for the user a reset link was sent to.
+func (s *UserService) ResetPassword(realm *realms.Realm, token, newPassword string) error {
+	user, err := s.CheckPasswordResetToken(realm, token)
+	if err != nil {
+		return err
+	}
+	// The link was delivered to the user's mailbox, so following it also
+	// proves they own the address.
+	user.EmailVerified = true
+	return s.setPassword(realm, user, newPassword)
+}
+
+// ChangePassword replaces the password of a signed-in user, at ip, who
+// knows the current one. Wrong current passwords count towards the same
+// lockout as failed logins, so a stolen access token can't be used to
+// guess the password.
+func (s *UserService) ChangePassword(realm *realms.Realm, userID uint, currentPassword, newPassword, ip string) error {
+	user := s.store.ForRealm(realm.Name).GetUser(userID)
+	if user == nil {
+		return ErrWrongPassword
+	}
+	if user.Source == models.SourceLDAP {
+		return ErrPasswordManagedByDirectory
+	}
+	if err := s.checkLoginAllowed(realm, user.Username, ip); err != nil {
+		return err
+	}
+	if ok, _ := passwords.Verify(currentPassword, user.Password); !ok {
+		s.recordLoginFailure(realm, user.Username, ip)
+		return ErrWrongPassword
+	}
+	s.clearLoginFailures(realm, user.Username)
+	return s.setPassword(realm, user, newPassword)
+}
+
+// setPassword stores the new password and revokes the user's refresh
+// tokens, so other devices have to sign in again. Access tokens already
+// issued stay valid until they expire.
+func (s *UserService) setPassword(realm *realms.Realm, user *models.User, password string) error {
+	if user.Source == models.SourceLDAP {
+		return ErrPasswordManagedByDirectory
+	}
+	if err := s.checkPassword(password, user.Username, user.Email); err != nil {
+		return err
+	}
+	history := passwordHistory(user)
+	for _, hash := range history {
+		if ok, _ := passwords.Verify(password, hash); ok {
+			problem := "must differ from your current password"
+			if n := config.Get().PasswordPolicy.History; n > 1 {
+				problem = fmt.Sprintf("must differ from your last %d passwords", n)
+			}
+			return &passwords.PolicyError{Problems: []string{problem}}
+		}
+	}
+	hashedPassword, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	store := s.store.ForRealm(realm.Name)
+	if len(history) > 0 && len(history) == config.Get().PasswordPolicy.History {
+		history = history[:len(history)-1]
+	}
+	user.PasswordHistory = strings.Join(history, " ")
+	user.Password = hashedPassword
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+
+	revoked, err := store.DeleteRefreshTokensForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Changed password of user %d in realm %s, revoked %d refresh tokens", user.ID, realm.Name, revoked)
+	return nil
+}
+
+// checkPassword applies the password policy to a password chosen by the
+// user with the given username and email address.
+func (s *UserService) checkPassword(password, username, email string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	if s.policy == nil {
+		return nil
+	}
+	return s.policy.Check(password, username, email)
+}
+
+// passwordHistory returns the hashes of the passwords the user may not
+// choose again: the current one first, then older ones, up to the
+// configured history.
+func passwordHistory(user *models.User) []string {
+	n := config.Get().PasswordPolicy.History
+	if n == 0 {
+		return nil
+	}
+	history := append([]string{user.Password}, strings.Fields(user.PasswordHistory)...)
+	if len(history) > n {
+		history = history[:n]
+	}
+	return history
+}
@@ -0,0 +1,76 @@
+package services_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"testing"
+	"time"
+)
+
+func TestChangePasswordLockout(t *testing.T) {
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.Lockout.MaxFailures = 3
+		cfg.Lockout.IPMaxFailures = 0
+		cfg.Lockout.Window = config.Duration(time.Hour)
+		cfg.Lockout.Duration = config.Duration(time.Hour)
+	})
+	realm := &realms.Realm{Name: "default"}
+	hash, err := passwords.Hash("current-password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		wrongTries  int
+		wantBlocked bool
+	}{
+		{name: "no failures", wrongTries: 0},
+		{name: "below the threshold", wrongTries: 2},
+		{name: "at the threshold", wrongTries: 3, wantBlocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := storage.NewMemoryStorage()
+			store := memory.ForRealm(realm.Name)
+			user := &models.User{Username: "alice", Email: "alice@example.com", Password: hash}
+			if err := store.StoreUser(user); err != nil {
+				t.Fatalf("StoreUser: %v", err)
+			}
+			userService := services.NewUserService(memory, nil, nil, nil, nil, nil, nil)
+
+			for i := 0; i < tt.wrongTries; i++ {
+				if err := userService.ChangePassword(realm, user.ID, "wrong", "Next-password-1", "192.0.2.1"); !errors.Is(err, services.ErrWrongPassword) {
+					t.Fatalf("attempt %d: ChangePassword error = %v, want ErrWrongPassword", i+1, err)
+				}
+			}
+
+			err := userService.ChangePassword(realm, user.ID, "current-password", "Next-password-1", "192.0.2.1")
+			var blocked *services.LoginBlockedError
+			if tt.wantBlocked {
+				if !errors.As(err, &blocked) || blocked.RetryAfter <= 0 {
+					t.Fatalf("ChangePassword error = %v, want a LoginBlockedError", err)
+				}
+				if ok, _ := passwords.Verify("current-password", store.GetUser(user.ID).Password); !ok {
+					t.Error("password changed while locked out")
+				}
+				// The lockout applies to logins as well
+				if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "current-password"}, ""); !errors.As(err, &blocked) {
+					t.Errorf("Login error = %v, want a LoginBlockedError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ChangePassword: %v", err)
+			}
+			if store.GetLoginAttempt("user:alice") != nil {
+				t.Error("failures not cleared by a successful change")
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+	"log"
+	"net/http"
+	"net/url"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SAML name ID formats, keyed by the models.NameID constants.
+var samlNameIDFormats = map[string]saml.NameIDFormat{
+	models.NameIDPersistent: saml.PersistentNameIDFormat,
+	models.NameIDEmail:      saml.EmailAddressNameIDFormat,
+	models.NameIDUsername:   saml.UnspecifiedNameIDFormat,
+}
+
+const (
+	// samlRequestTTL is how long an AuthnRequest may be answered after the
+	// service provider issued it, long enough for the user to sign in
+	// first.
+	samlRequestTTL = 10 * time.Minute
+	// samlAssertionTTL is how long a service provider may take to consume
+	// an assertion.
+	samlAssertionTTL = 5 * time.Minute
+
+	samlAttributeFormatBasic = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	samlAttributeFormatURI   = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	samlContextPassword      = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	samlContextUnspecified   = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+)
+
+var (
+	ErrSAMLDisabled           = errors.New("this realm is not a SAML identity provider")
+	ErrUnknownServiceProvider = errors.New("unknown service provider")
+	ErrInvalidSAMLRequest     = errors.New("invalid SAML request")
+	ErrNoSingleLogoutService  = errors.New("the service provider has no single logout service")
+)
+
+type SAMLService struct {
+	store storage.Store
+}
+
+func NewSAMLService(store storage.Store) *SAMLService {
+	return &SAMLService{store: store}
+}
+
+// SAMLResponse is a message for a service provider, delivered by the
+// user's browser.
+type SAMLResponse struct {
+	// RedirectURL is set for the HTTP-Redirect binding.
+	RedirectURL string
+	// Otherwise the browser posts Message and RelayState to URL.
+	URL        string
+	Message    string
+	RelayState string
+}
+
+// SAMLLogin is a service provider's request to sign a user in, either
+// an AuthnRequest or an IdP-initiated login.
+type SAMLLogin struct {
+	req      *saml.IdpAuthnRequest
+	provider *models.SAMLServiceProvider
+	// continuePath repeats the request, for the login page to send the
+	// user back to.
+	continuePath string
+}
+
+// ContinuePath is the path on this server that resumes the login once the
+// user has a login code.
+func (l *SAMLLogin) ContinuePath() string {
+	return l.continuePath
+}
+
+// Accepts reports whether auth is recent enough for the request. A
+// service provider asking for ForceAuthn needs the user to sign in again.
+func (l *SAMLLogin) Accepts(auth *Authentication) bool {
+	forceAuthn := l.req.Request.ForceAuthn
+	if forceAuthn == nil || !*forceAuthn {
+		return true
+	}
+	return auth.Time.After(l.req.Request.IssueInstant.Add(-saml.MaxClockSkew))
+}
+
+// samlServiceProviders looks up the service providers of one realm for
+// the SAML library.
+type samlServiceProviders struct {
+	store storage.Store
+}
+
+func (p samlServiceProviders) GetServiceProvider(_ *http.Request, entityID string) (*saml.EntityDescriptor, error) {
+	provider := p.store.GetSAMLServiceProvider(entityID)
+	if provider == nil {
+		return nil, os.ErrNotExist
+	}
+	return samlsp.ParseMetadata([]byte(provider.Metadata))
+}
+
+// SAMLMetadataURL is the realm's SAML entity ID, where its metadata is
+// published.
+func SAMLMetadataURL(realm *realms.Realm) string {
+	return realm.Issuer + "/saml/metadata"
+}
+
+func (s *SAMLService) identityProvider(realm *realms.Realm) (*saml.IdentityProvider, error) {
+	if realm.SAMLKey == nil {
+		return nil, ErrSAMLDisabled
+	}
+	metadataURL, err := url.Parse(SAMLMetadataURL(realm))
+	if err != nil {
+		return nil, err
+	}
+	return &saml.IdentityProvider{
+		Key:                     realm.SAMLKey.Key,
+		Certificate:             realm.SAMLKey.Certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *metadataURL.ResolveReference(&url.URL{Path: "sso"}),
+		LogoutURL:               *metadataURL.ResolveReference(&url.URL{Path: "slo"}),
+		ServiceProviderProvider: samlServiceProviders{store: s.store.ForRealm(realm.Name)},
+		SignatureMethod:         dsig.RSASHA256SignatureMethod,
+	}, nil
+}
+
+// Metadata returns the realm's IdP metadata document.
+func (s *SAMLService) Metadata(realm *realms.Realm) ([]byte, error) {
+	idp, err := s.identityProvider(realm)
+	if err != nil {
+		return nil, err
+	}
+	descriptor := idp.Metadata()
+	sso := &descriptor.IDPSSODescriptors[0]
+	// Assertions are signed, never decrypted, so only the signing key is
+	// published
+	sso.KeyDescriptors = sso.KeyDescriptors[:1]
+	sso.NameIDFormats = nil
+	for _, format := range []string{models.NameIDPersistent, models.NameIDEmail, models.NameIDUsername} {
+		sso.NameIDFormats = append(sso.NameIDFormats, samlNameIDFormats[format])
+	}
+	sso.SingleLogoutServices = append(sso.SingleLogoutServices, saml.Endpoint{
+		Binding:  saml.HTTPPostBinding,
+		Location: idp.LogoutURL.String(),
+	})
+	return xml.MarshalIndent(descriptor, "", "  ")
+}
+
+// RegisterServiceProvider registers a service provider from its metadata.
+func (s *SAMLService) RegisterServiceProvider(realm *realms.Realm, req *models.SAMLServiceProviderRegistration) (*models.SAMLServiceProvider, error) {
+	if realm.SAMLKey == nil {
+		return nil, ErrSAMLDisabled
+	}
+	provider := &models.SAMLServiceProvider{}
+	if err := applyServiceProviderRegistration(provider, req); err != nil {
+		return nil, err
+	}
+	if err := s.store.ForRealm(realm.Name).StoreSAMLServiceProvider(provider); err != nil {
+		return nil, err
+	}
+	audit(realm, AuditSAMLProviderRegistered, "entity_id", provider.EntityID)
+	return provider, nil
+}
+
+// ListServiceProviders returns the realm's service providers.
+func (s *SAMLService) ListServiceProviders(realm *realms.Realm) ([]models.SAMLServiceProvider, error) {
+	if realm.SAMLKey == nil {
+		return nil, ErrSAMLDisabled
+	}
+	return s.store.ForRealm(realm.Name).ListSAMLServiceProviders()
+}
+
+// UpdateServiceProvider replaces the metadata and settings of a service
+// provider. The new metadata must keep its entity ID.
+func (s *SAMLService) UpdateServiceProvider(realm *realms.Realm, entityID string, req *models.SAMLServiceProviderRegistration) (*models.SAMLServiceProvider, error) {
+	if realm.SAMLKey == nil {
+		return nil, ErrSAMLDisabled
+	}
+	store := s.store.ForRealm(realm.Name)
+	provider := store.GetSAMLServiceProvider(entityID)
+	if provider == nil {
+		return nil, ErrUnknownServiceProvider
+	}
+	if err := applyServiceProviderRegistration(provider, req); err != nil {
+		return nil, err
+	}
+	if provider.EntityID != entityID {
+		return nil, errors.New("the metadata is for a different entity ID; register it as a new service provider")
+	}
+	if err := store.UpdateSAMLServiceProvider(provider); err != nil {
+		return nil, err
+	}
+	audit(realm, AuditSAMLProviderUpdated, "entity_id", provider.EntityID)
+	return provider, nil
+}
+
+// DeleteServiceProvider removes a service provider. Its users keep their
+// sessions there until the service provider ends them.
+func (s *SAMLService) DeleteServiceProvider(realm *realms.Realm, entityID string) error {
+	if realm.SAMLKey == nil {
+		return ErrSAMLDisabled
+	}
+	store := s.store.ForRealm(realm.Name)
+	if store.GetSAMLServiceProvider(entityID) == nil {
+		return ErrUnknownServiceProvider
+	}
+	if err := store.DeleteSAMLServiceProvider(entityID); err != nil {
+		return err
+	}
+	audit(realm, AuditSAMLProviderDeleted, "entity_id", entityID)
+	return nil
+}
+
+// applyServiceProviderRegistration checks a registration and copies it
+// onto provider.
+func applyServiceProviderRegistration(provider *models.SAMLServiceProvider, req *models.SAMLServiceProviderRegistration) error {
+	descriptor, err := samlsp.ParseMetadata([]byte(req.Metadata))
+	if err != nil {
+		return fmt.Errorf("invalid metadata: %v", err)
+	}
+	if descriptor.EntityID == "" {
+		return errors.New("invalid metadata: no entity ID")
+	}
+	if _, acs := postACS(descriptor); acs == nil {
+		return errors.New("invalid metadata: no assertion consumer service with the HTTP-POST binding")
+	}
+
+	nameIDFormat := req.NameIDFormat
+	if nameIDFormat == "" {
+		nameIDFormat = models.NameIDPersistent
+	}
+	if _, ok := samlNameIDFormats[nameIDFormat]; !ok {
+		return fmt.Errorf("unsupported name_id_format %q; use persistent, email or username", req.NameIDFormat)
+	}
+
+	pairs := make([]string, 0, len(req.Attributes))
+	for field, name := range req.Attributes {
+		if !knownAttributeField(field) {
+			return fmt.Errorf("unknown attribute field %q; use one of %s", field, strings.Join(models.SAMLAttributeFields, ", "))
+		}
+		if name == "" || strings.ContainsAny(name, "= \t\r\n") {
+			return fmt.Errorf("invalid attribute name %q for %s", name, field)
+		}
+		pairs = append(pairs, field+"="+name)
+	}
+	sort.Strings(pairs)
+
+	provider.EntityID = descriptor.EntityID
+	provider.Metadata = req.Metadata
+	provider.NameIDFormat = nameIDFormat
+	provider.Attributes = strings.Join(pairs, " ")
+	return nil
+}
+
+func knownAttributeField(field string) bool {
+	for _, known := range models.SAMLAttributeFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// postACS returns the service provider's first assertion consumer service
+// with the HTTP-POST binding, the only one assertions are sent with, and
+// the descriptor listing it.
+func postACS(descriptor *saml.EntityDescriptor) (*saml.SPSSODescriptor, *saml.IndexedEndpoint) {
+	for i := range descriptor.SPSSODescriptors {
+		sp := &descriptor.SPSSODescriptors[i]
+		for j := range sp.AssertionConsumerServices {
+			if sp.AssertionConsumerServices[j].Binding == saml.HTTPPostBinding {
+				return sp, &sp.AssertionConsumerServices[j]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ParseAuthnRequest reads and validates a service provider's AuthnRequest
+// sent with the HTTP-Redirect or HTTP-POST binding.
+func (s *SAMLService) ParseAuthnRequest(realm *realms.Realm, r *http.Request) (*SAMLLogin, error) {
+	idp, err := s.identityProvider(realm)
+	if err != nil {
+		return nil, err
+	}
+	req, err := saml.NewIdpAuthnRequest(idp, r)
+	if err != nil {
+		return nil, ErrInvalidSAMLRequest
+	}
+
+	var peek saml.AuthnRequest
+	if err := xml.Unmarshal(req.RequestBuffer, &peek); err != nil || peek.Issuer == nil {
+		return nil, ErrInvalidSAMLRequest
+	}
+	provider := s.store.ForRealm(realm.Name).GetSAMLServiceProvider(peek.Issuer.Value)
+	if provider == nil {
+		return nil, ErrUnknownServiceProvider
+	}
+
+	// The library only answers requests issued in the last 90 seconds,
+	// which leaves no time to sign in. Validate as of the issue instant
+	// instead while the request is younger than samlRequestTTL.
+	now := req.Now
+	if peek.IssueInstant.Before(now) && peek.IssueInstant.Add(samlRequestTTL).After(now) {
+		req.Now = peek.IssueInstant
+	}
+	err = req.Validate()
+	req.Now = now
+	if err != nil {
+		log.Printf("Rejected SAML AuthnRequest from %s in realm %s: %v", provider.EntityID, realm.Name, err)
+		return nil, ErrInvalidSAMLRequest
+	}
+
+	// The login page sends the user back with a GET, so a posted request
+	// is carried over in the redirect encoding
+	query := url.Values{"SAMLRequest": {deflateSAMLMessage(req.RequestBuffer)}}
+	if req.RelayState != "" {
+		query.Set("RelayState", req.RelayState)
+	}
+	return &SAMLLogin{req: req, provider: provider, continuePath: r.URL.Path + "?" + query.Encode()}, nil
+}
+
+// BeginIdPInitiatedLogin starts a login the service provider didn't ask
+// for, which ends at its assertion consumer service with relayState.
+func (s *SAMLService) BeginIdPInitiatedLogin(realm *realms.Realm, r *http.Request, entityID, relayState string) (*SAMLLogin, error) {
+	idp, err := s.identityProvider(realm)
+	if err != nil {
+		return nil, err
+	}
+	provider := s.store.ForRealm(realm.Name).GetSAMLServiceProvider(entityID)
+	if provider == nil {
+		return nil, ErrUnknownServiceProvider
+	}
+	descriptor, err := samlsp.ParseMetadata([]byte(provider.Metadata))
+	if err != nil {
+		return nil, err
+	}
+	sp, acs := postACS(descriptor)
+	if acs == nil {
+		return nil, errors.New("the service provider has no assertion consumer service with the HTTP-POST binding")
+	}
+	req := &saml.IdpAuthnRequest{
+		IDP:                     idp,
+		HTTPRequest:             r,
+		RelayState:              relayState,
+		ServiceProviderMetadata: descriptor,
+		SPSSODescriptor:         sp,
+		ACSEndpoint:             acs,
+		Now:                     saml.TimeNow(),
+	}
+	query := url.Values{"sp": {entityID}}
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	return &SAMLLogin{req: req, provider: provider, continuePath: r.URL.Path + "?" + query.Encode()}, nil
+}
+
+// CompleteLogin answers a login with a signed assertion about the user
+// who signed in.
+func (s *SAMLService) CompleteLogin(realm *realms.Realm, login *SAMLLogin, auth *Authentication) (*SAMLResponse, error) {
+	user := s.store.ForRealm(realm.Name).GetUser(auth.UserID)
+	if user == nil || user.Disabled {
+		return nil, ErrInvalidLoginToken
+	}
+	if err := makeSAMLAssertion(realm, login.req, login.provider, user, auth); err != nil {
+		return nil, err
+	}
+	form, err := login.req.PostBinding()
+	if err != nil {
+		log.Printf("Error signing SAML response for %s: %v", login.provider.EntityID, err)
+		return nil, err
+	}
+	audit(realm, AuditSAMLLogin, "username", user.Username, "service_provider", login.provider.EntityID)
+	return &SAMLResponse{URL: form.URL, Message: form.SAMLResponse, RelayState: form.RelayState}, nil
+}
+
+// samlNameID returns the value the service provider identifies the user
+// by.
+func samlNameID(realm *realms.Realm, provider *models.SAMLServiceProvider, user *models.User) (string, error) {
+	switch provider.NameIDFormat {
+	case models.NameIDEmail:
+		if user.Email == "" {
+			return "", errors.New("the service provider identifies users by email address and you have none")
+		}
+		return user.Email, nil
+	case models.NameIDUsername:
+		return user.Username, nil
+	default:
+		return samlPersistentID(realm, provider, user.ID), nil
+	}
+}
+
+// samlPersistentID returns the user's persistent name ID at a service
+// provider: a keyed hash of the user's ID, so that service providers
+// can't link their users to each other's and can't name other users by
+// counting. Changing keys.token_hash_key changes it.
+func samlPersistentID(realm *realms.Realm, provider *models.SAMLServiceProvider, userID uint) string {
+	mac := hmac.New(sha256.New, []byte(config.Get().Keys.TokenHashKey))
+	mac.Write([]byte("saml-name-id:" + realm.Name + "\x00" + provider.EntityID + "\x00" + strconv.FormatUint(uint64(userID), 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// samlAttributes returns the user's fields under the attribute names the
+// service provider asked for. Empty fields are left out.
+func samlAttributes(provider *models.SAMLServiceProvider, user *models.User) []saml.Attribute {
+	values := map[string][]string{
+		"id":             {strconv.FormatUint(uint64(user.ID), 10)},
+		"username":       {user.Username},
+		"email":          {user.Email},
+		"email_verified": {strconv.FormatBool(user.EmailVerified)},
+		"roles":          strings.Fields(user.Roles),
+	}
+	mapping := provider.AttributeMap()
+	attributes := []saml.Attribute{}
+	for _, field := range models.SAMLAttributeFields {
+		name, ok := mapping[field]
+		if !ok || len(values[field]) == 0 || values[field][0] == "" {
+			continue
+		}
+		attribute := saml.Attribute{Name: name, NameFormat: samlAttributeFormatBasic}
+		if strings.Contains(name, ":") {
+			attribute.NameFormat = samlAttributeFormatURI
+		}
+		for _, value := range values[field] {
+			attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes
+}
+
+func makeSAMLAssertion(realm *realms.Realm, req *saml.IdpAuthnRequest, provider *models.SAMLServiceProvider, user *models.User, auth *Authentication) error {
+	nameID, err := samlNameID(realm, provider, user)
+	if err != nil {
+		return err
+	}
+	classRef := samlContextUnspecified
+	for _, method := range auth.Methods {
+		if method == AMRPassword {
+			classRef = samlContextPassword
+		}
+	}
+
+	id := "_" + utils.GenerateRandomString(32)
+	idpEntityID := req.IDP.MetadataURL.String()
+	req.Assertion = &saml.Assertion{
+		ID:           id,
+		IssueInstant: req.Now,
+		Version:      "2.0",
+		Issuer: saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idpEntityID,
+		},
+		Subject: &saml.Subject{
+			NameID: &saml.NameID{
+				Format:          string(samlNameIDFormats[provider.NameIDFormat]),
+				NameQualifier:   idpEntityID,
+				SPNameQualifier: provider.EntityID,
+				Value:           nameID,
+			},
+			SubjectConfirmations: []saml.SubjectConfirmation{{
+				Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+				SubjectConfirmationData: &saml.SubjectConfirmationData{
+					InResponseTo: req.Request.ID,
+					NotOnOrAfter: req.Now.Add(samlAssertionTTL),
+					Recipient:    req.ACSEndpoint.Location,
+				},
+			}},
+		},
+		Conditions: &saml.Conditions{
+			NotBefore:    req.Now.Add(-saml.MaxClockSkew),
+			NotOnOrAfter: req.Now.Add(samlAssertionTTL),
+			AudienceRestrictions: []saml.AudienceRestriction{{
+				Audience: saml.Audience{Value: provider.EntityID},
+			}},
+		},
+		AuthnStatements: []saml.AuthnStatement{{
+			AuthnInstant: auth.Time,
+			SessionIndex: id,
+			AuthnContext: saml.AuthnContext{
+				AuthnContextClassRef: &saml.AuthnContextClassRef{Value: classRef},
+			},
+		}},
+	}
+	if attributes := samlAttributes(provider, user); len(attributes) > 0 {
+		req.Assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: attributes}}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package services
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// samlMaxMessageSize caps inflated SAML messages.
+const samlMaxMessageSize = 256 << 10
+
+// Query string signature algorithms of the HTTP-Redirect binding.
+// RSA-SHA1 is not accepted, as SHA-1 is no longer collision resistant.
+var samlSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA256SignatureMethod: crypto.SHA256,
+	dsig.RSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// samlRedirectParams are the query parameters of the HTTP-Redirect
+// binding.
+var samlRedirectParams = map[string]bool{
+	"SAMLRequest":  true,
+	"SAMLResponse": true,
+	"RelayState":   true,
+	"SigAlg":       true,
+	"Signature":    true,
+}
+
+// Logout handles a service provider's signed LogoutRequest, sent with the
+// HTTP-Redirect or HTTP-POST binding, and returns the LogoutResponse.
+//
+// Sessions here are short-lived login tokens, which can't be revoked, so
+// logging out revokes the user's refresh tokens instead. Other service
+// providers the user signed in to are not notified: without a server-side
+// session there is no record of them.
+func (s *SAMLService) Logout(realm *realms.Realm, r *http.Request) (*SAMLResponse, error) {
+	idp, err := s.identityProvider(realm)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded, relayState string
+	var query redirectQuery
+	redirect := r.Method == http.MethodGet
+	if redirect {
+		if query, err = parseRedirectQuery(r.URL.RawQuery); err != nil {
+			log.Printf("Rejected SAML LogoutRequest in realm %s: %v", realm.Name, err)
+			return nil, ErrInvalidSAMLRequest
+		}
+		encoded, relayState = query.value("SAMLRequest"), query.value("RelayState")
+	} else {
+		encoded, relayState = r.PostFormValue("SAMLRequest"), r.PostFormValue("RelayState")
+	}
+	message, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || encoded == "" {
+		return nil, ErrInvalidSAMLRequest
+	}
+	if redirect {
+		if message, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(message)), samlMaxMessageSize)); err != nil {
+			return nil, ErrInvalidSAMLRequest
+		}
+	}
+	if err := xrv.Validate(bytes.NewReader(message)); err != nil {
+		return nil, ErrInvalidSAMLRequest
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil || doc.Root() == nil || doc.Root().Tag != "LogoutRequest" {
+		return nil, ErrInvalidSAMLRequest
+	}
+
+	// The issuer is read before the signature is checked, only to find the
+	// service provider's certificates
+	var unverified saml.LogoutRequest
+	if err := unmarshalSAMLElement(doc.Root(), &unverified); err != nil || unverified.Issuer == nil {
+		return nil, ErrInvalidSAMLRequest
+	}
+	provider := s.store.ForRealm(realm.Name).GetSAMLServiceProvider(unverified.Issuer.Value)
+	if provider == nil {
+		return nil, ErrUnknownServiceProvider
+	}
+	descriptor, err := samlsp.ParseMetadata([]byte(provider.Metadata))
+	if err != nil {
+		return nil, err
+	}
+	certs := spSigningCertificates(descriptor)
+
+	// Redirected requests are signed in the query string, unless the
+	// service provider signed the XML instead
+	var req saml.LogoutRequest
+	if redirect && query["Signature"] != "" {
+		if err := query.verifySignature("SAMLRequest", certs); err != nil {
+			log.Printf("Rejected SAML LogoutRequest from %s: %v", provider.EntityID, err)
+			return nil, ErrInvalidSAMLRequest
+		}
+		req = unverified
+	} else {
+		verified, err := verifyXMLSignature(doc.Root(), certs)
+		if err == nil {
+			err = unmarshalSAMLElement(verified, &req)
+		}
+		if err != nil {
+			log.Printf("Rejected SAML LogoutRequest from %s: %v", provider.EntityID, err)
+			return nil, ErrInvalidSAMLRequest
+		}
+	}
+
+	now := saml.TimeNow()
+	switch {
+	case req.Destination != "" && req.Destination != idp.LogoutURL.String():
+		return nil, ErrInvalidSAMLRequest
+	case req.IssueInstant.Add(samlRequestTTL).Before(now), req.IssueInstant.After(now.Add(saml.MaxClockSkew)):
+		return nil, ErrInvalidSAMLRequest
+	case req.NotOnOrAfter != nil && !req.NotOnOrAfter.After(now.Add(-saml.MaxClockSkew)):
+		return nil, ErrInvalidSAMLRequest
+	case req.NameID == nil:
+		return nil, ErrInvalidSAMLRequest
+	}
+
+	endpoint := logoutEndpoint(descriptor)
+	if endpoint == nil {
+		return nil, ErrNoSingleLogoutService
+	}
+
+	if user := s.samlUser(realm, provider, req.NameID.Value); user != nil {
+		revoked, err := s.store.ForRealm(realm.Name).DeleteRefreshTokensForUser(user.ID)
+		if err != nil {
+			log.Printf("Error revoking refresh tokens of %s: %v", user.Username, err)
+			return nil, err
+		}
+		audit(realm, AuditSAMLLogout, "username", user.Username, "service_provider", provider.EntityID, "refresh_tokens_revoked", strconv.FormatInt(revoked, 10))
+	}
+	return logoutResponse(idp, endpoint, req.ID, relayState, now)
+}
+
+// samlUser returns the user a service provider's name ID stands for, or
+// nil if there is none.
+func (s *SAMLService) samlUser(realm *realms.Realm, provider *models.SAMLServiceProvider, nameID string) *models.User {
+	store := s.store.ForRealm(realm.Name)
+	switch provider.NameIDFormat {
+	case models.NameIDEmail:
+		return store.GetUserByEmail(nameID)
+	case models.NameIDUsername:
+		return store.GetUserByUsername(nameID)
+	default:
+		// Persistent name IDs can't be reversed, so each user's is
+		// computed until one matches
+		users, err := store.ListUsers()
+		if err != nil {
+			log.Printf("Error listing users of realm %s: %v", realm.Name, err)
+			return nil
+		}
+		for i := range users {
+			if hmac.Equal([]byte(samlPersistentID(realm, provider, users[i].ID)), []byte(nameID)) {
+				return &users[i]
+			}
+		}
+		return nil
+	}
+}
+
+// logoutEndpoint returns the service provider's single logout service,
+// preferring the HTTP-POST binding, or nil if it has none.
+func logoutEndpoint(descriptor *saml.EntityDescriptor) *saml.Endpoint {
+	for _, binding := range []string{saml.HTTPPostBinding, saml.HTTPRedirectBinding} {
+		for i := range descriptor.SPSSODescriptors {
+			services := descriptor.SPSSODescriptors[i].SingleLogoutServices
+			for j := range services {
+				if services[j].Binding == binding {
+					return &services[j]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// logoutResponse builds the signed LogoutResponse for a single logout
+// service.
+func logoutResponse(idp *saml.IdentityProvider, endpoint *saml.Endpoint, inResponseTo, relayState string, now time.Time) (*SAMLResponse, error) {
+	location := endpoint.Location
+	if endpoint.ResponseLocation != "" {
+		location = endpoint.ResponseLocation
+	}
+
+	response := &saml.LogoutResponse{
+		ID:           "_" + utils.GenerateRandomString(32),
+		InResponseTo: inResponseTo,
+		Version:      "2.0",
+		IssueInstant: now,
+		Destination:  location,
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		Status: saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+
+	if endpoint.Binding == saml.HTTPRedirectBinding {
+		// The redirect binding signs the query string, not the XML
+		message, err := deflateSAMLElement(response.Element())
+		if err != nil {
+			return nil, err
+		}
+		query := "SAMLResponse=" + url.QueryEscape(message)
+		if relayState != "" {
+			query += "&RelayState=" + url.QueryEscape(relayState)
+		}
+		query += "&SigAlg=" + url.QueryEscape(idp.SignatureMethod)
+		hashed := crypto.SHA256.New()
+		hashed.Write([]byte(query))
+		signature, err := rsa.SignPKCS1v15(nil, idp.Key.(*rsa.PrivateKey), crypto.SHA256, hashed.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		separator := "?"
+		if strings.Contains(location, "?") {
+			separator = "&"
+		}
+		return &SAMLResponse{RedirectURL: location + separator + query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))}, nil
+	}
+
+	signed, err := signingContext(idp).SignEnveloped(response.Element())
+	if err != nil {
+		return nil, err
+	}
+	response.Signature = signed.ChildElements()[len(signed.ChildElements())-1]
+	doc := etree.NewDocument()
+	doc.SetRoot(response.Element())
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	return &SAMLResponse{URL: location, Message: base64.StdEncoding.EncodeToString(buf), RelayState: relayState}, nil
+}
+
+func signingContext(idp *saml.IdentityProvider) *dsig.SigningContext {
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore{
+		Certificate: [][]byte{idp.Certificate.Raw},
+		PrivateKey:  idp.Key,
+		Leaf:        idp.Certificate,
+	})
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	ctx.SetSignatureMethod(idp.SignatureMethod)
+	return ctx
+}
+
+// spSigningCertificates returns the certificates a service provider signs
+// its messages with.
+func spSigningCertificates(descriptor *saml.EntityDescriptor) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, sp := range descriptor.SPSSODescriptors {
+		for _, key := range sp.KeyDescriptors {
+			if key.Use != "" && key.Use != "signing" {
+				continue
+			}
+			for _, data := range key.KeyInfo.X509Data.X509Certificates {
+				der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data.Data), ""))
+				if err != nil {
+					continue
+				}
+				if cert, err := x509.ParseCertificate(der); err == nil {
+					certs = append(certs, cert)
+				}
+			}
+		}
+	}
+	return certs
+}
+
+// verifyXMLSignature checks the enveloped signature of el and returns the
+// signed element.
+func verifyXMLSignature(el *etree.Element, certs []*x509.Certificate) (*etree.Element, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("the service provider's metadata has no signing certificate")
+	}
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	ctx.IdAttribute = "ID"
+	return ctx.Validate(el)
+}
+
+// redirectQuery holds the parameters of a message sent with the
+// HTTP-Redirect binding as they were encoded in the query string, which
+// is what the signature covers.
+type redirectQuery map[string]string
+
+// parseRedirectQuery reads the binding's parameters from a raw query
+// string. A parameter given twice is rejected, so the message used is
+// always the one the signature was checked on.
+func parseRedirectQuery(rawQuery string) (redirectQuery, error) {
+	query := make(redirectQuery)
+	for _, part := range strings.Split(rawQuery, "&") {
+		key, value, _ := strings.Cut(part, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, errors.New("malformed query string")
+		}
+		if !samlRedirectParams[name] {
+			continue
+		}
+		if _, repeated := query[name]; repeated {
+			return nil, fmt.Errorf("%s given more than once", name)
+		}
+		if _, err := url.QueryUnescape(value); err != nil {
+			return nil, fmt.Errorf("malformed %s", name)
+		}
+		query[name] = value
+	}
+	return query, nil
+}
+
+// value returns a parameter decoded.
+func (q redirectQuery) value(name string) string {
+	value, _ := url.QueryUnescape(q[name])
+	return value
+}
+
+// verifySignature checks the signature of the message in messageParam.
+// The signature covers the parameters exactly as they were encoded.
+func (q redirectQuery) verifySignature(messageParam string, certs []*x509.Certificate) error {
+	signed := messageParam + "=" + q[messageParam]
+	if relayState, ok := q["RelayState"]; ok {
+		signed += "&RelayState=" + relayState
+	}
+	signed += "&SigAlg=" + q["SigAlg"]
+
+	sigAlg := q.value("SigAlg")
+	hash, ok := samlSignatureHashes[sigAlg]
+	if !ok {
+		return errors.New("unsupported signature algorithm " + strconv.Quote(sigAlg))
+	}
+	signature, err := base64.StdEncoding.DecodeString(q.value("Signature"))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	hashed := hash.New()
+	hashed.Write([]byte(signed))
+	digest := hashed.Sum(nil)
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature does not match any signing certificate")
+}
+
+func unmarshalSAMLElement(el *etree.Element, v interface{}) error {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf, v)
+}
+
+func deflateSAMLElement(el *etree.Element) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return "", err
+	}
+	return deflateSAMLMessage(buf), nil
+}
+
+// deflateSAMLMessage encodes a message for the HTTP-Redirect binding.
+func deflateSAMLMessage(message []byte) string {
+	var compressed bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	writer.Write(message)
+	writer.Close()
+	return base64.StdEncoding.EncodeToString(compressed.Bytes())
+}
@@ -0,0 +1,531 @@
+package services_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func newSAMLKey(t *testing.T, name string) *utils.SAMLKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &utils.SAMLKey{Certificate: cert, Key: key}
+}
+
+// samlFixture is a SAML identity provider realm with the users alice and
+// bob, and the service providers wiki and crm, which both identify users
+// by persistent name IDs.
+type samlFixture struct {
+	saml       *services.SAMLService
+	realm      *realms.Realm
+	store      storage.Store
+	alice, bob *models.User
+	wiki, crm  *saml.ServiceProvider
+}
+
+func newSAMLFixture(t *testing.T) *samlFixture {
+	useTestConfig(t, nil)
+	memory := storage.NewMemoryStorage()
+	f := &samlFixture{
+		saml:  services.NewSAMLService(memory),
+		realm: &realms.Realm{Name: "default", Issuer: "https://id.example.com", SAMLKey: newSAMLKey(t, "id.example.com")},
+		store: memory.ForRealm("default"),
+		alice: &models.User{Username: "alice", Email: "alice@example.com"},
+		bob:   &models.User{Username: "bob", Email: "bob@example.com"},
+	}
+	for _, user := range []*models.User{f.alice, f.bob} {
+		if err := f.store.StoreUser(user); err != nil {
+			t.Fatalf("StoreUser: %v", err)
+		}
+	}
+	f.wiki = f.registerServiceProvider(t, "https://wiki.example.com", models.NameIDPersistent)
+	f.crm = f.registerServiceProvider(t, "https://crm.example.com", models.NameIDPersistent)
+	return f
+}
+
+// registerServiceProvider registers a service provider at base, which
+// signs its messages with RSA-SHA256.
+func (f *samlFixture) registerServiceProvider(t *testing.T, base, nameIDFormat string) *saml.ServiceProvider {
+	metadata, err := f.saml.Metadata(f.realm)
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	idpMetadata, err := samlsp.ParseMetadata(metadata)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	key := newSAMLKey(t, base)
+	parse := func(s string) url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *u
+	}
+	sp := &saml.ServiceProvider{
+		EntityID:        base + "/saml/metadata",
+		Key:             key.Key,
+		Certificate:     key.Certificate,
+		MetadataURL:     parse(base + "/saml/metadata"),
+		AcsURL:          parse(base + "/saml/acs"),
+		SloURL:          parse(base + "/saml/slo"),
+		IDPMetadata:     idpMetadata,
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+		LogoutBindings:  []string{saml.HTTPPostBinding},
+	}
+	spMetadata, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.saml.RegisterServiceProvider(f.realm, &models.SAMLServiceProviderRegistration{
+		Metadata:     string(spMetadata),
+		NameIDFormat: nameIDFormat,
+		Attributes:   map[string]string{"username": "uid"},
+	})
+	if err != nil {
+		t.Fatalf("RegisterServiceProvider: %v", err)
+	}
+	return sp
+}
+
+func (f *samlFixture) authnRequest(t *testing.T, sp *saml.ServiceProvider) *saml.AuthnRequest {
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		t.Fatalf("MakeAuthenticationRequest: %v", err)
+	}
+	return req
+}
+
+func redirectRequest(t *testing.T, sp *saml.ServiceProvider, req *saml.AuthnRequest) *http.Request {
+	u, err := req.Redirect("state", sp)
+	if err != nil {
+		t.Fatalf("Redirect: %v", err)
+	}
+	return httptest.NewRequest(http.MethodGet, u.String(), nil)
+}
+
+// login signs user in at sp and returns the assertion sp accepts.
+func (f *samlFixture) login(t *testing.T, sp *saml.ServiceProvider, user *models.User) *saml.Assertion {
+	req := f.authnRequest(t, sp)
+	login, err := f.saml.ParseAuthnRequest(f.realm, redirectRequest(t, sp, req))
+	if err != nil {
+		t.Fatalf("ParseAuthnRequest: %v", err)
+	}
+	response, err := f.saml.CompleteLogin(f.realm, login, &services.Authentication{
+		UserID:  user.ID,
+		Methods: []string{services.AMRPassword},
+		Time:    time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("CompleteLogin: %v", err)
+	}
+	if response.URL != sp.AcsURL.String() || response.RelayState != "state" {
+		t.Fatalf("response posted to %s with relay state %q, want %s with %q", response.URL, response.RelayState, sp.AcsURL.String(), "state")
+	}
+	message, err := base64.StdEncoding.DecodeString(response.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := sp.ParseXMLResponse(message, []string{req.ID})
+	if err != nil {
+		t.Fatalf("the service provider rejected the response: %v", describeSAMLError(err))
+	}
+	return assertion
+}
+
+func describeSAMLError(err error) error {
+	var invalid *saml.InvalidResponseError
+	if errors.As(err, &invalid) {
+		return invalid.PrivateErr
+	}
+	return err
+}
+
+func TestSAMLAuthnRequest(t *testing.T) {
+	f := newSAMLFixture(t)
+	stranger := &saml.ServiceProvider{
+		EntityID:        "https://stranger.example.com/saml/metadata",
+		Key:             f.wiki.Key,
+		Certificate:     f.wiki.Certificate,
+		AcsURL:          f.wiki.AcsURL,
+		IDPMetadata:     f.wiki.IDPMetadata,
+		SignatureMethod: f.wiki.SignatureMethod,
+	}
+	tests := []struct {
+		name    string
+		sp      *saml.ServiceProvider
+		modify  func(req *saml.AuthnRequest)
+		wantErr error
+	}{
+		{name: "valid"},
+		// Users get samlRequestTTL to sign in before answering
+		{name: "issued five minutes ago", modify: func(req *saml.AuthnRequest) { req.IssueInstant = time.Now().Add(-5 * time.Minute) }},
+		{name: "expired", modify: func(req *saml.AuthnRequest) { req.IssueInstant = time.Now().Add(-11 * time.Minute) }, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "other destination", modify: func(req *saml.AuthnRequest) { req.Destination = "https://other.example.com/saml/sso" }, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "unregistered assertion consumer service", modify: func(req *saml.AuthnRequest) { req.AssertionConsumerServiceURL = "https://evil.example.com/acs" }, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "other version", modify: func(req *saml.AuthnRequest) { req.Version = "1.1" }, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "unknown service provider", sp: stranger, wantErr: services.ErrUnknownServiceProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := tt.sp
+			if sp == nil {
+				sp = f.wiki
+			}
+			req := f.authnRequest(t, sp)
+			if tt.modify != nil {
+				tt.modify(req)
+			}
+			login, err := f.saml.ParseAuthnRequest(f.realm, redirectRequest(t, sp, req))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseAuthnRequest = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// The login page resumes the login at the continue path
+			resumed := httptest.NewRequest(http.MethodGet, "https://id.example.com"+login.ContinuePath(), nil)
+			if _, err := f.saml.ParseAuthnRequest(f.realm, resumed); err != nil {
+				t.Errorf("ParseAuthnRequest of the continue path %s: %v", login.ContinuePath(), err)
+			}
+		})
+	}
+
+	for _, query := range []string{"SAMLRequest=not-deflated", "SAMLRequest=", "RelayState=state"} {
+		t.Run(query, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://id.example.com/saml/sso?"+query, nil)
+			if _, err := f.saml.ParseAuthnRequest(f.realm, r); !errors.Is(err, services.ErrInvalidSAMLRequest) {
+				t.Errorf("ParseAuthnRequest = %v, want ErrInvalidSAMLRequest", err)
+			}
+		})
+	}
+}
+
+func TestSAMLAssertion(t *testing.T) {
+	f := newSAMLFixture(t)
+	assertion := f.login(t, f.wiki, f.alice)
+
+	if assertion.Signature == nil {
+		t.Error("the assertion is not signed")
+	}
+	nameID := assertion.Subject.NameID
+	if nameID.Format != string(saml.PersistentNameIDFormat) {
+		t.Errorf("name ID format = %q, want persistent", nameID.Format)
+	}
+	if nameID.Value == strconv.FormatUint(uint64(f.alice.ID), 10) || len(nameID.Value) != 43 {
+		t.Errorf("persistent name ID = %q, want an opaque value", nameID.Value)
+	}
+	if again := f.login(t, f.wiki, f.alice).Subject.NameID.Value; again != nameID.Value {
+		t.Errorf("persistent name ID changed from %q to %q", nameID.Value, again)
+	}
+	if bob := f.login(t, f.wiki, f.bob).Subject.NameID.Value; bob == nameID.Value {
+		t.Errorf("alice and bob have the same persistent name ID %q", bob)
+	}
+	if crm := f.login(t, f.crm, f.alice).Subject.NameID.Value; crm == nameID.Value {
+		t.Errorf("alice has the same persistent name ID %q at two service providers", crm)
+	}
+
+	var uid []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name == "uid" {
+				for _, value := range attribute.Values {
+					uid = append(uid, value.Value)
+				}
+			}
+		}
+	}
+	if len(uid) != 1 || uid[0] != "alice" {
+		t.Errorf("uid attribute = %q, want alice", uid)
+	}
+	if got := assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value; got != "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport" {
+		t.Errorf("authentication context = %q, want PasswordProtectedTransport", got)
+	}
+}
+
+func TestSAMLAssertionNameIDFormats(t *testing.T) {
+	f := newSAMLFixture(t)
+	tests := []struct {
+		nameIDFormat string
+		want         string
+	}{
+		{nameIDFormat: models.NameIDEmail, want: "alice@example.com"},
+		{nameIDFormat: models.NameIDUsername, want: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nameIDFormat, func(t *testing.T) {
+			sp := f.registerServiceProvider(t, "https://"+tt.nameIDFormat+".example.com", tt.nameIDFormat)
+			if got := f.login(t, sp, f.alice).Subject.NameID.Value; got != tt.want {
+				t.Errorf("name ID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSAMLAssertionSignature checks that service providers only accept
+// assertions as the realm signed them.
+func TestSAMLAssertionSignature(t *testing.T) {
+	f := newSAMLFixture(t)
+	req := f.authnRequest(t, f.wiki)
+	login, err := f.saml.ParseAuthnRequest(f.realm, redirectRequest(t, f.wiki, req))
+	if err != nil {
+		t.Fatalf("ParseAuthnRequest: %v", err)
+	}
+	response, err := f.saml.CompleteLogin(f.realm, login, &services.Authentication{UserID: f.alice.ID, Time: time.Now()})
+	if err != nil {
+		t.Fatalf("CompleteLogin: %v", err)
+	}
+	message, err := base64.StdEncoding.DecodeString(response.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		message      []byte
+		sp           *saml.ServiceProvider
+		wantAccepted bool
+	}{
+		{name: "as signed", message: message, sp: f.wiki, wantAccepted: true},
+		{
+			name: "issue instant changed",
+			message: editSAMLResponse(t, message, func(response *etree.Element) {
+				response.CreateAttr("IssueInstant", time.Now().Add(-10*time.Second).UTC().Format(time.RFC3339))
+			}),
+			sp: f.wiki,
+		},
+		// The assertion is encrypted for wiki alone
+		{name: "other audience", message: message, sp: f.crm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.sp.ParseXMLResponse(tt.message, []string{req.ID})
+			if accepted := err == nil; accepted != tt.wantAccepted {
+				t.Errorf("the service provider accepted the response = %v, want %v (%v)", accepted, tt.wantAccepted, describeSAMLError(err))
+			}
+		})
+	}
+
+	if _, err := f.saml.CompleteLogin(f.realm, login, &services.Authentication{UserID: 999, Time: time.Now()}); !errors.Is(err, services.ErrInvalidLoginToken) {
+		t.Errorf("CompleteLogin for an unknown user = %v, want ErrInvalidLoginToken", err)
+	}
+}
+
+func editSAMLResponse(t *testing.T, message []byte, edit func(response *etree.Element)) []byte {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil {
+		t.Fatal(err)
+	}
+	edit(doc.Root())
+	edited, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return edited
+}
+
+// logoutRequest returns an unsigned LogoutRequest from sp naming nameID.
+func logoutRequest(t *testing.T, sp *saml.ServiceProvider, nameID string) *saml.LogoutRequest {
+	req, err := sp.MakeLogoutRequest(sp.GetSLOBindingLocation(saml.HTTPPostBinding), nameID)
+	if err != nil {
+		t.Fatalf("MakeLogoutRequest: %v", err)
+	}
+	req.Signature = nil
+	return req
+}
+
+// encodeRedirect encodes a LogoutRequest for the HTTP-Redirect binding.
+func encodeRedirect(t *testing.T, req *saml.LogoutRequest) string {
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	message, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	writer.Write(message)
+	writer.Close()
+	return url.QueryEscape(base64.StdEncoding.EncodeToString(compressed.Bytes()))
+}
+
+// signRedirect signs the query string of the HTTP-Redirect binding.
+func signRedirect(t *testing.T, query string, key *rsa.PrivateKey, sigAlg string, hash crypto.Hash) string {
+	query += "&SigAlg=" + url.QueryEscape(sigAlg)
+	hashed := hash.New()
+	hashed.Write([]byte(query))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, hashed.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+}
+
+func TestSAMLLogout(t *testing.T) {
+	f := newSAMLFixture(t)
+	aliceID := f.login(t, f.wiki, f.alice).Subject.NameID.Value
+	bobID := f.login(t, f.wiki, f.bob).Subject.NameID.Value
+	sign := func(query string) string {
+		return signRedirect(t, query, f.wiki.Key, dsig.RSASHA256SignatureMethod, crypto.SHA256)
+	}
+	aliceRequest := "SAMLRequest=" + encodeRedirect(t, logoutRequest(t, f.wiki, aliceID))
+	bobRequest := "SAMLRequest=" + encodeRedirect(t, logoutRequest(t, f.wiki, bobID))
+	signedAlice := sign(aliceRequest + "&RelayState=state")
+	otherKey := newSAMLKey(t, "other")
+
+	tests := []struct {
+		name        string
+		query       string
+		wantErr     error
+		wantRevoked []string
+	}{
+		{name: "signed", query: signedAlice, wantRevoked: []string{"alice"}},
+		{name: "without relay state", query: sign(bobRequest), wantRevoked: []string{"bob"}},
+		{name: "signed with RSA-SHA512", query: signRedirect(t, aliceRequest, f.wiki.Key, dsig.RSASHA512SignatureMethod, crypto.SHA512), wantRevoked: []string{"alice"}},
+		{name: "another request appended", query: signedAlice + "&" + bobRequest, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "another request prepended", query: bobRequest + "&" + signedAlice, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "another request under an encoded name", query: strings.Replace(bobRequest, "SAMLRequest", "SAML%52equest", 1) + "&" + signedAlice, wantErr: services.ErrInvalidSAMLRequest},
+		{name: "relay state repeated", query: signedAlice + "&RelayState=other", wantErr: services.ErrInvalidSAMLRequest},
+		{name: "signature repeated", query: signedAlice + "&Signature=AAAA", wantErr: services.ErrInvalidSAMLRequest},
+		{name: "relay state changed", query: strings.Replace(signedAlice, "RelayState=state", "RelayState=other", 1), wantErr: services.ErrInvalidSAMLRequest},
+		{name: "signed with RSA-SHA1", query: signRedirect(t, aliceRequest, f.wiki.Key, dsig.RSASHA1SignatureMethod, crypto.SHA1), wantErr: services.ErrInvalidSAMLRequest},
+		{name: "signed by another key", query: signRedirect(t, aliceRequest, otherKey.Key, dsig.RSASHA256SignatureMethod, crypto.SHA256), wantErr: services.ErrInvalidSAMLRequest},
+		{name: "unsigned", query: aliceRequest, wantErr: services.ErrInvalidSAMLRequest},
+		{
+			name:    "expired",
+			query:   sign("SAMLRequest=" + encodeRedirect(t, withIssueInstant(logoutRequest(t, f.wiki, aliceID), time.Now().Add(-11*time.Minute)))),
+			wantErr: services.ErrInvalidSAMLRequest,
+		},
+		// Name IDs are opaque: user IDs and other service providers' name
+		// IDs name nobody
+		{name: "user ID as the name ID", query: sign("SAMLRequest=" + encodeRedirect(t, logoutRequest(t, f.wiki, strconv.FormatUint(uint64(f.alice.ID), 10))))},
+		{
+			name:  "another service provider's name ID",
+			query: signRedirect(t, "SAMLRequest="+encodeRedirect(t, logoutRequest(t, f.crm, aliceID)), f.crm.Key, dsig.RSASHA256SignatureMethod, crypto.SHA256),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, user := range []*models.User{f.alice, f.bob} {
+				token := &models.RefreshToken{UserID: user.ID, ClientID: "app", ExpiresAt: time.Now().Add(time.Hour), AbsoluteExpiresAt: time.Now().Add(time.Hour)}
+				if err := f.store.StoreRefreshToken(user.Username+"-"+tt.name, token); err != nil {
+					t.Fatalf("StoreRefreshToken: %v", err)
+				}
+			}
+			r := httptest.NewRequest(http.MethodGet, "https://id.example.com/saml/slo?"+tt.query, nil)
+			response, err := f.saml.Logout(f.realm, r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Logout = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && response.URL != f.wiki.SloURL.String() && response.URL != f.crm.SloURL.String() {
+				t.Errorf("LogoutResponse posted to %s", response.URL)
+			}
+			for _, user := range []*models.User{f.alice, f.bob} {
+				wantRevoked := false
+				for _, username := range tt.wantRevoked {
+					wantRevoked = wantRevoked || username == user.Username
+				}
+				if revoked := f.store.GetRefreshToken(user.Username+"-"+tt.name) == nil; revoked != wantRevoked {
+					t.Errorf("%s's refresh token revoked = %v, want %v", user.Username, revoked, wantRevoked)
+				}
+			}
+		})
+	}
+}
+
+func withIssueInstant(req *saml.LogoutRequest, issued time.Time) *saml.LogoutRequest {
+	req.IssueInstant = issued
+	return req
+}
+
+// TestSAMLLogoutPost checks LogoutRequests sent with the HTTP-POST
+// binding, which carry an XML signature.
+func TestSAMLLogoutPost(t *testing.T) {
+	f := newSAMLFixture(t)
+	aliceID := f.login(t, f.wiki, f.alice).Subject.NameID.Value
+	encode := func(req *saml.LogoutRequest) string {
+		doc := etree.NewDocument()
+		doc.SetRoot(req.Element())
+		message, err := doc.WriteToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(message)
+	}
+	signed, err := f.wiki.MakeLogoutRequest(f.wiki.GetSLOBindingLocation(saml.HTTPPostBinding), aliceID)
+	if err != nil {
+		t.Fatalf("MakeLogoutRequest: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		message     string
+		wantErr     error
+		wantRevoked bool
+	}{
+		{name: "signed", message: encode(signed), wantRevoked: true},
+		{name: "unsigned", message: encode(logoutRequest(t, f.wiki, aliceID)), wantErr: services.ErrInvalidSAMLRequest},
+		{name: "not base64", message: "%%%", wantErr: services.ErrInvalidSAMLRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &models.RefreshToken{UserID: f.alice.ID, ClientID: "app", ExpiresAt: time.Now().Add(time.Hour), AbsoluteExpiresAt: time.Now().Add(time.Hour)}
+			if err := f.store.StoreRefreshToken(tt.name, token); err != nil {
+				t.Fatalf("StoreRefreshToken: %v", err)
+			}
+			form := url.Values{"SAMLRequest": {tt.message}, "RelayState": {"state"}}
+			r := httptest.NewRequest(http.MethodPost, "https://id.example.com/saml/slo", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			response, err := f.saml.Logout(f.realm, r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Logout = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (response.URL != f.wiki.SloURL.String() || response.RelayState != "state") {
+				t.Errorf("LogoutResponse posted to %s with relay state %q", response.URL, response.RelayState)
+			}
+			if revoked := f.store.GetRefreshToken(tt.name) == nil; revoked != tt.wantRevoked {
+				t.Errorf("refresh token revoked = %v, want %v", revoked, tt.wantRevoked)
+			}
+		})
+	}
+}
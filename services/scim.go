@@ -0,0 +1,826 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCIMScope is the scope of access tokens for the SCIM API. Only the
+// clients listed in scim.clients can get it, with the client_credentials
+// grant.
+const SCIMScope = "scim"
+
+const (
+	// scimDefaultCount is the page size of list requests that don't ask
+	// for one; scimMaxResults is the largest page served.
+	scimDefaultCount = 100
+	scimMaxResults   = 1000
+)
+
+var (
+	ErrSCIMNotFound = errors.New("resource not found")
+	// ErrSCIMPreconditionFailed is returned when an If-Match header names
+	// another version of the resource than the current one.
+	ErrSCIMPreconditionFailed = errors.New("resource has changed")
+)
+
+// SCIMError is a request the SCIM API rejects, described by one of the
+// scimType keywords of RFC 7644 section 3.12, such as invalidFilter or
+// uniqueness.
+type SCIMError struct {
+	Type   string
+	Detail string
+}
+
+func (e *SCIMError) Error() string {
+	return e.Detail
+}
+
+func scimError(scimType, format string, args ...interface{}) error {
+	return &SCIMError{Type: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+// isSCIMClient reports whether a client may get tokens for the SCIM API.
+func isSCIMClient(clientID string) bool {
+	for _, id := range config.Get().SCIM.Clients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// SCIMService provisions users and groups for an external system, such as
+// an HR system, over SCIM 2.0 (RFC 7643, RFC 7644). Resources are handled
+// in their JSON representation, which filters and patches work on
+// directly; only the attributes described by the Schemas endpoint are
+// stored.
+type SCIMService struct {
+	store storage.Store
+	// users applies the password policy to passwords set over SCIM.
+	users *UserService
+}
+
+func NewSCIMService(store storage.Store, users *UserService) *SCIMService {
+	return &SCIMService{store: store, users: users}
+}
+
+// SCIMResource is the JSON representation of a user or group.
+type SCIMResource map[string]interface{}
+
+// SCIMList is a page of resources matching a query.
+type SCIMList struct {
+	Schemas      []string       `json:"schemas"`
+	TotalResults int            `json:"totalResults"`
+	StartIndex   int            `json:"startIndex"`
+	ItemsPerPage int            `json:"itemsPerPage"`
+	Resources    []SCIMResource `json:"Resources"`
+}
+
+// SCIMQuery selects the resources of a list request.
+type SCIMQuery struct {
+	Filter string
+	// StartIndex is the 1-based index of the first result.
+	StartIndex int
+	// Count is the page size; negative asks for the default.
+	Count int
+}
+
+func (r SCIMResource) meta() map[string]interface{} {
+	meta, _ := r["meta"].(map[string]interface{})
+	return meta
+}
+
+// Version returns the resource's entity tag, a hash of its
+// representation.
+func (r SCIMResource) Version() string {
+	version, _ := r.meta()["version"].(string)
+	return version
+}
+
+// Location returns the URL of the resource.
+func (r SCIMResource) Location() string {
+	location, _ := r.meta()["location"].(string)
+	return location
+}
+
+// MatchesVersion reports whether an If-Match or If-None-Match header
+// lists the resource's version. * matches any version, and weak and
+// strong tags compare equal.
+func (r SCIMResource) MatchesVersion(header string) bool {
+	version := strings.TrimPrefix(r.Version(), "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Project returns the resource with only the listed attributes, or
+// without the excluded ones (RFC 7644 section 3.9); id and schemas are
+// always kept. A sub-attribute selects the attribute it belongs to.
+func (r SCIMResource) Project(attributes, excluded []string) SCIMResource {
+	if len(attributes) == 0 && len(excluded) == 0 {
+		return r
+	}
+	topLevel := func(paths []string) map[string]bool {
+		names := make(map[string]bool)
+		for _, path := range paths {
+			if strings.HasPrefix(strings.ToLower(path), "urn:") {
+				path = path[strings.LastIndexByte(path, ':')+1:]
+			}
+			name, _, _ := strings.Cut(path, ".")
+			names[strings.ToLower(name)] = true
+		}
+		return names
+	}
+	include, exclude := topLevel(attributes), topLevel(excluded)
+
+	projected := make(SCIMResource)
+	for key, value := range r {
+		name := strings.ToLower(key)
+		always := name == "id" || name == "schemas"
+		if always || ((len(include) == 0 || include[name]) && !exclude[name]) {
+			projected[key] = value
+		}
+	}
+	return projected
+}
+
+// newSCIMResource completes a representation with the common attributes
+// and its version.
+func newSCIMResource(realm *realms.Realm, t *scimResourceType, id uint, created, modified time.Time, attributes SCIMResource) SCIMResource {
+	idStr := strconv.FormatUint(uint64(id), 10)
+	attributes["schemas"] = []interface{}{t.Schema}
+	attributes["id"] = idStr
+	meta := map[string]interface{}{
+		"resourceType": t.Name,
+		"created":      created.UTC().Format(time.RFC3339),
+		"lastModified": modified.UTC().Format(time.RFC3339),
+		"location":     SCIMBaseURL(realm) + t.Endpoint + "/" + idStr,
+	}
+	attributes["meta"] = meta
+	// Maps marshal with sorted keys, so equal resources hash alike
+	data, _ := json.Marshal(attributes)
+	sum := sha256.Sum256(data)
+	meta["version"] = `W/"` + hex.EncodeToString(sum[:8]) + `"`
+	return attributes
+}
+
+func scimPage(resources []SCIMResource, query *SCIMQuery) *SCIMList {
+	start := query.StartIndex
+	if start < 1 {
+		start = 1
+	}
+	count := query.Count
+	if count < 0 {
+		count = scimDefaultCount
+	}
+	count = min(count, scimMaxResults)
+
+	page := []SCIMResource{}
+	if start <= len(resources) {
+		page = resources[start-1 : min(start-1+count, len(resources))]
+	}
+	return &SCIMList{
+		Schemas:      []string{SCIMListResponseSchema},
+		TotalResults: len(resources),
+		StartIndex:   start,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}
+}
+
+func parseSCIMQueryFilter(filter string, t *scimResourceType) (scimFilter, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	parsed, err := parseSCIMFilter(filter, t.Schema)
+	if err != nil {
+		return nil, scimError("invalidFilter", "invalid filter: %v", err)
+	}
+	return parsed, nil
+}
+
+// scimEquality returns the value of a filter of the form attribute eq
+// "value", which can be answered by a lookup instead of a scan.
+func scimEquality(filter scimFilter, attribute string) (string, bool) {
+	comparison, ok := filter.(*scimComparison)
+	if !ok || comparison.op != "eq" || !strings.EqualFold(comparison.attribute, attribute) {
+		return "", false
+	}
+	value, ok := comparison.value.(string)
+	return value, ok
+}
+
+func scimID(id string) uint {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return uint(n)
+}
+
+// scimAttr returns an attribute of a request body, ignoring case; null
+// counts as absent.
+func scimAttr(body map[string]interface{}, name string) (interface{}, bool) {
+	key, found := scimKey(body, name)
+	if !found || body[key] == nil {
+		return nil, false
+	}
+	return body[key], true
+}
+
+func scimStringAttr(body map[string]interface{}, name string) (string, error) {
+	value, found := scimAttr(body, name)
+	if !found {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", scimError("invalidValue", "%s must be a string", name)
+	}
+	return s, nil
+}
+
+// scimBoolAttr also accepts "true" and "false" as strings, which some
+// clients send.
+func scimBoolAttr(body map[string]interface{}, name string, fallback bool) (bool, error) {
+	value, found := scimAttr(body, name)
+	if !found {
+		return fallback, nil
+	}
+	switch value := value.(type) {
+	case bool:
+		return value, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.ToLower(value)); err == nil {
+			return b, nil
+		}
+	}
+	return false, scimError("invalidValue", "%s must be true or false", name)
+}
+
+// scimUser holds the stored attributes of a user representation.
+type scimUser struct {
+	userName   string
+	externalID string
+	active     bool
+	email      string
+	roles      []string
+	// password is nil if the representation doesn't set one.
+	password *string
+}
+
+func parseSCIMUser(body map[string]interface{}) (*scimUser, error) {
+	user := new(scimUser)
+	var err error
+	if user.userName, err = scimStringAttr(body, "userName"); err != nil {
+		return nil, err
+	}
+	if user.userName == "" {
+		return nil, scimError("invalidValue", "userName is required")
+	}
+	if user.externalID, err = scimStringAttr(body, "externalId"); err != nil {
+		return nil, err
+	}
+	if user.active, err = scimBoolAttr(body, "active", true); err != nil {
+		return nil, err
+	}
+
+	// Only one address is kept: the primary one, or else the first
+	emails, _ := scimAttr(body, "emails")
+	for _, element := range scimValues(emails) {
+		email, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, scimError("invalidValue", "emails must be a list of objects")
+		}
+		value, err := scimStringAttr(email, "value")
+		if err != nil {
+			return nil, err
+		}
+		primary, err := scimBoolAttr(email, "primary", false)
+		if err != nil {
+			return nil, err
+		}
+		if user.email == "" || primary {
+			user.email = value
+		}
+		if primary {
+			break
+		}
+	}
+	if user.email == "" {
+		return nil, scimError("invalidValue", "an email address is required")
+	}
+	if address, err := mail.ParseAddress(user.email); err != nil || address.Address != user.email {
+		return nil, scimError("invalidValue", "invalid email address %q", user.email)
+	}
+
+	roles, _ := scimAttr(body, "roles")
+	seen := make(map[string]bool)
+	for _, element := range scimValues(roles) {
+		role, ok := scimElementValue(element).(string)
+		if !ok || role == "" || strings.ContainsAny(role, " \t\r\n") {
+			return nil, scimError("invalidValue", "roles must be names without spaces")
+		}
+		if !seen[role] {
+			seen[role] = true
+			user.roles = append(user.roles, role)
+		}
+	}
+
+	if password, found := scimAttr(body, "password"); found {
+		s, ok := password.(string)
+		if !ok {
+			return nil, scimError("invalidValue", "password must be a string")
+		}
+		user.password = &s
+	}
+	return user, nil
+}
+
+// scimPasswordError explains a rejected password to the client.
+func scimPasswordError(err error) error {
+	var policyErr *passwords.PolicyError
+	if errors.As(err, &policyErr) || errors.Is(err, ErrEmptyPassword) || errors.Is(err, ErrPasswordManagedByDirectory) {
+		return scimError("invalidValue", "%v", err)
+	}
+	return err
+}
+
+func userSCIMResource(realm *realms.Realm, user *models.User, groups []models.Group) SCIMResource {
+	resource := SCIMResource{
+		"userName": user.Username,
+		"active":   !user.Disabled,
+		"emails": []interface{}{
+			map[string]interface{}{"value": user.Email, "type": "work", "primary": true},
+		},
+	}
+	if user.ExternalID != "" {
+		resource["externalId"] = user.ExternalID
+	}
+	var roles []interface{}
+	for _, role := range strings.Fields(user.Roles) {
+		roles = append(roles, map[string]interface{}{"value": role})
+	}
+	if len(roles) > 0 {
+		resource["roles"] = roles
+	}
+	var memberOf []interface{}
+	for i := range groups {
+		if hasGroupMember(&groups[i], user.ID) {
+			id := strconv.FormatUint(uint64(groups[i].ID), 10)
+			memberOf = append(memberOf, map[string]interface{}{
+				"value":   id,
+				"display": groups[i].DisplayName,
+				"$ref":    SCIMBaseURL(realm) + scimGroupType.Endpoint + "/" + id,
+				"type":    "direct",
+			})
+		}
+	}
+	if len(memberOf) > 0 {
+		resource["groups"] = memberOf
+	}
+	return newSCIMResource(realm, scimUserType, user.ID, user.CreatedAt, user.UpdatedAt, resource)
+}
+
+func (s *SCIMService) GetUser(realm *realms.Realm, id string) (SCIMResource, error) {
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(scimID(id))
+	if user == nil {
+		return nil, ErrSCIMNotFound
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	return userSCIMResource(realm, user, groups), nil
+}
+
+// ListUsers returns a page of the users matching the query's filter. The
+// filter is evaluated in memory, except for the userName eq lookups that
+// provisioning clients make before creating a user.
+func (s *SCIMService) ListUsers(realm *realms.Realm, query *SCIMQuery) (*SCIMList, error) {
+	filter, err := parseSCIMQueryFilter(query.Filter, scimUserType)
+	if err != nil {
+		return nil, err
+	}
+	store := s.store.ForRealm(realm.Name)
+	var users []models.User
+	if username, ok := scimEquality(filter, "userName"); ok {
+		if user := store.GetUserByUsername(username); user != nil {
+			users = append(users, *user)
+		}
+	} else if users, err = store.ListUsers(); err != nil {
+		return nil, err
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []SCIMResource
+	for i := range users {
+		resource := userSCIMResource(realm, &users[i], groups)
+		if filter == nil || filter.matches(resource, scimUserType, "") {
+			resources = append(resources, resource)
+		}
+	}
+	return scimPage(resources, query), nil
+}
+
+// CreateUser creates a user from its representation. The email address
+// counts as verified, as the provisioning system is trusted with it.
+func (s *SCIMService) CreateUser(realm *realms.Realm, body map[string]interface{}) (SCIMResource, error) {
+	input, err := parseSCIMUser(body)
+	if err != nil {
+		return nil, err
+	}
+	store := s.store.ForRealm(realm.Name)
+	if store.GetUserByUsername(input.userName) != nil {
+		return nil, scimError("uniqueness", "userName %q is already taken", input.userName)
+	}
+	if taken, err := s.users.externalUsernameTaken(realm, input.userName); err != nil {
+		return nil, err
+	} else if taken {
+		return nil, scimError("uniqueness", "userName %q is already taken", input.userName)
+	}
+	if store.GetUserByEmail(input.email) != nil {
+		return nil, scimError("uniqueness", "email address %q is already in use", input.email)
+	}
+
+	user := &models.User{
+		Username:      input.userName,
+		Email:         input.email,
+		EmailVerified: true,
+		ExternalID:    input.externalID,
+		Disabled:      !input.active,
+		Roles:         strings.Join(input.roles, " "),
+	}
+	if input.password != nil {
+		if err := s.users.checkPassword(*input.password, user.Username, user.Email); err != nil {
+			return nil, scimPasswordError(err)
+		}
+		if user.Password, err = passwords.Hash(*input.password); err != nil {
+			return nil, err
+		}
+	}
+	if err := store.StoreUser(user); err != nil {
+		return nil, err
+	}
+	audit(realm, AuditSCIMUserCreated, "username", user.Username, "active", strconv.FormatBool(input.active))
+	return userSCIMResource(realm, user, nil), nil
+}
+
+// ReplaceUser saves a new representation of a user. ifMatch is the
+// request's If-Match header, if any.
+func (s *SCIMService) ReplaceUser(realm *realms.Realm, id string, body map[string]interface{}, ifMatch string) (SCIMResource, error) {
+	return s.updateUser(realm, id, ifMatch, func(SCIMResource) (map[string]interface{}, error) {
+		return body, nil
+	})
+}
+
+// PatchUser applies a PatchOp message to a user.
+func (s *SCIMService) PatchUser(realm *realms.Realm, id string, body map[string]interface{}, ifMatch string) (SCIMResource, error) {
+	return s.updateUser(realm, id, ifMatch, func(current SCIMResource) (map[string]interface{}, error) {
+		if err := applySCIMPatch(current, body, scimUserType); err != nil {
+			return nil, err
+		}
+		return current, nil
+	})
+}
+
+// updateUser saves the representation change makes of the current one.
+// Deactivating a user revokes their refresh tokens; access tokens already
+// issued stay valid until they expire.
+func (s *SCIMService) updateUser(realm *realms.Realm, id, ifMatch string, change func(SCIMResource) (map[string]interface{}, error)) (SCIMResource, error) {
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(scimID(id))
+	if user == nil {
+		return nil, ErrSCIMNotFound
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	current := userSCIMResource(realm, user, groups)
+	if ifMatch != "" && !current.MatchesVersion(ifMatch) {
+		return nil, ErrSCIMPreconditionFailed
+	}
+
+	body, err := change(current)
+	if err != nil {
+		return nil, err
+	}
+	input, err := parseSCIMUser(body)
+	if err != nil {
+		return nil, err
+	}
+	if input.userName != user.Username {
+		return nil, scimError("mutability", "userName can't be changed")
+	}
+	if input.email != user.Email {
+		return nil, scimError("mutability", "the email address can't be changed")
+	}
+
+	deactivated := !input.active && !user.Disabled
+	user.ExternalID = input.externalID
+	user.Disabled = !input.active
+	user.Roles = strings.Join(input.roles, " ")
+	if input.password != nil {
+		// Saves the other changes too
+		if err := s.users.setPassword(realm, user, *input.password); err != nil {
+			return nil, scimPasswordError(err)
+		}
+	} else if err := store.UpdateUser(user); err != nil {
+		return nil, err
+	}
+	if deactivated {
+		revoked, err := store.DeleteRefreshTokensForUser(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Deactivated user %d in realm %s, revoked %d refresh tokens", user.ID, realm.Name, revoked)
+	}
+	audit(realm, AuditSCIMUserUpdated, "username", user.Username, "active", strconv.FormatBool(input.active))
+	return userSCIMResource(realm, user, groups), nil
+}
+
+// DeleteUser deletes a user for good, removing them from their groups and
+// revoking their refresh tokens.
+func (s *SCIMService) DeleteUser(realm *realms.Realm, id, ifMatch string) error {
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(scimID(id))
+	if user == nil {
+		return ErrSCIMNotFound
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !userSCIMResource(realm, user, groups).MatchesVersion(ifMatch) {
+		return ErrSCIMPreconditionFailed
+	}
+
+	for i := range groups {
+		if removeGroupMember(&groups[i], user.ID) {
+			if err := store.UpdateGroup(&groups[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := store.DeleteRefreshTokensForUser(user.ID); err != nil {
+		return err
+	}
+	if err := store.DeleteUser(user.ID); err != nil {
+		return err
+	}
+	audit(realm, AuditSCIMUserDeleted, "username", user.Username)
+	return nil
+}
+
+func hasGroupMember(group *models.Group, userID uint) bool {
+	id := strconv.FormatUint(uint64(userID), 10)
+	for _, member := range strings.Fields(group.Members) {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeGroupMember reports whether the user was a member.
+func removeGroupMember(group *models.Group, userID uint) bool {
+	id := strconv.FormatUint(uint64(userID), 10)
+	members := strings.Fields(group.Members)
+	kept := members[:0]
+	for _, member := range members {
+		if member != id {
+			kept = append(kept, member)
+		}
+	}
+	group.Members = strings.Join(kept, " ")
+	return len(kept) < len(members)
+}
+
+// scimGroup holds the stored attributes of a group representation.
+type scimGroup struct {
+	displayName string
+	externalID  string
+	members     []string
+}
+
+func parseSCIMGroup(body map[string]interface{}) (*scimGroup, error) {
+	group := new(scimGroup)
+	var err error
+	if group.displayName, err = scimStringAttr(body, "displayName"); err != nil {
+		return nil, err
+	}
+	if group.displayName == "" {
+		return nil, scimError("invalidValue", "displayName is required")
+	}
+	if group.externalID, err = scimStringAttr(body, "externalId"); err != nil {
+		return nil, err
+	}
+
+	members, _ := scimAttr(body, "members")
+	seen := make(map[string]bool)
+	for _, element := range scimValues(members) {
+		member, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, scimError("invalidValue", "members must be a list of objects")
+		}
+		if memberType, err := scimStringAttr(member, "type"); err != nil {
+			return nil, err
+		} else if memberType != "" && !strings.EqualFold(memberType, "User") {
+			return nil, scimError("invalidValue", "only users can be group members")
+		}
+		value, err := scimStringAttr(member, "value")
+		if err != nil {
+			return nil, err
+		}
+		id := scimID(value)
+		if id == 0 {
+			return nil, scimError("invalidValue", "no user with ID %q", value)
+		}
+		if value = strconv.FormatUint(uint64(id), 10); !seen[value] {
+			seen[value] = true
+			group.members = append(group.members, value)
+		}
+	}
+	return group, nil
+}
+
+// checkNewMembers makes sure the members not already in the group are
+// users of the realm.
+func checkNewMembers(store storage.UserRepository, members []string, current string) error {
+	existing := make(map[string]bool)
+	for _, member := range strings.Fields(current) {
+		existing[member] = true
+	}
+	for _, member := range members {
+		if !existing[member] && store.GetUser(scimID(member)) == nil {
+			return scimError("invalidValue", "no user with ID %q", member)
+		}
+	}
+	return nil
+}
+
+func groupSCIMResource(realm *realms.Realm, group *models.Group) SCIMResource {
+	resource := SCIMResource{"displayName": group.DisplayName}
+	if group.ExternalID != "" {
+		resource["externalId"] = group.ExternalID
+	}
+	var members []interface{}
+	for _, id := range strings.Fields(group.Members) {
+		members = append(members, map[string]interface{}{
+			"value": id,
+			"$ref":  SCIMBaseURL(realm) + scimUserType.Endpoint + "/" + id,
+			"type":  "User",
+		})
+	}
+	if len(members) > 0 {
+		resource["members"] = members
+	}
+	return newSCIMResource(realm, scimGroupType, group.ID, group.CreatedAt, group.UpdatedAt, resource)
+}
+
+func (s *SCIMService) GetGroup(realm *realms.Realm, id string) (SCIMResource, error) {
+	group := s.store.ForRealm(realm.Name).GetGroup(scimID(id))
+	if group == nil {
+		return nil, ErrSCIMNotFound
+	}
+	return groupSCIMResource(realm, group), nil
+}
+
+// ListGroups returns a page of the groups matching the query's filter.
+func (s *SCIMService) ListGroups(realm *realms.Realm, query *SCIMQuery) (*SCIMList, error) {
+	filter, err := parseSCIMQueryFilter(query.Filter, scimGroupType)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.ForRealm(realm.Name).ListGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []SCIMResource
+	for i := range groups {
+		resource := groupSCIMResource(realm, &groups[i])
+		if filter == nil || filter.matches(resource, scimGroupType, "") {
+			resources = append(resources, resource)
+		}
+	}
+	return scimPage(resources, query), nil
+}
+
+func (s *SCIMService) CreateGroup(realm *realms.Realm, body map[string]interface{}) (SCIMResource, error) {
+	input, err := parseSCIMGroup(body)
+	if err != nil {
+		return nil, err
+	}
+	store := s.store.ForRealm(realm.Name)
+	if err := checkNewMembers(store, input.members, ""); err != nil {
+		return nil, err
+	}
+
+	group := &models.Group{
+		DisplayName: input.displayName,
+		ExternalID:  input.externalID,
+		Members:     strings.Join(input.members, " "),
+	}
+	if err := store.StoreGroup(group); err != nil {
+		if errors.Is(err, storage.ErrGroupExists) {
+			return nil, scimError("uniqueness", "displayName %q is already taken", group.DisplayName)
+		}
+		return nil, err
+	}
+	audit(realm, AuditSCIMGroupCreated, "group", group.DisplayName, "members", strconv.Itoa(len(input.members)))
+	return groupSCIMResource(realm, group), nil
+}
+
+// ReplaceGroup saves a new representation of a group.
+func (s *SCIMService) ReplaceGroup(realm *realms.Realm, id string, body map[string]interface{}, ifMatch string) (SCIMResource, error) {
+	return s.updateGroup(realm, id, ifMatch, func(SCIMResource) (map[string]interface{}, error) {
+		return body, nil
+	})
+}
+
+// PatchGroup applies a PatchOp message to a group, typically adding or
+// removing members.
+func (s *SCIMService) PatchGroup(realm *realms.Realm, id string, body map[string]interface{}, ifMatch string) (SCIMResource, error) {
+	return s.updateGroup(realm, id, ifMatch, func(current SCIMResource) (map[string]interface{}, error) {
+		if err := applySCIMPatch(current, body, scimGroupType); err != nil {
+			return nil, err
+		}
+		return current, nil
+	})
+}
+
+func (s *SCIMService) updateGroup(realm *realms.Realm, id, ifMatch string, change func(SCIMResource) (map[string]interface{}, error)) (SCIMResource, error) {
+	store := s.store.ForRealm(realm.Name)
+	group := store.GetGroup(scimID(id))
+	if group == nil {
+		return nil, ErrSCIMNotFound
+	}
+	current := groupSCIMResource(realm, group)
+	if ifMatch != "" && !current.MatchesVersion(ifMatch) {
+		return nil, ErrSCIMPreconditionFailed
+	}
+
+	body, err := change(current)
+	if err != nil {
+		return nil, err
+	}
+	input, err := parseSCIMGroup(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNewMembers(store, input.members, group.Members); err != nil {
+		return nil, err
+	}
+
+	group.DisplayName = input.displayName
+	group.ExternalID = input.externalID
+	group.Members = strings.Join(input.members, " ")
+	if err := store.UpdateGroup(group); err != nil {
+		if errors.Is(err, storage.ErrGroupExists) {
+			return nil, scimError("uniqueness", "displayName %q is already taken", group.DisplayName)
+		}
+		return nil, err
+	}
+	audit(realm, AuditSCIMGroupUpdated, "group", group.DisplayName, "members", strconv.Itoa(len(input.members)))
+	return groupSCIMResource(realm, group), nil
+}
+
+func (s *SCIMService) DeleteGroup(realm *realms.Realm, id, ifMatch string) error {
+	store := s.store.ForRealm(realm.Name)
+	group := store.GetGroup(scimID(id))
+	if group == nil {
+		return ErrSCIMNotFound
+	}
+	if ifMatch != "" && !groupSCIMResource(realm, group).MatchesVersion(ifMatch) {
+		return ErrSCIMPreconditionFailed
+	}
+	if err := store.DeleteGroup(group.ID); err != nil {
+		return err
+	}
+	audit(realm, AuditSCIMGroupDeleted, "group", group.DisplayName)
+	return nil
+}
@@ -0,0 +1,415 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scimFilter is a parsed filter expression (RFC 7644 section 3.4.2.2).
+// Filters are evaluated against the JSON representation of a resource, so
+// every attribute a resource shows can be filtered on.
+type scimFilter interface {
+	// matches evaluates the filter against a resource, or against an
+	// element of the multi-valued attribute prefix inside a value path.
+	matches(resource map[string]interface{}, t *scimResourceType, prefix string) bool
+}
+
+type scimAnd struct{ left, right scimFilter }
+
+func (f *scimAnd) matches(resource map[string]interface{}, t *scimResourceType, prefix string) bool {
+	return f.left.matches(resource, t, prefix) && f.right.matches(resource, t, prefix)
+}
+
+type scimOr struct{ left, right scimFilter }
+
+func (f *scimOr) matches(resource map[string]interface{}, t *scimResourceType, prefix string) bool {
+	return f.left.matches(resource, t, prefix) || f.right.matches(resource, t, prefix)
+}
+
+type scimNot struct{ filter scimFilter }
+
+func (f *scimNot) matches(resource map[string]interface{}, t *scimResourceType, prefix string) bool {
+	return !f.filter.matches(resource, t, prefix)
+}
+
+// scimValuePath matches resources with at least one element of a
+// multi-valued attribute that matches the inner filter, as in
+// emails[type eq "work"].
+type scimValuePath struct {
+	attribute string
+	filter    scimFilter
+}
+
+func (f *scimValuePath) matches(resource map[string]interface{}, t *scimResourceType, prefix string) bool {
+	for _, value := range resolveSCIMPath(resource, f.attribute) {
+		if element, ok := value.(map[string]interface{}); ok && f.filter.matches(element, t, prefix+f.attribute+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// scimComparison is an attribute expression such as userName eq "bob"
+// or title pr. A multi-valued attribute matches if any of its values
+// does, except that ne only matches if none equals the value.
+type scimComparison struct {
+	attribute string
+	op        string
+	value     interface{}
+}
+
+func (f *scimComparison) matches(resource map[string]interface{}, t *scimResourceType, prefix string) bool {
+	// A complex value stands for its value sub-attribute, so emails eq "x"
+	// works like emails.value eq "x"
+	values := resolveSCIMPath(resource, f.attribute)
+	for i, value := range values {
+		values[i] = scimElementValue(value)
+	}
+	switch f.op {
+	case "pr":
+		for _, value := range values {
+			if value != nil && value != "" {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !(&scimComparison{attribute: f.attribute, op: "eq", value: f.value}).matches(resource, t, prefix)
+	}
+	if f.value == nil {
+		return f.op == "eq" && len(values) == 0
+	}
+	caseExact := t.caseExact(prefix + f.attribute)
+	for _, value := range values {
+		if compareSCIMValue(value, f.op, f.value, caseExact) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareSCIMValue(value interface{}, op string, operand interface{}, caseExact bool) bool {
+	switch operand := operand.(type) {
+	case string:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact {
+			s, operand = strings.ToLower(s), strings.ToLower(operand)
+		}
+		switch op {
+		case "eq":
+			return s == operand
+		case "co":
+			return strings.Contains(s, operand)
+		case "sw":
+			return strings.HasPrefix(s, operand)
+		case "ew":
+			return strings.HasSuffix(s, operand)
+		case "gt":
+			return s > operand
+		case "ge":
+			return s >= operand
+		case "lt":
+			return s < operand
+		case "le":
+			return s <= operand
+		}
+	case bool:
+		b, ok := value.(bool)
+		return ok && op == "eq" && b == operand
+	case float64:
+		n, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return n == operand
+		case "gt":
+			return n > operand
+		case "ge":
+			return n >= operand
+		case "lt":
+			return n < operand
+		case "le":
+			return n <= operand
+		}
+	}
+	return false
+}
+
+// resolveSCIMPath returns the values at a dotted attribute path, looking
+// names up without regard to case. Multi-valued attributes contribute
+// each of their values.
+func resolveSCIMPath(resource map[string]interface{}, path string) []interface{} {
+	current := []interface{}{resource}
+	for _, name := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, value := range current {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key, found := scimKey(object, name)
+			if !found || object[key] == nil {
+				continue
+			}
+			if list, ok := object[key].([]interface{}); ok {
+				next = append(next, list...)
+			} else {
+				next = append(next, object[key])
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// scimKey finds the key of an attribute in a JSON object, ignoring case
+// as SCIM attribute names are case insensitive.
+func scimKey(object map[string]interface{}, name string) (string, bool) {
+	if _, ok := object[name]; ok {
+		return name, true
+	}
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// stripSCIMSchema removes the schema URN an attribute path may be
+// qualified with, as in urn:ietf:params:scim:schemas:core:2.0:User:userName.
+// Paths into other schemas are returned unchanged.
+func stripSCIMSchema(path, schema string) string {
+	if len(path) > len(schema) && strings.EqualFold(path[:len(schema)+1], schema+":") {
+		return path[len(schema)+1:]
+	}
+	return path
+}
+
+var scimComparisonOps = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+type scimToken struct {
+	// kind is one of ( ) [ ], '"' for a string or 'w' for any other word.
+	kind byte
+	text string
+}
+
+type scimFilterParser struct {
+	tokens []scimToken
+	pos    int
+	schema string
+}
+
+// parseSCIMFilter parses a filter over resources of the given schema.
+func parseSCIMFilter(filter, schema string) (scimFilter, error) {
+	tokens, err := tokenizeSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens, schema: schema}
+	parsed, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return parsed, nil
+}
+
+func tokenizeSCIMFilter(filter string) ([]scimToken, error) {
+	var tokens []scimToken
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimToken{kind: c, text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			var text string
+			if err := json.Unmarshal([]byte(filter[i:end+1]), &text); err != nil {
+				return nil, fmt.Errorf("invalid string %s", filter[i:end+1])
+			}
+			tokens = append(tokens, scimToken{kind: '"', text: text})
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !strings.ContainsRune(" \t\n\r()[]\"", rune(filter[end])) {
+				end++
+			}
+			tokens = append(tokens, scimToken{kind: 'w', text: filter[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func (p *scimFilterParser) peek() *scimToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+// keyword consumes the next token if it is the given word.
+func (p *scimFilterParser) keyword(word string) bool {
+	if t := p.peek(); t != nil && t.kind == 'w' && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scimFilterParser) expect(kind byte) error {
+	t := p.peek()
+	if t == nil {
+		return fmt.Errorf("expected %q at the end", kind)
+	}
+	if t.kind != kind {
+		return fmt.Errorf("expected %q, found %q", kind, t.text)
+	}
+	p.pos++
+	return nil
+}
+
+// parseOr parses or-expressions, which bind weaker than and.
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseUnary() (scimFilter, error) {
+	negate := p.keyword("not")
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+
+	var filter scimFilter
+	var err error
+	switch {
+	case t.kind == '(':
+		p.pos++
+		if filter, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+	case negate:
+		return nil, fmt.Errorf("not must be followed by a parenthesized filter")
+	case t.kind == 'w':
+		if filter, err = p.parseAttributeExpression(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	if negate {
+		return &scimNot{filter}, nil
+	}
+	return filter, nil
+}
+
+func (p *scimFilterParser) parseAttributeExpression() (scimFilter, error) {
+	attribute := stripSCIMSchema(p.tokens[p.pos].text, p.schema)
+	p.pos++
+
+	if t := p.peek(); t != nil && t.kind == '[' {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(']'); err != nil {
+			return nil, err
+		}
+		return &scimValuePath{attribute: attribute, filter: inner}, nil
+	}
+
+	t := p.peek()
+	if t == nil || t.kind != 'w' {
+		return nil, fmt.Errorf("expected an operator after %s", attribute)
+	}
+	op := strings.ToLower(t.text)
+	p.pos++
+	if op == "pr" {
+		return &scimComparison{attribute: attribute, op: op}, nil
+	}
+	if !scimComparisonOps[op] {
+		return nil, fmt.Errorf("unknown operator %q", t.text)
+	}
+
+	t = p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("expected a value after %s %s", attribute, op)
+	}
+	p.pos++
+	comparison := &scimComparison{attribute: attribute, op: op}
+	switch {
+	case t.kind == '"':
+		comparison.value = t.text
+	case t.kind == 'w' && t.text == "true":
+		comparison.value = true
+	case t.kind == 'w' && t.text == "false":
+		comparison.value = false
+	case t.kind == 'w' && t.text == "null":
+		if op != "eq" && op != "ne" {
+			return nil, fmt.Errorf("null can only be compared with eq or ne")
+		}
+	case t.kind == 'w':
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", t.text)
+		}
+		comparison.value = n
+	default:
+		return nil, fmt.Errorf("expected a value after %s %s", attribute, op)
+	}
+	return comparison, nil
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scimPath is the target of a PATCH operation: an attribute, optionally
+// narrowed to the values matching a filter, optionally down to one
+// sub-attribute, as in emails[type eq "work"].value.
+type scimPath struct {
+	attribute string
+	filter    scimFilter
+	sub       string
+}
+
+// parseSCIMPath parses a PATCH path. It returns nil for paths into schema
+// extensions, which the server doesn't store.
+func parseSCIMPath(path string, t *scimResourceType) (*scimPath, error) {
+	path = stripSCIMSchema(path, t.Schema)
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return nil, nil
+	}
+
+	parsed := &scimPath{attribute: path}
+	if open := strings.IndexByte(path, '['); open >= 0 {
+		end := strings.LastIndexByte(path, ']')
+		if end < open {
+			return nil, scimError("invalidPath", "unbalanced brackets in path %q", path)
+		}
+		filter, err := parseSCIMFilter(path[open+1:end], t.Schema)
+		if err != nil {
+			return nil, scimError("invalidPath", "invalid filter in path %q: %v", path, err)
+		}
+		parsed.attribute, parsed.filter = path[:open], filter
+		if rest := path[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ".") {
+				return nil, scimError("invalidPath", "invalid path %q", path)
+			}
+			parsed.sub = rest[1:]
+		}
+	} else if attribute, sub, ok := strings.Cut(path, "."); ok {
+		parsed.attribute, parsed.sub = attribute, sub
+	}
+
+	for _, name := range []string{parsed.attribute, parsed.sub} {
+		if strings.ContainsAny(name, " .[]\"") {
+			return nil, scimError("invalidPath", "invalid path %q", path)
+		}
+	}
+	if parsed.attribute == "" || (parsed.sub == "" && strings.Contains(path, "].")) {
+		return nil, scimError("invalidPath", "invalid path %q", path)
+	}
+	parsed.attribute = t.canonicalName(parsed.attribute)
+	return parsed, nil
+}
+
+// applySCIMPatch applies the operations of a PatchOp message (RFC 7644
+// section 3.5.2) to the JSON representation of a resource. The result is
+// then saved like a replacement of the resource, so read-only attributes
+// it changes are ignored.
+func applySCIMPatch(resource map[string]interface{}, body map[string]interface{}, t *scimResourceType) error {
+	key, found := scimKey(body, "Operations")
+	if !found {
+		return scimError("invalidSyntax", "PatchOp message has no Operations")
+	}
+	operations, ok := body[key].([]interface{})
+	if !ok {
+		return scimError("invalidSyntax", "Operations must be a list")
+	}
+	for _, raw := range operations {
+		operation, ok := raw.(map[string]interface{})
+		if !ok {
+			return scimError("invalidSyntax", "each operation must be an object")
+		}
+		var op, path string
+		if key, found := scimKey(operation, "op"); found {
+			op, _ = operation[key].(string)
+		}
+		if key, found := scimKey(operation, "path"); found {
+			path, _ = operation[key].(string)
+		}
+		var value interface{}
+		if key, found := scimKey(operation, "value"); found {
+			value = operation[key]
+		}
+		if err := applySCIMPatchOp(resource, strings.ToLower(op), path, value, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applySCIMPatchOp(resource map[string]interface{}, op, path string, value interface{}, t *scimResourceType) error {
+	if op != "add" && op != "replace" && op != "remove" {
+		return scimError("invalidSyntax", "unknown operation %q", op)
+	}
+	if path != "" {
+		target, err := parseSCIMPath(path, t)
+		if err != nil || target == nil {
+			return err
+		}
+		return applySCIMPatchTarget(resource, op, target, value, t)
+	}
+
+	// Without a path the value holds the attributes to add or replace.
+	// Some clients qualify them with the schema, or name sub-attributes
+	// as in {"name.givenName": "Ann"}.
+	if op == "remove" {
+		return scimError("noTarget", "remove needs a path")
+	}
+	attributes, ok := value.(map[string]interface{})
+	if !ok {
+		return scimError("invalidValue", "%s without a path needs an object value", op)
+	}
+	for name, v := range attributes {
+		if strings.EqualFold(name, t.Schema) {
+			if err := applySCIMPatchOp(resource, op, "", v, t); err != nil {
+				return err
+			}
+			continue
+		}
+		target, err := parseSCIMPath(name, t)
+		if err != nil {
+			return err
+		}
+		if target == nil {
+			continue
+		}
+		if err := applySCIMPatchTarget(resource, op, target, v, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applySCIMPatchTarget(resource map[string]interface{}, op string, target *scimPath, value interface{}, t *scimResourceType) error {
+	key, found := scimKey(resource, target.attribute)
+	if !found {
+		key = target.attribute
+	}
+	current := resource[key]
+	attribute := t.attribute(target.attribute)
+	_, isList := current.([]interface{})
+	multiValued := isList || (attribute != nil && attribute.MultiValued)
+
+	if target.filter != nil {
+		return applySCIMPatchFilter(resource, key, op, target, value, t)
+	}
+
+	if target.sub != "" {
+		// A sub-attribute of a complex attribute, or of every value of a
+		// multi-valued one
+		var objects []map[string]interface{}
+		if multiValued {
+			list, _ := current.([]interface{})
+			for _, element := range list {
+				if object, ok := element.(map[string]interface{}); ok {
+					objects = append(objects, object)
+				}
+			}
+		} else {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				if op == "remove" {
+					return nil
+				}
+				object = make(map[string]interface{})
+				resource[key] = object
+			}
+			objects = append(objects, object)
+		}
+		for _, object := range objects {
+			setSCIMSubAttribute(object, op, target.sub, value)
+		}
+		return nil
+	}
+
+	switch {
+	case op == "remove" && multiValued && value != nil:
+		// Removing listed values rather than the whole attribute, as in
+		// {"op": "remove", "path": "members", "value": [{"value": "7"}]}
+		remove := make(map[string]bool)
+		for _, v := range scimValues(value) {
+			remove[fmt.Sprint(scimElementValue(v))] = true
+		}
+		var kept []interface{}
+		list, _ := current.([]interface{})
+		for _, element := range list {
+			if !remove[fmt.Sprint(scimElementValue(element))] {
+				kept = append(kept, element)
+			}
+		}
+		resource[key] = kept
+	case op == "remove":
+		delete(resource, key)
+	case op == "add" && multiValued:
+		list, _ := current.([]interface{})
+		resource[key] = append(list, scimValues(value)...)
+	case multiValued:
+		resource[key] = scimValues(value)
+	default:
+		// Complex attributes are merged: sub-attributes left out keep
+		// their values
+		existing, isObject := current.(map[string]interface{})
+		update, isUpdate := value.(map[string]interface{})
+		if isObject && isUpdate {
+			for name, v := range update {
+				setSCIMSubAttribute(existing, "replace", name, v)
+			}
+			return nil
+		}
+		resource[key] = value
+	}
+	return nil
+}
+
+// applySCIMPatchFilter applies an operation to the values of the
+// multi-valued attribute at key that match the path's filter.
+func applySCIMPatchFilter(resource map[string]interface{}, key, op string, target *scimPath, value interface{}, t *scimResourceType) error {
+	list, _ := resource[key].([]interface{})
+	var kept []interface{}
+	matched := false
+	for _, element := range list {
+		object, ok := element.(map[string]interface{})
+		if !ok || !target.filter.matches(object, t, target.attribute+".") {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+		switch {
+		case target.sub != "":
+			setSCIMSubAttribute(object, op, target.sub, value)
+			kept = append(kept, object)
+		case op == "remove":
+		case op == "replace":
+			kept = append(kept, value)
+		default:
+			if update, ok := value.(map[string]interface{}); ok {
+				for name, v := range update {
+					setSCIMSubAttribute(object, "replace", name, v)
+				}
+			}
+			kept = append(kept, object)
+		}
+	}
+	if matched || op == "remove" {
+		resource[key] = kept
+		return nil
+	}
+
+	// Clients set values they expect to exist, as in emails[type eq
+	// "work"].value; a simple equality filter says what the new value
+	// looks like
+	comparison, ok := target.filter.(*scimComparison)
+	if !ok || comparison.op != "eq" || comparison.value == nil || target.sub == "" {
+		return scimError("noTarget", "no value of %s matches the filter", target.attribute)
+	}
+	element := map[string]interface{}{comparison.attribute: comparison.value}
+	setSCIMSubAttribute(element, op, target.sub, value)
+	resource[key] = append(list, element)
+	return nil
+}
+
+func setSCIMSubAttribute(object map[string]interface{}, op, name string, value interface{}) {
+	key, found := scimKey(object, name)
+	if !found {
+		key = name
+	}
+	if op == "remove" {
+		delete(object, key)
+	} else {
+		object[key] = value
+	}
+}
+
+// scimValues returns a value as a list, wrapping a single one.
+func scimValues(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok {
+		return list
+	}
+	if value == nil {
+		return nil
+	}
+	return []interface{}{value}
+}
+
+// scimElementValue returns the value sub-attribute of a complex value.
+func scimElementValue(element interface{}) interface{} {
+	if object, ok := element.(map[string]interface{}); ok {
+		if key, found := scimKey(object, "value"); found {
+			return object[key]
+		}
+	}
+	return element
+}
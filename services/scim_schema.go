@@ -0,0 +1,268 @@
+package services
+
+import (
+	"oauth2-provider/realms"
+	"strings"
+)
+
+// SCIM schema and message URNs (RFC 7643, RFC 7644).
+const (
+	scimUserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	SCIMListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// scimAttribute describes an attribute of a resource type, as published
+// on the Schemas endpoint. Filters and patches also consult it for case
+// sensitivity and for which attributes are multi-valued.
+type scimAttribute struct {
+	Name            string          `json:"name"`
+	Type            string          `json:"type"`
+	MultiValued     bool            `json:"multiValued"`
+	Description     string          `json:"description"`
+	Required        bool            `json:"required"`
+	CaseExact       bool            `json:"caseExact"`
+	Mutability      string          `json:"mutability"`
+	Returned        string          `json:"returned"`
+	Uniqueness      string          `json:"uniqueness"`
+	CanonicalValues []string        `json:"canonicalValues,omitempty"`
+	ReferenceTypes  []string        `json:"referenceTypes,omitempty"`
+	SubAttributes   []scimAttribute `json:"subAttributes,omitempty"`
+}
+
+// scimResourceType is one of the resource types served under /scim/v2.
+type scimResourceType struct {
+	Name        string
+	Endpoint    string
+	Description string
+	Schema      string
+	Attributes  []scimAttribute
+}
+
+func scimString(name, description string, required, caseExact bool, mutability, uniqueness string) scimAttribute {
+	return scimAttribute{
+		Name:        name,
+		Type:        "string",
+		Description: description,
+		Required:    required,
+		CaseExact:   caseExact,
+		Mutability:  mutability,
+		Returned:    "default",
+		Uniqueness:  uniqueness,
+	}
+}
+
+// Usernames and group names are unique as stored, so they compare case
+// sensitively. Usernames and email addresses can't be changed once the
+// user exists, as logins and upstream links rely on them.
+var scimUserType = &scimResourceType{
+	Name:        "User",
+	Endpoint:    "/Users",
+	Description: "User account",
+	Schema:      scimUserSchema,
+	Attributes: []scimAttribute{
+		scimString("userName", "Unique identifier the user signs in with.", true, true, "immutable", "server"),
+		{
+			Name:        "active",
+			Type:        "boolean",
+			Description: "Whether the user can sign in. Deactivating a user revokes their refresh tokens.",
+			Mutability:  "readWrite",
+			Returned:    "default",
+			Uniqueness:  "none",
+		},
+		{
+			Name:        "password",
+			Type:        "string",
+			Description: "The user's password, checked against the password policy. Users created without one sign in by other means or set it with a reset link.",
+			Mutability:  "writeOnly",
+			Returned:    "never",
+			Uniqueness:  "none",
+		},
+		{
+			Name:        "emails",
+			Type:        "complex",
+			MultiValued: true,
+			Description: "The user's email address; the primary one is used if several are given.",
+			Required:    true,
+			Mutability:  "immutable",
+			Returned:    "default",
+			Uniqueness:  "none",
+			SubAttributes: []scimAttribute{
+				scimString("value", "Email address.", true, false, "immutable", "server"),
+				{Name: "type", Type: "string", Description: "Label of the address.", CanonicalValues: []string{"work", "home", "other"}, Mutability: "immutable", Returned: "default", Uniqueness: "none"},
+				{Name: "primary", Type: "boolean", Description: "Whether this is the address used.", Mutability: "immutable", Returned: "default", Uniqueness: "none"},
+			},
+		},
+		{
+			Name:        "roles",
+			Type:        "complex",
+			MultiValued: true,
+			Description: "Roles of the user, included in their tokens and SAML assertions. Directory users get theirs from the directory.",
+			Mutability:  "readWrite",
+			Returned:    "default",
+			Uniqueness:  "none",
+			SubAttributes: []scimAttribute{
+				scimString("value", "Role name, without spaces.", true, true, "readWrite", "none"),
+			},
+		},
+		{
+			Name:        "groups",
+			Type:        "complex",
+			MultiValued: true,
+			Description: "Groups the user is a member of; change them through the Groups endpoint.",
+			Mutability:  "readOnly",
+			Returned:    "default",
+			Uniqueness:  "none",
+			SubAttributes: []scimAttribute{
+				scimString("value", "ID of the group.", false, true, "readOnly", "none"),
+				{Name: "$ref", Type: "reference", ReferenceTypes: []string{"Group"}, Description: "URI of the group.", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+				scimString("display", "Display name of the group.", false, true, "readOnly", "none"),
+				scimString("type", "Always direct; groups don't nest.", false, false, "readOnly", "none"),
+			},
+		},
+	},
+}
+
+var scimGroupType = &scimResourceType{
+	Name:        "Group",
+	Endpoint:    "/Groups",
+	Description: "Group of users",
+	Schema:      scimGroupSchema,
+	Attributes: []scimAttribute{
+		scimString("displayName", "Unique name of the group.", true, true, "readWrite", "server"),
+		{
+			Name:        "members",
+			Type:        "complex",
+			MultiValued: true,
+			Description: "Users in the group; groups can't be members.",
+			Mutability:  "readWrite",
+			Returned:    "default",
+			Uniqueness:  "none",
+			SubAttributes: []scimAttribute{
+				scimString("value", "ID of the user.", true, true, "immutable", "none"),
+				{Name: "$ref", Type: "reference", ReferenceTypes: []string{"User"}, Description: "URI of the user.", Mutability: "immutable", Returned: "default", Uniqueness: "none"},
+				scimString("type", "Always User.", false, false, "immutable", "none"),
+			},
+		},
+	},
+}
+
+var scimResourceTypes = []*scimResourceType{scimUserType, scimGroupType}
+
+// attribute returns the definition of an attribute path such as
+// "emails.value", ignoring case, or nil if the type has no such attribute.
+func (t *scimResourceType) attribute(path string) *scimAttribute {
+	attributes := t.Attributes
+	var found *scimAttribute
+	for _, name := range strings.Split(path, ".") {
+		found = nil
+		for i := range attributes {
+			if strings.EqualFold(attributes[i].Name, name) {
+				found = &attributes[i]
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		attributes = found.SubAttributes
+	}
+	return found
+}
+
+// caseExact reports whether values of an attribute path compare case
+// sensitively. The common attributes id and externalId do.
+func (t *scimResourceType) caseExact(path string) bool {
+	if strings.EqualFold(path, "id") || strings.EqualFold(path, "externalId") {
+		return true
+	}
+	attribute := t.attribute(path)
+	return attribute != nil && attribute.CaseExact
+}
+
+// canonicalName returns the spelling of an attribute name the type uses,
+// or name itself for attributes it doesn't know.
+func (t *scimResourceType) canonicalName(name string) string {
+	for _, common := range []string{"id", "externalId", "meta", "schemas"} {
+		if strings.EqualFold(name, common) {
+			return common
+		}
+	}
+	if attribute := t.attribute(name); attribute != nil {
+		return attribute.Name
+	}
+	return name
+}
+
+// SCIMBaseURL is the URL the realm's SCIM endpoints are served under.
+func SCIMBaseURL(realm *realms.Realm) string {
+	return realm.Issuer + "/scim/v2"
+}
+
+// SCIMServiceProviderConfig describes which optional SCIM features the
+// server supports.
+func SCIMServiceProviderConfig(realm *realms.Realm) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":        []string{scimServiceProviderConfigSchema},
+		"patch":          map[string]interface{}{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": map[string]interface{}{"supported": true},
+		"sort":           map[string]interface{}{"supported": false},
+		"etag":           map[string]interface{}{"supported": true},
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Access token with the " + SCIMScope + " scope from the client_credentials grant",
+			"specUri":     "https://www.rfc-editor.org/info/rfc6750",
+			"primary":     true,
+		}},
+		"meta": map[string]interface{}{
+			"resourceType": "ServiceProviderConfig",
+			"location":     SCIMBaseURL(realm) + "/ServiceProviderConfig",
+		},
+	}
+}
+
+// SCIMResourceTypes describes the resource types the server serves.
+func SCIMResourceTypes(realm *realms.Realm) []map[string]interface{} {
+	var types []map[string]interface{}
+	for _, t := range scimResourceTypes {
+		types = append(types, map[string]interface{}{
+			"schemas":     []string{scimResourceTypeSchema},
+			"id":          t.Name,
+			"name":        t.Name,
+			"endpoint":    t.Endpoint,
+			"description": t.Description,
+			"schema":      t.Schema,
+			"meta": map[string]interface{}{
+				"resourceType": "ResourceType",
+				"location":     SCIMBaseURL(realm) + "/ResourceTypes/" + t.Name,
+			},
+		})
+	}
+	return types
+}
+
+// SCIMSchemas describes the attributes of each resource type.
+func SCIMSchemas(realm *realms.Realm) []map[string]interface{} {
+	var schemas []map[string]interface{}
+	for _, t := range scimResourceTypes {
+		schemas = append(schemas, map[string]interface{}{
+			"schemas":     []string{scimSchemaSchema},
+			"id":          t.Schema,
+			"name":        t.Name,
+			"description": t.Description,
+			"attributes":  t.Attributes,
+			"meta": map[string]interface{}{
+				"resourceType": "Schema",
+				"location":     SCIMBaseURL(realm) + "/Schemas/" + t.Schema,
+			},
+		})
+	}
+	return schemas
+}
@@ -0,0 +1,544 @@
+package services_test
+
+import (
+	"encoding/json"
+	"errors"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scimFixture is a realm with three users and two groups:
+//
+//	alice  alice@example.com  externalId HR-1, roles admin and auditor
+//	bob    Bob@Example.org    deactivated
+//	carol  carol@example.com  externalId hr-3
+//
+//	Engineering  alice and carol
+//	Sales        bob
+type scimFixture struct {
+	scim  *services.SCIMService
+	realm *realms.Realm
+	store storage.Store
+	// ids holds the IDs of the users and groups by name.
+	ids map[string]string
+}
+
+func newSCIMFixture(t *testing.T) *scimFixture {
+	useTestConfig(t, nil)
+	memory := storage.NewMemoryStorage()
+	f := &scimFixture{
+		scim:  services.NewSCIMService(memory, services.NewUserService(memory, nil, nil, nil, nil, nil, nil)),
+		realm: &realms.Realm{Name: "default", Issuer: "https://id.example.com"},
+		store: memory.ForRealm("default"),
+		ids:   make(map[string]string),
+	}
+	for _, user := range []*models.User{
+		{Username: "alice", Email: "alice@example.com", ExternalID: "HR-1", Roles: "admin auditor"},
+		{Username: "bob", Email: "Bob@Example.org", Disabled: true},
+		{Username: "carol", Email: "carol@example.com", ExternalID: "hr-3"},
+	} {
+		if err := f.store.StoreUser(user); err != nil {
+			t.Fatalf("StoreUser: %v", err)
+		}
+		f.ids[user.Username] = strconv.FormatUint(uint64(user.ID), 10)
+	}
+	for _, group := range []*models.Group{
+		{DisplayName: "Engineering", Members: f.ids["alice"] + " " + f.ids["carol"]},
+		{DisplayName: "Sales", Members: f.ids["bob"]},
+	} {
+		if err := f.store.StoreGroup(group); err != nil {
+			t.Fatalf("StoreGroup: %v", err)
+		}
+		f.ids[group.DisplayName] = strconv.FormatUint(uint64(group.ID), 10)
+	}
+	return f
+}
+
+// expand replaces the {name} placeholders of a test input with IDs.
+func (f *scimFixture) expand(s string) string {
+	for name, id := range f.ids {
+		s = strings.ReplaceAll(s, "{"+name+"}", id)
+	}
+	return s
+}
+
+func scimNames(list *services.SCIMList, attribute string) []string {
+	names := []string{}
+	for _, resource := range list.Resources {
+		names = append(names, resource[attribute].(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func scimBody(t *testing.T, s string) map[string]interface{} {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &body); err != nil {
+		t.Fatalf("invalid test body %s: %v", s, err)
+	}
+	return body
+}
+
+// wantSCIMError fails the test unless err is a SCIMError of the type.
+func wantSCIMError(t *testing.T, err error, scimType string) {
+	t.Helper()
+	var scimErr *services.SCIMError
+	if !errors.As(err, &scimErr) || scimErr.Type != scimType {
+		t.Fatalf("error = %v, want a SCIMError of type %s", err, scimType)
+	}
+}
+
+func TestSCIMUserFilter(t *testing.T) {
+	f := newSCIMFixture(t)
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{filter: "", want: []string{"alice", "bob", "carol"}},
+		{filter: `userName eq "alice"`, want: []string{"alice"}},
+		{filter: `USERNAME Eq "alice"`, want: []string{"alice"}},
+		{filter: `userName eq "Alice"`, want: []string{}},
+		{filter: `userName eq "nobody"`, want: []string{}},
+		{filter: `urn:ietf:params:scim:schemas:core:2.0:User:userName eq "bob"`, want: []string{"bob"}},
+		{filter: `userName ne "alice"`, want: []string{"bob", "carol"}},
+		{filter: `userName sw "a" or userName ew "l"`, want: []string{"alice", "carol"}},
+		{filter: `userName co "o"`, want: []string{"bob", "carol"}},
+		{filter: `userName gt "alice" and userName lt "carol"`, want: []string{"bob"}},
+		{filter: `userName ge "bob" and userName le "bob"`, want: []string{"bob"}},
+		{filter: `id eq "{carol}"`, want: []string{"carol"}},
+		{filter: `emails.value eq "bob@example.org"`, want: []string{"bob"}},
+		{filter: `emails co "EXAMPLE.COM"`, want: []string{"alice", "carol"}},
+		{filter: `emails[type eq "work" and value ew ".org"]`, want: []string{"bob"}},
+		{filter: `emails[type eq "home"]`, want: []string{}},
+		{filter: `emails.primary eq true`, want: []string{"alice", "bob", "carol"}},
+		{filter: `active eq false`, want: []string{"bob"}},
+		{filter: `not (active eq false)`, want: []string{"alice", "carol"}},
+		{filter: `externalId pr`, want: []string{"alice", "carol"}},
+		{filter: `externalId eq null`, want: []string{"bob"}},
+		{filter: `externalId ne null`, want: []string{"alice", "carol"}},
+		{filter: `externalId eq "hr-1"`, want: []string{}},
+		{filter: `externalId ne "HR-1"`, want: []string{"bob", "carol"}},
+		{filter: `roles eq "auditor"`, want: []string{"alice"}},
+		{filter: `roles[value eq "admin"] and roles[value eq "auditor"]`, want: []string{"alice"}},
+		{filter: `groups.display eq "Engineering"`, want: []string{"alice", "carol"}},
+		{filter: `groups.display eq "engineering"`, want: []string{}},
+		{filter: `groups[value eq "{Sales}"]`, want: []string{"bob"}},
+		{filter: `meta.resourceType eq "User"`, want: []string{"alice", "bob", "carol"}},
+		// and binds tighter than or
+		{filter: `userName eq "alice" or userName eq "bob" and active eq false`, want: []string{"alice", "bob"}},
+		{filter: `(userName eq "alice" or userName eq "bob") and active eq false`, want: []string{"bob"}},
+		{filter: `not (userName eq "alice" or (emails co "example.org"))`, want: []string{"carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			list, err := f.scim.ListUsers(f.realm, &services.SCIMQuery{Filter: f.expand(tt.filter), Count: -1})
+			if err != nil {
+				t.Fatalf("ListUsers: %v", err)
+			}
+			if got := scimNames(list, "userName"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("users = %q, want %q", got, tt.want)
+			}
+			if list.TotalResults != len(tt.want) {
+				t.Errorf("totalResults = %d, want %d", list.TotalResults, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSCIMGroupFilter(t *testing.T) {
+	f := newSCIMFixture(t)
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{filter: `displayName eq "Sales"`, want: []string{"Sales"}},
+		{filter: `displayName eq "sales"`, want: []string{}},
+		{filter: `members eq "{carol}"`, want: []string{"Engineering"}},
+		{filter: `members[value eq "{bob}" or value eq "{alice}"]`, want: []string{"Engineering", "Sales"}},
+		{filter: `members.type eq "user"`, want: []string{"Engineering", "Sales"}},
+		{filter: `not (members pr)`, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			list, err := f.scim.ListGroups(f.realm, &services.SCIMQuery{Filter: f.expand(tt.filter), Count: -1})
+			if err != nil {
+				t.Fatalf("ListGroups: %v", err)
+			}
+			if got := scimNames(list, "displayName"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groups = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSCIMInvalidFilter(t *testing.T) {
+	f := newSCIMFixture(t)
+	tests := []string{
+		`userName`,
+		`userName eq`,
+		`userName is "alice"`,
+		`userName eq alice`,
+		`userName eq "alice`,
+		`userName eq "alice" userName eq "bob"`,
+		`userName eq "alice" and`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`emails[type eq "work"`,
+		`not userName eq "alice"`,
+		`userName gt null`,
+		`"alice" eq userName`,
+	}
+	for _, filter := range tests {
+		t.Run(filter, func(t *testing.T) {
+			_, err := f.scim.ListUsers(f.realm, &services.SCIMQuery{Filter: filter, Count: -1})
+			wantSCIMError(t, err, "invalidFilter")
+		})
+	}
+}
+
+func TestSCIMPatchUser(t *testing.T) {
+	type state struct {
+		roles      string
+		externalID string
+		disabled   bool
+	}
+	unchanged := state{roles: "admin auditor", externalID: "HR-1"}
+	tests := []struct {
+		name     string
+		body     string
+		want     state
+		wantType string
+	}{
+		{
+			name: "replace with a path",
+			body: `{"op": "replace", "path": "active", "value": false}`,
+			want: state{roles: "admin auditor", externalID: "HR-1", disabled: true},
+		},
+		{
+			name: "operation and attribute names in any case",
+			body: `{"op": "Replace", "path": "ACTIVE", "value": "False"}`,
+			want: state{roles: "admin auditor", externalID: "HR-1", disabled: true},
+		},
+		{
+			name: "replace without a path",
+			body: `{"op": "replace", "value": {"active": false, "externalId": "HR-9"}}`,
+			want: state{roles: "admin auditor", externalID: "HR-9", disabled: true},
+		},
+		{
+			name: "schema qualified attributes",
+			body: `{"op": "replace", "value": {"urn:ietf:params:scim:schemas:core:2.0:User:externalId": "HR-9"}}`,
+			want: state{roles: "admin auditor", externalID: "HR-9"},
+		},
+		{
+			name: "attributes nested in the schema",
+			body: `{"op": "replace", "value": {"urn:ietf:params:scim:schemas:core:2.0:User": {"externalId": "HR-9"}}}`,
+			want: state{roles: "admin auditor", externalID: "HR-9"},
+		},
+		{
+			name: "remove an attribute",
+			body: `{"op": "remove", "path": "externalId"}`,
+			want: state{roles: "admin auditor"},
+		},
+		{
+			name: "add values",
+			body: `{"op": "add", "path": "roles", "value": [{"value": "editor"}, {"value": "admin"}]}`,
+			want: state{roles: "admin auditor editor", externalID: "HR-1"},
+		},
+		{
+			name: "add a single value",
+			body: `{"op": "add", "path": "roles", "value": {"value": "editor"}}`,
+			want: state{roles: "admin auditor editor", externalID: "HR-1"},
+		},
+		{
+			name: "replace values",
+			body: `{"op": "replace", "path": "roles", "value": [{"value": "editor"}]}`,
+			want: state{roles: "editor", externalID: "HR-1"},
+		},
+		{
+			name: "remove values by filter",
+			body: `{"op": "remove", "path": "roles[value eq \"admin\"]"}`,
+			want: state{roles: "auditor", externalID: "HR-1"},
+		},
+		{
+			name: "remove listed values",
+			body: `{"op": "remove", "path": "roles", "value": [{"value": "auditor"}]}`,
+			want: state{roles: "admin", externalID: "HR-1"},
+		},
+		{
+			name: "remove all values",
+			body: `{"op": "remove", "path": "roles"}`,
+			want: state{externalID: "HR-1"},
+		},
+		{
+			name: "replace a sub-attribute of filtered values",
+			body: `{"op": "replace", "path": "roles[value eq \"admin\"].value", "value": "owner"}`,
+			want: state{roles: "owner auditor", externalID: "HR-1"},
+		},
+		{
+			name: "add through a filter no value matches",
+			body: `{"op": "add", "path": "roles[value eq \"editor\"].display", "value": "Editor"}`,
+			want: state{roles: "admin auditor editor", externalID: "HR-1"},
+		},
+		{
+			name: "remove by a filter no value matches",
+			body: `{"op": "remove", "path": "roles[value eq \"editor\"]"}`,
+			want: unchanged,
+		},
+		{
+			name: "several operations in order",
+			body: `{"op": "remove", "path": "roles"}, {"op": "add", "path": "roles", "value": [{"value": "editor"}]}`,
+			want: state{roles: "editor", externalID: "HR-1"},
+		},
+		{
+			name: "extension attributes are ignored",
+			body: `{"op": "add", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "value": "Sales"}`,
+			want: unchanged,
+		},
+		{
+			name: "unchanged email address",
+			body: `{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "alice@example.com"}`,
+			want: unchanged,
+		},
+		{name: "unknown operation", body: `{"op": "move", "path": "active"}`, wantType: "invalidSyntax"},
+		{name: "remove without a path", body: `{"op": "remove"}`, wantType: "noTarget"},
+		{name: "no value matches a complex filter", body: `{"op": "replace", "path": "roles[value sw \"x\"].value", "value": "y"}`, wantType: "noTarget"},
+		{name: "value without a path not an object", body: `{"op": "replace", "value": false}`, wantType: "invalidValue"},
+		{name: "unbalanced brackets", body: `{"op": "remove", "path": "roles]value eq \"admin\"["}`, wantType: "invalidPath"},
+		{name: "invalid filter in the path", body: `{"op": "remove", "path": "roles[value eq]"}`, wantType: "invalidPath"},
+		{name: "text after the filter", body: `{"op": "remove", "path": "roles[value eq \"admin\"]value"}`, wantType: "invalidPath"},
+		{name: "invalid role", body: `{"op": "add", "path": "roles", "value": [{"value": "two words"}]}`, wantType: "invalidValue"},
+		{name: "change the username", body: `{"op": "replace", "path": "userName", "value": "alicia"}`, wantType: "mutability"},
+		{
+			name:     "change the email address",
+			body:     `{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "alice@example.org"}`,
+			wantType: "mutability",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSCIMFixture(t)
+			body := scimBody(t, `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [`+tt.body+`]}`)
+			_, err := f.scim.PatchUser(f.realm, f.ids["alice"], body, "")
+			if tt.wantType != "" {
+				wantSCIMError(t, err, tt.wantType)
+				tt.want = unchanged
+			} else if err != nil {
+				t.Fatalf("PatchUser: %v", err)
+			}
+			alice := f.store.GetUserByUsername("alice")
+			if got := (state{roles: alice.Roles, externalID: alice.ExternalID, disabled: alice.Disabled}); got != tt.want {
+				t.Errorf("user = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSCIMPatchMessage(t *testing.T) {
+	f := newSCIMFixture(t)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "no operations", body: `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"]}`},
+		{name: "operations not a list", body: `{"Operations": {"op": "remove", "path": "roles"}}`},
+		{name: "operation not an object", body: `{"Operations": ["remove roles"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := f.scim.PatchUser(f.realm, f.ids["alice"], scimBody(t, tt.body), "")
+			wantSCIMError(t, err, "invalidSyntax")
+		})
+	}
+}
+
+func TestSCIMPatchGroup(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantName    string
+		wantMembers string
+		wantType    string
+	}{
+		{
+			name:        "add members",
+			body:        `{"op": "add", "path": "members", "value": [{"value": "{bob}"}, {"value": "{alice}"}]}`,
+			wantMembers: "{alice} {carol} {bob}",
+		},
+		{
+			name:        "remove a member by filter",
+			body:        `{"op": "remove", "path": "members[value eq \"{alice}\"]"}`,
+			wantMembers: "{carol}",
+		},
+		{
+			name:        "remove listed members",
+			body:        `{"op": "Remove", "path": "members", "value": [{"value": "{carol}"}]}`,
+			wantMembers: "{alice}",
+		},
+		{
+			name:        "replace members",
+			body:        `{"op": "replace", "path": "members", "value": [{"value": "{bob}"}]}`,
+			wantMembers: "{bob}",
+		},
+		{
+			name:        "remove all members",
+			body:        `{"op": "remove", "path": "members"}`,
+			wantMembers: "",
+		},
+		{
+			name:        "rename without a path",
+			body:        `{"op": "replace", "value": {"id": "{Sales}", "displayName": "Platform"}}`,
+			wantName:    "Platform",
+			wantMembers: "{alice} {carol}",
+		},
+		{name: "add a user that doesn't exist", body: `{"op": "add", "path": "members", "value": [{"value": "999"}]}`, wantType: "invalidValue"},
+		{name: "add a group as a member", body: `{"op": "add", "path": "members", "value": [{"value": "{Sales}", "type": "Group"}]}`, wantType: "invalidValue"},
+		{name: "take another group's name", body: `{"op": "replace", "path": "displayName", "value": "Sales"}`, wantType: "uniqueness"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSCIMFixture(t)
+			body := scimBody(t, f.expand(`{"Operations": [`+tt.body+`]}`))
+			_, err := f.scim.PatchGroup(f.realm, f.ids["Engineering"], body, "")
+			if tt.wantType != "" {
+				wantSCIMError(t, err, tt.wantType)
+				tt.wantMembers = "{alice} {carol}"
+			} else if err != nil {
+				t.Fatalf("PatchGroup: %v", err)
+			}
+			wantName := tt.wantName
+			if wantName == "" {
+				wantName = "Engineering"
+			}
+			group := f.store.GetGroup(scimID(t, f.ids["Engineering"]))
+			if group.DisplayName != wantName {
+				t.Errorf("displayName = %q, want %q", group.DisplayName, wantName)
+			}
+			if want := f.expand(tt.wantMembers); group.Members != want {
+				t.Errorf("members = %q, want %q", group.Members, want)
+			}
+		})
+	}
+}
+
+func scimID(t *testing.T, id string) uint {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint(n)
+}
+
+func TestSCIMResourceMatchesVersion(t *testing.T) {
+	f := newSCIMFixture(t)
+	alice, err := f.scim.GetUser(f.realm, f.ids["alice"])
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	version := alice.Version()
+	if !strings.HasPrefix(version, `W/"`) || !strings.HasSuffix(version, `"`) {
+		t.Fatalf("version = %q, want a weak entity tag", version)
+	}
+	strong := strings.TrimPrefix(version, "W/")
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "weak tag", header: version, want: true},
+		{name: "strong tag", header: strong, want: true},
+		{name: "any version", header: "*", want: true},
+		{name: "one of several tags", header: `W/"0123456789abcdef", ` + version, want: true},
+		{name: "other tag", header: `W/"0123456789abcdef"`},
+		{name: "tag without quotes", header: strings.Trim(strong, `"`)},
+		{name: "empty", header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := alice.MatchesVersion(tt.header); got != tt.want {
+				t.Errorf("MatchesVersion(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSCIMVersion checks that versions change exactly when a resource's
+// representation does, and that If-Match preconditions are enforced.
+func TestSCIMVersion(t *testing.T) {
+	f := newSCIMFixture(t)
+	get := func(id string) services.SCIMResource {
+		t.Helper()
+		resource, err := f.scim.GetUser(f.realm, id)
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		return resource
+	}
+	alice := get(f.ids["alice"])
+	if again := get(f.ids["alice"]); again.Version() != alice.Version() {
+		t.Fatalf("version changed without a change: %q, then %q", alice.Version(), again.Version())
+	}
+	if carol := get(f.ids["carol"]); carol.Version() == alice.Version() {
+		t.Fatalf("alice and carol have the same version %q", alice.Version())
+	}
+
+	deactivate := scimBody(t, `{"Operations": [{"op": "replace", "path": "active", "value": false}]}`)
+	stale := `W/"0123456789abcdef"`
+	if _, err := f.scim.PatchUser(f.realm, f.ids["alice"], deactivate, stale); !errors.Is(err, services.ErrSCIMPreconditionFailed) {
+		t.Fatalf("PatchUser with a stale version = %v, want ErrSCIMPreconditionFailed", err)
+	}
+	if f.store.GetUserByUsername("alice").Disabled {
+		t.Fatal("PatchUser with a stale version changed the user")
+	}
+
+	patched, err := f.scim.PatchUser(f.realm, f.ids["alice"], deactivate, alice.Version())
+	if err != nil {
+		t.Fatalf("PatchUser with the current version: %v", err)
+	}
+	if patched.Version() == alice.Version() {
+		t.Fatal("version unchanged by a change")
+	}
+	if got := get(f.ids["alice"]).Version(); got != patched.Version() {
+		t.Errorf("version = %q, want %q as returned by PatchUser", got, patched.Version())
+	}
+
+	// The version alice had before the change is stale now
+	replacement := map[string]interface{}(get(f.ids["alice"]))
+	if _, err := f.scim.ReplaceUser(f.realm, f.ids["alice"], replacement, alice.Version()); !errors.Is(err, services.ErrSCIMPreconditionFailed) {
+		t.Errorf("ReplaceUser with a stale version = %v, want ErrSCIMPreconditionFailed", err)
+	}
+	if err := f.scim.DeleteUser(f.realm, f.ids["alice"], alice.Version()); !errors.Is(err, services.ErrSCIMPreconditionFailed) {
+		t.Errorf("DeleteUser with a stale version = %v, want ErrSCIMPreconditionFailed", err)
+	}
+	if err := f.scim.DeleteUser(f.realm, f.ids["alice"], patched.Version()); err != nil {
+		t.Errorf("DeleteUser with the current version: %v", err)
+	}
+
+	// Group versions follow their membership, which changed when alice
+	// was deleted
+	if err := f.scim.DeleteGroup(f.realm, f.ids["Engineering"], stale); !errors.Is(err, services.ErrSCIMPreconditionFailed) {
+		t.Errorf("DeleteGroup with a stale version = %v, want ErrSCIMPreconditionFailed", err)
+	}
+	engineering, err := f.scim.GetGroup(f.realm, f.ids["Engineering"])
+	if err != nil {
+		t.Fatalf("GetGroup: %v", err)
+	}
+	rename := scimBody(t, `{"Operations": [{"op": "replace", "path": "displayName", "value": "Platform"}]}`)
+	renamed, err := f.scim.PatchGroup(f.realm, f.ids["Engineering"], rename, engineering.Version())
+	if err != nil {
+		t.Fatalf("PatchGroup with the current version: %v", err)
+	}
+	if _, err := f.scim.ReplaceGroup(f.realm, f.ids["Engineering"], map[string]interface{}(renamed), engineering.Version()); !errors.Is(err, services.ErrSCIMPreconditionFailed) {
+		t.Errorf("ReplaceGroup with a stale version = %v, want ErrSCIMPreconditionFailed", err)
+	}
+	if err := f.scim.DeleteGroup(f.realm, f.ids["Engineering"], "*"); err != nil {
+		t.Errorf("DeleteGroup with If-Match *: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package services_test
+
+import (
+	"oauth2-provider/config"
+	"testing"
+)
+
+// useTestConfig installs the default configuration, with a token hash key
+// and without login delays, for the duration of the test. modify, if
+// given, adjusts it first.
+func useTestConfig(t *testing.T, modify func(cfg *config.Config)) *config.Config {
+	cfg := config.Default()
+	cfg.Keys.TokenHashKey = "test-token-hash-key"
+	cfg.Lockout.Delay = 0
+	if modify != nil {
+		modify(cfg)
+	}
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(config.Default()) })
+	return cfg
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"strings"
+	"time"
+)
+
+const offlineAccessScope = "offline_access"
+
+// TokenPolicy is the effective token configuration for a client, combining
+// the client's overrides with the defaults of its realm.
+type TokenPolicy struct {
+	AccessTokenTTL          time.Duration
+	RefreshTokenIdleTTL     time.Duration
+	RefreshTokenAbsoluteTTL time.Duration
+	RotateRefreshTokens     bool
+	RequireOfflineAccess    bool
+}
+
+func tokenPolicyFor(realm *realms.Realm, client *models.Client) TokenPolicy {
+	defaults := realm.Tokens
+	policy := TokenPolicy{
+		AccessTokenTTL:          defaults.AccessTokenExpiry.Duration(),
+		RefreshTokenIdleTTL:     defaults.RefreshTokenIdleExpiry.Duration(),
+		RefreshTokenAbsoluteTTL: defaults.RefreshTokenAbsoluteExpiry.Duration(),
+		RotateRefreshTokens:     defaults.RotateRefreshTokens,
+		RequireOfflineAccess:    defaults.RequireOfflineAccess,
+	}
+
+	if client.AccessTokenTTL > 0 {
+		policy.AccessTokenTTL = time.Duration(client.AccessTokenTTL) * time.Second
+	}
+	if client.RefreshTokenIdleTTL > 0 {
+		policy.RefreshTokenIdleTTL = time.Duration(client.RefreshTokenIdleTTL) * time.Second
+	}
+	if client.RefreshTokenAbsoluteTTL > 0 {
+		policy.RefreshTokenAbsoluteTTL = time.Duration(client.RefreshTokenAbsoluteTTL) * time.Second
+	}
+	if client.RotateRefreshTokens != nil {
+		policy.RotateRefreshTokens = *client.RotateRefreshTokens
+	}
+	if client.RequireOfflineAccess != nil {
+		policy.RequireOfflineAccess = *client.RequireOfflineAccess
+	}
+
+	return policy
+}
+
+// allowsRefreshToken reports whether a refresh token may be issued for the
+// given scope under this policy.
+func (p TokenPolicy) allowsRefreshToken(scope string) bool {
+	return !p.RequireOfflineAccess || hasScope(scope, offlineAccessScope)
+}
+
+// idleExpiry returns the next idle expiry, capped at the absolute expiry.
+func (p TokenPolicy) idleExpiry(now, absoluteExpiresAt time.Time) time.Time {
+	expiresAt := now.Add(p.RefreshTokenIdleTTL)
+	if expiresAt.After(absoluteExpiresAt) {
+		return absoluteExpiresAt
+	}
+	return expiresAt
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"strconv"
+	"strings"
+)
+
+// Import formats.
+const (
+	ImportFormatCSV  = "csv"
+	ImportFormatJSON = "json"
+)
+
+// ImportResult reports a bulk import. Rows count from 1 in the order the
+// users were given.
+type ImportResult struct {
+	Imported int             `json:"imported"`
+	Failed   []ImportFailure `json:"failed"`
+}
+
+type ImportFailure struct {
+	Row      int    `json:"row"`
+	Username string `json:"username"`
+	Error    string `json:"error"`
+}
+
+// ParseUserImport reads the users of a bulk import. CSV needs a header
+// row naming the username, email and password_hash columns, plus
+// optionally email_verified, in any order. JSON is an array of
+// models.UserImport objects.
+func ParseUserImport(r io.Reader, format string) ([]models.UserImport, error) {
+	switch format {
+	case ImportFormatJSON:
+		var users []models.UserImport
+		if err := json.NewDecoder(r).Decode(&users); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return users, nil
+	case ImportFormatCSV:
+		return parseUserCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+}
+
+func parseUserCSV(r io.Reader) ([]models.UserImport, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"username", "email", "password_hash"} {
+		if _, found := columns[name]; !found {
+			return nil, fmt.Errorf("invalid CSV: no %s column", name)
+		}
+	}
+
+	var users []models.UserImport
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		user := models.UserImport{
+			Username:     record[columns["username"]],
+			Email:        record[columns["email"]],
+			PasswordHash: record[columns["password_hash"]],
+		}
+		if i, found := columns["email_verified"]; found && record[i] != "" {
+			if user.EmailVerified, err = strconv.ParseBool(record[i]); err != nil {
+				line, _ := reader.FieldPos(i)
+				return nil, fmt.Errorf("invalid CSV: line %d: email_verified must be true or false", line)
+			}
+		}
+		users = append(users, user)
+	}
+}
+
+// ImportUsers creates users with password hashes exported from another
+// system, so they can keep signing in with their passwords. Each hash is
+// replaced with one made by the configured algorithm at the user's first
+// login. Users that can't be imported are reported and skipped; the
+// password policy doesn't apply, as only hashes are known.
+func (s *UserService) ImportUsers(realm *realms.Realm, users []models.UserImport) *ImportResult {
+	result := &ImportResult{Failed: []ImportFailure{}}
+	for i := range users {
+		if err := s.importUser(realm, &users[i]); err != nil {
+			result.Failed = append(result.Failed, ImportFailure{Row: i + 1, Username: users[i].Username, Error: err.Error()})
+			continue
+		}
+		result.Imported++
+	}
+	audit(realm, AuditUsersImported,
+		"imported", strconv.Itoa(result.Imported),
+		"failed", strconv.Itoa(len(result.Failed)),
+	)
+	return result
+}
+
+func (s *UserService) importUser(realm *realms.Realm, imported *models.UserImport) error {
+	if imported.Username == "" {
+		return errors.New("username is required")
+	}
+	if address, err := mail.ParseAddress(imported.Email); err != nil || address.Address != imported.Email {
+		return errors.New("invalid email address")
+	}
+	hash, err := passwords.ImportHash(imported.PasswordHash)
+	if err != nil {
+		return err
+	}
+
+	store := s.store.ForRealm(realm.Name)
+	if store.GetUserByUsername(imported.Username) != nil {
+		return errors.New("username already exists")
+	}
+	if taken, err := s.externalUsernameTaken(realm, imported.Username); err != nil {
+		return err
+	} else if taken {
+		return errors.New("username already exists")
+	}
+	if store.GetUserByEmail(imported.Email) != nil {
+		return errors.New("email already exists")
+	}
+	return store.StoreUser(&models.User{
+		Username:      imported.Username,
+		Password:      hash,
+		Email:         imported.Email,
+		EmailVerified: imported.EmailVerified,
+	})
+}
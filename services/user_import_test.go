@@ -0,0 +1,220 @@
+package services_test
+
+import (
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// importedHash is a Django pbkdf2_sha256 hash of "alice-password".
+const importedHash = "pbkdf2_sha256$1000$pepper$96q1VXOw/2D5Y4yuReN8Mnx1l++5PA6CMDuyP9Z5+DY="
+
+func TestParseUserImport(t *testing.T) {
+	alice := models.UserImport{Username: "alice", Email: "alice@example.com", PasswordHash: "{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0"}
+	verifiedAlice := alice
+	verifiedAlice.EmailVerified = true
+	bob := models.UserImport{Username: "bob", Email: "bob@example.com", PasswordHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"}
+
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		want    []models.UserImport
+		wantErr string
+	}{
+		{
+			name:   "csv",
+			format: services.ImportFormatCSV,
+			input: "username,email,password_hash\n" +
+				"alice,alice@example.com,{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0\n" +
+				"bob,bob@example.com,$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n",
+			want: []models.UserImport{alice, bob},
+		},
+		{
+			name:   "csv columns in any order and case",
+			format: services.ImportFormatCSV,
+			input: "Password_Hash, EMAIL ,Username,Department\n" +
+				"{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0,alice@example.com,alice,sales\n",
+			want: []models.UserImport{alice},
+		},
+		{
+			name:   "csv email_verified",
+			format: services.ImportFormatCSV,
+			input: "username,email,password_hash,email_verified\n" +
+				"alice,alice@example.com,{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0,true\n" +
+				"bob,bob@example.com,$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5,\n",
+			want: []models.UserImport{verifiedAlice, bob},
+		},
+		{
+			name:   "csv quoted fields",
+			format: services.ImportFormatCSV,
+			input: "username,email,password_hash,email_verified\n" +
+				"\"alice\", \"alice@example.com\",\"{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0\",1\n",
+			want: []models.UserImport{verifiedAlice},
+		},
+		{name: "csv header only", format: services.ImportFormatCSV, input: "username,email,password_hash\n"},
+		{name: "csv empty", format: services.ImportFormatCSV, input: "", wantErr: "invalid CSV: EOF"},
+		{
+			name:    "csv missing column",
+			format:  services.ImportFormatCSV,
+			input:   "username,email,password\nalice,alice@example.com,secret\n",
+			wantErr: "invalid CSV: no password_hash column",
+		},
+		{
+			name:   "csv email_verified not a boolean",
+			format: services.ImportFormatCSV,
+			input: "username,email,password_hash,email_verified\n" +
+				"alice,alice@example.com,{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0,true\n" +
+				"bob,bob@example.com,$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5,yes\n",
+			wantErr: "invalid CSV: line 3: email_verified must be true or false",
+		},
+		{
+			name:    "csv wrong number of fields",
+			format:  services.ImportFormatCSV,
+			input:   "username,email,password_hash\nalice,alice@example.com\n",
+			wantErr: "invalid CSV: record on line 2: wrong number of fields",
+		},
+		{
+			name:   "json",
+			format: services.ImportFormatJSON,
+			input: `[
+				{"username": "alice", "email": "alice@example.com", "password_hash": "{SSHA}yI6cZwQadOA1e+/f+T+H3eCQQhRzYWx0", "email_verified": true},
+				{"username": "bob", "email": "bob@example.com", "password_hash": "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"}
+			]`,
+			want: []models.UserImport{verifiedAlice, bob},
+		},
+		{name: "json empty array", format: services.ImportFormatJSON, input: "[]", want: []models.UserImport{}},
+		{name: "json not an array", format: services.ImportFormatJSON, input: `{"username": "alice"}`, wantErr: "invalid JSON: "},
+		{name: "json truncated", format: services.ImportFormatJSON, input: `[{"username": "alice"`, wantErr: "invalid JSON: "},
+		{name: "unknown format", format: "ldif", input: "dn: uid=alice\n", wantErr: `unknown import format "ldif"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := services.ParseUserImport(strings.NewReader(tt.input), tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseUserImport error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseUserImport: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseUserImport = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.PasswordHashing.Algorithm = config.HashArgon2id
+		cfg.PasswordHashing.Argon2id = config.Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1}
+	})
+	realm := &realms.Realm{Name: "default"}
+	memory := storage.NewMemoryStorage()
+	store := memory.ForRealm(realm.Name)
+	if err := store.StoreUser(&models.User{Username: "carol", Email: "carol@example.com"}); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	userService := services.NewUserService(memory, nil, nil, nil, nil, nil, nil)
+
+	result := userService.ImportUsers(realm, []models.UserImport{
+		{Username: "alice", Email: "alice@example.com", PasswordHash: importedHash, EmailVerified: true},
+		{Username: "", Email: "nobody@example.com", PasswordHash: importedHash},
+		{Username: "bob", Email: "Bob <bob@example.com>", PasswordHash: importedHash},
+		{Username: "bob", Email: "bob.example.com", PasswordHash: importedHash},
+		{Username: "bob", Email: "bob@example.com", PasswordHash: "$1$saltstri$YMyguxXMBpd2TEZ.vS/3q1"},
+		{Username: "carol", Email: "carol@example.org", PasswordHash: importedHash},
+		{Username: "alice", Email: "alice@example.org", PasswordHash: importedHash},
+		{Username: "dave", Email: "carol@example.com", PasswordHash: importedHash},
+		{Username: "bob", Email: "bob@example.com", PasswordHash: "  " + importedHash + "\n"},
+	})
+
+	if result.Imported != 2 {
+		t.Errorf("imported %d users, want 2", result.Imported)
+	}
+	wantFailed := []services.ImportFailure{
+		{Row: 2, Username: "", Error: "username is required"},
+		{Row: 3, Username: "bob", Error: "invalid email address"},
+		{Row: 4, Username: "bob", Error: "invalid email address"},
+		{Row: 5, Username: "bob", Error: "unsupported or malformed password hash"},
+		{Row: 6, Username: "carol", Error: "username already exists"},
+		{Row: 7, Username: "alice", Error: "username already exists"},
+		{Row: 8, Username: "dave", Error: "email already exists"},
+	}
+	if !reflect.DeepEqual(result.Failed, wantFailed) {
+		t.Errorf("failed = %+v, want %+v", result.Failed, wantFailed)
+	}
+	if dave := store.GetUserByUsername("dave"); dave != nil {
+		t.Error("a user whose import failed was stored")
+	}
+
+	tests := []struct {
+		username          string
+		wantEmailVerified bool
+	}{
+		{username: "alice", wantEmailVerified: true},
+		{username: "bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			user := store.GetUserByUsername(tt.username)
+			if user == nil {
+				t.Fatal("imported user not stored")
+			}
+			if user.EmailVerified != tt.wantEmailVerified {
+				t.Errorf("EmailVerified = %v, want %v", user.EmailVerified, tt.wantEmailVerified)
+			}
+			if !strings.HasPrefix(user.Password, "$pbkdf2-sha256$i=1000$") {
+				t.Errorf("stored hash = %q, want the imported hash in PHC form", user.Password)
+			}
+
+			// The imported password works and the hash is replaced with a
+			// current one at the first login
+			if _, err := userService.Login(realm, &models.UserLogin{Username: tt.username, Password: "wrong"}, ""); err == nil {
+				t.Fatal("Login with a wrong password succeeded")
+			}
+			if _, err := userService.Login(realm, &models.UserLogin{Username: tt.username, Password: "alice-password"}, ""); err != nil {
+				t.Fatalf("Login with the imported password: %v", err)
+			}
+			if stored := store.GetUser(user.ID).Password; !strings.HasPrefix(stored, "$argon2id$") {
+				t.Errorf("hash after login = %q, want an argon2id hash", stored)
+			}
+		})
+	}
+}
+
+func TestImportUsersLegacyUsername(t *testing.T) {
+	cfg := useTestConfig(t, func(cfg *config.Config) {
+		cfg.PasswordHashing.Algorithm = config.HashArgon2id
+		cfg.PasswordHashing.Argon2id = config.Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1}
+	})
+	realm := &realms.Realm{Name: cfg.LegacyAuth.Realm}
+	memory := storage.NewMemoryStorage()
+	userService := services.NewUserService(memory, nil, nil, nil, &countingLegacyStore{}, nil, nil)
+
+	// alice is only in the legacy store; importing her would lock the
+	// legacy user out of the migration at the first login
+	result := userService.ImportUsers(realm, []models.UserImport{
+		{Username: "alice", Email: "alice@example.org", PasswordHash: importedHash},
+		{Username: "bob", Email: "bob@example.com", PasswordHash: importedHash},
+	})
+
+	if result.Imported != 1 {
+		t.Errorf("imported %d users, want 1", result.Imported)
+	}
+	wantFailed := []services.ImportFailure{{Row: 1, Username: "alice", Error: "username already exists"}}
+	if !reflect.DeepEqual(result.Failed, wantFailed) {
+		t.Errorf("failed = %+v, want %+v", result.Failed, wantFailed)
+	}
+	if memory.ForRealm(realm.Name).GetUserByUsername("alice") != nil {
+		t.Error("a legacy username was imported")
+	}
+}
@@ -2,25 +2,82 @@ package services
 
 import (
 	"errors"
+	"log"
+	"net/mail"
+	"oauth2-provider/directory"
+	"oauth2-provider/encryption"
+	"oauth2-provider/federation"
+	"oauth2-provider/legacy"
+	"oauth2-provider/mailer"
 	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
 	"oauth2-provider/storage"
-	"oauth2-provider/utils"
+	"time"
 )
 
+var ErrEmailNotVerified = errors.New("email address not verified")
+
+// ErrAccountDisabled is returned when a disabled user, typically one
+// deactivated over SCIM, signs in.
+var ErrAccountDisabled = errors.New("account disabled")
+
 type UserService struct {
-	store *storage.PostgresStorage
+	store  storage.Store
+	mailer mailer.Sender
+	// keyring encrypts TOTP secrets; without one TOTP can't be enabled.
+	keyring *encryption.Keyring
+	// policy checks new passwords; without one any non-empty password is
+	// accepted.
+	policy *passwords.Policy
+	// legacy is the user store being migrated from, if any.
+	legacy legacy.Authenticator
+	// upstream lists the identity providers users can sign in with.
+	upstream []*federation.Provider
+	// directory is the LDAP directory users sign in against, if any.
+	directory *directory.Directory
+}
+
+func NewUserService(store storage.Store, sender mailer.Sender, keyring *encryption.Keyring, policy *passwords.Policy, legacyAuth legacy.Authenticator, upstream []*federation.Provider, dir *directory.Directory) *UserService {
+	return &UserService{store: store, mailer: sender, keyring: keyring, policy: policy, legacy: legacyAuth, upstream: upstream, directory: dir}
 }
 
-func NewUserService(store *storage.PostgresStorage) *UserService {
-	return &UserService{store: store}
+// LoginResult is the outcome of a successful password check.
+type LoginResult struct {
+	User *models.User
+	// MFAToken is set when the user has a second factor: the login is only
+	// complete once VerifyMFA or FinishWebAuthnMFA accepts it.
+	MFAToken string
+	// MFAMethods lists the second factors the user can use with MFAToken.
+	MFAMethods []string
+	// LoginToken is set once the login is complete. It is exchanged for
+	// the one-time codes the authorization and SAML endpoints accept as
+	// proof of the login (see IssueLoginCode).
+	LoginToken string
+	// RecentLoginToken is set with LoginToken. It lets the user change
+	// security settings once (see RedeemRecentLogin).
+	RecentLoginToken string
 }
 
-func (s *UserService) Register(req *models.UserRegister) error {
-	if s.store.GetUserByUsername(req.Username) != nil {
+func (s *UserService) Register(realm *realms.Realm, req *models.UserRegister) error {
+	if address, err := mail.ParseAddress(req.Email); err != nil || address.Address != req.Email {
+		return errors.New("invalid email address")
+	}
+
+	store := s.store.ForRealm(realm.Name)
+	if store.GetUserByUsername(req.Username) != nil {
+		return errors.New("username already exists")
+	}
+	if taken, err := s.externalUsernameTaken(realm, req.Username); err != nil {
+		return err
+	} else if taken {
 		return errors.New("username already exists")
 	}
+	if err := s.checkPassword(req.Password, req.Username, req.Email); err != nil {
+		return err
+	}
 
-	hashedPassword, err := utils.HashPassword(req.Password)
+	hashedPassword, err := passwords.Hash(req.Password)
 	if err != nil {
 		return err
 	}
@@ -31,18 +88,97 @@ func (s *UserService) Register(req *models.UserRegister) error {
 		Email:    req.Email,
 	}
 
-	return s.store.StoreUser(user)
+	if err := store.StoreUser(user); err != nil {
+		return err
+	}
+
+	// The user can ask for another email if this one fails
+	if err := s.sendVerification(realm, user); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+	}
+	return nil
 }
 
-func (s *UserService) Login(req *models.UserLogin) (*models.User, error) {
-	user := s.store.GetUserByUsername(req.Username)
-	if user == nil {
-		return nil, errors.New("invalid credentials")
+// Login checks a username and password from the client at ip. Repeated
+// failures delay and then lock out further attempts; see LoginBlockedError.
+func (s *UserService) Login(realm *realms.Realm, req *models.UserLogin, ip string) (*LoginResult, error) {
+	if err := s.checkLoginAllowed(realm, req.Username, ip); err != nil {
+		return nil, err
 	}
 
-	if !utils.CheckPasswordHash(req.Password, user.Password) {
+	user := s.store.ForRealm(realm.Name).GetUserByUsername(req.Username)
+	if s.usesDirectory(realm) && (user == nil || user.Source == models.SourceLDAP) {
+		// The directory keeps its users' passwords; users it doesn't know
+		// may still be in the legacy store
+		found, err := s.directoryLogin(realm, req.Username, req.Password)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil && user == nil {
+			if found, err = s.migrateLegacyUser(realm, req.Username, req.Password); err != nil {
+				return nil, err
+			}
+		}
+		if found == nil {
+			s.recordLoginFailure(realm, req.Username, ip)
+			return nil, errors.New("invalid credentials")
+		}
+		user = found
+	} else if user == nil {
+		// Users not migrated yet are checked against the legacy store
+		var err error
+		if user, err = s.migrateLegacyUser(realm, req.Username, req.Password); err != nil {
+			return nil, err
+		}
+		if user == nil {
+			s.recordLoginFailure(realm, req.Username, ip)
+			return nil, errors.New("invalid credentials")
+		}
+	} else if ok, rehash := passwords.Verify(req.Password, user.Password); !ok {
+		s.recordLoginFailure(realm, req.Username, ip)
 		return nil, errors.New("invalid credentials")
+	} else if rehash {
+		s.rehashPassword(realm, user, req.Password)
 	}
+	s.clearLoginFailures(realm, req.Username)
 
-	return user, nil
-}
\ No newline at end of file
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if realm.RequireEmailVerification && !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	methods, err := s.mfaMethods(realm, user)
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) > 0 {
+		return &LoginResult{User: user, MFAToken: issueMFAToken(realm, user, AMRPassword), MFAMethods: methods}, nil
+	}
+	return s.completeLogin(realm, user, AMRPassword)
+}
+
+// rehashPassword replaces the user's password hash with one made by the
+// configured algorithm and parameters. Failing only means trying again at
+// the next login.
+func (s *UserService) rehashPassword(realm *realms.Realm, user *models.User, password string) {
+	hashedPassword, err := passwords.Hash(password)
+	if err != nil {
+		log.Printf("Error rehashing password of user %d: %v", user.ID, err)
+		return
+	}
+	user.Password = hashedPassword
+	if err := s.store.ForRealm(realm.Name).UpdateUser(user); err != nil {
+		log.Printf("Error rehashing password of user %d: %v", user.ID, err)
+	}
+}
+
+func (s *UserService) completeLogin(realm *realms.Realm, user *models.User, methods ...string) (*LoginResult, error) {
+	auth := &Authentication{UserID: user.ID, Methods: methods, Time: time.Now()}
+	recentLoginToken, err := storeOneTimeLogin(s.store, realm, recentLoginClient, auth)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, LoginToken: issueLoginToken(realm, auth), RecentLoginToken: recentLoginToken}, nil
+}
@@ -0,0 +1,206 @@
+package services_test
+
+import (
+	"errors"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoginRehash checks that a login replaces a password hash made with
+// other settings than configured by a current one, and leaves current
+// hashes alone.
+func TestLoginRehash(t *testing.T) {
+	cheap := config.PasswordHashingConfig{
+		Algorithm: config.HashArgon2id,
+		Argon2id:  config.Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1},
+		Bcrypt:    config.BcryptConfig{Cost: 4},
+		PBKDF2:    config.PBKDF2Config{Iterations: 1000},
+	}
+	tests := []struct {
+		name       string
+		hashedWith func(cfg *config.PasswordHashingConfig)
+		wantRehash bool
+	}{
+		{name: "current hash"},
+		{name: "bcrypt hash", hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashBcrypt }, wantRehash: true},
+		{name: "pbkdf2 hash", hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Algorithm = config.HashPBKDF2 }, wantRehash: true},
+		{name: "weaker argon2id hash", hashedWith: func(cfg *config.PasswordHashingConfig) { cfg.Argon2id.Memory = 32 }, wantRehash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashedWith := cheap
+			if tt.hashedWith != nil {
+				tt.hashedWith(&hashedWith)
+			}
+			useTestConfig(t, func(cfg *config.Config) { cfg.PasswordHashing = hashedWith })
+			hash, err := passwords.Hash("alice-password")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			useTestConfig(t, func(cfg *config.Config) { cfg.PasswordHashing = cheap })
+
+			realm := &realms.Realm{Name: "default"}
+			memory := storage.NewMemoryStorage()
+			store := memory.ForRealm(realm.Name)
+			alice := &models.User{Username: "alice", Email: "alice@example.com", Password: hash}
+			if err := store.StoreUser(alice); err != nil {
+				t.Fatalf("StoreUser: %v", err)
+			}
+			userService := services.NewUserService(memory, nil, nil, nil, nil, nil, nil)
+
+			// A wrong password never touches the hash
+			if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "wrong"}, ""); err == nil {
+				t.Fatal("Login with a wrong password succeeded")
+			}
+			if got := store.GetUser(alice.ID).Password; got != hash {
+				t.Fatalf("hash after a failed login = %q, want %q", got, hash)
+			}
+
+			if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "alice-password"}, ""); err != nil {
+				t.Fatalf("Login: %v", err)
+			}
+			stored := store.GetUser(alice.ID).Password
+			if rehashed := stored != hash; rehashed != tt.wantRehash {
+				t.Fatalf("hash after login = %q, rehashed %v, want %v", stored, rehashed, tt.wantRehash)
+			}
+			if ok, rehash := passwords.Verify("alice-password", stored); !ok || rehash || !strings.HasPrefix(stored, "$argon2id$v=19$m=64,t=1,p=1$") {
+				t.Errorf("hash after login = %q, want a current argon2id hash of the password", stored)
+			}
+			if _, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "alice-password"}, ""); err != nil {
+				t.Errorf("Login with the rehashed password: %v", err)
+			}
+		})
+	}
+}
+
+// loginAlice signs alice in with her password in a new store.
+func loginAlice(t *testing.T) (*services.UserService, *storage.MemoryStorage, *realms.Realm, *services.LoginResult) {
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.PasswordHashing.Algorithm = config.HashArgon2id
+		cfg.PasswordHashing.Argon2id = config.Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1}
+	})
+	hash, err := passwords.Hash("alice-password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	realm := &realms.Realm{Name: "default"}
+	memory := storage.NewMemoryStorage()
+	if err := memory.ForRealm(realm.Name).StoreUser(&models.User{Username: "alice", Email: "alice@example.com", Password: hash}); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	userService := services.NewUserService(memory, nil, nil, nil, nil, nil, nil)
+	result, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "alice-password"}, "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if result.LoginToken == "" || result.RecentLoginToken == "" {
+		t.Fatalf("Login = %+v, want a login token and a recent login token", result)
+	}
+	return userService, memory, realm, result
+}
+
+func TestLoginCode(t *testing.T) {
+	userService, memory, realm, result := loginAlice(t)
+	oauthService := services.NewOAuthService(memory)
+	samlService := services.NewSAMLService(memory)
+
+	if _, err := userService.IssueLoginCode(realm, result.RecentLoginToken); !errors.Is(err, services.ErrInvalidLoginToken) {
+		t.Errorf("IssueLoginCode for a recent login token: error = %v, want ErrInvalidLoginToken", err)
+	}
+	code, err := userService.IssueLoginCode(realm, result.LoginToken)
+	if err != nil {
+		t.Fatalf("IssueLoginCode: %v", err)
+	}
+	auth, err := oauthService.RedeemLoginCode(realm, code)
+	if err != nil {
+		t.Fatalf("RedeemLoginCode: %v", err)
+	}
+	if auth.UserID != result.User.ID || len(auth.Methods) != 1 || auth.Methods[0] != services.AMRPassword {
+		t.Errorf("RedeemLoginCode = %+v, want alice's password login", auth)
+	}
+
+	// Each code works once, anywhere a login code is taken
+	if _, err := samlService.RedeemLoginCode(realm, code); !errors.Is(err, services.ErrInvalidLoginToken) {
+		t.Errorf("RedeemLoginCode of a used code: error = %v, want ErrInvalidLoginToken", err)
+	}
+	code, err = userService.IssueLoginCode(realm, result.LoginToken)
+	if err != nil {
+		t.Fatalf("IssueLoginCode: %v", err)
+	}
+	if _, err := samlService.RedeemLoginCode(realm, code); err != nil {
+		t.Errorf("RedeemLoginCode of a second code: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+	}{
+		{name: "empty"},
+		{name: "login token", code: result.LoginToken},
+		{name: "recent login token", code: result.RecentLoginToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := oauthService.RedeemLoginCode(realm, tt.code); !errors.Is(err, services.ErrInvalidLoginToken) {
+				t.Errorf("RedeemLoginCode: error = %v, want ErrInvalidLoginToken", err)
+			}
+		})
+	}
+}
+
+func TestRecentLogin(t *testing.T) {
+	userService, memory, realm, result := loginAlice(t)
+
+	auth, next, err := userService.RedeemRecentLogin(realm, result.RecentLoginToken)
+	if err != nil {
+		t.Fatalf("RedeemRecentLogin: %v", err)
+	}
+	if auth.UserID != result.User.ID || next == "" || next == result.RecentLoginToken {
+		t.Fatalf("RedeemRecentLogin = %+v, %q; want alice and a new token", auth, next)
+	}
+	if _, _, err := userService.RedeemRecentLogin(realm, result.RecentLoginToken); !errors.Is(err, services.ErrInvalidLoginToken) {
+		t.Errorf("RedeemRecentLogin of a used token: error = %v, want ErrInvalidLoginToken", err)
+	}
+
+	// The next token is for the same login, so chaining them doesn't
+	// extend how long settings may be changed
+	chained, _, err := userService.RedeemRecentLogin(realm, next)
+	if err != nil {
+		t.Fatalf("RedeemRecentLogin of the next token: %v", err)
+	}
+	if !chained.Time.Equal(auth.Time) {
+		t.Errorf("login time of the next token = %v, want %v", chained.Time, auth.Time)
+	}
+
+	code, err := userService.IssueLoginCode(realm, result.LoginToken)
+	if err != nil {
+		t.Fatalf("IssueLoginCode: %v", err)
+	}
+	longAgo := time.Now().Add(-6 * time.Minute)
+	if err := memory.ForRealm(realm.Name).StoreAuthCodeGrant("old-recent-login", &models.AuthCode{ClientID: "recent-login", UserID: result.User.ID, AuthTime: &longAgo}); err != nil {
+		t.Fatalf("StoreAuthCodeGrant: %v", err)
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "empty"},
+		{name: "login token", token: result.LoginToken},
+		{name: "login code", token: code},
+		{name: "login six minutes ago", token: "old-recent-login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := userService.RedeemRecentLogin(realm, tt.token); !errors.Is(err, services.ErrInvalidLoginToken) {
+				t.Errorf("RedeemRecentLogin: error = %v, want ErrInvalidLoginToken", err)
+			}
+		})
+	}
+}
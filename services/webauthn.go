@@ -0,0 +1,478 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"log"
+	"net/url"
+	"oauth2-provider/config"
+	"oauth2-provider/models"
+	"oauth2-provider/realms"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Ceremony purposes bind WebAuthn session tokens to the step that
+	// consumes them.
+	webAuthnRegistrationPurpose = "webauthn-registration"
+	webAuthnLoginPurpose        = "webauthn-login"
+	// webAuthnSessionTTL is how long the user has to answer a WebAuthn
+	// prompt.
+	webAuthnSessionTTL = 5 * time.Minute
+	// maxCredentialNameLength bounds the names users give authenticators.
+	maxCredentialNameLength = 64
+)
+
+var (
+	ErrInvalidWebAuthnSession  = errors.New("invalid or expired WebAuthn session")
+	ErrInvalidWebAuthnResponse = errors.New("the authenticator response could not be verified")
+	ErrCredentialNotFound      = errors.New("authenticator not found")
+	ErrCredentialRegistered    = errors.New("this authenticator is already registered")
+	ErrInvalidCredentialName   = errors.New("authenticator names must be 1 to 64 characters")
+)
+
+// webAuthnUser adapts a user and their authenticators to the WebAuthn
+// library. The user handle is the decimal user ID, which is only unique
+// within a realm; every realm has its own relying party.
+type webAuthnUser struct {
+	user        *models.User
+	credentials []models.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.FormatUint(uint64(u.user.ID), 10))
+}
+
+func (u *webAuthnUser) WebAuthnName() string        { return u.user.Username }
+func (u *webAuthnUser) WebAuthnDisplayName() string { return u.user.Username }
+func (u *webAuthnUser) WebAuthnIcon() string        { return "" }
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, stored := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(stored.CredentialID)
+		if err != nil {
+			continue
+		}
+		aaguid, _ := uuid.Parse(stored.AAGUID)
+		var transports []protocol.AuthenticatorTransport
+		for _, transport := range strings.Fields(stored.Transports) {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       stored.PublicKey,
+			AttestationType: stored.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: stored.BackupEligible,
+				BackupState:    stored.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    aaguid[:],
+				SignCount: stored.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func (u *webAuthnUser) credential(id []byte) *models.WebAuthnCredential {
+	encoded := base64.RawURLEncoding.EncodeToString(id)
+	for i := range u.credentials {
+		if u.credentials[i].CredentialID == encoded {
+			return &u.credentials[i]
+		}
+	}
+	return nil
+}
+
+// relyingParty returns the WebAuthn relying party of a realm. Unless
+// configured, it is the host of the realm's issuer, and ceremonies must
+// run on the issuer's origin.
+func relyingParty(realm *realms.Realm) (*webauthn.WebAuthn, error) {
+	cfg := config.Get().WebAuthn
+	issuer, err := url.Parse(realm.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	rpID := cfg.RPID
+	if rpID == "" {
+		rpID = issuer.Hostname()
+	}
+	origins := cfg.Origins
+	if len(origins) == 0 {
+		origins = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     origins,
+	})
+}
+
+func (s *UserService) loadWebAuthnUser(realm *realms.Realm, userID uint) (*webAuthnUser, error) {
+	store := s.store.ForRealm(realm.Name)
+	user := store.GetUser(userID)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	credentials, err := store.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// issueWebAuthnSession carries the library's ceremony state to the finish
+// step. The issue time lets the finish step reject a challenge that
+// already completed a login.
+func issueWebAuthnSession(purpose string, realm *realms.Realm, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return utils.SignToken(purpose, now.Add(webAuthnSessionTTL),
+		realm.Name,
+		strconv.FormatInt(now.UnixNano(), 10),
+		string(data),
+	), nil
+}
+
+func parseWebAuthnSession(purpose string, realm *realms.Realm, token string) (*webauthn.SessionData, time.Time, error) {
+	fields, err := utils.VerifySignedToken(purpose, token)
+	if err != nil || len(fields) != 3 || fields[0] != realm.Name {
+		return nil, time.Time{}, ErrInvalidWebAuthnSession
+	}
+	issuedAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidWebAuthnSession
+	}
+	session := new(webauthn.SessionData)
+	if err := json.Unmarshal([]byte(fields[2]), session); err != nil {
+		return nil, time.Time{}, ErrInvalidWebAuthnSession
+	}
+	return session, time.Unix(0, issuedAt), nil
+}
+
+// BeginWebAuthnRegistration starts registering a new authenticator for the
+// user. Authenticators are asked for a discoverable credential, so the
+// same one can later sign in without a username.
+func (s *UserService) BeginWebAuthnRegistration(realm *realms.Realm, userID uint) (*models.WebAuthnChallenge, error) {
+	rp, err := relyingParty(realm)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadWebAuthnUser(realm, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	options, session, err := rp.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationPreferred,
+		}),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, err
+	}
+	token, err := issueWebAuthnSession(webAuthnRegistrationPurpose, realm, session)
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebAuthnChallenge{Options: options, Session: token}, nil
+}
+
+// FinishWebAuthnRegistration verifies the authenticator's response to
+// BeginWebAuthnRegistration and stores the new credential.
+func (s *UserService) FinishWebAuthnRegistration(realm *realms.Realm, userID uint, req *models.WebAuthnRegistration) (*models.WebAuthnCredential, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Security key"
+	}
+	if len(name) > maxCredentialNameLength {
+		return nil, ErrInvalidCredentialName
+	}
+	rp, err := relyingParty(realm)
+	if err != nil {
+		return nil, err
+	}
+	session, _, err := parseWebAuthnSession(webAuthnRegistrationPurpose, realm, req.Session)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadWebAuthnUser(realm, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		logWebAuthnError(user.user.ID, err)
+		return nil, ErrInvalidWebAuthnResponse
+	}
+	created, err := rp.CreateCredential(user, *session, parsed)
+	if err != nil {
+		logWebAuthnError(user.user.ID, err)
+		return nil, ErrInvalidWebAuthnResponse
+	}
+
+	var transports []string
+	for _, transport := range created.Transport {
+		transports = append(transports, string(transport))
+	}
+	aaguid, _ := uuid.FromBytes(created.Authenticator.AAGUID)
+	credential := &models.WebAuthnCredential{
+		UserID:          user.user.ID,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(created.ID),
+		Name:            name,
+		PublicKey:       created.PublicKey,
+		AttestationType: created.AttestationType,
+		AAGUID:          aaguid.String(),
+		SignCount:       created.Authenticator.SignCount,
+		Transports:      strings.Join(transports, " "),
+		BackupEligible:  created.Flags.BackupEligible,
+		BackupState:     created.Flags.BackupState,
+	}
+	if err := s.store.ForRealm(realm.Name).StoreWebAuthnCredential(credential); err != nil {
+		if errors.Is(err, storage.ErrCredentialExists) {
+			return nil, ErrCredentialRegistered
+		}
+		return nil, err
+	}
+	log.Printf("Registered WebAuthn credential %d for user %d in realm %s", credential.ID, user.user.ID, realm.Name)
+	return credential, nil
+}
+
+// BeginPasskeyLogin starts a passwordless login with a discoverable
+// credential. The authenticator must verify the user (PIN or biometric),
+// which makes the passkey a multi-factor login on its own.
+func (s *UserService) BeginPasskeyLogin(realm *realms.Realm) (*models.WebAuthnChallenge, error) {
+	rp, err := relyingParty(realm)
+	if err != nil {
+		return nil, err
+	}
+	options, session, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, err
+	}
+	token, err := issueWebAuthnSession(webAuthnLoginPurpose, realm, session)
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebAuthnChallenge{Options: options, Session: token}, nil
+}
+
+// FinishPasskeyLogin completes a login started by BeginPasskeyLogin.
+func (s *UserService) FinishPasskeyLogin(realm *realms.Realm, req *models.WebAuthnLogin) (*LoginResult, error) {
+	rp, err := relyingParty(realm)
+	if err != nil {
+		return nil, err
+	}
+	session, issuedAt, err := parseWebAuthnSession(webAuthnLoginPurpose, realm, req.Session)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		logWebAuthnError(0, err)
+		return nil, ErrInvalidWebAuthnResponse
+	}
+
+	var user *webAuthnUser
+	discover := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := strconv.ParseUint(string(userHandle), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		user, err = s.loadWebAuthnUser(realm, uint(userID))
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	validated, err := rp.ValidateDiscoverableLogin(discover, *session, parsed)
+	if err != nil {
+		logWebAuthnError(0, err)
+		return nil, ErrInvalidWebAuthnResponse
+	}
+	if err := s.recordWebAuthnUse(realm, user, validated, issuedAt); err != nil {
+		return nil, err
+	}
+
+	if user.user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if realm.RequireEmailVerification && !user.user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	return s.completeLogin(realm, user.user, AMRHardwareKey, AMRMFA)
+}
+
+// BeginWebAuthnMFA starts using an authenticator as the second factor of
+// a login that Login answered with an MFA token.
+func (s *UserService) BeginWebAuthnMFA(realm *realms.Realm, mfaToken string) (*models.WebAuthnChallenge, error) {
+	rp, err := relyingParty(realm)
+	if err != nil {
+		return nil, err
+	}
+	found, _ := s.parseMFAToken(realm, mfaToken)
+	if found == nil {
+		return nil, ErrInvalidMFAToken
+	}
+	user, err := s.loadWebAuthnUser(realm, found.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.credentials) == 0 {
+		return nil, ErrInvalidMFAToken
+	}
+
+	options, session, err := rp.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationDiscouraged))
+	if err != nil {
+		return nil, err
+	}
+	token, err := issueWebAuthnSession(webAuthnLoginPurpose, realm, session)
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebAuthnChallenge{Options: options, Session: token}, nil
+}
+
+// FinishWebAuthnMFA completes a login started by BeginWebAuthnMFA.
+func (s *UserService) FinishWebAuthnMFA(realm *realms.Realm, req *models.WebAuthnLogin) (*LoginResult, error) {
+	rp, err := relyingParty(realm)
+	if err != nil {
+		return nil, err
+	}
+	found, firstFactor := s.parseMFAToken(realm, req.MFAToken)
+	if found == nil {
+		return nil, ErrInvalidMFAToken
+	}
+	session, issuedAt, err := parseWebAuthnSession(webAuthnLoginPurpose, realm, req.Session)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadWebAuthnUser(realm, found.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		logWebAuthnError(user.user.ID, err)
+		return nil, ErrInvalidWebAuthnResponse
+	}
+	validated, err := rp.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		logWebAuthnError(user.user.ID, err)
+		return nil, ErrInvalidWebAuthnResponse
+	}
+	if err := s.recordWebAuthnUse(realm, user, validated, issuedAt); err != nil {
+		return nil, err
+	}
+	return s.completeLogin(realm, user.user, firstFactor, AMRHardwareKey, AMRMFA)
+}
+
+// recordWebAuthnUse updates the stored credential after a successful
+// assertion. Since session tokens are stateless, it is also what makes
+// each challenge single-use: a credential last used after the challenge
+// was issued has already answered it.
+func (s *UserService) recordWebAuthnUse(realm *realms.Realm, user *webAuthnUser, validated *webauthn.Credential, issuedAt time.Time) error {
+	credential := user.credential(validated.ID)
+	if credential == nil {
+		return ErrInvalidWebAuthnResponse
+	}
+	if credential.LastUsedAt != nil && !credential.LastUsedAt.Before(issuedAt) {
+		log.Printf("Rejected replayed WebAuthn assertion for credential %d of user %d", credential.ID, user.user.ID)
+		return ErrInvalidWebAuthnResponse
+	}
+	if validated.Authenticator.CloneWarning {
+		log.Printf("Rejected WebAuthn assertion for credential %d of user %d: signature counter went backwards, the authenticator may be cloned",
+			credential.ID, user.user.ID)
+		return ErrInvalidWebAuthnResponse
+	}
+
+	now := time.Now()
+	credential.SignCount = validated.Authenticator.SignCount
+	credential.BackupState = validated.Flags.BackupState
+	credential.LastUsedAt = &now
+	return s.store.ForRealm(realm.Name).UpdateWebAuthnCredential(credential)
+}
+
+// ListWebAuthnCredentials returns the user's authenticators, oldest first.
+func (s *UserService) ListWebAuthnCredentials(realm *realms.Realm, userID uint) ([]models.WebAuthnCredential, error) {
+	return s.store.ForRealm(realm.Name).ListWebAuthnCredentials(userID)
+}
+
+// RenameWebAuthnCredential changes the name of one of the user's
+// authenticators.
+func (s *UserService) RenameWebAuthnCredential(realm *realms.Realm, userID uint, credentialID, name string) (*models.WebAuthnCredential, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxCredentialNameLength {
+		return nil, ErrInvalidCredentialName
+	}
+	credential, err := s.ownedCredential(realm, userID, credentialID)
+	if err != nil {
+		return nil, err
+	}
+	credential.Name = name
+	if err := s.store.ForRealm(realm.Name).UpdateWebAuthnCredential(credential); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// DeleteWebAuthnCredential removes one of the user's authenticators.
+func (s *UserService) DeleteWebAuthnCredential(realm *realms.Realm, userID uint, credentialID string) error {
+	credential, err := s.ownedCredential(realm, userID, credentialID)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ForRealm(realm.Name).DeleteWebAuthnCredential(credential.CredentialID); err != nil {
+		return err
+	}
+	log.Printf("Removed WebAuthn credential %d of user %d in realm %s", credential.ID, userID, realm.Name)
+	return nil
+}
+
+// ownedCredential looks a credential up among the user's own, so users
+// can't touch each other's authenticators.
+func (s *UserService) ownedCredential(realm *realms.Realm, userID uint, credentialID string) (*models.WebAuthnCredential, error) {
+	credentials, err := s.store.ForRealm(realm.Name).ListWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range credentials {
+		if credentials[i].CredentialID == credentialID {
+			return &credentials[i], nil
+		}
+	}
+	return nil, ErrCredentialNotFound
+}
+
+// logWebAuthnError logs why a ceremony failed; clients only learn that it
+// did.
+func logWebAuthnError(userID uint, err error) {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) && protocolErr.DevInfo != "" {
+		err = errors.New(protocolErr.Details + ": " + protocolErr.DevInfo)
+	}
+	log.Printf("WebAuthn ceremony failed for user %d: %v", userID, err)
+}
@@ -0,0 +1,448 @@
+package services_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"oauth2-provider/models"
+	"oauth2-provider/passwords"
+	"oauth2-provider/realms"
+	"oauth2-provider/services"
+	"oauth2-provider/storage"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// Authenticator data flags (WebAuthn §6.1)
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+const webAuthnOrigin = "https://auth.example.com"
+
+// softAuthenticator is a software authenticator holding one ES256
+// credential, answering ceremonies the way a browser passes them on.
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	signCount  uint32
+	// origin is the web origin the browser reports; webAuthnOrigin unless
+	// a test pretends to be a phishing site.
+	origin string
+	// userVerified is whether the authenticator checks a PIN or biometric.
+	userVerified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatalf("reading random credential ID: %v", err)
+	}
+	return &softAuthenticator{key: key, id: id, origin: webAuthnOrigin, userVerified: true}
+}
+
+func (a *softAuthenticator) credentialID() string {
+	return base64.RawURLEncoding.EncodeToString(a.id)
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	data, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge.String(), "origin": a.origin})
+	if err != nil {
+		t.Fatalf("encoding client data: %v", err)
+	}
+	return data
+}
+
+// authenticatorData returns the authenticator data for rpID, with the
+// attested credential data when registering.
+func (a *softAuthenticator) authenticatorData(t *testing.T, rpID string, register bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(flagUserPresent)
+	if a.userVerified {
+		flags |= flagUserVerified
+	}
+	if register {
+		flags |= flagAttestedData
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !register {
+		return data
+	}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("encoding public key: %v", err)
+	}
+	data = append(data, make([]byte, 16)...) // AAGUID withheld
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+	data = append(data, a.id...)
+	return append(data, publicKey...)
+}
+
+// register answers navigator.credentials.create() with a credential
+// without attestation.
+func (a *softAuthenticator) register(t *testing.T, challenge *models.WebAuthnChallenge) json.RawMessage {
+	options, ok := challenge.Options.(*protocol.CredentialCreation)
+	if !ok {
+		t.Fatalf("registration options are %T", challenge.Options)
+	}
+	a.userHandle = options.Response.User.ID.(protocol.URLEncodedBase64)
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(t, options.Response.RelyingParty.ID, true),
+	})
+	if err != nil {
+		t.Fatalf("encoding attestation: %v", err)
+	}
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", options.Response.Challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// assert answers navigator.credentials.get(), counting the signature.
+func (a *softAuthenticator) assert(t *testing.T, challenge *models.WebAuthnChallenge) json.RawMessage {
+	options, ok := challenge.Options.(*protocol.CredentialAssertion)
+	if !ok {
+		t.Fatalf("login options are %T", challenge.Options)
+	}
+	a.signCount++
+	authData := a.authenticatorData(t, options.Response.RelyingPartyID, false)
+	clientData := a.clientData(t, "webauthn.get", options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("signing assertion: %v", err)
+	}
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) credential(t *testing.T, response map[string]string) json.RawMessage {
+	data, err := json.Marshal(map[string]interface{}{
+		"id":       a.credentialID(),
+		"rawId":    a.credentialID(),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatalf("encoding credential: %v", err)
+	}
+	return data
+}
+
+// newWebAuthnService returns a user service and alice, whose password is
+// "alice-password".
+func newWebAuthnService(t *testing.T) (*services.UserService, storage.Store, *models.User) {
+	useTestConfig(t, nil)
+	memory := storage.NewMemoryStorage()
+	hash, err := passwords.Hash("alice-password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	store := memory.ForRealm("default")
+	alice := &models.User{Username: "alice", Email: "alice@example.com", EmailVerified: true, Password: hash}
+	if err := store.StoreUser(alice); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	return services.NewUserService(memory, nil, nil, nil, nil, nil, nil), store, alice
+}
+
+// registerAuthenticator registers a new authenticator for user.
+func registerAuthenticator(t *testing.T, userService *services.UserService, realm *realms.Realm, user *models.User) *softAuthenticator {
+	authenticator := newSoftAuthenticator(t)
+	challenge, err := userService.BeginWebAuthnRegistration(realm, user.ID)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration: %v", err)
+	}
+	if _, err := userService.FinishWebAuthnRegistration(realm, user.ID, &models.WebAuthnRegistration{
+		Session:    challenge.Session,
+		Credential: authenticator.register(t, challenge),
+	}); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %v", err)
+	}
+	return authenticator
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	realm := &realms.Realm{Name: "default", Issuer: webAuthnOrigin}
+	userService, store, alice := newWebAuthnService(t)
+	bob := &models.User{Username: "bob", Email: "bob@example.com", Password: "x"}
+	if err := store.StoreUser(bob); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+
+	t.Run("stores the credential", func(t *testing.T) {
+		authenticator := newSoftAuthenticator(t)
+		challenge, err := userService.BeginWebAuthnRegistration(realm, alice.ID)
+		if err != nil {
+			t.Fatalf("BeginWebAuthnRegistration: %v", err)
+		}
+		credential, err := userService.FinishWebAuthnRegistration(realm, alice.ID, &models.WebAuthnRegistration{
+			Session:    challenge.Session,
+			Name:       "  Laptop  ",
+			Credential: authenticator.register(t, challenge),
+		})
+		if err != nil {
+			t.Fatalf("FinishWebAuthnRegistration: %v", err)
+		}
+		if credential.CredentialID != authenticator.credentialID() || credential.Name != "Laptop" || credential.UserID != alice.ID {
+			t.Errorf("credential = %+v, want %s named Laptop for alice", credential, authenticator.credentialID())
+		}
+		listed, err := userService.ListWebAuthnCredentials(realm, alice.ID)
+		if err != nil || len(listed) != 1 || listed[0].CredentialID != credential.CredentialID {
+			t.Errorf("ListWebAuthnCredentials = %+v, %v; want the new credential", listed, err)
+		}
+
+		// Registering it again is refused, and it is excluded up front
+		again, err := userService.BeginWebAuthnRegistration(realm, alice.ID)
+		if err != nil {
+			t.Fatalf("BeginWebAuthnRegistration: %v", err)
+		}
+		excluded := again.Options.(*protocol.CredentialCreation).Response.CredentialExcludeList
+		if len(excluded) != 1 || excluded[0].CredentialID.String() != authenticator.credentialID() {
+			t.Errorf("excluded credentials = %+v, want the registered one", excluded)
+		}
+		if _, err := userService.FinishWebAuthnRegistration(realm, alice.ID, &models.WebAuthnRegistration{
+			Session:    again.Session,
+			Credential: authenticator.register(t, again),
+		}); !errors.Is(err, services.ErrCredentialRegistered) {
+			t.Errorf("registering twice: error = %v, want ErrCredentialRegistered", err)
+		}
+	})
+
+	tests := []struct {
+		name string
+		// modify adjusts the request and authenticator before the
+		// authenticator answers the challenge.
+		modify  func(req *models.WebAuthnRegistration, authenticator *softAuthenticator)
+		userID  uint
+		wantErr error
+	}{
+		{
+			name:    "name too long",
+			modify:  func(req *models.WebAuthnRegistration, _ *softAuthenticator) { req.Name = strings.Repeat("k", 65) },
+			wantErr: services.ErrInvalidCredentialName,
+		},
+		{
+			name: "other origin",
+			modify: func(_ *models.WebAuthnRegistration, authenticator *softAuthenticator) {
+				authenticator.origin = "https://phish.example.net"
+			},
+			wantErr: services.ErrInvalidWebAuthnResponse,
+		},
+		{
+			name:    "tampered session",
+			modify:  func(req *models.WebAuthnRegistration, _ *softAuthenticator) { req.Session += "x" },
+			wantErr: services.ErrInvalidWebAuthnSession,
+		},
+		{
+			name:    "session of another user",
+			userID:  bob.ID,
+			wantErr: services.ErrInvalidWebAuthnResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t)
+			challenge, err := userService.BeginWebAuthnRegistration(realm, alice.ID)
+			if err != nil {
+				t.Fatalf("BeginWebAuthnRegistration: %v", err)
+			}
+			req := &models.WebAuthnRegistration{Session: challenge.Session}
+			if tt.modify != nil {
+				tt.modify(req, authenticator)
+			}
+			req.Credential = authenticator.register(t, challenge)
+			userID := alice.ID
+			if tt.userID != 0 {
+				userID = tt.userID
+			}
+			if _, err := userService.FinishWebAuthnRegistration(realm, userID, req); !errors.Is(err, tt.wantErr) {
+				t.Errorf("FinishWebAuthnRegistration error = %v, want %v", err, tt.wantErr)
+			}
+			for _, user := range []*models.User{alice, bob} {
+				credentials, err := store.ListWebAuthnCredentials(user.ID)
+				if err != nil {
+					t.Fatalf("ListWebAuthnCredentials: %v", err)
+				}
+				for _, credential := range credentials {
+					if credential.CredentialID == authenticator.credentialID() {
+						t.Errorf("failed registration stored the credential for %s", user.Username)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	realm := &realms.Realm{Name: "default", Issuer: webAuthnOrigin}
+	userService, _, alice := newWebAuthnService(t)
+	authenticator := registerAuthenticator(t, userService, realm, alice)
+
+	login := func(t *testing.T, authenticator *softAuthenticator) (*services.LoginResult, error) {
+		challenge, err := userService.BeginPasskeyLogin(realm)
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+		return userService.FinishPasskeyLogin(realm, &models.WebAuthnLogin{Session: challenge.Session, Credential: authenticator.assert(t, challenge)})
+	}
+
+	t.Run("signs in", func(t *testing.T) {
+		result, err := login(t, authenticator)
+		if err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+		if result.User.ID != alice.ID || result.LoginToken == "" || result.MFAToken != "" {
+			t.Errorf("FinishPasskeyLogin = %+v, want a complete login of alice", result)
+		}
+	})
+
+	// Registering, renaming and deleting authenticators take the recent
+	// login token of a login like this one, once
+	t.Run("recent login token", func(t *testing.T) {
+		result, err := login(t, authenticator)
+		if err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+		auth, _, err := userService.RedeemRecentLogin(realm, result.RecentLoginToken)
+		if err != nil {
+			t.Fatalf("RedeemRecentLogin: %v", err)
+		}
+		if auth.UserID != alice.ID || auth.ACR() != services.ACRMultiFactor {
+			t.Errorf("RedeemRecentLogin = %+v, want alice's multi-factor login", auth)
+		}
+		for _, token := range []string{result.RecentLoginToken, result.LoginToken} {
+			if _, _, err := userService.RedeemRecentLogin(realm, token); !errors.Is(err, services.ErrInvalidLoginToken) {
+				t.Errorf("RedeemRecentLogin(%q): error = %v, want ErrInvalidLoginToken", token, err)
+			}
+		}
+	})
+
+	t.Run("challenges are single-use", func(t *testing.T) {
+		challenge, err := userService.BeginPasskeyLogin(realm)
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+		if _, err := userService.FinishPasskeyLogin(realm, &models.WebAuthnLogin{Session: challenge.Session, Credential: authenticator.assert(t, challenge)}); err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+		if _, err := userService.FinishPasskeyLogin(realm, &models.WebAuthnLogin{Session: challenge.Session, Credential: authenticator.assert(t, challenge)}); !errors.Is(err, services.ErrInvalidWebAuthnResponse) {
+			t.Errorf("second FinishPasskeyLogin error = %v, want ErrInvalidWebAuthnResponse", err)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		modify func(authenticator *softAuthenticator)
+	}{
+		{name: "without user verification", modify: func(a *softAuthenticator) { a.userVerified = false }},
+		{name: "other origin", modify: func(a *softAuthenticator) { a.origin = "https://phish.example.net" }},
+		{name: "counter going backwards", modify: func(a *softAuthenticator) { a.signCount = 0 }},
+		{name: "unregistered key", modify: func(a *softAuthenticator) {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			a.key = key
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clone := *authenticator
+			tt.modify(&clone)
+			if _, err := login(t, &clone); !errors.Is(err, services.ErrInvalidWebAuthnResponse) {
+				t.Errorf("FinishPasskeyLogin error = %v, want ErrInvalidWebAuthnResponse", err)
+			}
+		})
+	}
+}
+
+func TestWebAuthnMFA(t *testing.T) {
+	realm := &realms.Realm{Name: "default", Issuer: webAuthnOrigin}
+	userService, _, alice := newWebAuthnService(t)
+	authenticator := registerAuthenticator(t, userService, realm, alice)
+
+	first, err := userService.Login(realm, &models.UserLogin{Username: "alice", Password: "alice-password"}, "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if first.MFAToken == "" || len(first.MFAMethods) != 1 || first.MFAMethods[0] != services.MFAMethodWebAuthn {
+		t.Fatalf("Login = %+v, want a WebAuthn second step", first)
+	}
+
+	tests := []struct {
+		name string
+		// modify adjusts the authenticator before it answers.
+		modify   func(a *softAuthenticator)
+		mfaToken string
+		wantErr  error
+	}{
+		// The second factor doesn't need user verification
+		{name: "user present", modify: func(a *softAuthenticator) { a.userVerified = false }},
+		{name: "other authenticator", modify: func(a *softAuthenticator) { *a = *newSoftAuthenticator(t) }, wantErr: services.ErrInvalidWebAuthnResponse},
+		{name: "tampered MFA token", mfaToken: first.MFAToken + "x", wantErr: services.ErrInvalidMFAToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfaToken := first.MFAToken
+			if tt.mfaToken != "" {
+				mfaToken = tt.mfaToken
+			}
+			challenge, err := userService.BeginWebAuthnMFA(realm, first.MFAToken)
+			if err != nil {
+				t.Fatalf("BeginWebAuthnMFA: %v", err)
+			}
+			allowed := challenge.Options.(*protocol.CredentialAssertion).Response.AllowedCredentials
+			if len(allowed) != 1 || allowed[0].CredentialID.String() != authenticator.credentialID() {
+				t.Errorf("allowed credentials = %+v, want alice's authenticator", allowed)
+			}
+
+			clone := *authenticator
+			if tt.modify != nil {
+				tt.modify(&clone)
+			}
+			result, err := userService.FinishWebAuthnMFA(realm, &models.WebAuthnLogin{
+				MFAToken:   mfaToken,
+				Session:    challenge.Session,
+				Credential: clone.assert(t, challenge),
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FinishWebAuthnMFA error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (result.User.ID != alice.ID || result.LoginToken == "") {
+				t.Errorf("FinishWebAuthnMFA = %+v, want a login of alice", result)
+			}
+			authenticator.signCount = clone.signCount
+		})
+	}
+}
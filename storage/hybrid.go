@@ -0,0 +1,61 @@
+package storage
+
+// HybridStorage combines one backend for long-lived accounts (users,
+// clients, credentials, federated identities, SAML service providers,
+// groups and data keys) with another for short-lived codes, tokens and login
+// attempts, typically Postgres and Redis.
+type HybridStorage struct {
+	UserRepository
+	ClientRepository
+	AuthCodeRepository
+	RefreshTokenRepository
+	DataKeyRepository
+	WebAuthnCredentialRepository
+	FederatedIdentityRepository
+	SAMLServiceProviderRepository
+	GroupRepository
+	LoginAttemptRepository
+
+	accounts AccountStore
+	tokens   TokenStore
+}
+
+type AccountStore interface {
+	UserRepository
+	ClientRepository
+	DataKeyRepository
+	WebAuthnCredentialRepository
+	FederatedIdentityRepository
+	SAMLServiceProviderRepository
+	GroupRepository
+	ForRealm(realm string) Store
+}
+
+type TokenStore interface {
+	AuthCodeRepository
+	RefreshTokenRepository
+	LoginAttemptRepository
+	ForRealm(realm string) Store
+}
+
+func NewHybridStorage(accounts AccountStore, tokens TokenStore) *HybridStorage {
+	return &HybridStorage{
+		UserRepository:               accounts,
+		ClientRepository:             accounts,
+		AuthCodeRepository:           tokens,
+		RefreshTokenRepository:       tokens,
+		DataKeyRepository:            accounts,
+		WebAuthnCredentialRepository: accounts,
+		FederatedIdentityRepository:   accounts,
+		SAMLServiceProviderRepository: accounts,
+		GroupRepository:               accounts,
+		LoginAttemptRepository:        tokens,
+
+		accounts: accounts,
+		tokens:   tokens,
+	}
+}
+
+func (s *HybridStorage) ForRealm(realm string) Store {
+	return NewHybridStorage(s.accounts.ForRealm(realm), s.tokens.ForRealm(realm))
+}
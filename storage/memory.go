@@ -1,42 +1,89 @@
 package storage
 
 import (
+	"errors"
 	"oauth2-provider/models"
-	"strconv"
+	"oauth2-provider/utils"
+	"sort"
 	"sync"
 	"time"
 )
 
-type AuthCode struct {
-	Code               string
-	ClientID           string
-	UserID             uint
-	ExpiresAt          time.Time
-	CodeChallenge      string
-	CodeChallengeMethod string
+// MemoryStorage keeps everything in process memory. Auth codes and refresh
+// tokens are keyed by utils.HashToken of their raw value, matching
+// PostgresStorage. Stored values are copied in and out so callers can't
+// mutate them behind the store's back.
+type MemoryStorage struct {
+	*memoryData
+	realm string
 }
 
-type MemoryStorage struct {
+// memoryData is shared by a store and all of its realm views. Records
+// carry their realm and lookups skip records from other realms.
+type memoryData struct {
 	users         map[uint]*models.User
 	clients       map[string]*models.Client
-	authCodes     map[string]*AuthCode
-	refreshTokens map[string]string
+	authCodes     map[string]*models.AuthCode
+	refreshTokens map[string]*models.RefreshToken
+	dataKeys      map[string]*models.DataKey
+	credentials   map[uint]*models.WebAuthnCredential
+	identities    map[uint]*models.FederatedIdentity
+	samlProviders map[uint]*models.SAMLServiceProvider
+	groups        map[uint]*models.Group
+	loginAttempts map[string]*models.LoginAttempt
+	nextID        uint
 	mu            sync.RWMutex
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		users:         make(map[uint]*models.User),
-		clients:       make(map[string]*models.Client),
-		authCodes:     make(map[string]*AuthCode),
-		refreshTokens: make(map[string]string),
+		memoryData: &memoryData{
+			users:         make(map[uint]*models.User),
+			clients:       make(map[string]*models.Client),
+			authCodes:     make(map[string]*models.AuthCode),
+			refreshTokens: make(map[string]*models.RefreshToken),
+			dataKeys:      make(map[string]*models.DataKey),
+			credentials:   make(map[uint]*models.WebAuthnCredential),
+			identities:    make(map[uint]*models.FederatedIdentity),
+			samlProviders: make(map[uint]*models.SAMLServiceProvider),
+			groups:        make(map[uint]*models.Group),
+			loginAttempts: make(map[string]*models.LoginAttempt),
+		},
+		realm: models.DefaultRealm,
 	}
 }
 
+func (s *MemoryStorage) ForRealm(realm string) Store {
+	return &MemoryStorage{memoryData: s.memoryData, realm: realm}
+}
+
+// newID returns the next primary key, shared across all record types.
+// Callers must hold the write lock.
+func (s *MemoryStorage) newID() uint {
+	s.nextID++
+	return s.nextID
+}
+
 func (s *MemoryStorage) StoreUser(user *models.User) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.users[user.ID] = user
+	for _, existing := range s.users {
+		if existing.Realm != s.realm {
+			continue
+		}
+		if existing.Username == user.Username {
+			return errors.New("username already exists")
+		}
+		if existing.Email == user.Email {
+			return errors.New("email already exists")
+		}
+	}
+	user.ID = s.newID()
+	user.Realm = s.realm
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	stored := *user
+	s.users[user.ID] = &stored
 	return nil
 }
 
@@ -44,8 +91,82 @@ func (s *MemoryStorage) GetUserByUsername(username string) *models.User {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, user := range s.users {
-		if user.Username == username {
-			return user
+		if user.Realm == s.realm && user.Username == username {
+			found := *user
+			return &found
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) GetUser(id uint) *models.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if user, exists := s.users[id]; exists && user.Realm == s.realm {
+		found := *user
+		return &found
+	}
+	return nil
+}
+
+func (s *MemoryStorage) GetUserByEmail(email string) *models.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.Realm == s.realm && user.Email == email {
+			found := *user
+			return &found
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) UpdateUser(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, exists := s.users[user.ID]
+	if !exists || existing.Realm != s.realm {
+		return errors.New("user not found")
+	}
+	stored := *user
+	stored.Realm = existing.Realm
+	stored.Username = existing.Username
+	stored.Email = existing.Email
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now()
+	s.users[user.ID] = &stored
+	user.UpdatedAt = stored.UpdatedAt
+	return nil
+}
+
+func (s *MemoryStorage) ListUsers() ([]models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var users []models.User
+	for _, user := range s.users {
+		if user.Realm == s.realm {
+			users = append(users, *user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *MemoryStorage) DeleteUser(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, exists := s.users[id]; !exists || user.Realm != s.realm {
+		return nil
+	}
+	delete(s.users, id)
+	for credentialID, credential := range s.credentials {
+		if credential.Realm == s.realm && credential.UserID == id {
+			delete(s.credentials, credentialID)
+		}
+	}
+	for identityID, identity := range s.identities {
+		if identity.Realm == s.realm && identity.UserID == id {
+			delete(s.identities, identityID)
 		}
 	}
 	return nil
@@ -54,67 +175,594 @@ func (s *MemoryStorage) GetUserByUsername(username string) *models.User {
 func (s *MemoryStorage) GetClient(clientID string) *models.Client {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.clients[clientID]
+	if client, exists := s.clients[clientID]; exists && client.Realm == s.realm {
+		found := *client
+		return &found
+	}
+	return nil
 }
 
 func (s *MemoryStorage) StoreClient(client *models.Client) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.clients[client.ClientID] = client
+
+	// Generate client ID; the secret hash is set by the caller
+	client.ClientID = utils.GenerateRandomString(24)
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{"authorization_code"}
+	}
+	if _, exists := s.clients[client.ClientID]; exists {
+		return errors.New("client already exists")
+	}
+
+	client.ID = s.newID()
+	client.Realm = s.realm
+	client.CreatedAt = time.Now()
+	client.UpdatedAt = client.CreatedAt
+	stored := *client
+	s.clients[client.ClientID] = &stored
 	return nil
 }
 
-func (s *MemoryStorage) StoreAuthCode(code, clientID string, userID uint) error {
+func (s *MemoryStorage) UpdateClient(client *models.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, exists := s.clients[client.ClientID]
+	if !exists || existing.Realm != s.realm {
+		return errors.New("client not found")
+	}
+	client.Realm = s.realm
+	client.UpdatedAt = time.Now()
+	stored := *client
+	s.clients[client.ClientID] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) StoreAuthCodeGrant(code string, authCode *models.AuthCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := utils.HashToken(code)
+	if _, exists := s.authCodes[hash]; exists {
+		return errors.New("auth code already exists")
+	}
+	authCode.CodeHash = hash
+	authCode.Realm = s.realm
+	authCode.ExpiresAt = time.Now().Add(10 * time.Minute)
+	authCode.ID = s.newID()
+	authCode.CreatedAt = time.Now()
+	authCode.UpdatedAt = authCode.CreatedAt
+	stored := *authCode
+	s.authCodes[hash] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) GetAuthCode(code string) *models.AuthCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authCode, exists := s.authCodes[utils.HashToken(code)]
+	if !exists || authCode.Realm != s.realm || authCode.Used || !time.Now().Before(authCode.ExpiresAt) {
+		return nil
+	}
+
+	// Mark the auth code as used
+	authCode.Used = true
+	authCode.UpdatedAt = time.Now()
+
+	found := *authCode
+	return &found
+}
+
+func (s *MemoryStorage) StoreRefreshToken(token string, refreshToken *models.RefreshToken) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.authCodes[code] = &AuthCode{
-		Code:      code,
-		ClientID:  clientID,
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(10 * time.Minute),
+	hash := utils.HashToken(token)
+	if _, exists := s.refreshTokens[hash]; exists {
+		return errors.New("refresh token already exists")
 	}
+	refreshToken.TokenHash = hash
+	refreshToken.Realm = s.realm
+	refreshToken.ID = s.newID()
+	refreshToken.CreatedAt = time.Now()
+	refreshToken.UpdatedAt = refreshToken.CreatedAt
+	stored := *refreshToken
+	s.refreshTokens[hash] = &stored
 	return nil
 }
 
-func (s *MemoryStorage) GetAuthCode(code string) *AuthCode {
+func (s *MemoryStorage) GetRefreshToken(token string) *models.RefreshToken {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if auth, exists := s.authCodes[code]; exists && time.Now().Before(auth.ExpiresAt) {
-		return auth
+	refreshToken, exists := s.refreshTokens[utils.HashToken(token)]
+	now := time.Now()
+	if !exists || refreshToken.Realm != s.realm || !now.Before(refreshToken.ExpiresAt) || !now.Before(refreshToken.AbsoluteExpiresAt) {
+		return nil
+	}
+	found := *refreshToken
+	return &found
+}
+
+func (s *MemoryStorage) UpdateRefreshTokenExpiry(token string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if refreshToken, exists := s.refreshTokens[utils.HashToken(token)]; exists && refreshToken.Realm == s.realm {
+		refreshToken.ExpiresAt = expiresAt
+		refreshToken.UpdatedAt = time.Now()
 	}
 	return nil
 }
 
-func (s *MemoryStorage) StoreRefreshToken(token string, userID uint, clientID string) error {
+func (s *MemoryStorage) DeleteRefreshToken(token string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.refreshTokens[token] = strconv.FormatUint(uint64(userID), 10)
+	hash := utils.HashToken(token)
+	if refreshToken, exists := s.refreshTokens[hash]; exists && refreshToken.Realm == s.realm {
+		delete(s.refreshTokens, hash)
+	}
 	return nil
 }
 
-func (s *MemoryStorage) StoreAuthCodeWithPKCE(code, clientID string, userID uint, codeChallenge, codeChallengeMethod string) error {
+func (s *MemoryStorage) DeleteRefreshTokensForUser(userID uint) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for hash, refreshToken := range s.refreshTokens {
+		if refreshToken.Realm == s.realm && refreshToken.UserID == userID {
+			delete(s.refreshTokens, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStorage) RotateRefreshToken(oldToken, newToken string, refreshToken *models.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldHash := utils.HashToken(oldToken)
+	if old, exists := s.refreshTokens[oldHash]; !exists || old.Realm != s.realm {
+		return ErrRefreshTokenNotFound
+	}
+	newHash := utils.HashToken(newToken)
+	if _, exists := s.refreshTokens[newHash]; exists {
+		return errors.New("refresh token already exists")
+	}
+	delete(s.refreshTokens, oldHash)
+
+	refreshToken.TokenHash = newHash
+	refreshToken.Realm = s.realm
+	refreshToken.ID = s.newID()
+	refreshToken.CreatedAt = time.Now()
+	refreshToken.UpdatedAt = refreshToken.CreatedAt
+	stored := *refreshToken
+	s.refreshTokens[newHash] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) PurgeAuthCodes(now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged int64
+	for hash, authCode := range s.authCodes {
+		if purged >= int64(limit) {
+			break
+		}
+		if authCode.Used || !now.Before(authCode.ExpiresAt) {
+			delete(s.authCodes, hash)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *MemoryStorage) PurgeRefreshTokens(now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged int64
+	for hash, refreshToken := range s.refreshTokens {
+		if purged >= int64(limit) {
+			break
+		}
+		if !now.Before(refreshToken.ExpiresAt) || !now.Before(refreshToken.AbsoluteExpiresAt) {
+			delete(s.refreshTokens, hash)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *MemoryStorage) StoreDataKey(key *models.DataKey) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.authCodes[code] = &AuthCode{
-		Code:               code,
-		ClientID:           clientID,
-		UserID:             userID,
-		ExpiresAt:          time.Now().Add(10 * time.Minute),
-		CodeChallenge:      codeChallenge,
-		CodeChallengeMethod: codeChallengeMethod,
+	if _, exists := s.dataKeys[key.KeyID]; exists {
+		return errors.New("data key already exists")
 	}
+	if key.Active {
+		for _, existing := range s.dataKeys {
+			existing.Active = false
+		}
+	}
+	key.ID = s.newID()
+	key.CreatedAt = time.Now()
+	key.UpdatedAt = key.CreatedAt
+	stored := *key
+	s.dataKeys[key.KeyID] = &stored
 	return nil
 }
 
-func (s *MemoryStorage) GetRefreshToken(token string) string {
+func (s *MemoryStorage) GetDataKey(keyID string) *models.DataKey {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.refreshTokens[token]
+	if key, exists := s.dataKeys[keyID]; exists {
+		found := *key
+		return &found
+	}
+	return nil
 }
 
-func (s *MemoryStorage) DeleteRefreshToken(token string) error {
+func (s *MemoryStorage) GetActiveDataKey() *models.DataKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.dataKeys {
+		if key.Active {
+			found := *key
+			return &found
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ListDataKeys() ([]models.DataKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]models.DataKey, 0, len(s.dataKeys))
+	for _, key := range s.dataKeys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (s *MemoryStorage) UpdateDataKey(key *models.DataKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.dataKeys[key.KeyID]; !exists {
+		return errors.New("data key not found")
+	}
+	key.UpdatedAt = time.Now()
+	stored := *key
+	s.dataKeys[key.KeyID] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) StoreWebAuthnCredential(credential *models.WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findCredentialLocked(credential.CredentialID) != nil {
+		return ErrCredentialExists
+	}
+	credential.ID = s.newID()
+	credential.Realm = s.realm
+	credential.CreatedAt = time.Now()
+	credential.UpdatedAt = credential.CreatedAt
+	stored := *credential
+	s.credentials[stored.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) ListWebAuthnCredentials(userID uint) ([]models.WebAuthnCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var credentials []models.WebAuthnCredential
+	for _, credential := range s.credentials {
+		if credential.Realm == s.realm && credential.UserID == userID {
+			credentials = append(credentials, *credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].ID < credentials[j].ID })
+	return credentials, nil
+}
+
+func (s *MemoryStorage) UpdateWebAuthnCredential(credential *models.WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing := s.findCredentialLocked(credential.CredentialID)
+	if existing == nil {
+		return errors.New("credential not found")
+	}
+	existing.Name = credential.Name
+	existing.SignCount = credential.SignCount
+	existing.BackupState = credential.BackupState
+	existing.LastUsedAt = credential.LastUsedAt
+	existing.UpdatedAt = time.Now()
+	credential.UpdatedAt = existing.UpdatedAt
+	return nil
+}
+
+func (s *MemoryStorage) DeleteWebAuthnCredential(credentialID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if credential := s.findCredentialLocked(credentialID); credential != nil {
+		delete(s.credentials, credential.ID)
+	}
+	return nil
+}
+
+// findCredentialLocked returns the realm's credential with the given ID.
+// Callers must hold the lock.
+func (s *MemoryStorage) findCredentialLocked(credentialID string) *models.WebAuthnCredential {
+	for _, credential := range s.credentials {
+		if credential.Realm == s.realm && credential.CredentialID == credentialID {
+			return credential
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) StoreFederatedIdentity(identity *models.FederatedIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findIdentityLocked(identity.Provider, identity.Subject) != nil {
+		return ErrIdentityLinked
+	}
+	identity.ID = s.newID()
+	identity.Realm = s.realm
+	identity.CreatedAt = time.Now()
+	identity.UpdatedAt = identity.CreatedAt
+	stored := *identity
+	s.identities[stored.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) GetFederatedIdentity(provider, subject string) *models.FederatedIdentity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if identity := s.findIdentityLocked(provider, subject); identity != nil {
+		found := *identity
+		return &found
+	}
+	return nil
+}
+
+func (s *MemoryStorage) UpdateFederatedIdentity(identity *models.FederatedIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing := s.findIdentityLocked(identity.Provider, identity.Subject)
+	if existing == nil {
+		return errors.New("federated identity not found")
+	}
+	existing.Email = identity.Email
+	existing.LastLoginAt = identity.LastLoginAt
+	existing.UpdatedAt = time.Now()
+	identity.UpdatedAt = existing.UpdatedAt
+	return nil
+}
+
+// findIdentityLocked returns the realm's link of an upstream account.
+// Callers must hold the lock.
+func (s *MemoryStorage) findIdentityLocked(provider, subject string) *models.FederatedIdentity {
+	for _, identity := range s.identities {
+		if identity.Realm == s.realm && identity.Provider == provider && identity.Subject == subject {
+			return identity
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) StoreSAMLServiceProvider(provider *models.SAMLServiceProvider) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findSAMLProviderLocked(provider.EntityID) != nil {
+		return ErrServiceProviderExists
+	}
+	provider.ID = s.newID()
+	provider.Realm = s.realm
+	provider.CreatedAt = time.Now()
+	provider.UpdatedAt = provider.CreatedAt
+	stored := *provider
+	s.samlProviders[stored.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) GetSAMLServiceProvider(entityID string) *models.SAMLServiceProvider {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if provider := s.findSAMLProviderLocked(entityID); provider != nil {
+		found := *provider
+		return &found
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ListSAMLServiceProviders() ([]models.SAMLServiceProvider, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var providers []models.SAMLServiceProvider
+	for _, provider := range s.samlProviders {
+		if provider.Realm == s.realm {
+			providers = append(providers, *provider)
+		}
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].ID < providers[j].ID })
+	return providers, nil
+}
+
+func (s *MemoryStorage) UpdateSAMLServiceProvider(provider *models.SAMLServiceProvider) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing := s.findSAMLProviderLocked(provider.EntityID)
+	if existing == nil {
+		return errors.New("service provider not found")
+	}
+	existing.Metadata = provider.Metadata
+	existing.NameIDFormat = provider.NameIDFormat
+	existing.Attributes = provider.Attributes
+	existing.UpdatedAt = time.Now()
+	provider.UpdatedAt = existing.UpdatedAt
+	return nil
+}
+
+func (s *MemoryStorage) DeleteSAMLServiceProvider(entityID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if provider := s.findSAMLProviderLocked(entityID); provider != nil {
+		delete(s.samlProviders, provider.ID)
+	}
+	return nil
+}
+
+// findSAMLProviderLocked returns the realm's service provider with the
+// given entity ID. Callers must hold the lock.
+func (s *MemoryStorage) findSAMLProviderLocked(entityID string) *models.SAMLServiceProvider {
+	for _, provider := range s.samlProviders {
+		if provider.Realm == s.realm && provider.EntityID == entityID {
+			return provider
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) StoreGroup(group *models.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findGroupLocked(group.DisplayName) != nil {
+		return ErrGroupExists
+	}
+	group.ID = s.newID()
+	group.Realm = s.realm
+	group.CreatedAt = time.Now()
+	group.UpdatedAt = group.CreatedAt
+	stored := *group
+	s.groups[stored.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStorage) GetGroup(id uint) *models.Group {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if group, exists := s.groups[id]; exists && group.Realm == s.realm {
+		found := *group
+		return &found
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ListGroups() ([]models.Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var groups []models.Group
+	for _, group := range s.groups {
+		if group.Realm == s.realm {
+			groups = append(groups, *group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+func (s *MemoryStorage) UpdateGroup(group *models.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, exists := s.groups[group.ID]
+	if !exists || existing.Realm != s.realm {
+		return errors.New("group not found")
+	}
+	if other := s.findGroupLocked(group.DisplayName); other != nil && other.ID != group.ID {
+		return ErrGroupExists
+	}
+	existing.DisplayName = group.DisplayName
+	existing.ExternalID = group.ExternalID
+	existing.Members = group.Members
+	existing.UpdatedAt = time.Now()
+	group.UpdatedAt = existing.UpdatedAt
+	return nil
+}
+
+func (s *MemoryStorage) DeleteGroup(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if group, exists := s.groups[id]; exists && group.Realm == s.realm {
+		delete(s.groups, id)
+	}
+	return nil
+}
+
+// findGroupLocked returns the realm's group with the given display name.
+// Callers must hold the lock.
+func (s *MemoryStorage) findGroupLocked(displayName string) *models.Group {
+	for _, group := range s.groups {
+		if group.Realm == s.realm && group.DisplayName == displayName {
+			return group
+		}
+	}
+	return nil
+}
+
+// loginAttemptKey returns the map key of a login attempt record; keys are
+// only unique within a realm.
+func (s *MemoryStorage) loginAttemptKey(key string) string {
+	return s.realm + "\x00" + key
+}
+
+func (s *MemoryStorage) RecordLoginFailure(key string, now time.Time, window time.Duration) (*models.LoginAttempt, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.refreshTokens, token)
+	attempt, exists := s.loginAttempts[s.loginAttemptKey(key)]
+	if !exists {
+		attempt = &models.LoginAttempt{ID: s.newID(), Realm: s.realm, Key: key}
+		s.loginAttempts[s.loginAttemptKey(key)] = attempt
+	}
+	if !now.Before(attempt.ExpiresAt) {
+		attempt.Failures = 0
+		attempt.FirstFailureAt = now
+		attempt.ExpiresAt = now.Add(window)
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	found := *attempt
+	return &found, nil
+}
+
+func (s *MemoryStorage) GetLoginAttempt(key string) *models.LoginAttempt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	attempt, exists := s.loginAttempts[s.loginAttemptKey(key)]
+	if !exists {
+		return nil
+	}
+	found := *attempt
+	return &found
+}
+
+func (s *MemoryStorage) LockLogin(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt, exists := s.loginAttempts[s.loginAttemptKey(key)]
+	if !exists {
+		attempt = &models.LoginAttempt{ID: s.newID(), Realm: s.realm, Key: key, ExpiresAt: time.Now()}
+		s.loginAttempts[s.loginAttemptKey(key)] = attempt
+	}
+	attempt.LockedUntil = &until
+	return nil
+}
+
+func (s *MemoryStorage) ClearLoginAttempts(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loginAttempts, s.loginAttemptKey(key))
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *MemoryStorage) PurgeLoginAttempts(now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged int64
+	for key, attempt := range s.loginAttempts {
+		if purged >= int64(limit) {
+			break
+		}
+		if !now.Before(attempt.ExpiresAt) && (attempt.LockedUntil == nil || !now.Before(*attempt.LockedUntil)) {
+			delete(s.loginAttempts, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"oauth2-provider/models"
 	"oauth2-provider/utils"
 	"time"
@@ -9,33 +12,98 @@ import (
 )
 
 type PostgresStorage struct {
-	db *gorm.DB
+	db    *gorm.DB
+	realm string
 }
 
 func NewPostgresStorage(db *gorm.DB) *PostgresStorage {
-	return &PostgresStorage{db: db}
+	return &PostgresStorage{db: db, realm: models.DefaultRealm}
+}
+
+func (s *PostgresStorage) ForRealm(realm string) Store {
+	return s.forRealm(realm)
+}
+
+func (s *PostgresStorage) forRealm(realm string) *PostgresStorage {
+	return &PostgresStorage{db: s.db, realm: realm}
+}
+
+// scoped starts a query limited to the store's realm. Every query on
+// realm-owned tables must go through it.
+func (s *PostgresStorage) scoped(tx *gorm.DB) *gorm.DB {
+	return tx.Where("realm = ?", s.realm)
 }
 
 func (s *PostgresStorage) StoreUser(user *models.User) error {
+	user.Realm = s.realm
 	return s.db.Create(user).Error
 }
 
 func (s *PostgresStorage) GetUserByUsername(username string) *models.User {
 	var user models.User
-	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
+	if err := s.scoped(s.db).Where("username = ?", username).First(&user).Error; err != nil {
 		log.Printf("Error getting user by username: %v", err)
 		return nil
 	}
 	return &user
 }
 
+func (s *PostgresStorage) GetUser(id uint) *models.User {
+	var user models.User
+	if err := s.scoped(s.db).Where("id = ?", id).First(&user).Error; err != nil {
+		log.Printf("Error getting user: %v", err)
+		return nil
+	}
+	return &user
+}
+
+func (s *PostgresStorage) GetUserByEmail(email string) *models.User {
+	var user models.User
+	if err := s.scoped(s.db).Where("email = ?", email).First(&user).Error; err != nil {
+		log.Printf("Error getting user by email: %v", err)
+		return nil
+	}
+	return &user
+}
+
+func (s *PostgresStorage) UpdateUser(user *models.User) error {
+	result := s.scoped(s.db.Model(user)).Select("*").Omit("id", "created_at", "realm", "username", "email").Updates(user)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListUsers() ([]models.User, error) {
+	var users []models.User
+	err := s.scoped(s.db).Order("id").Find(&users).Error
+	return users, err
+}
+
+// DeleteUser removes the rows for good rather than soft deleting them, as
+// the unique indexes would keep the username and email taken otherwise.
+func (s *PostgresStorage) DeleteUser(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.scoped(tx.Unscoped()).Where("user_id = ?", id).Delete(&models.WebAuthnCredential{}).Error; err != nil {
+			return err
+		}
+		if err := s.scoped(tx).Where("user_id = ?", id).Delete(&models.FederatedIdentity{}).Error; err != nil {
+			return err
+		}
+		return s.scoped(tx.Unscoped()).Where("id = ?", id).Delete(&models.User{}).Error
+	})
+}
+
 func (s *PostgresStorage) StoreClient(client *models.Client) error {
 	// Log the client data before storing
 	log.Printf("Storing client with RedirectURIs: %v, GrantTypes: %v", client.RedirectURIs, client.GrantTypes)
 
-	// Generate client credentials
+	// Generate client ID; the secret hash is set by the caller
 	client.ClientID = utils.GenerateRandomString(24)
-	client.Secret = utils.GenerateRandomString(32)
+	client.Realm = s.realm
 
 	// Ensure arrays are initialized
 	if len(client.RedirectURIs) == 0 {
@@ -58,67 +126,523 @@ func (s *PostgresStorage) StoreClient(client *models.Client) error {
 
 func (s *PostgresStorage) GetClient(clientID string) *models.Client {
 	var client models.Client
-	if err := s.db.Where("client_id = ?", clientID).First(&client).Error; err != nil {
+	if err := s.scoped(s.db).Where("client_id = ?", clientID).First(&client).Error; err != nil {
 		log.Printf("Error getting client: %v", err)
 		return nil
 	}
 	return &client
 }
 
-func (s *PostgresStorage) StoreAuthCode(code, clientID string, userID uint) error {
-	authCode := &models.AuthCode{
-		Code:      code,
-		ClientID:  clientID,
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(10 * time.Minute),
+func (s *PostgresStorage) UpdateClient(client *models.Client) error {
+	result := s.scoped(s.db.Model(client)).Select("*").Omit("id", "created_at", "realm").Updates(client)
+	if result.Error != nil {
+		return result.Error
 	}
-	return s.db.Create(authCode).Error
+	if result.RowsAffected == 0 {
+		return errors.New("client not found")
+	}
+	return nil
 }
 
-func (s *PostgresStorage) StoreAuthCodeWithPKCE(code, clientID string, userID uint, codeChallenge, codeChallengeMethod string) error {
-	authCode := &models.AuthCode{
-		Code:                code,
-		ClientID:            clientID,
-		UserID:             userID,
-		ExpiresAt:          time.Now().Add(10 * time.Minute),
-		CodeChallenge:      codeChallenge,
-		CodeChallengeMethod: codeChallengeMethod,
+// MigrateClientSecrets hashes client secrets left in the legacy plaintext
+// "secret" column and then drops that column. It is a no-op once the
+// column is gone.
+func (s *PostgresStorage) MigrateClientSecrets() error {
+	migrator := s.db.Migrator()
+	if !migrator.HasColumn(&models.Client{}, "secret") {
+		return nil
 	}
+
+	type legacyClient struct {
+		ID     uint
+		Secret string
+	}
+	var legacy []legacyClient
+	if err := s.db.Table("clients").Select("id, secret").Where("secret <> ''").Find(&legacy).Error; err != nil {
+		return err
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for _, c := range legacy {
+			if err := tx.Table("clients").Where("id = ?", c.ID).Update("secret_hash", utils.HashSecret(c.Secret)).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropColumn(&models.Client{}, "secret")
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Hashed %d legacy client secrets", len(legacy))
+	return nil
+}
+
+func (s *PostgresStorage) StoreAuthCodeGrant(code string, authCode *models.AuthCode) error {
+	authCode.CodeHash = utils.HashToken(code)
+	authCode.Realm = s.realm
+	authCode.ExpiresAt = time.Now().Add(10 * time.Minute)
 	return s.db.Create(authCode).Error
 }
 
 func (s *PostgresStorage) GetAuthCode(code string) *models.AuthCode {
+	// Mark the auth code as used in the same statement that finds it, so
+	// concurrent exchanges of one code can't both succeed
 	var authCode models.AuthCode
-	if err := s.db.Where("code = ? AND expires_at > ? AND used = ?", code, time.Now(), false).First(&authCode).Error; err != nil {
-		log.Printf("Error getting auth code: %v", err)
+	result := s.scoped(s.db.Model(&authCode)).Clauses(clause.Returning{}).
+		Where("code_hash = ? AND expires_at > ? AND used = ?", utils.HashToken(code), time.Now(), false).
+		Update("used", true)
+	if result.Error != nil {
+		log.Printf("Error getting auth code: %v", result.Error)
+		return nil
+	}
+	if result.RowsAffected == 0 {
 		return nil
 	}
-
-	// Mark the auth code as used
-	s.db.Model(&authCode).Update("used", true)
 
 	return &authCode
 }
 
-func (s *PostgresStorage) StoreRefreshToken(token string, userID uint, clientID string) error {
-	refreshToken := &models.RefreshToken{
-		Token:     token,
-		UserID:    userID,
-		ClientID:  clientID,
-		ExpiresAt: time.Now().Add(24 * time.Hour * 30), // 30 days
-	}
+// StoreRefreshToken stores refreshToken under the keyed hash of token.
+func (s *PostgresStorage) StoreRefreshToken(token string, refreshToken *models.RefreshToken) error {
+	refreshToken.TokenHash = utils.HashToken(token)
+	refreshToken.Realm = s.realm
 	return s.db.Create(refreshToken).Error
 }
 
 func (s *PostgresStorage) GetRefreshToken(token string) *models.RefreshToken {
 	var refreshToken models.RefreshToken
-	if err := s.db.Where("token = ? AND expires_at > ?", token, time.Now()).First(&refreshToken).Error; err != nil {
+	if err := s.scoped(s.db).Where("token_hash = ? AND expires_at > ? AND absolute_expires_at > ?", utils.HashToken(token), time.Now(), time.Now()).First(&refreshToken).Error; err != nil {
 		log.Printf("Error getting refresh token: %v", err)
 		return nil
 	}
 	return &refreshToken
 }
 
+func (s *PostgresStorage) UpdateRefreshTokenExpiry(token string, expiresAt time.Time) error {
+	return s.scoped(s.db.Model(&models.RefreshToken{})).Where("token_hash = ?", utils.HashToken(token)).Update("expires_at", expiresAt).Error
+}
+
 func (s *PostgresStorage) DeleteRefreshToken(token string) error {
-	return s.db.Where("token = ?", token).Delete(&models.RefreshToken{}).Error
+	return s.scoped(s.db).Where("token_hash = ?", utils.HashToken(token)).Delete(&models.RefreshToken{}).Error
+}
+
+func (s *PostgresStorage) DeleteRefreshTokensForUser(userID uint) (int64, error) {
+	result := s.scoped(s.db).Where("user_id = ?", userID).Delete(&models.RefreshToken{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *PostgresStorage) RotateRefreshToken(oldToken, newToken string, refreshToken *models.RefreshToken) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := s.scoped(tx).Where("token_hash = ?", utils.HashToken(oldToken)).Delete(&models.RefreshToken{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenNotFound
+		}
+		refreshToken.TokenHash = utils.HashToken(newToken)
+		refreshToken.Realm = s.realm
+		return tx.Create(refreshToken).Error
+	})
+}
+
+func (s *PostgresStorage) PurgeAuthCodes(now time.Time, limit int) (int64, error) {
+	ids := s.db.Unscoped().Model(&models.AuthCode{}).Select("id").
+		Where("expires_at <= ? OR used = ? OR deleted_at IS NOT NULL", now, true).Limit(limit)
+	result := s.db.Unscoped().Where("id IN (?)", ids).Delete(&models.AuthCode{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *PostgresStorage) PurgeRefreshTokens(now time.Time, limit int) (int64, error) {
+	ids := s.db.Unscoped().Model(&models.RefreshToken{}).Select("id").
+		Where("expires_at <= ? OR absolute_expires_at <= ? OR deleted_at IS NOT NULL", now, now).Limit(limit)
+	result := s.db.Unscoped().Where("id IN (?)", ids).Delete(&models.RefreshToken{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *PostgresStorage) StoreDataKey(key *models.DataKey) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if key.Active {
+			if err := tx.Model(&models.DataKey{}).Where("active = ?", true).Update("active", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(key).Error
+	})
+}
+
+func (s *PostgresStorage) GetDataKey(keyID string) *models.DataKey {
+	var key models.DataKey
+	if err := s.db.Where("key_id = ?", keyID).First(&key).Error; err != nil {
+		log.Printf("Error getting data key: %v", err)
+		return nil
+	}
+	return &key
+}
+
+func (s *PostgresStorage) GetActiveDataKey() *models.DataKey {
+	var key models.DataKey
+	if err := s.db.Where("active = ?", true).Order("id DESC").First(&key).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("Error getting active data key: %v", err)
+		}
+		return nil
+	}
+	return &key
+}
+
+func (s *PostgresStorage) ListDataKeys() ([]models.DataKey, error) {
+	var keys []models.DataKey
+	err := s.db.Order("id").Find(&keys).Error
+	return keys, err
+}
+
+func (s *PostgresStorage) UpdateDataKey(key *models.DataKey) error {
+	return s.db.Save(key).Error
+}
+
+func (s *PostgresStorage) StoreWebAuthnCredential(credential *models.WebAuthnCredential) error {
+	credential.Realm = s.realm
+	if err := s.db.Create(credential).Error; err != nil {
+		// Drivers word unique violations differently; look for the culprit
+		var count int64
+		if s.scoped(s.db.Model(&models.WebAuthnCredential{})).
+			Where("credential_id = ?", credential.CredentialID).Count(&count).Error == nil && count > 0 {
+			return ErrCredentialExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListWebAuthnCredentials(userID uint) ([]models.WebAuthnCredential, error) {
+	var credentials []models.WebAuthnCredential
+	err := s.scoped(s.db).Where("user_id = ?", userID).Order("id").Find(&credentials).Error
+	return credentials, err
+}
+
+func (s *PostgresStorage) UpdateWebAuthnCredential(credential *models.WebAuthnCredential) error {
+	credential.UpdatedAt = time.Now()
+	result := s.scoped(s.db.Model(&models.WebAuthnCredential{})).
+		Where("credential_id = ?", credential.CredentialID).
+		Updates(map[string]interface{}{
+			"name":         credential.Name,
+			"sign_count":   credential.SignCount,
+			"backup_state": credential.BackupState,
+			"last_used_at": credential.LastUsedAt,
+			"updated_at":   credential.UpdatedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("credential not found")
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential removes the row for good, so the same
+// authenticator can be registered again.
+func (s *PostgresStorage) DeleteWebAuthnCredential(credentialID string) error {
+	return s.scoped(s.db.Unscoped()).Where("credential_id = ?", credentialID).Delete(&models.WebAuthnCredential{}).Error
+}
+
+func (s *PostgresStorage) StoreFederatedIdentity(identity *models.FederatedIdentity) error {
+	identity.Realm = s.realm
+	if err := s.db.Create(identity).Error; err != nil {
+		if s.GetFederatedIdentity(identity.Provider, identity.Subject) != nil {
+			return ErrIdentityLinked
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetFederatedIdentity(provider, subject string) *models.FederatedIdentity {
+	var identity models.FederatedIdentity
+	if err := s.scoped(s.db).Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("Error getting federated identity: %v", err)
+		}
+		return nil
+	}
+	return &identity
+}
+
+func (s *PostgresStorage) UpdateFederatedIdentity(identity *models.FederatedIdentity) error {
+	identity.UpdatedAt = time.Now()
+	result := s.scoped(s.db.Model(&models.FederatedIdentity{})).
+		Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).
+		Updates(map[string]interface{}{
+			"email":         identity.Email,
+			"last_login_at": identity.LastLoginAt,
+			"updated_at":    identity.UpdatedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("federated identity not found")
+	}
+	return nil
+}
+
+func (s *PostgresStorage) StoreSAMLServiceProvider(provider *models.SAMLServiceProvider) error {
+	provider.Realm = s.realm
+	if err := s.db.Create(provider).Error; err != nil {
+		if s.GetSAMLServiceProvider(provider.EntityID) != nil {
+			return ErrServiceProviderExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetSAMLServiceProvider(entityID string) *models.SAMLServiceProvider {
+	var provider models.SAMLServiceProvider
+	if err := s.scoped(s.db).Where("entity_id = ?", entityID).First(&provider).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("Error getting SAML service provider: %v", err)
+		}
+		return nil
+	}
+	return &provider
+}
+
+func (s *PostgresStorage) ListSAMLServiceProviders() ([]models.SAMLServiceProvider, error) {
+	var providers []models.SAMLServiceProvider
+	err := s.scoped(s.db).Order("id").Find(&providers).Error
+	return providers, err
+}
+
+func (s *PostgresStorage) UpdateSAMLServiceProvider(provider *models.SAMLServiceProvider) error {
+	provider.UpdatedAt = time.Now()
+	result := s.scoped(s.db.Model(&models.SAMLServiceProvider{})).
+		Where("entity_id = ?", provider.EntityID).
+		Updates(map[string]interface{}{
+			"metadata":       provider.Metadata,
+			"name_id_format": provider.NameIDFormat,
+			"attributes":     provider.Attributes,
+			"updated_at":     provider.UpdatedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("service provider not found")
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteSAMLServiceProvider(entityID string) error {
+	return s.scoped(s.db).Where("entity_id = ?", entityID).Delete(&models.SAMLServiceProvider{}).Error
+}
+
+func (s *PostgresStorage) StoreGroup(group *models.Group) error {
+	group.Realm = s.realm
+	if err := s.db.Create(group).Error; err != nil {
+		if s.groupNameTaken(group.DisplayName, 0) {
+			return ErrGroupExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetGroup(id uint) *models.Group {
+	var group models.Group
+	if err := s.scoped(s.db).Where("id = ?", id).First(&group).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("Error getting group: %v", err)
+		}
+		return nil
+	}
+	return &group
+}
+
+func (s *PostgresStorage) ListGroups() ([]models.Group, error) {
+	var groups []models.Group
+	err := s.scoped(s.db).Order("id").Find(&groups).Error
+	return groups, err
+}
+
+func (s *PostgresStorage) UpdateGroup(group *models.Group) error {
+	group.UpdatedAt = time.Now()
+	result := s.scoped(s.db.Model(&models.Group{})).
+		Where("id = ?", group.ID).
+		Updates(map[string]interface{}{
+			"display_name": group.DisplayName,
+			"external_id":  group.ExternalID,
+			"members":      group.Members,
+			"updated_at":   group.UpdatedAt,
+		})
+	if result.Error != nil {
+		if s.groupNameTaken(group.DisplayName, group.ID) {
+			return ErrGroupExists
+		}
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("group not found")
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteGroup(id uint) error {
+	return s.scoped(s.db).Where("id = ?", id).Delete(&models.Group{}).Error
+}
+
+// groupNameTaken reports whether a group other than exceptID has the
+// display name; drivers word unique violations differently, so this is
+// how a failed write is explained.
+func (s *PostgresStorage) groupNameTaken(displayName string, exceptID uint) bool {
+	var count int64
+	err := s.scoped(s.db.Model(&models.Group{})).
+		Where("display_name = ? AND id <> ?", displayName, exceptID).Count(&count).Error
+	return err == nil && count > 0
+}
+
+func (s *PostgresStorage) RecordLoginFailure(key string, now time.Time, window time.Duration) (*models.LoginAttempt, error) {
+	attempt := &models.LoginAttempt{
+		Realm:          s.realm,
+		Key:            key,
+		Failures:       1,
+		FirstFailureAt: now,
+		LastFailureAt:  now,
+		ExpiresAt:      now.Add(window),
+	}
+	// An existing count either goes up or, once its window has passed,
+	// starts over; the upsert does both atomically
+	restart := func(fresh, kept string, args ...interface{}) clause.Expr {
+		return gorm.Expr("CASE WHEN login_attempts.expires_at <= ? THEN "+fresh+" ELSE "+kept+" END",
+			append([]interface{}{now}, args...)...)
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "realm"}, {Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":         restart("1", "login_attempts.failures + 1"),
+			"first_failure_at": restart("?", "login_attempts.first_failure_at", now),
+			"expires_at":       restart("?", "login_attempts.expires_at", now.Add(window)),
+			"last_failure_at":  now,
+		}),
+	}).Create(attempt).Error
+	if err != nil {
+		return nil, err
+	}
+	if attempt = s.GetLoginAttempt(key); attempt == nil {
+		return nil, errors.New("login attempt vanished after recording")
+	}
+	return attempt, nil
+}
+
+func (s *PostgresStorage) GetLoginAttempt(key string) *models.LoginAttempt {
+	var attempt models.LoginAttempt
+	if err := s.scoped(s.db).Where("key = ?", key).First(&attempt).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error getting login attempt: %v", err)
+		}
+		return nil
+	}
+	return &attempt
+}
+
+func (s *PostgresStorage) LockLogin(key string, until time.Time) error {
+	now := time.Now()
+	attempt := &models.LoginAttempt{Realm: s.realm, Key: key, ExpiresAt: now, LockedUntil: &until}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "realm"}, {Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"locked_until": until}),
+	}).Create(attempt).Error
+}
+
+func (s *PostgresStorage) ClearLoginAttempts(key string) error {
+	return s.scoped(s.db).Where("key = ?", key).Delete(&models.LoginAttempt{}).Error
+}
+
+func (s *PostgresStorage) PurgeLoginAttempts(now time.Time, limit int) (int64, error) {
+	ids := s.db.Model(&models.LoginAttempt{}).Select("id").
+		Where("expires_at <= ? AND (locked_until IS NULL OR locked_until <= ?)", now, now).Limit(limit)
+	result := s.db.Where("id IN (?)", ids).Delete(&models.LoginAttempt{})
+	return result.RowsAffected, result.Error
+}
+
+// TryLock takes a session-level advisory lock keyed by the hash of name.
+// The lock lives on a dedicated connection that is held until release.
+func (s *PostgresStorage) TryLock(name string) (func(), bool, error) {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	release := func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", name); err != nil {
+			log.Printf("Error releasing advisory lock %s: %v", name, err)
+		}
+		conn.Close()
+	}
+	return release, true, nil
+}
+
+// MigrateTokenHashes replaces the legacy cleartext auth code and refresh
+// token columns with their keyed hashes. Each table is backfilled and its
+// cleartext column dropped in one transaction; tables already migrated
+// are skipped.
+func (s *PostgresStorage) MigrateTokenHashes() error {
+	if err := s.migrateTokenHashColumn(&models.AuthCode{}, "auth_codes", "code", "code_hash"); err != nil {
+		return err
+	}
+	return s.migrateTokenHashColumn(&models.RefreshToken{}, "refresh_tokens", "token", "token_hash")
+}
+
+func (s *PostgresStorage) migrateTokenHashColumn(model interface{}, table, column, hashColumn string) error {
+	if !s.db.Migrator().HasColumn(model, column) {
+		return nil
+	}
+
+	type legacyRow struct {
+		ID    uint
+		Value string
+	}
+
+	migrated := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var rows []legacyRow
+		err := tx.Table(table).Select("id, "+column+" AS value").Where(column+" <> ''").
+			FindInBatches(&rows, 500, func(_ *gorm.DB, _ int) error {
+				for _, row := range rows {
+					if err := tx.Table(table).Where("id = ?", row.ID).Update(hashColumn, utils.HashToken(row.Value)).Error; err != nil {
+						return err
+					}
+				}
+				migrated += len(rows)
+				return nil
+			}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(model, column)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Hashed %d legacy values in %s.%s", migrated, table, column)
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,150 @@
+package storage_test
+
+import (
+	"context"
+	"oauth2-provider/config"
+	"oauth2-provider/migrations"
+	"oauth2-provider/storage"
+	"oauth2-provider/storage/storagetest"
+	"oauth2-provider/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		db, err := config.OpenSQLite(filepath.Join(t.TempDir(), "oauth2.db"), logger.Default.LogMode(logger.Silent))
+		if err != nil {
+			t.Fatalf("failed to open sqlite: %v", err)
+		}
+		migrateTestDB(t, db)
+		t.Cleanup(func() {
+			if sqlDB, err := db.DB(); err == nil {
+				sqlDB.Close()
+			}
+		})
+		return storage.NewSQLiteStorage(db)
+	})
+}
+
+// TestRedisStorage runs against the Redis database in TEST_REDIS_URL, for
+// example a local redis-server. The database is flushed before every test.
+func TestRedisStorage(t *testing.T) {
+	client := testRedisClient(t)
+	storagetest.RunWithOptions(t, func(t *testing.T) storage.Store {
+		flushRedis(t, client)
+		return storage.NewRedisStorage(client)
+	}, storagetest.Options{ExpiresNatively: true})
+}
+
+func TestHybridStorage(t *testing.T) {
+	client := testRedisClient(t)
+	storagetest.RunWithOptions(t, func(t *testing.T) storage.Store {
+		flushRedis(t, client)
+		return storage.NewHybridStorage(storage.NewMemoryStorage(), storage.NewRedisStorage(client))
+	}, storagetest.Options{ExpiresNatively: true})
+}
+
+func testRedisClient(t *testing.T) *redis.Client {
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL not set")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatalf("invalid TEST_REDIS_URL: %v", err)
+	}
+	client := redis.NewClient(opts)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func flushRedis(t *testing.T, client *redis.Client) {
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+}
+
+// TestPostgresStorage runs against the database in TEST_DATABASE_URL. The
+// tables it uses are truncated before every test, so never point it at a
+// database holding real data.
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	migrateTestDB(t, db)
+
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		if err := db.Exec("TRUNCATE users, clients, auth_codes, refresh_tokens, data_keys, webauthn_credentials, login_attempts, federated_identities, saml_service_providers, groups RESTART IDENTITY").Error; err != nil {
+			t.Fatalf("failed to truncate tables: %v", err)
+		}
+		return storage.NewPostgresStorage(db)
+	})
+}
+
+func migrateTestDB(t *testing.T, db *gorm.DB) {
+	migrator, err := migrations.New(db)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if _, err := migrator.Up(0); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+}
+
+// TestRefreshTokenAbsoluteExpiryBackfill upgrades a database holding a
+// refresh token from before absolute expiries were recorded, which must
+// keep working until its idle expiry and then be purged.
+func TestRefreshTokenAbsoluteExpiryBackfill(t *testing.T) {
+	db, err := config.OpenSQLite(filepath.Join(t.TempDir(), "oauth2.db"), logger.Default.LogMode(logger.Silent))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	migrator, err := migrations.New(db)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if _, err := migrator.Up(12); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	expiresAt := time.Now().Add(time.Hour).UTC()
+	if err := db.Exec("INSERT INTO refresh_tokens (realm, token_hash, user_id, client_id, expires_at) VALUES (?, ?, ?, ?, ?)",
+		"default", utils.HashToken("old-token"), 1, "app", expiresAt).Error; err != nil {
+		t.Fatalf("failed to insert refresh token: %v", err)
+	}
+	migrateTestDB(t, db)
+
+	store := storage.NewSQLiteStorage(db)
+	token := store.GetRefreshToken("old-token")
+	if token == nil {
+		t.Fatal("GetRefreshToken returned nil for a token issued before the upgrade")
+	}
+	if !token.AbsoluteExpiresAt.Equal(token.ExpiresAt) {
+		t.Errorf("AbsoluteExpiresAt = %v, want the idle expiry %v", token.AbsoluteExpiresAt, token.ExpiresAt)
+	}
+	if purged, err := store.PurgeRefreshTokens(time.Now(), 100); err != nil || purged != 0 {
+		t.Errorf("PurgeRefreshTokens before expiry = %d, %v; want 0", purged, err)
+	}
+	if purged, err := store.PurgeRefreshTokens(expiresAt.Add(time.Second), 100); err != nil || purged != 1 {
+		t.Errorf("PurgeRefreshTokens after expiry = %d, %v; want 1", purged, err)
+	}
+}
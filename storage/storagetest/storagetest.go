@@ -0,0 +1,1559 @@
+// Package storagetest is a conformance suite for storage.Store
+// implementations. Backends call Run from their own tests to prove they
+// match the semantics the services rely on.
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"oauth2-provider/models"
+	"oauth2-provider/storage"
+	"oauth2-provider/utils"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// NewStore returns an empty store for a single test. Implementations should
+// register any cleanup with t.Cleanup.
+type NewStore func(t *testing.T) storage.Store
+
+// Options describe how a backend differs from what the suite expects by
+// default.
+type Options struct {
+	// ExpiresNatively is set for backends, like Redis, that expire codes,
+	// tokens and login attempts themselves, so purging finds nothing to
+	// remove. The expired records must be gone all the same.
+	ExpiresNatively bool
+}
+
+// Run runs the full conformance suite against stores created by newStore.
+func Run(t *testing.T, newStore NewStore) {
+	RunWithOptions(t, newStore, Options{})
+}
+
+// RunWithOptions runs the full conformance suite against stores created by
+// newStore, adjusted by opts.
+func RunWithOptions(t *testing.T, newStore NewStore, opts Options) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, newStore) })
+	t.Run("Clients", func(t *testing.T) { testClients(t, newStore) })
+	t.Run("AuthCodes", func(t *testing.T) { testAuthCodes(t, newStore, opts) })
+	t.Run("RefreshTokens", func(t *testing.T) { testRefreshTokens(t, newStore, opts) })
+	t.Run("DataKeys", func(t *testing.T) { testDataKeys(t, newStore) })
+	t.Run("WebAuthnCredentials", func(t *testing.T) { testWebAuthnCredentials(t, newStore) })
+	t.Run("FederatedIdentities", func(t *testing.T) { testFederatedIdentities(t, newStore) })
+	t.Run("SAMLServiceProviders", func(t *testing.T) { testSAMLServiceProviders(t, newStore) })
+	t.Run("Groups", func(t *testing.T) { testGroups(t, newStore) })
+	t.Run("LoginAttempts", func(t *testing.T) { testLoginAttempts(t, newStore, opts) })
+	t.Run("Realms", func(t *testing.T) { testRealms(t, newStore) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newStore) })
+}
+
+func testUsers(t *testing.T, newStore NewStore) {
+	t.Run("StoreAndGet", func(t *testing.T) {
+		store := newStore(t)
+		user := &models.User{Username: "alice", Password: "hash", Email: "alice@example.com"}
+		if err := store.StoreUser(user); err != nil {
+			t.Fatalf("StoreUser: %v", err)
+		}
+		if user.ID == 0 {
+			t.Fatal("StoreUser did not assign an ID")
+		}
+
+		got := store.GetUserByUsername("alice")
+		if got == nil {
+			t.Fatal("GetUserByUsername returned nil for a stored user")
+		}
+		if got.ID != user.ID || got.Email != user.Email || got.Password != user.Password {
+			t.Errorf("GetUserByUsername = %+v, want %+v", got, user)
+		}
+	})
+
+	t.Run("GetByIDAndEmail", func(t *testing.T) {
+		store := newStore(t)
+		user := mustStoreUser(t, store, "alice", "alice@example.com")
+
+		if got := store.GetUser(user.ID); got == nil || got.Username != "alice" {
+			t.Errorf("GetUser = %+v, want alice", got)
+		}
+		if got := store.GetUserByEmail("alice@example.com"); got == nil || got.ID != user.ID {
+			t.Errorf("GetUserByEmail = %+v, want user %d", got, user.ID)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		store := newStore(t)
+		if got := store.GetUserByUsername("nobody"); got != nil {
+			t.Errorf("GetUserByUsername = %+v, want nil", got)
+		}
+		if got := store.GetUserByEmail("nobody@example.com"); got != nil {
+			t.Errorf("GetUserByEmail = %+v, want nil", got)
+		}
+		if got := store.GetUser(12345); got != nil {
+			t.Errorf("GetUser = %+v, want nil", got)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		user := mustStoreUser(t, store, "alice", "alice@example.com")
+
+		sentAt := time.Now().Truncate(time.Second)
+		user.EmailVerified = true
+		user.VerificationSentAt = &sentAt
+		user.Password = "new-hash"
+		user.PasswordHistory = "old-hash-1 old-hash-2"
+		user.TOTPSecret = "enc:v1:secret"
+		user.TOTPEnabled = true
+		user.TOTPLastStep = 42
+		user.RecoveryCodes = "hash-1 hash-2"
+		user.Source = models.SourceLDAP
+		user.Roles = "admin staff"
+		user.ExternalID = "hr-1001"
+		user.Disabled = true
+		user.Username = "mallory"
+		if err := store.UpdateUser(user); err != nil {
+			t.Fatalf("UpdateUser: %v", err)
+		}
+
+		got := store.GetUserByUsername("alice")
+		if got == nil {
+			t.Fatal("UpdateUser changed the username")
+		}
+		if !got.EmailVerified || got.Password != "new-hash" || got.PasswordHistory != "old-hash-1 old-hash-2" || got.TOTPSecret != "enc:v1:secret" ||
+			!got.TOTPEnabled || got.TOTPLastStep != 42 || got.RecoveryCodes != "hash-1 hash-2" || got.Source != models.SourceLDAP || got.Roles != "admin staff" ||
+			got.ExternalID != "hr-1001" || !got.Disabled {
+			t.Errorf("user not updated: %+v", got)
+		}
+		if got.VerificationSentAt == nil || !got.VerificationSentAt.Equal(sentAt) {
+			t.Errorf("VerificationSentAt = %v, want %v", got.VerificationSentAt, sentAt)
+		}
+		if store.GetUserByUsername("mallory") != nil {
+			t.Error("UpdateUser changed the username")
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		store := newStore(t)
+		if users, err := store.ListUsers(); err != nil || len(users) != 0 {
+			t.Errorf("ListUsers on an empty store = %+v, %v", users, err)
+		}
+		alice := mustStoreUser(t, store, "alice", "alice@example.com")
+		bob := mustStoreUser(t, store, "bob", "bob@example.com")
+
+		users, err := store.ListUsers()
+		if err != nil {
+			t.Fatalf("ListUsers: %v", err)
+		}
+		if len(users) != 2 || users[0].ID != alice.ID || users[1].ID != bob.ID {
+			t.Errorf("ListUsers = %+v, want alice and bob oldest first", users)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		alice := mustStoreUser(t, store, "alice", "alice@example.com")
+		bob := mustStoreUser(t, store, "bob", "bob@example.com")
+		mustStoreCredential(t, store, alice.ID, "cred-1")
+		mustStoreCredential(t, store, bob.ID, "cred-2")
+		mustStoreIdentity(t, store, alice.ID, "corp", "sub-1")
+		if err := store.DeleteUser(alice.ID); err != nil {
+			t.Fatalf("DeleteUser: %v", err)
+		}
+
+		if got := store.GetUser(alice.ID); got != nil {
+			t.Errorf("GetUser after delete = %+v, want nil", got)
+		}
+		if credentials, err := store.ListWebAuthnCredentials(alice.ID); err != nil || len(credentials) != 0 {
+			t.Errorf("ListWebAuthnCredentials after delete = %+v, %v", credentials, err)
+		}
+		if got := store.GetFederatedIdentity("corp", "sub-1"); got != nil {
+			t.Errorf("GetFederatedIdentity after delete = %+v, want nil", got)
+		}
+		if credentials, err := store.ListWebAuthnCredentials(bob.ID); err != nil || len(credentials) != 1 {
+			t.Errorf("DeleteUser removed another user's credentials: %+v, %v", credentials, err)
+		}
+		if err := store.DeleteUser(alice.ID); err != nil {
+			t.Errorf("DeleteUser(unknown) = %v, want nil", err)
+		}
+		// The username, email address and upstream account are free again
+		user := mustStoreUser(t, store, "alice", "alice@example.com")
+		mustStoreIdentity(t, store, user.ID, "corp", "sub-1")
+	})
+
+	t.Run("UniqueUsername", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreUser(t, store, "alice", "alice@example.com")
+		if err := store.StoreUser(&models.User{Username: "alice", Password: "hash", Email: "other@example.com"}); err == nil {
+			t.Error("StoreUser accepted a duplicate username")
+		}
+	})
+
+	t.Run("UniqueEmail", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreUser(t, store, "alice", "alice@example.com")
+		if err := store.StoreUser(&models.User{Username: "bob", Password: "hash", Email: "alice@example.com"}); err == nil {
+			t.Error("StoreUser accepted a duplicate email")
+		}
+	})
+}
+
+func testClients(t *testing.T, newStore NewStore) {
+	t.Run("StoreAndGet", func(t *testing.T) {
+		store := newStore(t)
+		client := mustStoreClient(t, store)
+		if client.ClientID == "" {
+			t.Fatal("StoreClient did not assign a ClientID")
+		}
+
+		got := store.GetClient(client.ClientID)
+		if got == nil {
+			t.Fatal("GetClient returned nil for a stored client")
+		}
+		if got.SecretHash != client.SecretHash {
+			t.Errorf("SecretHash = %q, want %q", got.SecretHash, client.SecretHash)
+		}
+		if len(got.RedirectURIs) != 1 || got.RedirectURIs[0] != "https://app.example.com/callback" {
+			t.Errorf("RedirectURIs = %v", got.RedirectURIs)
+		}
+		if len(got.GrantTypes) == 0 {
+			t.Error("GrantTypes is empty")
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		store := newStore(t)
+		if got := store.GetClient("missing"); got != nil {
+			t.Errorf("GetClient = %+v, want nil", got)
+		}
+	})
+
+	t.Run("UniqueClientID", func(t *testing.T) {
+		store := newStore(t)
+		first := mustStoreClient(t, store)
+		second := mustStoreClient(t, store)
+		if first.ClientID == second.ClientID {
+			t.Errorf("two clients share ClientID %q", first.ClientID)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		client := mustStoreClient(t, store)
+
+		expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+		client.PreviousSecretHash = client.SecretHash
+		client.PreviousSecretExpiresAt = &expiresAt
+		client.SecretHash = utils.HashSecret("rotated")
+		if err := store.UpdateClient(client); err != nil {
+			t.Fatalf("UpdateClient: %v", err)
+		}
+
+		got := store.GetClient(client.ClientID)
+		if got == nil {
+			t.Fatal("GetClient returned nil after update")
+		}
+		if got.SecretHash != client.SecretHash || got.PreviousSecretHash != client.PreviousSecretHash {
+			t.Errorf("secret hashes not updated: %+v", got)
+		}
+		if got.PreviousSecretExpiresAt == nil || !got.PreviousSecretExpiresAt.Equal(expiresAt) {
+			t.Errorf("PreviousSecretExpiresAt = %v, want %v", got.PreviousSecretExpiresAt, expiresAt)
+		}
+	})
+}
+
+func testAuthCodes(t *testing.T, newStore NewStore, opts Options) {
+	t.Run("StoreAndConsume", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{
+			ClientID:            "client-1",
+			UserID:              7,
+			Scope:               "openid offline_access",
+			CodeChallenge:       "challenge",
+			CodeChallengeMethod: "S256",
+		}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+
+		got := store.GetAuthCode("code-1")
+		if got == nil {
+			t.Fatal("GetAuthCode returned nil for a stored code")
+		}
+		if got.ClientID != "client-1" || got.UserID != 7 || got.Scope != "openid offline_access" ||
+			got.CodeChallenge != "challenge" || got.CodeChallengeMethod != "S256" {
+			t.Errorf("GetAuthCode = %+v", got)
+		}
+		if !got.ExpiresAt.After(time.Now()) {
+			t.Errorf("ExpiresAt = %v, want a future time", got.ExpiresAt)
+		}
+	})
+
+	t.Run("StoreGrant", func(t *testing.T) {
+		store := newStore(t)
+		authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{
+			ClientID:            "client-1",
+			UserID:              7,
+			Scope:               "openid",
+			CodeChallenge:       "challenge",
+			CodeChallengeMethod: "S256",
+			Nonce:               "nonce",
+			AuthMethods:         "pwd otp mfa",
+			AuthTime:            &authTime,
+		}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+
+		got := store.GetAuthCode("code-1")
+		if got == nil {
+			t.Fatal("GetAuthCode returned nil for a stored code")
+		}
+		if got.UserID != 7 || got.Nonce != "nonce" || got.AuthMethods != "pwd otp mfa" ||
+			got.AuthTime == nil || !got.AuthTime.Equal(authTime) {
+			t.Errorf("GetAuthCode = %+v", got)
+		}
+		if !got.ExpiresAt.After(time.Now()) {
+			t.Errorf("ExpiresAt = %v, want a future time", got.ExpiresAt)
+		}
+	})
+
+	t.Run("NotStoredInClear", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{ClientID: "client-1", UserID: 7}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+		got := store.GetAuthCode("code-1")
+		if got == nil {
+			t.Fatal("GetAuthCode returned nil for a stored code")
+		}
+		if got.CodeHash != utils.HashToken("code-1") {
+			t.Errorf("CodeHash = %q, want the keyed hash of the code", got.CodeHash)
+		}
+	})
+
+	t.Run("SingleUse", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{ClientID: "client-1", UserID: 7}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+		if store.GetAuthCode("code-1") == nil {
+			t.Fatal("first GetAuthCode returned nil")
+		}
+		if got := store.GetAuthCode("code-1"); got != nil {
+			t.Errorf("second GetAuthCode = %+v, want nil", got)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		store := newStore(t)
+		for _, code := range []string{"used-1", "used-2", "used-3", "live"} {
+			if err := store.StoreAuthCodeGrant(code, &models.AuthCode{ClientID: "client-1", UserID: 7}); err != nil {
+				t.Fatalf("StoreAuthCodeGrant: %v", err)
+			}
+		}
+		for _, code := range []string{"used-1", "used-2", "used-3"} {
+			if store.GetAuthCode(code) == nil {
+				t.Fatalf("GetAuthCode(%q) returned nil", code)
+			}
+		}
+
+		purged := purgeAll(t, 2, func(limit int) (int64, error) { return store.PurgeAuthCodes(time.Now(), limit) })
+		if want := opts.purged(3); purged != want {
+			t.Errorf("purged %d auth codes, want %d", purged, want)
+		}
+		// Codes are unique, so a used one can only be stored again once
+		// it is gone
+		for _, code := range []string{"used-1", "used-2", "used-3"} {
+			if err := store.StoreAuthCodeGrant(code, &models.AuthCode{ClientID: "client-1", UserID: 7}); err != nil {
+				t.Errorf("StoreAuthCodeGrant(%q) after purge: %v", code, err)
+			}
+		}
+		if store.GetAuthCode("live") == nil {
+			t.Error("purge removed an unused, unexpired code")
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		store := newStore(t)
+		if got := store.GetAuthCode("missing"); got != nil {
+			t.Errorf("GetAuthCode = %+v, want nil", got)
+		}
+	})
+
+	t.Run("UniqueCode", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{ClientID: "client-1", UserID: 7}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{ClientID: "client-2", UserID: 8}); err == nil {
+			t.Error("StoreAuthCodeGrant accepted a duplicate code")
+		}
+	})
+}
+
+func testRefreshTokens(t *testing.T, newStore NewStore, opts Options) {
+	t.Run("StoreAndGet", func(t *testing.T) {
+		store := newStore(t)
+		stored := mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+
+		got := store.GetRefreshToken("token-1")
+		if got == nil {
+			t.Fatal("GetRefreshToken returned nil for a stored token")
+		}
+		if got.UserID != stored.UserID || got.ClientID != stored.ClientID || got.Scope != stored.Scope {
+			t.Errorf("GetRefreshToken = %+v, want %+v", got, stored)
+		}
+		if got.TokenHash != utils.HashToken("token-1") {
+			t.Errorf("TokenHash = %q, want the keyed hash of the token", got.TokenHash)
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		store := newStore(t)
+		if got := store.GetRefreshToken("missing"); got != nil {
+			t.Errorf("GetRefreshToken = %+v, want nil", got)
+		}
+	})
+
+	t.Run("IdleExpiry", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreRefreshToken(t, store, "token-1", -time.Minute, 24*time.Hour)
+		if got := store.GetRefreshToken("token-1"); got != nil {
+			t.Errorf("GetRefreshToken returned an idle-expired token: %+v", got)
+		}
+	})
+
+	t.Run("AbsoluteExpiry", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreRefreshToken(t, store, "token-1", time.Hour, -time.Minute)
+		if got := store.GetRefreshToken("token-1"); got != nil {
+			t.Errorf("GetRefreshToken returned an absolutely expired token: %+v", got)
+		}
+	})
+
+	t.Run("UpdateExpiry", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+
+		if err := store.UpdateRefreshTokenExpiry("token-1", time.Now().Add(2*time.Hour)); err != nil {
+			t.Fatalf("UpdateRefreshTokenExpiry: %v", err)
+		}
+		got := store.GetRefreshToken("token-1")
+		if got == nil || got.ExpiresAt.Before(time.Now().Add(90*time.Minute)) {
+			t.Errorf("expiry not extended: %+v", got)
+		}
+
+		if err := store.UpdateRefreshTokenExpiry("token-1", time.Now().Add(-time.Minute)); err != nil {
+			t.Fatalf("UpdateRefreshTokenExpiry: %v", err)
+		}
+		if got := store.GetRefreshToken("token-1"); got != nil {
+			t.Errorf("GetRefreshToken returned a token whose expiry was moved into the past: %+v", got)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+		if err := store.DeleteRefreshToken("token-1"); err != nil {
+			t.Fatalf("DeleteRefreshToken: %v", err)
+		}
+		if got := store.GetRefreshToken("token-1"); got != nil {
+			t.Errorf("GetRefreshToken returned a deleted token: %+v", got)
+		}
+	})
+
+	t.Run("DeleteForUser", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+		stored := mustStoreRefreshToken(t, store, "token-2", time.Hour, 24*time.Hour)
+		mustStoreRefreshToken(t, other, "other-realm", time.Hour, 24*time.Hour)
+		next := *stored
+		next.ID = 0
+		if err := store.RotateRefreshToken("token-2", "token-3", &next); err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+		if err := store.StoreRefreshToken("other-user", &models.RefreshToken{
+			UserID:            8,
+			ClientID:          "client-1",
+			ExpiresAt:         time.Now().Add(time.Hour),
+			AbsoluteExpiresAt: time.Now().Add(24 * time.Hour),
+		}); err != nil {
+			t.Fatalf("StoreRefreshToken: %v", err)
+		}
+
+		deleted, err := store.DeleteRefreshTokensForUser(stored.UserID)
+		if err != nil {
+			t.Fatalf("DeleteRefreshTokensForUser: %v", err)
+		}
+		if deleted != 2 {
+			t.Errorf("DeleteRefreshTokensForUser deleted %d tokens, want 2", deleted)
+		}
+		for _, token := range []string{"token-1", "token-3"} {
+			if got := store.GetRefreshToken(token); got != nil {
+				t.Errorf("GetRefreshToken(%q) returned a revoked token: %+v", token, got)
+			}
+		}
+		if store.GetRefreshToken("other-user") == nil {
+			t.Error("DeleteRefreshTokensForUser removed another user's token")
+		}
+		if other.GetRefreshToken("other-realm") == nil {
+			t.Error("DeleteRefreshTokensForUser removed a token from another realm")
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		store := newStore(t)
+		stored := mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+
+		next := &models.RefreshToken{
+			UserID:            stored.UserID,
+			ClientID:          stored.ClientID,
+			Scope:             stored.Scope,
+			ExpiresAt:         time.Now().Add(time.Hour),
+			AbsoluteExpiresAt: stored.AbsoluteExpiresAt,
+		}
+		if err := store.RotateRefreshToken("token-1", "token-2", next); err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+		if got := store.GetRefreshToken("token-1"); got != nil {
+			t.Errorf("GetRefreshToken returned the rotated-out token: %+v", got)
+		}
+		if got := store.GetRefreshToken("token-2"); got == nil || got.UserID != stored.UserID {
+			t.Errorf("GetRefreshToken(new) = %+v", got)
+		}
+
+		again := *next
+		again.ID = 0
+		if err := store.RotateRefreshToken("token-1", "token-3", &again); !errors.Is(err, storage.ErrRefreshTokenNotFound) {
+			t.Errorf("second RotateRefreshToken error = %v, want ErrRefreshTokenNotFound", err)
+		}
+		if got := store.GetRefreshToken("token-3"); got != nil {
+			t.Errorf("failed rotation stored a token: %+v", got)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		store := newStore(t)
+		expired := []string{"idle-expired", "absolute-expired", "both-expired"}
+		mustStoreRefreshToken(t, store, "idle-expired", -time.Minute, 24*time.Hour)
+		mustStoreRefreshToken(t, store, "absolute-expired", time.Hour, -time.Minute)
+		mustStoreRefreshToken(t, store, "both-expired", -time.Minute, -time.Minute)
+		mustStoreRefreshToken(t, store, "live", time.Hour, 24*time.Hour)
+
+		purged := purgeAll(t, 2, func(limit int) (int64, error) { return store.PurgeRefreshTokens(time.Now(), limit) })
+		if want := opts.purged(3); purged != want {
+			t.Errorf("purged %d refresh tokens, want %d", purged, want)
+		}
+		// Tokens are unique, so an expired one can only be stored again
+		// once it is gone
+		for _, token := range expired {
+			mustStoreRefreshToken(t, store, token, time.Hour, 24*time.Hour)
+		}
+		if store.GetRefreshToken("live") == nil {
+			t.Error("purge removed a live refresh token")
+		}
+
+		// Deleted tokens may be removed at once or kept until purged
+		mustStoreRefreshToken(t, store, "deleted", time.Hour, 24*time.Hour)
+		if err := store.DeleteRefreshToken("deleted"); err != nil {
+			t.Fatalf("DeleteRefreshToken: %v", err)
+		}
+		if purged := purgeAll(t, 2, func(limit int) (int64, error) { return store.PurgeRefreshTokens(time.Now(), limit) }); purged > 1 {
+			t.Errorf("purged %d refresh tokens after a delete, want at most 1", purged)
+		}
+		mustStoreRefreshToken(t, store, "deleted", time.Hour, 24*time.Hour)
+		for _, token := range append(expired, "live") {
+			if store.GetRefreshToken(token) == nil {
+				t.Errorf("purge after a delete removed the token %q", token)
+			}
+		}
+	})
+
+	t.Run("UniqueToken", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+		duplicate := &models.RefreshToken{
+			UserID:            8,
+			ClientID:          "client-2",
+			ExpiresAt:         time.Now().Add(time.Hour),
+			AbsoluteExpiresAt: time.Now().Add(24 * time.Hour),
+		}
+		if err := store.StoreRefreshToken("token-1", duplicate); err == nil {
+			t.Error("StoreRefreshToken accepted a duplicate token")
+		}
+	})
+}
+
+func testDataKeys(t *testing.T, newStore NewStore) {
+	t.Run("StoreAndGet", func(t *testing.T) {
+		store := newStore(t)
+		key := &models.DataKey{KeyID: "dk-1", MasterKeyID: "mk-1", WrappedKey: "wrapped", Active: true}
+		if err := store.StoreDataKey(key); err != nil {
+			t.Fatalf("StoreDataKey: %v", err)
+		}
+
+		got := store.GetDataKey("dk-1")
+		if got == nil {
+			t.Fatal("GetDataKey returned nil for a stored key")
+		}
+		if got.MasterKeyID != "mk-1" || got.WrappedKey != "wrapped" || !got.Active {
+			t.Errorf("GetDataKey = %+v", got)
+		}
+		if got := store.GetDataKey("missing"); got != nil {
+			t.Errorf("GetDataKey(missing) = %+v, want nil", got)
+		}
+	})
+
+	t.Run("NoActiveKey", func(t *testing.T) {
+		store := newStore(t)
+		if got := store.GetActiveDataKey(); got != nil {
+			t.Errorf("GetActiveDataKey = %+v, want nil", got)
+		}
+	})
+
+	t.Run("ActiveKeySwitches", func(t *testing.T) {
+		store := newStore(t)
+		for _, id := range []string{"dk-1", "dk-2"} {
+			if err := store.StoreDataKey(&models.DataKey{KeyID: id, MasterKeyID: "mk-1", WrappedKey: "wrapped", Active: true}); err != nil {
+				t.Fatalf("StoreDataKey: %v", err)
+			}
+		}
+
+		if got := store.GetActiveDataKey(); got == nil || got.KeyID != "dk-2" {
+			t.Errorf("GetActiveDataKey = %+v, want dk-2", got)
+		}
+		if got := store.GetDataKey("dk-1"); got == nil || got.Active {
+			t.Errorf("previous key still active: %+v", got)
+		}
+
+		keys, err := store.ListDataKeys()
+		if err != nil {
+			t.Fatalf("ListDataKeys: %v", err)
+		}
+		if len(keys) != 2 || keys[0].KeyID != "dk-1" || keys[1].KeyID != "dk-2" {
+			t.Errorf("ListDataKeys = %+v, want dk-1 then dk-2", keys)
+		}
+	})
+
+	t.Run("UniqueKeyID", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreDataKey(&models.DataKey{KeyID: "dk-1", MasterKeyID: "mk-1", WrappedKey: "wrapped"}); err != nil {
+			t.Fatalf("StoreDataKey: %v", err)
+		}
+		if err := store.StoreDataKey(&models.DataKey{KeyID: "dk-1", MasterKeyID: "mk-1", WrappedKey: "other"}); err == nil {
+			t.Error("StoreDataKey accepted a duplicate key ID")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		key := &models.DataKey{KeyID: "dk-1", MasterKeyID: "mk-1", WrappedKey: "wrapped", Active: true}
+		if err := store.StoreDataKey(key); err != nil {
+			t.Fatalf("StoreDataKey: %v", err)
+		}
+
+		key.MasterKeyID = "mk-2"
+		key.WrappedKey = "rewrapped"
+		if err := store.UpdateDataKey(key); err != nil {
+			t.Fatalf("UpdateDataKey: %v", err)
+		}
+		got := store.GetDataKey("dk-1")
+		if got == nil || got.MasterKeyID != "mk-2" || got.WrappedKey != "rewrapped" || !got.Active {
+			t.Errorf("GetDataKey after update = %+v", got)
+		}
+	})
+}
+
+func testWebAuthnCredentials(t *testing.T, newStore NewStore) {
+	t.Run("StoreAndList", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreCredential(t, store, 7, "cred-1")
+		mustStoreCredential(t, store, 7, "cred-2")
+		mustStoreCredential(t, store, 8, "cred-3")
+
+		got, err := store.ListWebAuthnCredentials(7)
+		if err != nil {
+			t.Fatalf("ListWebAuthnCredentials: %v", err)
+		}
+		if len(got) != 2 || got[0].CredentialID != "cred-1" || got[1].CredentialID != "cred-2" {
+			t.Fatalf("ListWebAuthnCredentials = %+v, want cred-1 and cred-2", got)
+		}
+		if got[0].ID == 0 || string(got[0].PublicKey) != "public-key" || got[0].AAGUID != "aaguid" ||
+			got[0].Transports != "usb nfc" || got[0].SignCount != 3 || !got[0].BackupEligible {
+			t.Errorf("credential not stored intact: %+v", got[0])
+		}
+	})
+
+	t.Run("NoCredentials", func(t *testing.T) {
+		store := newStore(t)
+		got, err := store.ListWebAuthnCredentials(7)
+		if err != nil || len(got) != 0 {
+			t.Errorf("ListWebAuthnCredentials = %+v, %v; want none", got, err)
+		}
+	})
+
+	t.Run("UniqueCredentialID", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreCredential(t, store, 7, "cred-1")
+		duplicate := &models.WebAuthnCredential{UserID: 8, CredentialID: "cred-1", PublicKey: []byte("other")}
+		if err := store.StoreWebAuthnCredential(duplicate); !errors.Is(err, storage.ErrCredentialExists) {
+			t.Errorf("StoreWebAuthnCredential(duplicate) = %v, want ErrCredentialExists", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		credential := mustStoreCredential(t, store, 7, "cred-1")
+
+		usedAt := time.Now().Truncate(time.Second)
+		credential.Name = "Laptop"
+		credential.SignCount = 9
+		credential.BackupState = true
+		credential.LastUsedAt = &usedAt
+		credential.PublicKey = []byte("forged")
+		if err := store.UpdateWebAuthnCredential(credential); err != nil {
+			t.Fatalf("UpdateWebAuthnCredential: %v", err)
+		}
+
+		got, err := store.ListWebAuthnCredentials(7)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("ListWebAuthnCredentials = %+v, %v", got, err)
+		}
+		if got[0].Name != "Laptop" || got[0].SignCount != 9 || !got[0].BackupState ||
+			got[0].LastUsedAt == nil || !got[0].LastUsedAt.Equal(usedAt) {
+			t.Errorf("credential not updated: %+v", got[0])
+		}
+		if string(got[0].PublicKey) != "public-key" {
+			t.Error("UpdateWebAuthnCredential changed the public key")
+		}
+
+		missing := &models.WebAuthnCredential{UserID: 7, CredentialID: "missing"}
+		if err := store.UpdateWebAuthnCredential(missing); err == nil {
+			t.Error("UpdateWebAuthnCredential accepted an unknown credential")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreCredential(t, store, 7, "cred-1")
+		mustStoreCredential(t, store, 7, "cred-2")
+		if err := store.DeleteWebAuthnCredential("cred-1"); err != nil {
+			t.Fatalf("DeleteWebAuthnCredential: %v", err)
+		}
+
+		got, err := store.ListWebAuthnCredentials(7)
+		if err != nil || len(got) != 1 || got[0].CredentialID != "cred-2" {
+			t.Errorf("ListWebAuthnCredentials after delete = %+v, %v", got, err)
+		}
+		// The authenticator can be registered again
+		mustStoreCredential(t, store, 7, "cred-1")
+	})
+}
+
+func testFederatedIdentities(t *testing.T, newStore NewStore) {
+	t.Run("StoreAndGet", func(t *testing.T) {
+		store := newStore(t)
+		identity := mustStoreIdentity(t, store, 7, "corp", "sub-1")
+		if identity.ID == 0 || identity.Realm != models.DefaultRealm {
+			t.Errorf("StoreFederatedIdentity did not set ID and realm: %+v", identity)
+		}
+
+		got := store.GetFederatedIdentity("corp", "sub-1")
+		if got == nil || got.ID != identity.ID || got.UserID != 7 || got.Email != "alice@example.com" {
+			t.Errorf("GetFederatedIdentity = %+v, want %+v", got, identity)
+		}
+		if got := store.GetFederatedIdentity("social", "sub-1"); got != nil {
+			t.Errorf("GetFederatedIdentity found the subject under another provider: %+v", got)
+		}
+		if got := store.GetFederatedIdentity("corp", "sub-2"); got != nil {
+			t.Errorf("GetFederatedIdentity(unknown) = %+v, want nil", got)
+		}
+	})
+
+	t.Run("UniqueSubject", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreIdentity(t, store, 7, "corp", "sub-1")
+		duplicate := &models.FederatedIdentity{UserID: 8, Provider: "corp", Subject: "sub-1"}
+		if err := store.StoreFederatedIdentity(duplicate); !errors.Is(err, storage.ErrIdentityLinked) {
+			t.Errorf("StoreFederatedIdentity(duplicate) = %v, want ErrIdentityLinked", err)
+		}
+		// A user may have accounts at several providers
+		mustStoreIdentity(t, store, 7, "social", "sub-1")
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		identity := mustStoreIdentity(t, store, 7, "corp", "sub-1")
+
+		loginAt := time.Now().Truncate(time.Second)
+		identity.Email = "alice@corp.example.com"
+		identity.LastLoginAt = &loginAt
+		identity.UserID = 8
+		if err := store.UpdateFederatedIdentity(identity); err != nil {
+			t.Fatalf("UpdateFederatedIdentity: %v", err)
+		}
+
+		got := store.GetFederatedIdentity("corp", "sub-1")
+		if got == nil || got.Email != "alice@corp.example.com" || got.LastLoginAt == nil || !got.LastLoginAt.Equal(loginAt) {
+			t.Errorf("federated identity not updated: %+v", got)
+		}
+		if got != nil && got.UserID != 7 {
+			t.Error("UpdateFederatedIdentity moved the link to another user")
+		}
+
+		missing := &models.FederatedIdentity{UserID: 7, Provider: "corp", Subject: "missing"}
+		if err := store.UpdateFederatedIdentity(missing); err == nil {
+			t.Error("UpdateFederatedIdentity accepted an unknown identity")
+		}
+	})
+}
+
+func testSAMLServiceProviders(t *testing.T, newStore NewStore) {
+	t.Run("StoreGetAndList", func(t *testing.T) {
+		store := newStore(t)
+		first := mustStoreSAMLProvider(t, store, "https://crm.example.com/saml")
+		if first.ID == 0 || first.Realm != models.DefaultRealm {
+			t.Errorf("StoreSAMLServiceProvider did not set ID and realm: %+v", first)
+		}
+		mustStoreSAMLProvider(t, store, "urn:example:wiki")
+
+		got := store.GetSAMLServiceProvider("https://crm.example.com/saml")
+		if got == nil || got.ID != first.ID || got.Metadata != first.Metadata || got.NameIDFormat != models.NameIDEmail || got.Attributes != "email=mail" {
+			t.Errorf("GetSAMLServiceProvider = %+v, want %+v", got, first)
+		}
+		if got := store.GetSAMLServiceProvider("https://unknown.example.com"); got != nil {
+			t.Errorf("GetSAMLServiceProvider(unknown) = %+v, want nil", got)
+		}
+
+		providers, err := store.ListSAMLServiceProviders()
+		if err != nil {
+			t.Fatalf("ListSAMLServiceProviders: %v", err)
+		}
+		if len(providers) != 2 || providers[0].EntityID != "https://crm.example.com/saml" || providers[1].EntityID != "urn:example:wiki" {
+			t.Errorf("ListSAMLServiceProviders = %+v, want both providers oldest first", providers)
+		}
+	})
+
+	t.Run("UniqueEntityID", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreSAMLProvider(t, store, "urn:example:wiki")
+		duplicate := &models.SAMLServiceProvider{EntityID: "urn:example:wiki", Metadata: "<other/>", NameIDFormat: models.NameIDPersistent}
+		if err := store.StoreSAMLServiceProvider(duplicate); !errors.Is(err, storage.ErrServiceProviderExists) {
+			t.Errorf("StoreSAMLServiceProvider(duplicate) = %v, want ErrServiceProviderExists", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		provider := mustStoreSAMLProvider(t, store, "urn:example:wiki")
+		provider.Metadata = "<updated/>"
+		provider.NameIDFormat = models.NameIDPersistent
+		provider.Attributes = "username=uid roles=groups"
+		if err := store.UpdateSAMLServiceProvider(provider); err != nil {
+			t.Fatalf("UpdateSAMLServiceProvider: %v", err)
+		}
+		got := store.GetSAMLServiceProvider("urn:example:wiki")
+		if got == nil || got.Metadata != "<updated/>" || got.NameIDFormat != models.NameIDPersistent || got.Attributes != "username=uid roles=groups" {
+			t.Errorf("service provider not updated: %+v", got)
+		}
+
+		missing := &models.SAMLServiceProvider{EntityID: "urn:example:missing", Metadata: "<x/>", NameIDFormat: models.NameIDEmail}
+		if err := store.UpdateSAMLServiceProvider(missing); err == nil {
+			t.Error("UpdateSAMLServiceProvider accepted an unknown provider")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreSAMLProvider(t, store, "urn:example:wiki")
+		mustStoreSAMLProvider(t, store, "urn:example:crm")
+		if err := store.DeleteSAMLServiceProvider("urn:example:wiki"); err != nil {
+			t.Fatalf("DeleteSAMLServiceProvider: %v", err)
+		}
+		if got := store.GetSAMLServiceProvider("urn:example:wiki"); got != nil {
+			t.Errorf("GetSAMLServiceProvider after delete = %+v, want nil", got)
+		}
+		providers, err := store.ListSAMLServiceProviders()
+		if err != nil || len(providers) != 1 || providers[0].EntityID != "urn:example:crm" {
+			t.Errorf("ListSAMLServiceProviders after delete = %+v, %v", providers, err)
+		}
+		if err := store.DeleteSAMLServiceProvider("urn:example:wiki"); err != nil {
+			t.Errorf("DeleteSAMLServiceProvider(unknown) = %v, want nil", err)
+		}
+		// The entity ID can be registered again
+		mustStoreSAMLProvider(t, store, "urn:example:wiki")
+	})
+}
+
+func testGroups(t *testing.T, newStore NewStore) {
+	t.Run("StoreGetAndList", func(t *testing.T) {
+		store := newStore(t)
+		first := mustStoreGroup(t, store, "engineering", "7 8")
+		if first.ID == 0 || first.Realm != models.DefaultRealm {
+			t.Errorf("StoreGroup did not set ID and realm: %+v", first)
+		}
+		mustStoreGroup(t, store, "sales", "")
+
+		got := store.GetGroup(first.ID)
+		if got == nil || got.DisplayName != "engineering" || got.ExternalID != "ext-engineering" || got.Members != "7 8" {
+			t.Errorf("GetGroup = %+v, want %+v", got, first)
+		}
+		if got := store.GetGroup(12345); got != nil {
+			t.Errorf("GetGroup(unknown) = %+v, want nil", got)
+		}
+
+		groups, err := store.ListGroups()
+		if err != nil {
+			t.Fatalf("ListGroups: %v", err)
+		}
+		if len(groups) != 2 || groups[0].DisplayName != "engineering" || groups[1].DisplayName != "sales" {
+			t.Errorf("ListGroups = %+v, want both groups oldest first", groups)
+		}
+	})
+
+	t.Run("UniqueDisplayName", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreGroup(t, store, "engineering", "")
+		duplicate := &models.Group{DisplayName: "engineering"}
+		if err := store.StoreGroup(duplicate); !errors.Is(err, storage.ErrGroupExists) {
+			t.Errorf("StoreGroup(duplicate) = %v, want ErrGroupExists", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		group := mustStoreGroup(t, store, "engineering", "7")
+		mustStoreGroup(t, store, "sales", "")
+
+		group.DisplayName = "platform"
+		group.ExternalID = "ext-platform"
+		group.Members = "7 9"
+		if err := store.UpdateGroup(group); err != nil {
+			t.Fatalf("UpdateGroup: %v", err)
+		}
+		got := store.GetGroup(group.ID)
+		if got == nil || got.DisplayName != "platform" || got.ExternalID != "ext-platform" || got.Members != "7 9" {
+			t.Errorf("group not updated: %+v", got)
+		}
+		// The old name is free again, and names stay unique
+		mustStoreGroup(t, store, "engineering", "")
+		group.DisplayName = "sales"
+		if err := store.UpdateGroup(group); !errors.Is(err, storage.ErrGroupExists) {
+			t.Errorf("UpdateGroup to a taken name = %v, want ErrGroupExists", err)
+		}
+		if got := store.GetGroup(group.ID); got == nil || got.DisplayName != "platform" {
+			t.Errorf("rejected rename changed the group: %+v", got)
+		}
+
+		missing := &models.Group{ID: 12345, DisplayName: "missing"}
+		if err := store.UpdateGroup(missing); err == nil {
+			t.Error("UpdateGroup accepted an unknown group")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		group := mustStoreGroup(t, store, "engineering", "")
+		mustStoreGroup(t, store, "sales", "")
+		if err := store.DeleteGroup(group.ID); err != nil {
+			t.Fatalf("DeleteGroup: %v", err)
+		}
+		if got := store.GetGroup(group.ID); got != nil {
+			t.Errorf("GetGroup after delete = %+v, want nil", got)
+		}
+		groups, err := store.ListGroups()
+		if err != nil || len(groups) != 1 || groups[0].DisplayName != "sales" {
+			t.Errorf("ListGroups after delete = %+v, %v", groups, err)
+		}
+		if err := store.DeleteGroup(group.ID); err != nil {
+			t.Errorf("DeleteGroup(unknown) = %v, want nil", err)
+		}
+		// The name can be used again
+		mustStoreGroup(t, store, "engineering", "")
+	})
+}
+
+func testLoginAttempts(t *testing.T, newStore NewStore, opts Options) {
+	t.Run("RecordAndGet", func(t *testing.T) {
+		store := newStore(t)
+		if got := store.GetLoginAttempt("user:alice"); got != nil {
+			t.Fatalf("GetLoginAttempt before any failure = %+v, want nil", got)
+		}
+
+		first := time.Now().Truncate(time.Second)
+		for i := 1; i <= 3; i++ {
+			now := first.Add(time.Duration(i-1) * time.Second)
+			got, err := store.RecordLoginFailure("user:alice", now, time.Minute)
+			if err != nil {
+				t.Fatalf("RecordLoginFailure: %v", err)
+			}
+			if got.Failures != i || !got.LastFailureAt.Equal(now) {
+				t.Errorf("failure %d recorded as %d at %v", i, got.Failures, got.LastFailureAt)
+			}
+		}
+
+		got := store.GetLoginAttempt("user:alice")
+		if got == nil {
+			t.Fatal("GetLoginAttempt returned nil")
+		}
+		if got.Key != "user:alice" || got.Failures != 3 || got.LockedUntil != nil {
+			t.Errorf("GetLoginAttempt = %+v", got)
+		}
+		if !got.FirstFailureAt.Equal(first) || !got.ExpiresAt.Equal(first.Add(time.Minute)) {
+			t.Errorf("window = %v to %v, want %v to %v", got.FirstFailureAt, got.ExpiresAt, first, first.Add(time.Minute))
+		}
+		if other := store.GetLoginAttempt("user:bob"); other != nil {
+			t.Errorf("GetLoginAttempt for another key = %+v, want nil", other)
+		}
+	})
+
+	t.Run("WindowStartsOver", func(t *testing.T) {
+		store := newStore(t)
+		start := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+		for i := 0; i < 3; i++ {
+			if _, err := store.RecordLoginFailure("ip:192.0.2.1", start, time.Minute); err != nil {
+				t.Fatalf("RecordLoginFailure: %v", err)
+			}
+		}
+
+		now := time.Now().Truncate(time.Second)
+		got, err := store.RecordLoginFailure("ip:192.0.2.1", now, time.Minute)
+		if err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if got.Failures != 1 || !got.FirstFailureAt.Equal(now) || !got.ExpiresAt.Equal(now.Add(time.Minute)) {
+			t.Errorf("failure after the window = %+v, want a new count", got)
+		}
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		store := newStore(t)
+		until := time.Now().Add(time.Hour).Truncate(time.Second)
+		if err := store.LockLogin("user:alice", until); err != nil {
+			t.Fatalf("LockLogin: %v", err)
+		}
+		got := store.GetLoginAttempt("user:alice")
+		if got == nil || got.LockedUntil == nil || !got.LockedUntil.Equal(until) {
+			t.Fatalf("GetLoginAttempt after LockLogin = %+v, want locked until %v", got, until)
+		}
+		if got.Failures != 0 {
+			t.Errorf("LockLogin recorded %d failures", got.Failures)
+		}
+
+		// Further failures keep the lock
+		got, err := store.RecordLoginFailure("user:alice", time.Now(), time.Minute)
+		if err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if got.Failures != 1 || got.LockedUntil == nil || !got.LockedUntil.Equal(until) {
+			t.Errorf("RecordLoginFailure on a locked key = %+v", got)
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		store := newStore(t)
+		if _, err := store.RecordLoginFailure("user:alice", time.Now(), time.Minute); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if err := store.LockLogin("user:alice", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("LockLogin: %v", err)
+		}
+		if err := store.ClearLoginAttempts("user:alice"); err != nil {
+			t.Fatalf("ClearLoginAttempts: %v", err)
+		}
+		if got := store.GetLoginAttempt("user:alice"); got != nil {
+			t.Errorf("GetLoginAttempt after ClearLoginAttempts = %+v, want nil", got)
+		}
+		if err := store.ClearLoginAttempts("user:nobody"); err != nil {
+			t.Errorf("ClearLoginAttempts of an unknown key: %v", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		store := newStore(t)
+		past := time.Now().Add(-time.Hour)
+		for _, key := range []string{"user:a", "user:b", "user:c"} {
+			if _, err := store.RecordLoginFailure(key, past, time.Minute); err != nil {
+				t.Fatalf("RecordLoginFailure: %v", err)
+			}
+		}
+		if _, err := store.RecordLoginFailure("user:live", time.Now(), time.Hour); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if _, err := store.RecordLoginFailure("user:locked", past, time.Minute); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if err := store.LockLogin("user:locked", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("LockLogin: %v", err)
+		}
+
+		purged := purgeAll(t, 2, func(limit int) (int64, error) { return store.PurgeLoginAttempts(time.Now(), limit) })
+		if want := opts.purged(3); purged != want {
+			t.Errorf("purged %d login attempts, want %d", purged, want)
+		}
+		for _, key := range []string{"user:a", "user:b", "user:c"} {
+			if got := store.GetLoginAttempt(key); got != nil {
+				t.Errorf("GetLoginAttempt(%q) after purge = %+v, want nil", key, got)
+			}
+		}
+		if store.GetLoginAttempt("user:live") == nil {
+			t.Error("purge removed a login attempt within its window")
+		}
+		if store.GetLoginAttempt("user:locked") == nil {
+			t.Error("purge removed a locked login attempt")
+		}
+	})
+}
+
+func testRealms(t *testing.T, newStore NewStore) {
+	t.Run("Users", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		alice := mustStoreUser(t, store, "alice", "alice@example.com")
+
+		if got := other.GetUserByUsername("alice"); got != nil {
+			t.Errorf("GetUserByUsername found a user from another realm: %+v", got)
+		}
+		if got := other.GetUser(alice.ID); got != nil {
+			t.Errorf("GetUser found a user from another realm: %+v", got)
+		}
+		// Usernames and emails only need to be unique within a realm
+		user := mustStoreUser(t, other, "alice", "alice@example.com")
+		if user.Realm != "other" {
+			t.Errorf("Realm = %q, want %q", user.Realm, "other")
+		}
+		if got := other.GetUserByUsername("alice"); got == nil || got.ID != user.ID {
+			t.Errorf("GetUserByUsername = %+v, want user %d", got, user.ID)
+		}
+		if got := store.GetUserByUsername("alice"); got == nil || got.ID == user.ID {
+			t.Errorf("GetUserByUsername in the default realm = %+v", got)
+		}
+	})
+
+	t.Run("Clients", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		client := mustStoreClient(t, store)
+
+		if got := other.GetClient(client.ClientID); got != nil {
+			t.Errorf("GetClient found a client from another realm: %+v", got)
+		}
+		client.SecretHash = utils.HashSecret("hijacked")
+		if err := other.UpdateClient(client); err == nil {
+			t.Error("UpdateClient changed a client from another realm")
+		}
+		if got := store.GetClient(client.ClientID); got == nil || got.SecretHash == client.SecretHash {
+			t.Errorf("client changed through another realm: %+v", got)
+		}
+	})
+
+	t.Run("AuthCodes", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		if err := store.StoreAuthCodeGrant("code", &models.AuthCode{ClientID: "client", UserID: 1, CodeChallenge: "challenge", CodeChallengeMethod: "S256"}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+
+		if got := other.GetAuthCode("code"); got != nil {
+			t.Errorf("GetAuthCode consumed a code from another realm: %+v", got)
+		}
+		if got := store.GetAuthCode("code"); got == nil {
+			t.Error("GetAuthCode returned nil after a lookup from another realm")
+		}
+	})
+
+	t.Run("RefreshTokens", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		mustStoreRefreshToken(t, store, "token", time.Hour, 24*time.Hour)
+
+		if got := other.GetRefreshToken("token"); got != nil {
+			t.Errorf("GetRefreshToken found a token from another realm: %+v", got)
+		}
+		if err := other.RotateRefreshToken("token", "stolen", &models.RefreshToken{
+			UserID:            1,
+			ClientID:          "client",
+			ExpiresAt:         time.Now().Add(time.Hour),
+			AbsoluteExpiresAt: time.Now().Add(time.Hour),
+		}); !errors.Is(err, storage.ErrRefreshTokenNotFound) {
+			t.Errorf("RotateRefreshToken across realms = %v, want ErrRefreshTokenNotFound", err)
+		}
+		if err := other.DeleteRefreshToken("token"); err != nil {
+			t.Fatalf("DeleteRefreshToken: %v", err)
+		}
+		if got := store.GetRefreshToken("token"); got == nil {
+			t.Error("refresh token deleted through another realm")
+		}
+	})
+
+	t.Run("WebAuthnCredentials", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		mustStoreCredential(t, store, 7, "cred")
+
+		if got, err := other.ListWebAuthnCredentials(7); err != nil || len(got) != 0 {
+			t.Errorf("ListWebAuthnCredentials found credentials from another realm: %+v", got)
+		}
+		if err := other.DeleteWebAuthnCredential("cred"); err != nil {
+			t.Fatalf("DeleteWebAuthnCredential: %v", err)
+		}
+		if got, _ := store.ListWebAuthnCredentials(7); len(got) != 1 {
+			t.Error("credential deleted through another realm")
+		}
+		// The same credential ID may exist in another realm
+		mustStoreCredential(t, other, 7, "cred")
+	})
+
+	t.Run("FederatedIdentities", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		mustStoreIdentity(t, store, 7, "corp", "sub-1")
+
+		if got := other.GetFederatedIdentity("corp", "sub-1"); got != nil {
+			t.Errorf("GetFederatedIdentity found an identity from another realm: %+v", got)
+		}
+		// The same upstream account may be linked in another realm
+		identity := mustStoreIdentity(t, other, 9, "corp", "sub-1")
+		if identity.Realm != "other" {
+			t.Errorf("Realm = %q, want %q", identity.Realm, "other")
+		}
+		if got := store.GetFederatedIdentity("corp", "sub-1"); got == nil || got.UserID != 7 {
+			t.Errorf("GetFederatedIdentity in the default realm = %+v", got)
+		}
+	})
+
+	t.Run("SAMLServiceProviders", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		mustStoreSAMLProvider(t, store, "urn:example:wiki")
+
+		if got := other.GetSAMLServiceProvider("urn:example:wiki"); got != nil {
+			t.Errorf("GetSAMLServiceProvider found a provider from another realm: %+v", got)
+		}
+		if providers, err := other.ListSAMLServiceProviders(); err != nil || len(providers) != 0 {
+			t.Errorf("ListSAMLServiceProviders in another realm = %+v, %v", providers, err)
+		}
+		// The same entity ID may be registered in another realm
+		provider := mustStoreSAMLProvider(t, other, "urn:example:wiki")
+		if provider.Realm != "other" {
+			t.Errorf("Realm = %q, want %q", provider.Realm, "other")
+		}
+		if err := other.DeleteSAMLServiceProvider("urn:example:wiki"); err != nil {
+			t.Fatalf("DeleteSAMLServiceProvider: %v", err)
+		}
+		if got := store.GetSAMLServiceProvider("urn:example:wiki"); got == nil {
+			t.Error("DeleteSAMLServiceProvider removed the provider of another realm")
+		}
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		group := mustStoreGroup(t, store, "engineering", "7")
+
+		if got := other.GetGroup(group.ID); got != nil {
+			t.Errorf("GetGroup found a group from another realm: %+v", got)
+		}
+		if groups, err := other.ListGroups(); err != nil || len(groups) != 0 {
+			t.Errorf("ListGroups in another realm = %+v, %v", groups, err)
+		}
+		group.Members = ""
+		if err := other.UpdateGroup(group); err == nil {
+			t.Error("UpdateGroup changed a group from another realm")
+		}
+		if err := other.DeleteGroup(group.ID); err != nil {
+			t.Fatalf("DeleteGroup: %v", err)
+		}
+		if got := store.GetGroup(group.ID); got == nil || got.Members != "7" {
+			t.Errorf("group changed through another realm: %+v", got)
+		}
+		// The same name may be used in another realm
+		if created := mustStoreGroup(t, other, "engineering", ""); created.Realm != "other" {
+			t.Errorf("Realm = %q, want %q", created.Realm, "other")
+		}
+	})
+
+	t.Run("LoginAttempts", func(t *testing.T) {
+		store := newStore(t)
+		other := store.ForRealm("other")
+		if _, err := store.RecordLoginFailure("user:alice", time.Now(), time.Minute); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+
+		if got := other.GetLoginAttempt("user:alice"); got != nil {
+			t.Errorf("GetLoginAttempt found an attempt from another realm: %+v", got)
+		}
+		if err := other.ClearLoginAttempts("user:alice"); err != nil {
+			t.Fatalf("ClearLoginAttempts: %v", err)
+		}
+		if store.GetLoginAttempt("user:alice") == nil {
+			t.Error("login attempts cleared through another realm")
+		}
+	})
+
+	t.Run("DataKeysAreShared", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreDataKey(&models.DataKey{KeyID: "k1", MasterKeyID: "m1", WrappedKey: "wrapped", Active: true}); err != nil {
+			t.Fatalf("StoreDataKey: %v", err)
+		}
+		if got := store.ForRealm("other").GetActiveDataKey(); got == nil || got.KeyID != "k1" {
+			t.Errorf("GetActiveDataKey from another realm = %+v, want k1", got)
+		}
+	})
+}
+
+func testConcurrency(t *testing.T, newStore NewStore) {
+	const workers = 16
+
+	t.Run("AuthCodeConsumedOnce", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.StoreAuthCodeGrant("code-1", &models.AuthCode{ClientID: "client-1", UserID: 7}); err != nil {
+			t.Fatalf("StoreAuthCodeGrant: %v", err)
+		}
+
+		var consumed int32
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if store.GetAuthCode("code-1") != nil {
+					atomic.AddInt32(&consumed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if consumed != 1 {
+			t.Errorf("auth code consumed %d times, want 1", consumed)
+		}
+	})
+
+	t.Run("RefreshTokenRotatedOnce", func(t *testing.T) {
+		store := newStore(t)
+		mustStoreRefreshToken(t, store, "token-1", time.Hour, 24*time.Hour)
+
+		var rotated int32
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				next := &models.RefreshToken{
+					UserID:            7,
+					ClientID:          "client-1",
+					ExpiresAt:         time.Now().Add(time.Hour),
+					AbsoluteExpiresAt: time.Now().Add(24 * time.Hour),
+				}
+				if store.RotateRefreshToken("token-1", fmt.Sprintf("token-%d", i+2), next) == nil {
+					atomic.AddInt32(&rotated, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if rotated != 1 {
+			t.Errorf("refresh token rotated %d times, want 1", rotated)
+		}
+	})
+
+	t.Run("UsernameClaimedOnce", func(t *testing.T) {
+		store := newStore(t)
+
+		var stored int32
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				user := &models.User{Username: "alice", Password: "hash", Email: fmt.Sprintf("alice%d@example.com", i)}
+				if store.StoreUser(user) == nil {
+					atomic.AddInt32(&stored, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if stored != 1 {
+			t.Errorf("username stored %d times, want 1", stored)
+		}
+	})
+
+	t.Run("LoginFailuresCounted", func(t *testing.T) {
+		store := newStore(t)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.RecordLoginFailure("user:alice", time.Now(), time.Minute); err != nil {
+					t.Errorf("RecordLoginFailure: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if got := store.GetLoginAttempt("user:alice"); got == nil || got.Failures != workers {
+			t.Errorf("GetLoginAttempt after %d parallel failures = %+v", workers, got)
+		}
+	})
+
+	t.Run("ParallelWrites", func(t *testing.T) {
+		store := newStore(t)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				token := fmt.Sprintf("token-%d", i)
+				refreshToken := &models.RefreshToken{
+					UserID:            uint(i + 1),
+					ClientID:          "client-1",
+					ExpiresAt:         time.Now().Add(time.Hour),
+					AbsoluteExpiresAt: time.Now().Add(24 * time.Hour),
+				}
+				if err := store.StoreRefreshToken(token, refreshToken); err != nil {
+					errs <- err
+					return
+				}
+				if got := store.GetRefreshToken(token); got == nil || got.UserID != uint(i+1) {
+					errs <- fmt.Errorf("GetRefreshToken(%q) = %+v", token, got)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+}
+
+// purged returns how many records a purge should remove when n have
+// expired.
+func (o Options) purged(n int64) int64 {
+	if o.ExpiresNatively {
+		return 0
+	}
+	return n
+}
+
+// purgeAll calls purge with the given batch limit until it reports nothing
+// left, checking every batch respects the limit, and returns the total.
+func purgeAll(t *testing.T, limit int, purge func(limit int) (int64, error)) int64 {
+	t.Helper()
+	var total int64
+	for i := 0; i < 10; i++ {
+		n, err := purge(limit)
+		if err != nil {
+			t.Fatalf("purge: %v", err)
+		}
+		if n > int64(limit) {
+			t.Fatalf("purge removed %d records, over the batch limit of %d", n, limit)
+		}
+		if n == 0 {
+			return total
+		}
+		total += n
+	}
+	t.Fatal("purge never reported completion")
+	return total
+}
+
+func mustStoreUser(t *testing.T, store storage.Store, username, email string) *models.User {
+	t.Helper()
+	user := &models.User{Username: username, Password: "hash", Email: email}
+	if err := store.StoreUser(user); err != nil {
+		t.Fatalf("StoreUser: %v", err)
+	}
+	return user
+}
+
+func mustStoreClient(t *testing.T, store storage.Store) *models.Client {
+	t.Helper()
+	client := &models.Client{
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		GrantTypes:   []string{"authorization_code"},
+		SecretHash:   utils.HashSecret("secret"),
+	}
+	if err := store.StoreClient(client); err != nil {
+		t.Fatalf("StoreClient: %v", err)
+	}
+	return client
+}
+
+func mustStoreRefreshToken(t *testing.T, store storage.Store, token string, idle, absolute time.Duration) *models.RefreshToken {
+	t.Helper()
+	refreshToken := &models.RefreshToken{
+		UserID:            7,
+		ClientID:          "client-1",
+		Scope:             "openid offline_access",
+		ExpiresAt:         time.Now().Add(idle),
+		AbsoluteExpiresAt: time.Now().Add(absolute),
+	}
+	if err := store.StoreRefreshToken(token, refreshToken); err != nil {
+		t.Fatalf("StoreRefreshToken: %v", err)
+	}
+	return refreshToken
+}
+
+func mustStoreCredential(t *testing.T, store storage.Store, userID uint, credentialID string) *models.WebAuthnCredential {
+	t.Helper()
+	credential := &models.WebAuthnCredential{
+		UserID:          userID,
+		CredentialID:    credentialID,
+		PublicKey:       []byte("public-key"),
+		AttestationType: "none",
+		AAGUID:          "aaguid",
+		SignCount:       3,
+		Transports:      "usb nfc",
+		BackupEligible:  true,
+	}
+	if err := store.StoreWebAuthnCredential(credential); err != nil {
+		t.Fatalf("StoreWebAuthnCredential: %v", err)
+	}
+	return credential
+}
+
+func mustStoreIdentity(t *testing.T, store storage.Store, userID uint, provider, subject string) *models.FederatedIdentity {
+	t.Helper()
+	identity := &models.FederatedIdentity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  subject,
+		Email:    "alice@example.com",
+	}
+	if err := store.StoreFederatedIdentity(identity); err != nil {
+		t.Fatalf("StoreFederatedIdentity: %v", err)
+	}
+	return identity
+}
+
+func mustStoreSAMLProvider(t *testing.T, store storage.Store, entityID string) *models.SAMLServiceProvider {
+	t.Helper()
+	provider := &models.SAMLServiceProvider{
+		EntityID:     entityID,
+		Metadata:     `<EntityDescriptor entityID="` + entityID + `"/>`,
+		NameIDFormat: models.NameIDEmail,
+		Attributes:   "email=mail",
+	}
+	if err := store.StoreSAMLServiceProvider(provider); err != nil {
+		t.Fatalf("StoreSAMLServiceProvider: %v", err)
+	}
+	return provider
+}
+
+func mustStoreGroup(t *testing.T, store storage.Store, displayName, members string) *models.Group {
+	t.Helper()
+	group := &models.Group{DisplayName: displayName, ExternalID: "ext-" + displayName, Members: members}
+	if err := store.StoreGroup(group); err != nil {
+		t.Fatalf("StoreGroup: %v", err)
+	}
+	return group
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"errors"
+	"oauth2-provider/models"
+	"time"
+)
+
+// Store is the full storage layer used by the services. Every backend must
+// implement all of its repositories with the same semantics.
+type Store interface {
+	UserRepository
+	ClientRepository
+	AuthCodeRepository
+	RefreshTokenRepository
+	DataKeyRepository
+	WebAuthnCredentialRepository
+	FederatedIdentityRepository
+	SAMLServiceProviderRepository
+	GroupRepository
+	LoginAttemptRepository
+
+	// ForRealm returns a view of the store confined to one realm. Users,
+	// clients, credentials, federated identities, SAML service providers,
+	// groups, codes, tokens and login attempts are only visible in the
+	// realm they were created in; data keys and purges span all realms. The store
+	// itself serves models.DefaultRealm.
+	ForRealm(realm string) Store
+}
+
+type UserRepository interface {
+	// StoreUser creates a user. Usernames and emails must be unique
+	// within the realm.
+	StoreUser(user *models.User) error
+	GetUser(id uint) *models.User
+	GetUserByUsername(username string) *models.User
+	GetUserByEmail(email string) *models.User
+	// UpdateUser saves a user. Its username and email are never changed.
+	UpdateUser(user *models.User) error
+	// ListUsers returns the realm's users, oldest first.
+	ListUsers() ([]models.User, error)
+	// DeleteUser removes a user for good, together with their WebAuthn
+	// credentials and upstream links, so the username and email can be
+	// taken again. Refresh tokens are revoked separately.
+	DeleteUser(id uint) error
+}
+
+type ClientRepository interface {
+	// StoreClient creates a client and assigns its ClientID.
+	StoreClient(client *models.Client) error
+	GetClient(clientID string) *models.Client
+	UpdateClient(client *models.Client) error
+}
+
+type AuthCodeRepository interface {
+	// StoreAuthCodeGrant stores authCode under the keyed hash of code. The
+	// store sets the hash, realm and a 10 minute expiry.
+	StoreAuthCodeGrant(code string, authCode *models.AuthCode) error
+	// GetAuthCode consumes an unexpired, unused code. A code is returned at
+	// most once; later lookups return nil.
+	GetAuthCode(code string) *models.AuthCode
+	// PurgeAuthCodes permanently removes up to limit codes that are expired
+	// or used as of now, returning how many were removed.
+	PurgeAuthCodes(now time.Time, limit int) (int64, error)
+}
+
+type RefreshTokenRepository interface {
+	// StoreRefreshToken stores refreshToken under the keyed hash of token.
+	StoreRefreshToken(token string, refreshToken *models.RefreshToken) error
+	// GetRefreshToken returns the token if neither its idle nor its
+	// absolute expiry has passed.
+	GetRefreshToken(token string) *models.RefreshToken
+	UpdateRefreshTokenExpiry(token string, expiresAt time.Time) error
+	DeleteRefreshToken(token string) error
+	// DeleteRefreshTokensForUser revokes every refresh token of a user,
+	// returning how many were revoked.
+	DeleteRefreshTokensForUser(userID uint) (int64, error)
+	// RotateRefreshToken atomically replaces oldToken with newToken. It
+	// fails with ErrRefreshTokenNotFound if oldToken was already used, so
+	// a token can be rotated at most once.
+	RotateRefreshToken(oldToken, newToken string, refreshToken *models.RefreshToken) error
+	// PurgeRefreshTokens permanently removes up to limit tokens that are
+	// expired or deleted as of now, returning how many were removed.
+	PurgeRefreshTokens(now time.Time, limit int) (int64, error)
+}
+
+type DataKeyRepository interface {
+	// StoreDataKey creates a data key. Storing an active key deactivates
+	// the previously active one.
+	StoreDataKey(key *models.DataKey) error
+	GetDataKey(keyID string) *models.DataKey
+	GetActiveDataKey() *models.DataKey
+	ListDataKeys() ([]models.DataKey, error)
+	// UpdateDataKey saves a re-wrapped key.
+	UpdateDataKey(key *models.DataKey) error
+}
+
+type WebAuthnCredentialRepository interface {
+	// StoreWebAuthnCredential registers a credential. Credential IDs must
+	// be unique within the realm.
+	StoreWebAuthnCredential(credential *models.WebAuthnCredential) error
+	// ListWebAuthnCredentials returns a user's credentials, oldest first.
+	ListWebAuthnCredentials(userID uint) ([]models.WebAuthnCredential, error)
+	// UpdateWebAuthnCredential saves the name, counter, backup state and
+	// last use of a credential.
+	UpdateWebAuthnCredential(credential *models.WebAuthnCredential) error
+	DeleteWebAuthnCredential(credentialID string) error
+}
+
+type FederatedIdentityRepository interface {
+	// StoreFederatedIdentity links an upstream account to a user. Each
+	// provider and subject may only be linked once within the realm.
+	StoreFederatedIdentity(identity *models.FederatedIdentity) error
+	// GetFederatedIdentity returns the link of an upstream account, or nil
+	// if it isn't linked.
+	GetFederatedIdentity(provider, subject string) *models.FederatedIdentity
+	// UpdateFederatedIdentity saves the email and last login of a link.
+	UpdateFederatedIdentity(identity *models.FederatedIdentity) error
+}
+
+type SAMLServiceProviderRepository interface {
+	// StoreSAMLServiceProvider registers a service provider. Entity IDs
+	// must be unique within the realm.
+	StoreSAMLServiceProvider(provider *models.SAMLServiceProvider) error
+	// GetSAMLServiceProvider returns the provider with the given entity
+	// ID, or nil if there is none.
+	GetSAMLServiceProvider(entityID string) *models.SAMLServiceProvider
+	// ListSAMLServiceProviders returns the realm's providers, oldest first.
+	ListSAMLServiceProviders() ([]models.SAMLServiceProvider, error)
+	// UpdateSAMLServiceProvider saves the metadata, name ID format and
+	// attributes of a provider.
+	UpdateSAMLServiceProvider(provider *models.SAMLServiceProvider) error
+	DeleteSAMLServiceProvider(entityID string) error
+}
+
+type GroupRepository interface {
+	// StoreGroup creates a group. Display names must be unique within the
+	// realm.
+	StoreGroup(group *models.Group) error
+	// GetGroup returns the group with the given ID, or nil if there is
+	// none.
+	GetGroup(id uint) *models.Group
+	// ListGroups returns the realm's groups, oldest first.
+	ListGroups() ([]models.Group, error)
+	// UpdateGroup saves the display name, external ID and members of a
+	// group. It fails with ErrGroupExists if the new display name is
+	// taken.
+	UpdateGroup(group *models.Group) error
+	DeleteGroup(id uint) error
+}
+
+// LoginAttemptRepository tracks failed logins for brute-force protection.
+// Keys are opaque to the store; the services use one per username and one
+// per client IP.
+type LoginAttemptRepository interface {
+	// RecordLoginFailure counts a failed login for key and returns the
+	// updated record. If the previous count has expired it starts over at
+	// one, with a new window ending at now+window. A lockout is kept.
+	RecordLoginFailure(key string, now time.Time, window time.Duration) (*models.LoginAttempt, error)
+	// GetLoginAttempt returns the record of key, or nil if there is none.
+	// Callers check ExpiresAt and LockedUntil themselves.
+	GetLoginAttempt(key string) *models.LoginAttempt
+	// LockLogin locks key until the given time, creating the record if
+	// needed.
+	LockLogin(key string, until time.Time) error
+	// ClearLoginAttempts forgets the failures and any lockout of key.
+	ClearLoginAttempts(key string) error
+	// PurgeLoginAttempts permanently removes up to limit records whose
+	// window and lockout have both passed as of now, returning how many
+	// were removed.
+	PurgeLoginAttempts(now time.Time, limit int) (int64, error)
+}
+
+// Locker is implemented by backends shared between replicas. TryLock takes
+// a named lock without waiting; release must be called once the work is
+// done. Backends without it are assumed to serve a single node.
+type Locker interface {
+	TryLock(name string) (release func(), acquired bool, err error)
+}
+
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// ErrCredentialExists is returned when a WebAuthn credential ID is already
+// registered in the realm.
+var ErrCredentialExists = errors.New("credential already registered")
+
+// ErrIdentityLinked is returned when an upstream account is already linked
+// to a user in the realm.
+var ErrIdentityLinked = errors.New("upstream account already linked")
+
+// ErrServiceProviderExists is returned when a SAML entity ID is already
+// registered in the realm.
+var ErrServiceProviderExists = errors.New("service provider already registered")
+
+// ErrGroupExists is returned when a group display name is already taken
+// in the realm.
+var ErrGroupExists = errors.New("group already exists")
+
+var (
+	_ Store = (*PostgresStorage)(nil)
+	_ Store = (*MemoryStorage)(nil)
+	_ Store = (*RedisStorage)(nil)
+	_ Store = (*SQLiteStorage)(nil)
+	_ Store = (*HybridStorage)(nil)
+)
@@ -1,9 +1,13 @@
 package utils
 
 import (
+    "crypto/hmac"
     "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
     "encoding/base64"
-    "golang.org/x/crypto/bcrypt"
+    "encoding/hex"
+    "oauth2-provider/config"
 )
 
 func GenerateRandomString(length int) string {
@@ -12,12 +16,25 @@ func GenerateRandomString(length int) string {
     return base64.URLEncoding.EncodeToString(b)[:length]
 }
 
-func HashPassword(password string) (string, error) {
-    bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-    return string(bytes), err
+// HashSecret hashes a high-entropy generated secret such as a client secret.
+// Use passwords.Hash for user-chosen passwords instead.
+func HashSecret(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
 }
 
-func CheckPasswordHash(password, hash string) bool {
-    err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-    return err == nil
+func CheckSecretHash(secret, hash string) bool {
+    if hash == "" {
+        return false
+    }
+    return subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(hash)) == 1
+}
+
+// HashToken returns the keyed hash under which authorization codes and
+// refresh tokens are stored and looked up. Keying with a server secret
+// means a leaked table can't be used to verify guessed tokens offline.
+func HashToken(token string) string {
+    mac := hmac.New(sha256.New, []byte(config.Get().Keys.TokenHashKey))
+    mac.Write([]byte(token))
+    return hex.EncodeToString(mac.Sum(nil))
 }
@@ -1,35 +1,197 @@
 package utils
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
-	"oauth2-provider/config"
+	"math/big"
+	"strings"
 	"time"
 )
 
-func GenerateJWT(userID uint, duration time.Duration) (string, error) {
-	claims := jwt.StandardClaims{
-		Subject:   fmt.Sprintf("%d", userID),
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(duration).Unix(),
+// SigningKey signs and verifies the access tokens of one realm, either
+// with a shared HMAC secret or with an RSA or P-256 private key.
+type SigningKey struct {
+	Method jwt.SigningMethod
+	// KeyID identifies an asymmetric key in the kid header and the JWKS
+	// document; it is empty for HMAC secrets.
+	KeyID   string
+	signKey interface{}
+	public  interface{}
+}
+
+func NewHMACKey(secret []byte) *SigningKey {
+	return &SigningKey{Method: jwt.SigningMethodHS256, signKey: secret, public: secret}
+}
+
+// ParseSigningKey reads a PEM encoded RSA (RS256) or P-256 (ES256)
+// private key.
+func ParseSigningKey(pemData string) (*SigningKey, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(pemData)); err == nil {
+		return newAsymmetricKey(jwt.SigningMethodRS256, key, &key.PublicKey)
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM([]byte(pemData)); err == nil {
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("EC signing keys must use the P-256 curve")
+		}
+		return newAsymmetricKey(jwt.SigningMethodES256, key, &key.PublicKey)
+	}
+	return nil, errors.New("signing key must be a PEM encoded RSA or EC private key")
+}
+
+func newAsymmetricKey(method jwt.SigningMethod, private, public interface{}) (*SigningKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	return &SigningKey{
+		Method:  method,
+		KeyID:   base64.RawURLEncoding.EncodeToString(sum[:12]),
+		signKey: private,
+		public:  public,
+	}, nil
+}
+
+// JWK returns the public key as a JSON Web Key, or nil for HMAC secrets,
+// which must never be published.
+func (k *SigningKey) JWK() map[string]string {
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": k.Method.Alg(),
+			"kid": k.KeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC",
+			"use": "sig",
+			"alg": k.Method.Alg(),
+			"kid": k.KeyID,
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32))),
+		}
+	default:
+		return nil
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.JWTSecret))
+// accessTokenType is the typ header of access tokens (RFC 9068), which
+// tells them apart from ID tokens signed with the same key.
+const accessTokenType = "at+jwt"
+
+// AccessTokenClaims are the claims of an access token. Tokens issued to a
+// user have the user's ID as subject; tokens a client gets for itself with
+// the client_credentials grant have its client ID as both subject and
+// client_id.
+type AccessTokenClaims struct {
+	jwt.StandardClaims
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
 }
 
-func ValidateJWT(tokenString string) (*jwt.StandardClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWTSecret), nil
+// GenerateJWT signs an access token for a user, granting scope.
+func GenerateJWT(key *SigningKey, issuer string, userID uint, scope string, duration time.Duration) (string, error) {
+	return generateAccessToken(key, issuer, fmt.Sprintf("%d", userID), "", scope, duration)
+}
+
+// GenerateClientJWT signs an access token for a client acting on its own
+// behalf.
+func GenerateClientJWT(key *SigningKey, issuer, clientID, scope string, duration time.Duration) (string, error) {
+	return generateAccessToken(key, issuer, clientID, clientID, scope, duration)
+}
+
+func generateAccessToken(key *SigningKey, issuer, subject, clientID, scope string, duration time.Duration) (string, error) {
+	claims := AccessTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			Subject:   subject,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(duration).Unix(),
+		},
+		Scope:    scope,
+		ClientID: clientID,
+	}
+
+	return sign(key, accessTokenType, claims)
+}
+
+// IDTokenClaims are the OpenID Connect claims of an ID token beyond the
+// registered ones.
+type IDTokenClaims struct {
+	jwt.StandardClaims
+	Nonce    string `json:"nonce,omitempty"`
+	AuthTime int64  `json:"auth_time,omitempty"`
+	// AMR lists the authentication methods used (RFC 8176); ACR names the
+	// assurance level they add up to.
+	AMR []string `json:"amr,omitempty"`
+	ACR string   `json:"acr,omitempty"`
+	// Email and EmailVerified are set when the email scope was granted.
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// GenerateIDToken signs an ID token for audience (the client ID). The
+// registered claims are filled in from the arguments.
+func GenerateIDToken(key *SigningKey, issuer, audience string, userID uint, duration time.Duration, claims IDTokenClaims) (string, error) {
+	claims.Issuer = issuer
+	claims.Subject = fmt.Sprintf("%d", userID)
+	claims.Audience = audience
+	claims.IssuedAt = time.Now().Unix()
+	claims.ExpiresAt = time.Now().Add(duration).Unix()
+	return sign(key, "JWT", claims)
+}
+
+func sign(key *SigningKey, typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["typ"] = typ
+	if key.KeyID != "" {
+		token.Header["kid"] = key.KeyID
+	}
+	return token.SignedString(key.signKey)
+}
+
+// ValidateJWT verifies an access token signed with key and issued by
+// issuer. Other tokens signed with the key, such as ID tokens, are
+// rejected.
+func ValidateJWT(key *SigningKey, issuer, tokenString string) (*AccessTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		typ, _ := token.Header["typ"].(string)
+		if !strings.EqualFold(strings.TrimPrefix(typ, "application/"), accessTokenType) {
+			return nil, fmt.Errorf("not an access token: typ %q", typ)
+		}
+		return key.public, nil
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
+	if claims, ok := token.Claims.(*AccessTokenClaims); ok && token.Valid {
+		if !claims.VerifyIssuer(issuer, true) {
+			return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+		}
+		// Access tokens have no audience; a token with one is meant for a
+		// client
+		if claims.Audience != "" {
+			return nil, errors.New("not an access token: audience set")
+		}
 		return claims, nil
 	}
 
 	return nil, jwt.ErrSignatureInvalid
-}
\ No newline at end of file
+}
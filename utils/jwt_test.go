@@ -0,0 +1,78 @@
+package utils_test
+
+import (
+	"oauth2-provider/utils"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const testIssuer = "https://auth.example.com"
+
+func TestValidateJWT(t *testing.T) {
+	key := utils.NewHMACKey([]byte("test-secret-test-secret-test-secret"))
+	otherKey := utils.NewHMACKey([]byte("other-secret-other-secret-other-secret"))
+
+	userToken, err := utils.GenerateJWT(key, testIssuer, 7, "openid email", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateJWT: %v", err)
+	}
+	clientToken, err := utils.GenerateClientJWT(key, testIssuer, "client-1", "scim", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateClientJWT: %v", err)
+	}
+	idToken, err := utils.GenerateIDToken(key, testIssuer, "client-1", 7, time.Hour, utils.IDTokenClaims{Nonce: "n"})
+	if err != nil {
+		t.Fatalf("GenerateIDToken: %v", err)
+	}
+	expired, err := utils.GenerateJWT(key, testIssuer, 7, "openid", -time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateJWT: %v", err)
+	}
+	// An access token without the at+jwt type, as issued before tokens
+	// were typed
+	untyped, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Issuer:    testIssuer,
+		Subject:   "7",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("test-secret-test-secret-test-secret"))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     *utils.SigningKey
+		issuer  string
+		token   string
+		subject string
+		scope   string
+	}{
+		{name: "user token", key: key, issuer: testIssuer, token: userToken, subject: "7", scope: "openid email"},
+		{name: "client token", key: key, issuer: testIssuer, token: clientToken, subject: "client-1", scope: "scim"},
+		{name: "ID token", key: key, issuer: testIssuer, token: idToken},
+		{name: "untyped token", key: key, issuer: testIssuer, token: untyped},
+		{name: "expired", key: key, issuer: testIssuer, token: expired},
+		{name: "other key", key: otherKey, issuer: testIssuer, token: userToken},
+		{name: "other issuer", key: key, issuer: "https://other.example.com", token: userToken},
+		{name: "garbage", key: key, issuer: testIssuer, token: "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := utils.ValidateJWT(tt.key, tt.issuer, tt.token)
+			if tt.subject == "" {
+				if err == nil {
+					t.Fatalf("ValidateJWT accepted the token: %+v", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateJWT: %v", err)
+			}
+			if claims.Subject != tt.subject || claims.Scope != tt.scope {
+				t.Errorf("claims = %+v, want subject %q and scope %q", claims, tt.subject, tt.scope)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/golang-jwt/jwt"
+)
+
+// SAMLKey is the certificate and RSA private key a realm signs SAML
+// assertions and logout responses with.
+type SAMLKey struct {
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+}
+
+// ParseSAMLKey reads a PEM encoded X.509 certificate and the RSA private
+// key it certifies.
+func ParseSAMLKey(certPEM, keyPEM string) (*SAMLKey, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("SAML certificate must be a PEM encoded X.509 certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(keyPEM))
+	if err != nil {
+		return nil, errors.New("SAML key must be a PEM encoded RSA private key")
+	}
+	if public, ok := cert.PublicKey.(*rsa.PublicKey); !ok || !public.Equal(&key.PublicKey) {
+		return nil, errors.New("SAML certificate does not match the SAML key")
+	}
+	return &SAMLKey{Certificate: cert, Key: key}, nil
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"oauth2-provider/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSignedToken = errors.New("invalid token")
+	ErrSignedTokenExpired = errors.New("token expired")
+)
+
+// SignToken returns a URL-safe token carrying fields until expiresAt,
+// authenticated with the token hash key. The purpose is part of the
+// signature, so a token issued for one flow is useless in any other.
+// Tokens are stateless: to make one single-use, include a field that
+// changes once it has been used.
+func SignToken(purpose string, expiresAt time.Time, fields ...string) string {
+	payload := strings.Join(append([]string{strconv.FormatInt(expiresAt.Unix(), 10)}, fields...), "\x00")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signTokenPayload(purpose, payload))
+}
+
+// VerifySignedToken checks a token from SignToken and returns its fields.
+func VerifySignedToken(purpose, token string) ([]string, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidSignedToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, signTokenPayload(purpose, string(payload))) {
+		return nil, ErrInvalidSignedToken
+	}
+
+	fields := strings.Split(string(payload), "\x00")
+	expiresAt, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	if !time.Now().Before(time.Unix(expiresAt, 0)) {
+		return nil, ErrSignedTokenExpired
+	}
+	return fields[1:], nil
+}
+
+func signTokenPayload(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(config.Get().Keys.TokenHashKey))
+	mac.Write([]byte("signed-token:" + purpose + "\x00" + payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,101 @@
+package utils_test
+
+import (
+	"net/url"
+	"oauth2-provider/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	// The six-digit codes of the RFC 6238 SHA-1 test vectors
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		step, ok := utils.ValidateTOTP(rfc6238Secret, v.code, time.Unix(v.unix, 0), 0)
+		if !ok || step != v.unix/30 {
+			t.Errorf("ValidateTOTP(%q) at %d = %d, %v; want %d, true", v.code, v.unix, step, ok, v.unix/30)
+		}
+	}
+
+	const code = "005924"
+	at := time.Unix(1234567890, 0)
+	codeStep := at.Unix() / 30
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		now      time.Time
+		lastStep int64
+		want     bool
+	}{
+		{name: "current step", secret: rfc6238Secret, code: code, now: at, want: true},
+		{name: "lowercase secret", secret: strings.ToLower(rfc6238Secret), code: code, now: at, want: true},
+		{name: "one step late", secret: rfc6238Secret, code: code, now: at.Add(30 * time.Second), want: true},
+		{name: "one step early", secret: rfc6238Secret, code: code, now: at.Add(-30 * time.Second), want: true},
+		{name: "two steps late", secret: rfc6238Secret, code: code, now: at.Add(60 * time.Second)},
+		{name: "two steps early", secret: rfc6238Secret, code: code, now: at.Add(-60 * time.Second)},
+		{name: "step already used", secret: rfc6238Secret, code: code, now: at, lastStep: codeStep},
+		{name: "later step used", secret: rfc6238Secret, code: code, now: at, lastStep: codeStep + 1},
+		{name: "earlier step used", secret: rfc6238Secret, code: code, now: at, lastStep: codeStep - 1, want: true},
+		{name: "wrong code", secret: rfc6238Secret, code: "005925", now: at},
+		{name: "too short", secret: rfc6238Secret, code: "05924", now: at},
+		{name: "too long", secret: rfc6238Secret, code: "0005924", now: at},
+		{name: "empty", secret: rfc6238Secret, code: "", now: at},
+		{name: "other secret", secret: "JBSWY3DPEHPK3PXP", code: code, now: at},
+		{name: "malformed secret", secret: "not base32!", code: code, now: at},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := utils.ValidateTOTP(tt.secret, tt.code, tt.now, tt.lastStep)
+			if ok != tt.want {
+				t.Fatalf("ValidateTOTP = %v, want %v", ok, tt.want)
+			}
+			if ok && step != codeStep {
+				t.Errorf("step = %d, want %d", step, codeStep)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	first, second := utils.GenerateTOTPSecret(), utils.GenerateTOTPSecret()
+	if len(first) != 32 || first == second {
+		t.Errorf("secrets %q and %q, want two different 160-bit base32 strings", first, second)
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := utils.TOTPProvisioningURI("auth.example.com", "alice:admin", rfc6238Secret)
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", uri, err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("URI %q, want an otpauth://totp/ URI", uri)
+	}
+	// The colon in the account must not split the label again
+	if want := "/auth.example.com:alice%3Aadmin"; u.EscapedPath() != want {
+		t.Errorf("label = %q, want %q", u.EscapedPath(), want)
+	}
+	query := u.Query()
+	for name, want := range map[string]string{"secret": rfc6238Secret, "issuer": "auth.example.com", "digits": "6", "period": "30", "algorithm": "SHA1"} {
+		if got := query.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}